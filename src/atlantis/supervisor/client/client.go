@@ -15,13 +15,17 @@ import (
 	. "atlantis/common"
 	. "atlantis/supervisor/constant"
 	. "atlantis/supervisor/rpc/types"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/jigish/go-flags"
+	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -54,6 +58,9 @@ func New() *Supervisor {
 	ih.AddCommand("health", "check supervisor's health", "", &HealthCommand{})
 	ih.AddCommand("list", "list supervisor containers & unused ports", "", &ListCommand{})
 	ih.AddCommand("deploy", "deploy an app+sha", "", &DeployCommand{})
+	ih.AddCommand("update-deps", "update the dependencies of a running container", "", &UpdateDepsCommand{})
+	ih.AddCommand("reencrypt-state", "re-encrypt all dependency data with the active key", "",
+		&ReencryptStateCommand{})
 	ih.AddCommand("teardown", "teardown one or more containers", "", &TeardownCommand{})
 	ih.AddCommand("get", "get information about a container", "", &GetCommand{})
 	ih.AddCommand("version", "check supervisor's client and server versions", "", &VersionCommand{})
@@ -63,6 +70,17 @@ func New() *Supervisor {
 		&ContainerMaintenanceCommand{})
 	ih.AddCommand("update-ip-group", "update an ip group", "", &UpdateIPGroupCommand{})
 	ih.AddCommand("delete-ip-group", "delete an ip group", "", &DeleteIPGroupCommand{})
+	ih.AddCommand("list-ip-groups", "list ip groups and the containers using them", "", &ListIPGroupsCommand{})
+	ih.AddCommand("get-ip-group", "get information about an ip group", "", &GetIPGroupCommand{})
+	ih.AddCommand("get-container-security", "get the network security of a container", "",
+		&GetContainerSecurityCommand{})
+	ih.AddCommand("netsec-status", "check the installed firewall rules match netsec", "", &NetsecStatusCommand{})
+	ih.AddCommand("rule-counters", "get what matched the firewall rules of containers", "", &RuleCountersCommand{})
+	ih.AddCommand("list-volumes", "list persistent volumes", "", &ListVolumesCommand{})
+	ih.AddCommand("delete-volume", "delete a persistent volume and its data", "", &DeleteVolumeCommand{})
+	ih.AddCommand("update-quota", "update the quota for an app or env", "", &UpdateQuotaCommand{})
+	ih.AddCommand("delete-quota", "delete the quota for an app or env", "", &DeleteQuotaCommand{})
+	ih.AddCommand("list-events", "list recent supervisor events", "", &ListEventsCommand{})
 	ih.AddCommand("idle", "check if supervisor is idle", "", &IdleCommand{})
 	return ih
 }
@@ -118,11 +136,46 @@ func (c *HealthCommand) Execute(args []string) error {
 			reply.CPUShares.Free)
 		log.Printf("-> memory: %d MB total, %d MB used, %d MB free", reply.Memory.Total, reply.Memory.Used,
 			reply.Memory.Free)
+		log.Printf("-> dedicated cpus: %d total, %d used, %d free, reserved %v", reply.CPUSet.Total,
+			reply.CPUSet.Used, reply.CPUSet.Free, reply.CPUSet.ReservedCPUs)
+		for _, node := range reply.CPUSet.Nodes {
+			log.Printf("--> node %d: used %v, free %v", node.Node, node.UsedCPUs, node.FreeCPUs)
+		}
+		for _, quota := range reply.Quotas {
+			log.Printf("-> %s %s quota:", quota.Scope, quota.Name)
+			log.Printf("--> containers: %d total, %d used, %d free", quota.Containers.Total, quota.Containers.Used,
+				quota.Containers.Free)
+			log.Printf("--> cpu shares: %d total, %d used, %d free", quota.CPUShares.Total, quota.CPUShares.Used,
+				quota.CPUShares.Free)
+			log.Printf("--> memory: %d MB total, %d MB used, %d MB free", quota.Memory.Total, quota.Memory.Used,
+				quota.Memory.Free)
+		}
+		log.Printf("-> docker: %s healthy: %t, %d reconnects", reply.Docker.Endpoint, reply.Docker.Healthy,
+			reply.Docker.Reconnects)
+		if reply.Docker.LastError != "" {
+			log.Printf("--> last error: %s", reply.Docker.LastError)
+		}
+		log.Printf("-> netsec: %s healthy: %t, %d drifts, %d repairs", reply.Netsec.Backend, reply.Netsec.Healthy,
+			reply.Netsec.Drifts, reply.Netsec.Repairs)
+		if reply.Netsec.LastError != "" {
+			log.Printf("--> last error: %s", reply.Netsec.LastError)
+		}
+		for _, bw := range reply.Bandwidth {
+			log.Printf("-> bandwidth %s (%s): in %d kbit/s of %s, out %d kbit/s of %s", bw.ContainerID, bw.Veth,
+				bw.Ingress, bandwidthLimit(bw.IngressLimit), bw.Egress, bandwidthLimit(bw.EgressLimit))
+		}
 		log.Printf("-> status: %s", reply.Status)
 	}
 	return nil
 }
 
+func bandwidthLimit(kbit uint) string {
+	if kbit == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d kbit/s", kbit)
+}
+
 type ListCommand struct {
 }
 
@@ -144,14 +197,40 @@ func (c *ListCommand) Execute(args []string) error {
 }
 
 type DeployCommand struct {
-	Host        string `short:"H" long:"host" description:"the host we're deploying on"`
-	App         string `short:"a" long:"app" description:"the app to deploy"`
-	Sha         string `short:"s" long:"sha" description:"the sha to deploy"`
-	Env         string `short:"e" long:"env" description:"the env to deploy"`
-	Container   string `short:"c" long:"container" description:"the container id to deploy"`
-	CPUShares   uint   `short:"C" long:"cpu-shares" description:"the number of cpu shares to use"`
-	MemoryLimit uint   `short:"m" long:"memory-limit" description:"the MBytes of memory to use"`
-	DepsFile    string `short:"d" long:"deps-file" description:"specify a file with dependencies"`
+	Host          string   `short:"H" long:"host" description:"the host we're deploying on"`
+	App           string   `short:"a" long:"app" description:"the app to deploy"`
+	Sha           string   `short:"s" long:"sha" description:"the sha to deploy"`
+	Env           string   `short:"e" long:"env" description:"the env to deploy"`
+	Container     string   `short:"c" long:"container" description:"the container id to deploy"`
+	CPUShares     uint     `short:"C" long:"cpu-shares" description:"the number of cpu shares to use"`
+	DedicatedCPUs uint     `long:"dedicated-cpus" description:"the number of cores to pin the container to"`
+	MemoryLimit   uint     `short:"m" long:"memory-limit" description:"the MBytes of memory to use"`
+	DepsFile      string   `short:"d" long:"deps-file" description:"specify a file with dependencies"`
+	EnvVars       []string `long:"env-var" description:"NAME=value env var(s) to set. values may be templates"`
+	Entrypoint    []string `long:"entrypoint" description:"override the entrypoint (repeat for each argument)"`
+	Command       []string `long:"cmd" description:"override the command (repeat for each argument)"`
+	Volumes       []string `long:"volume" description:"name:/container/path[:size MB] persistent volume(s)"`
+	PrimaryPort   string   `long:"primary-port" description:"protocol[@host ip] for the primary port"`
+	SecondaryPort []string `long:"secondary-port" description:"protocol[@host ip] for each secondary port, in order"`
+	Image         string   `long:"image" description:"the full image reference to run (repo[:tag][@digest])"`
+	Digest        string   `long:"digest" description:"the digest the pulled image must have"`
+	SignatureFile string   `long:"signature-file" description:"a file with the raw detached signature over the digest"`
+	Renderings    []string `long:"config-rendering" description:"format:file[:template file] extra rendering(s) of the config"`
+	ReloadSignal  string   `long:"reload-signal" description:"the signal to send when the config changes (default HUP)"`
+	ReloadCommand string   `long:"reload-command" description:"a command to run in the container when the config changes"`
+}
+
+// tcp, udp@10.0.0.1 or @127.0.0.1
+func parsePortSpec(spec string) (*PortSpec, error) {
+	parts := strings.SplitN(spec, "@", 2)
+	portSpec := &PortSpec{Protocol: parts[0]}
+	if len(parts) == 2 {
+		portSpec.HostIP = parts[1]
+	}
+	if err := portSpec.Validate(); err != nil {
+		return nil, errors.New("Invalid port (should be protocol[@host ip]): " + spec)
+	}
+	return portSpec, nil
 }
 
 func (c *DeployCommand) Execute(args []string) error {
@@ -180,16 +259,143 @@ func (c *DeployCommand) Execute(args []string) error {
 	manifest := &Manifest{}
 	manifest.Deps = deps
 	manifest.CPUShares = c.CPUShares
+	manifest.DedicatedCPUs = c.DedicatedCPUs
+	manifest.Entrypoint = c.Entrypoint
+	manifest.Command = c.Command
+	for _, volume := range c.Volumes {
+		parts := strings.Split(volume, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return errors.New("Invalid volume (should be name:/container/path[:size MB]): " + volume)
+		}
+		vol := &Volume{Name: parts[0], Path: parts[1]}
+		if len(parts) == 3 {
+			size, err := strconv.ParseUint(parts[2], 10, 32)
+			if err != nil {
+				return errors.New("Invalid volume size: " + volume)
+			}
+			vol.SizeMB = uint(size)
+		}
+		manifest.Volumes = append(manifest.Volumes, vol)
+	}
+	if len(c.EnvVars) > 0 {
+		manifest.Environment = map[string]string{}
+		for _, envVar := range c.EnvVars {
+			parts := strings.SplitN(envVar, "=", 2)
+			if len(parts) != 2 {
+				return errors.New("Invalid env var (should be NAME=value): " + envVar)
+			}
+			manifest.Environment[parts[0]] = parts[1]
+		}
+	}
+	if c.PrimaryPort != "" {
+		spec, err := parsePortSpec(c.PrimaryPort)
+		if err != nil {
+			return err
+		}
+		manifest.PrimaryPort = spec
+	}
+	for _, port := range c.SecondaryPort {
+		spec, err := parsePortSpec(port)
+		if err != nil {
+			return err
+		}
+		manifest.SecondaryPorts = append(manifest.SecondaryPorts, spec)
+	}
+	for _, rendering := range c.Renderings {
+		parts := strings.SplitN(rendering, ":", 3)
+		if len(parts) < 2 {
+			return errors.New("Invalid config rendering (should be format:file[:template file]): " + rendering)
+		}
+		configRendering := &ConfigRendering{Format: parts[0], File: parts[1]}
+		if len(parts) == 3 {
+			tmpl, err := ioutil.ReadFile(parts[2])
+			if err != nil {
+				return err
+			}
+			configRendering.Template = string(tmpl)
+		}
+		manifest.ConfigRenderings = append(manifest.ConfigRenderings, configRendering)
+	}
+	manifest.ReloadSignal = c.ReloadSignal
+	manifest.ReloadCommand = c.ReloadCommand
 	manifest.MemoryLimit = c.MemoryLimit
 	log.Printf("-> Dependencies: %#v", manifest.Deps)
-	arg := SupervisorDeployArg{c.Host, c.App, c.Sha, c.Env, c.Container, manifest}
+	signature := ""
+	if c.SignatureFile != "" {
+		sigBytes, err := ioutil.ReadFile(c.SignatureFile)
+		if err != nil {
+			return err
+		}
+		signature = base64.StdEncoding.EncodeToString(sigBytes)
+	}
+	arg := SupervisorDeployArg{c.Host, c.App, c.Sha, c.Env, c.Container, c.Image, c.Digest, signature, manifest}
 	var reply SupervisorDeployReply
 	err := rpcClient.Call("Deploy", arg, &reply)
 	if err != nil {
 		return err
 	}
 	log.Printf("-> %v @ %v - STATUS: %v", c.App, c.Sha, reply.Status)
-	log.Println("-> " + reply.Container.String())
+	for _, problem := range reply.Problems {
+		log.Println("--> " + problem.String())
+	}
+	if reply.Container != nil {
+		log.Println("-> " + reply.Container.String())
+	}
+	return nil
+}
+
+type UpdateDepsCommand struct {
+	Container string `short:"c" long:"container" description:"the container to update"`
+	DepsFile  string `short:"d" long:"deps-file" description:"specify a file with the new dependencies"`
+}
+
+func (c *UpdateDepsCommand) Execute(args []string) error {
+	overlayConfig()
+	if c.Container == "" {
+		return errors.New("Please specify a container")
+	}
+	if c.DepsFile == "" {
+		return errors.New("Please specify a deps file")
+	}
+	deps := DepsType{}
+	df, err := os.Open(c.DepsFile)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+	if err := json.NewDecoder(df).Decode(&deps); err != nil {
+		return err
+	}
+	log.Printf("Supervisor Update Deps %s...", c.Container)
+	arg := SupervisorUpdateDepsArg{ContainerID: c.Container, Deps: deps}
+	var reply SupervisorUpdateDepsReply
+	err = rpcClient.Call("UpdateDeps", arg, &reply)
+	if reply.Container != nil {
+		log.Println("-> " + reply.Container.String())
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("-> status: %s", reply.Status)
+	for _, problem := range reply.Problems {
+		log.Println("--> " + problem.String())
+	}
+	return nil
+}
+
+type ReencryptStateCommand struct {
+}
+
+func (c *ReencryptStateCommand) Execute(args []string) error {
+	overlayConfig()
+	log.Println("Supervisor Reencrypt State...")
+	arg := SupervisorReencryptStateArg{}
+	var reply SupervisorReencryptStateReply
+	if err := rpcClient.Call("ReencryptState", arg, &reply); err != nil {
+		return err
+	}
+	log.Printf("-> key: %s, re-encrypted: %d, already current: %d", reply.Stats.KeyID, reply.Stats.Reencrypted,
+		reply.Stats.Current)
 	return nil
 }
 
@@ -297,37 +503,313 @@ func (c *DeauthorizeSSHCommand) Execute(args []string) error {
 }
 
 type UpdateIPGroupCommand struct {
-	Name string   `short:"n" long:"name" description:"the name of the IP group"`
-	IPs  []string `short:"i" long:"ip" description:"the IP(s) in the group"`
+	Name   string   `short:"n" long:"name" description:"the name of the IP group"`
+	IPs    []string `short:"i" long:"ip" description:"the IP(s), CIDR block(s) or hostname(s) in the group"`
+	DryRun bool     `long:"dry-run" description:"only show what would change"`
 }
 
 func (c *UpdateIPGroupCommand) Execute(args []string) error {
 	overlayConfig()
 	log.Println("Update IP Group...")
-	arg := SupervisorUpdateIPGroupArg{Name: c.Name, IPs: c.IPs}
+	arg := SupervisorUpdateIPGroupArg{Name: c.Name, IPs: c.IPs, DryRun: c.DryRun}
 	var reply SupervisorUpdateIPGroupReply
 	err := rpcClient.Call("UpdateIPGroup", arg, &reply)
 	if err != nil {
 		return err
 	}
 	log.Printf("-> UpdateIPGroup [%s] %s -> %v", reply.Status, c.Name, c.IPs)
+	logIPGroupDiff(reply.Diff)
 	return nil
 }
 
 type DeleteIPGroupCommand struct {
-	Name string `short:"n" long:"name" description:"the name of the IP group"`
+	Name   string `short:"n" long:"name" description:"the name of the IP group"`
+	DryRun bool   `long:"dry-run" description:"only show what would change"`
 }
 
 func (c *DeleteIPGroupCommand) Execute(args []string) error {
 	overlayConfig()
 	log.Println("Delete IP Group...")
-	arg := SupervisorDeleteIPGroupArg{Name: c.Name}
+	arg := SupervisorDeleteIPGroupArg{Name: c.Name, DryRun: c.DryRun}
 	var reply SupervisorDeleteIPGroupReply
 	err := rpcClient.Call("DeleteIPGroup", arg, &reply)
 	if err != nil {
 		return err
 	}
 	log.Printf("-> DeleteIPGroup [%s] %s", reply.Status, c.Name)
+	logIPGroupDiff(reply.Diff)
+	return nil
+}
+
+// only dry runs have a diff
+func logIPGroupDiff(diff *IPGroupDiff) {
+	if diff == nil {
+		return
+	}
+	log.Println("-> dry run, nothing was changed")
+	for _, addr := range diff.Added {
+		log.Printf("--> add ip: %s", addr)
+	}
+	for _, addr := range diff.Removed {
+		log.Printf("--> remove ip: %s", addr)
+	}
+	for _, user := range diff.Affected {
+		log.Printf("--> affects %s on %s %v", user.ContainerID, user.Protocol, user.Ports)
+	}
+	for _, rule := range diff.Inserted {
+		log.Printf("--> insert rule: %s", rule)
+	}
+	for _, rule := range diff.Deleted {
+		log.Printf("--> delete rule: %s", rule)
+	}
+}
+
+func logIPGroup(group *IPGroupInfo) {
+	log.Printf("-> %s installed: %t", group.Name, group.Installed)
+	for _, member := range group.Members {
+		if ips, isHost := group.Resolved[member]; isHost {
+			log.Printf("--> member: %s %v", member, ips)
+		} else {
+			log.Printf("--> member: %s", member)
+		}
+	}
+	log.Printf("--> ipv4: %v", group.IPv4)
+	log.Printf("--> ipv6: %v", group.IPv6)
+	for _, user := range group.Users {
+		if user.Ingress {
+			log.Printf("--> lets in to %s on %s %v", user.ContainerID, user.Protocol, user.Ports)
+		} else {
+			log.Printf("--> used by %s on %s %v", user.ContainerID, user.Protocol, user.Ports)
+		}
+	}
+	for _, rule := range group.Missing {
+		log.Printf("--> missing: %s", rule)
+	}
+	if group.LastError != "" {
+		log.Printf("--> could not read live rules: %s", group.LastError)
+	}
+}
+
+type ListIPGroupsCommand struct {
+}
+
+func (c *ListIPGroupsCommand) Execute(args []string) error {
+	overlayConfig()
+	log.Println("List IP Groups...")
+	arg := SupervisorListIPGroupsArg{}
+	var reply SupervisorListIPGroupsReply
+	if err := rpcClient.Call("ListIPGroups", arg, &reply); err != nil {
+		return err
+	}
+	for _, group := range reply.IPGroups {
+		logIPGroup(group)
+	}
+	return nil
+}
+
+type GetIPGroupCommand struct {
+	Name string `short:"n" long:"name" description:"the name of the IP group"`
+}
+
+func (c *GetIPGroupCommand) Execute(args []string) error {
+	overlayConfig()
+	log.Println("Get IP Group...")
+	arg := SupervisorGetIPGroupArg{Name: c.Name}
+	var reply SupervisorGetIPGroupReply
+	if err := rpcClient.Call("GetIPGroup", arg, &reply); err != nil {
+		return err
+	}
+	logIPGroup(reply.IPGroup)
+	return nil
+}
+
+type GetContainerSecurityCommand struct {
+	Container string `short:"c" long:"container" description:"the container to get the network security of"`
+}
+
+func (c *GetContainerSecurityCommand) Execute(args []string) error {
+	overlayConfig()
+	log.Println("Get Container Security...")
+	arg := SupervisorGetContainerSecurityArg{ContainerID: c.Container}
+	var reply SupervisorGetContainerSecurityReply
+	if err := rpcClient.Call("GetContainerSecurity", arg, &reply); err != nil {
+		return err
+	}
+	sec := reply.Security
+	log.Printf("-> %s pid %d, veth %s, mark %s, installed: %t", sec.ContainerID, sec.Pid, sec.Veth, sec.Mark,
+		sec.Installed)
+	for group, ports := range sec.SecurityGroups {
+		log.Printf("--> tcp %s %v", group, ports)
+	}
+	for group, ports := range sec.UDPSecurityGroups {
+		log.Printf("--> udp %s %v", group, ports)
+	}
+	for _, in := range sec.Ingress {
+		log.Printf("--> ingress %s %d from %v", in.Protocol, in.Port, in.Sources)
+	}
+	if sec.Bandwidth.Limited() {
+		log.Printf("--> bandwidth: in %s, out %s", bandwidthLimit(sec.Bandwidth.IngressKbit),
+			bandwidthLimit(sec.Bandwidth.EgressKbit))
+	}
+	for _, rule := range sec.Missing {
+		log.Printf("--> missing: %s", rule)
+	}
+	if sec.LastError != "" {
+		log.Printf("--> could not read live rules: %s", sec.LastError)
+	}
+	return nil
+}
+
+type NetsecStatusCommand struct {
+	Check bool `long:"check" description:"check the live rules now instead of showing the last check"`
+}
+
+func (c *NetsecStatusCommand) Execute(args []string) error {
+	overlayConfig()
+	log.Println("Netsec Status...")
+	arg := SupervisorNetsecStatusArg{Check: c.Check}
+	var reply SupervisorNetsecStatusReply
+	if err := rpcClient.Call("NetsecStatus", arg, &reply); err != nil {
+		return err
+	}
+	log.Printf("-> backend: %s, ipv6: %t, repair: %t", reply.Netsec.Backend, reply.Netsec.IPv6, reply.Netsec.Repair)
+	log.Printf("-> healthy: %t, last check: %s", reply.Netsec.Healthy, reply.Netsec.LastCheck)
+	for _, rule := range reply.Netsec.Missing {
+		log.Printf("--> missing: %s", rule)
+	}
+	for _, rule := range reply.Netsec.Extra {
+		log.Printf("--> extra: %s", rule)
+	}
+	if reply.Netsec.LastError != "" {
+		log.Printf("-> last error: %s", reply.Netsec.LastError)
+	}
+	log.Printf("-> drifts: %d, repairs: %d", reply.Netsec.Drifts, reply.Netsec.Repairs)
+	log.Printf("-> status: %s", reply.Status)
+	return nil
+}
+
+type RuleCountersCommand struct {
+	Container string `short:"c" long:"container" description:"only get the counters of this container"`
+}
+
+func (c *RuleCountersCommand) Execute(args []string) error {
+	overlayConfig()
+	log.Println("Rule Counters...")
+	arg := SupervisorRuleCountersArg{ContainerID: c.Container}
+	var reply SupervisorRuleCountersReply
+	if err := rpcClient.Call("RuleCounters", arg, &reply); err != nil {
+		return err
+	}
+	for _, counter := range reply.Counters {
+		if counter.ContainerID == "" {
+			log.Printf("-> %s: %d packets, %d bytes", counter.Rule, counter.Packets, counter.Bytes)
+		} else {
+			log.Printf("-> %s %s: %d packets, %d bytes", counter.ContainerID, counter.Rule, counter.Packets,
+				counter.Bytes)
+		}
+	}
+	log.Printf("-> status: %s", reply.Status)
+	return nil
+}
+
+type ListVolumesCommand struct {
+	App string `short:"a" long:"app" description:"only list volumes for this app"`
+	Env string `short:"e" long:"env" description:"only list volumes for this env"`
+}
+
+func (c *ListVolumesCommand) Execute(args []string) error {
+	overlayConfig()
+	log.Println("List Volumes...")
+	arg := SupervisorListVolumesArg{App: c.App, Env: c.Env}
+	var reply SupervisorListVolumesReply
+	err := rpcClient.Call("ListVolumes", arg, &reply)
+	if err != nil {
+		return err
+	}
+	for _, vol := range reply.Volumes {
+		log.Printf("-> %s @ %s : %d bytes used (%d MB hint), %d refs %v", vol.Key(), vol.HostPath, vol.UsedBytes,
+			vol.SizeMB, vol.RefCount, vol.Containers)
+	}
+	return nil
+}
+
+type ListEventsCommand struct {
+	Kind      string `short:"k" long:"kind" description:"only list events of this kind"`
+	Container string `short:"c" long:"container" description:"only list events for this container"`
+	Limit     int    `short:"n" long:"limit" description:"only list this many of the most recent events"`
+}
+
+func (c *ListEventsCommand) Execute(args []string) error {
+	overlayConfig()
+	log.Println("List Events...")
+	arg := SupervisorListEventsArg{Kind: c.Kind, ContainerID: c.Container, Limit: c.Limit}
+	var reply SupervisorListEventsReply
+	err := rpcClient.Call("ListEvents", arg, &reply)
+	if err != nil {
+		return err
+	}
+	for _, event := range reply.Events {
+		log.Println("-> " + event.String())
+	}
+	return nil
+}
+
+type DeleteVolumeCommand struct {
+	App  string `short:"a" long:"app" description:"the app the volume belongs to"`
+	Env  string `short:"e" long:"env" description:"the env the volume belongs to"`
+	Name string `short:"n" long:"name" description:"the name of the volume"`
+}
+
+func (c *DeleteVolumeCommand) Execute(args []string) error {
+	overlayConfig()
+	log.Println("Delete Volume...")
+	arg := SupervisorDeleteVolumeArg{App: c.App, Env: c.Env, Name: c.Name}
+	var reply SupervisorDeleteVolumeReply
+	err := rpcClient.Call("DeleteVolume", arg, &reply)
+	if err != nil {
+		return err
+	}
+	log.Printf("-> DeleteVolume [%s] %s", reply.Status, VolumeKey(c.App, c.Env, c.Name))
+	return nil
+}
+
+type UpdateQuotaCommand struct {
+	Scope         string `short:"s" long:"scope" description:"the scope of the quota (app or env)"`
+	Name          string `short:"n" long:"name" description:"the name of the app or env"`
+	MaxContainers uint   `short:"c" long:"containers" description:"the maximum # of containers (0 for no limit)"`
+	CPUShares     uint   `short:"C" long:"cpu-shares" description:"the maximum # of cpu shares (0 for no limit)"`
+	MemoryLimit   uint   `short:"m" long:"memory-limit" description:"the maximum MBytes of memory (0 for no limit)"`
+}
+
+func (c *UpdateQuotaCommand) Execute(args []string) error {
+	overlayConfig()
+	log.Println("Update Quota...")
+	quota := &Quota{MaxContainers: c.MaxContainers, CPUShares: c.CPUShares, MemoryLimit: c.MemoryLimit}
+	arg := SupervisorUpdateQuotaArg{Scope: c.Scope, Name: c.Name, Quota: quota}
+	var reply SupervisorUpdateQuotaReply
+	err := rpcClient.Call("UpdateQuota", arg, &reply)
+	if err != nil {
+		return err
+	}
+	log.Printf("-> UpdateQuota [%s] %s %s -> %+v", reply.Status, c.Scope, c.Name, *quota)
+	return nil
+}
+
+type DeleteQuotaCommand struct {
+	Scope string `short:"s" long:"scope" description:"the scope of the quota (app or env)"`
+	Name  string `short:"n" long:"name" description:"the name of the app or env"`
+}
+
+func (c *DeleteQuotaCommand) Execute(args []string) error {
+	overlayConfig()
+	log.Println("Delete Quota...")
+	arg := SupervisorDeleteQuotaArg{Scope: c.Scope, Name: c.Name}
+	var reply SupervisorDeleteQuotaReply
+	err := rpcClient.Call("DeleteQuota", arg, &reply)
+	if err != nil {
+		return err
+	}
+	log.Printf("-> DeleteQuota [%s] %s %s", reply.Status, c.Scope, c.Name)
 	return nil
 }
 
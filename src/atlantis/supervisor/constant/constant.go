@@ -21,12 +21,15 @@ const (
 	SupervisorRPCVersion            = "3.0.0"
 	DefaultSupervisorRPCPort        = uint16(1337)
 	DefaultSupervisorSaveDir        = "/etc/atlantis/supervisor/save"
+	DefaultSupervisorVolumeDir      = "/var/lib/atlantis/volumes"
 	DefaultSupervisorNumContainers  = uint16(100)
 	DefaultSupervisorNumSecondary   = uint16(5)
 	DefaultSupervisorMinPort        = uint16(61000)
 	DefaultSupervisorCPUShares      = uint(100)
 	DefaultSupervisorMemoryLimit    = uint(4096)
 	DefaultSupervisorRegistryHost   = "localhost"
+	DefaultSupervisorImageTemplate  = "{{.Registry}}/{{.Repo}}/{{.App}}-{{.Sha}}"
+	DefaultSupervisorImageRepo      = "apps"
 	DefaultResultDuration           = "30m"
 	DefaultMaintenanceFile          = "/etc/atlantis/supervisor/maint"
 	DefaultMaintenanceCheckInterval = "5s"
@@ -14,6 +14,7 @@ package containers
 import (
 	"atlantis/supervisor/docker"
 	"atlantis/supervisor/rpc/types"
+	"errors"
 )
 
 type Container struct {
@@ -21,26 +22,52 @@ type Container struct {
 }
 
 // Deploy the given app+sha with the dependencies defined in deps. This will spin up a new docker container.
-func (c *Container) Deploy(host, app, sha, env string) error {
+func (c *Container) Deploy(host, app, sha, env string, image *types.ImageSpec) error {
 	c.Host = host
 	c.App = app
 	c.Sha = sha
 	c.Env = env
+	c.Image = image.Ref
+	c.ExpectedDigest = image.ExpectedDigest
+	c.DigestSignature = image.DigestSignature
 	err := docker.Deploy(&c.Container)
 	if err != nil {
 		return err
 	}
 	// by this time Pid should be filled in
-	NetworkSecurity.AddContainerSecurity(c.ID, c.Pid, c.getSecurityGroups()) // add network security
-	save()                                                                   // save here because this is when we know the deployed container is actually alive
-	inventory()                                                              // now that the container is up and we've saved it, inventory check_mk
+	tcpSGs, udpSGs := c.getSecurityGroups()
+	// add network security
+	NetworkSecurity.AddContainerSecurity(c.ID, c.Pid, tcpSGs, udpSGs, c.PortIngress(), c.Manifest.Bandwidth)
+	save()      // save here because this is when we know the deployed container is actually alive
+	inventory() // now that the container is up and we've saved it, inventory check_mk
 	return nil
 }
 
-func (c *Container) getSecurityGroups() map[string][]uint16 {
-	sgsMap := map[string]map[uint16]bool{}
+// returns the tcp and udp security groups of all deps
+func (c *Container) getSecurityGroups() (map[string][]uint16, map[string][]uint16) {
+	tcpGroups := []map[string][]uint16{}
+	udpGroups := []map[string][]uint16{}
 	for _, appDep := range c.Manifest.Deps {
-		for name, ports := range appDep.SecurityGroup {
+		tcpGroups = append(tcpGroups, appDep.SecurityGroup)
+		udpGroups = append(udpGroups, appDep.UDPSecurityGroup)
+	}
+	return mergeSecurityGroups(tcpGroups), mergeSecurityGroups(udpGroups)
+}
+
+// make sure every IP group a manifest lets in to its ports exists
+func checkIngress(manifest *types.Manifest) error {
+	// the port numbers don't matter here, only the sources
+	cont := &types.Container{Manifest: manifest, SecondaryPorts: make([]uint16, len(manifest.SecondaryPorts))}
+	if err := NetworkSecurity.ValidateIngress(cont.PortIngress()); err != nil {
+		return errors.New("Invalid Manifest: ingress: " + err.Error())
+	}
+	return nil
+}
+
+func mergeSecurityGroups(groups []map[string][]uint16) map[string][]uint16 {
+	sgsMap := map[string]map[uint16]bool{}
+	for _, group := range groups {
+		for name, ports := range group {
 			if len(ports) == 0 {
 				continue
 			}
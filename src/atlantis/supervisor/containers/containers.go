@@ -14,11 +14,13 @@ package containers
 import (
 	"atlantis/supervisor/containers/serialize"
 	"atlantis/supervisor/docker"
+	"atlantis/supervisor/helper"
 	"atlantis/supervisor/netsec"
 	"atlantis/supervisor/rpc/types"
 	"errors"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"time"
 )
@@ -26,11 +28,15 @@ import (
 const (
 	ContainersFile      = "containers"
 	PortsFile           = "ports"
+	QuotasFile          = "quotas"
+	VolumesFile         = "volumes"
 	NetworkSecurityFile = "netsec"
 )
 
 type ReserveReq struct {
 	id       string
+	app      string
+	env      string
 	manifest *types.Manifest
 	respChan chan *ReserveResp
 }
@@ -67,33 +73,73 @@ var (
 	NumContainers     uint16 // for maximum efficiency, should = CPUShares
 	NumSecondaryPorts uint16
 	MinPort           uint16
-	CPUShares         uint // relative
-	MemoryLimit       uint // actual MB
+	CPUShares         uint         // relative
+	MemoryLimit       uint         // actual MB
+	Topology          CPUTopology  // detected on Init if not set
+	ReservedCPUs      map[int]bool // cores never dedicated to a container
 	reserveChan       chan *ReserveReq
 	teardownChan      chan *TeardownReq
 	getChan           chan *GetReq
 	listChan          chan chan *ListResp
 	numsChan          chan chan *NumsResp
+	quotaChan         chan *QuotaReq
+	quotaNumsChan     chan chan []*types.QuotaStats
+	cpuSetNumsChan    chan chan *types.CPUSetStats
+	listVolumesChan   chan *ListVolumesReq
+	deleteVolumeChan  chan *DeleteVolumeReq
+	updateDepsChan    chan *UpdateDepsReq
+	validateDepsChan  chan *ValidateDepsReq
+	reencryptChan     chan chan *ReencryptResp
 	dieChan           chan bool
-	containers        map[string]*Container // not for direct access. must go through containerManager.
-	ports             []uint16              // not for direct access. must go through containerManager.
-	usedMemoryLimit   uint                  // not for direct access. must go through containerManager.
-	usedCPUShares     uint                  // not for direct access. must go through containerManager.
+	containers        map[string]*Container              // not for direct access. must go through containerManager.
+	ports             []uint16                           // not for direct access. must go through containerManager.
+	usedMemoryLimit   uint                               // not for direct access. must go through containerManager.
+	usedCPUShares     uint                               // not for direct access. must go through containerManager.
+	quotas            map[string]map[string]*types.Quota // scope -> name -> quota. must go through containerManager.
+	volumes           map[string]*types.VolumeInfo       // app/env/name -> volume. must go through containerManager.
+	currentPid        = docker.CurrentPid                // swapped out in tests
+	// watches the network security of our containers once it is restored. swapped out in tests.
+	monitorNetworkSecurity = func(n *netsec.NetworkSecurity) {
+		go n.MonitorDrift()
+		go n.MonitorHostnames()
+		go n.MonitorThroughput()
+		go n.MonitorCounters()
+		go n.MonitorRejects()
+	}
 )
 
+// Set the cores that are reserved for the host. Must be called before Init.
+func InitCPUs(reservedCPUList string) error {
+	reserved, err := helper.ParseCPUList(reservedCPUList)
+	if err != nil {
+		return err
+	}
+	ReservedCPUs = map[int]bool{}
+	for _, cpu := range reserved {
+		ReservedCPUs[cpu] = true
+	}
+	return nil
+}
+
 // Initialize everything needed to use containers
 func Init(registry, saveDir string, numContainers, numSecondaryPorts, minPort uint16, cpu, memory uint, enableNetsec bool) error {
 	if err := serialize.Init(saveDir); err != nil {
 		return err
 	}
-	
+
 	NumContainers = numContainers
 	NumSecondaryPorts = numSecondaryPorts
 	MinPort = minPort
 	CPUShares = cpu
 	MemoryLimit = memory
 	EnableNetsec = enableNetsec
-	
+	if Topology == nil {
+		Topology = DetectCPUTopology()
+	}
+	if ReservedCPUs == nil {
+		ReservedCPUs = map[int]bool{}
+	}
+
 	if uint64(MinPort)+(uint64(NumSecondaryPorts)+2)*uint64(NumContainers)-1 > 65535 {
 		return errors.New("Invalid Config. MinPort+(NumSecondaryPorts+2)*NumContainers-1 > 65535")
 	}
@@ -106,18 +152,29 @@ func Init(registry, saveDir string, numContainers, numSecondaryPorts, minPort ui
 	getChan = make(chan *GetReq)
 	listChan = make(chan chan *ListResp)
 	numsChan = make(chan chan *NumsResp)
+	quotaChan = make(chan *QuotaReq)
+	quotaNumsChan = make(chan chan []*types.QuotaStats)
+	cpuSetNumsChan = make(chan chan *types.CPUSetStats)
+	listVolumesChan = make(chan *ListVolumesReq)
+	deleteVolumeChan = make(chan *DeleteVolumeReq)
+	updateDepsChan = make(chan *UpdateDepsReq)
+	validateDepsChan = make(chan *ValidateDepsReq)
+	reencryptChan = make(chan chan *ReencryptResp)
 	dieChan = make(chan bool)
 	if err := docker.Init(registry); err != nil {
 		return err
 	}
 	go containerManager()
+	if !pretending() {
+		go janitor()
+	}
 	return nil
 }
 
-// Reserve a container
-func Reserve(id string, manifest *types.Manifest) (*Container, error) {
+// Reserve a container for app in env
+func Reserve(id, app, env string, manifest *types.Manifest) (*Container, error) {
 	respChan := make(chan *ReserveResp)
-	req := &ReserveReq{id, manifest, respChan}
+	req := &ReserveReq{id, app, env, manifest, respChan}
 	reserveChan <- req
 	resp := <-respChan
 	close(respChan)
@@ -161,6 +218,15 @@ func Nums() (containers *types.ResourceStats, cpu *types.ResourceStats, memory *
 	return resp.Containers, resp.CPUShares, resp.Memory
 }
 
+// Return the total, used, and free dedicated cores
+func CPUSetNums() *types.CPUSetStats {
+	respChan := make(chan *types.CPUSetStats)
+	cpuSetNumsChan <- respChan
+	resp := <-respChan
+	close(respChan)
+	return resp
+}
+
 func reserve(req *ReserveReq) {
 	resp := &ReserveResp{}
 	if len(containers) >= int(NumContainers) { // check if there are enough containers
@@ -173,6 +239,18 @@ func reserve(req *ReserveReq) {
 	} else if req.manifest.MemoryLimit+usedMemoryLimit > MemoryLimit { // check memory
 		resp.err = errors.New(fmt.Sprintf("Not enough Memory to reserve. (%d requested, %d available)",
 			req.manifest.MemoryLimit, MemoryLimit-usedMemoryLimit))
+	} else if err := checkQuotas(req.app, req.env, req.manifest); err != nil { // check app and env quotas
+		resp.err = err
+	} else if err := checkVolumes(req); err != nil { // check volumes
+		resp.err = err
+	} else if err := req.manifest.ValidatePorts(NumSecondaryPorts); err != nil { // check port specs
+		resp.err = err
+	} else if err := checkIngress(req.manifest); err != nil { // check ingress groups
+		resp.err = err
+	} else if cpuSet, err := allocateCPUs(req.manifest.DedicatedCPUs); err != nil { // check dedicated cores
+		resp.err = err
+	} else if len(cpuSet) == 0 && len(sharedCPUs()) == 0 { // check shared cores
+		resp.err = errors.New("No CPUs left for containers without dedicated CPUs")
 	} else {
 		port := ports[0]
 		ports = ports[1:]
@@ -181,8 +259,11 @@ func reserve(req *ReserveReq) {
 			secondaryPorts[i] = MinPort + (NumContainers * (i + 2)) + port
 		}
 		containers[req.id] = &Container{Container: types.Container{ID: req.id, PrimaryPort: MinPort + port,
-			SSHPort: MinPort + NumContainers + port, SecondaryPorts: secondaryPorts, Manifest: req.manifest}}
+			SSHPort: MinPort + NumContainers + port, SecondaryPorts: secondaryPorts, CPUSet: cpuSet, App: req.app,
+			Env: req.env, Manifest: req.manifest}}
+		updateSharedCPUs()
 		resp.container = containers[req.id]
+		registerVolumes(resp.container)
 		usedMemoryLimit = usedMemoryLimit + req.manifest.MemoryLimit
 		usedCPUShares = usedCPUShares + req.manifest.CPUShares
 	}
@@ -193,12 +274,14 @@ func reserve(req *ReserveReq) {
 func teardown(req *TeardownReq) {
 	container := containers[req.id]
 	if container != nil {
+		startTeardown(req.id)
 		NetworkSecurity.RemoveContainerSecurity(req.id)
 		docker.Teardown(containers[req.id])
 		ports = append(ports, containers[req.id].PrimaryPort-MinPort)
 		usedMemoryLimit = usedMemoryLimit - containers[req.id].Manifest.MemoryLimit
 		usedCPUShares = usedCPUShares - containers[req.id].Manifest.CPUShares
 		delete(containers, req.id)
+		updateSharedCPUs()
 		save()
 		go func() {
 			// inventory() eventually calls back into the supervisor via cmk_admin -I
@@ -248,6 +331,38 @@ func nums(respChan chan *NumsResp) {
 	respChan <- resp
 }
 
+// Restore network security for the containers we have and reinstall its rules. Returns false if it could not be
+// restored. Having nothing saved yet is fine.
+func restoreNetworkSecurity() bool {
+	pids := map[string]int{}
+	changed := false
+	for id, cont := range containers {
+		pid, err := currentPid(&cont.Container)
+		if err != nil {
+			log.Printf("-> could not get the current pid of %s, using %d: %v", id, cont.Pid, err)
+			pid = cont.Pid
+		}
+		if pid != cont.Pid {
+			cont.Pid = pid
+			changed = true
+		}
+		pids[id] = pid
+	}
+	var err error
+	// Enable is negated because it is "Pretend" on the inside, "Enable" on the outside.
+	NetworkSecurity, err = netsec.Restore(NetworkSecurityFile, !EnableNetsec, pids)
+	if os.IsNotExist(err) {
+		log.Printf("-> using default network security (wide open)")
+		err = nil
+	} else if err != nil {
+		log.Printf("-> could not restore network security: %v", err)
+	}
+	if changed {
+		save()
+	}
+	return err == nil
+}
+
 func containerManager() {
 	if err := serialize.RetrieveObject(ContainersFile, &containers); err != nil || containers == nil {
 		containers = map[string]*Container{}
@@ -260,13 +375,18 @@ func containerManager() {
 		}
 		log.Printf("-> using default port list: %+v", ports)
 	}
-	var ns netsec.NetworkSecurity
-	if err := serialize.RetrieveObject(NetworkSecurityFile, ns); err != nil {
-		// Enable is negated because it is "Pretend" on the inside, "Enable" on the outside.
-		NetworkSecurity = netsec.New(NetworkSecurityFile, !EnableNetsec)
-		log.Printf("-> using default network security (wide open)")
-	} else {
-		NetworkSecurity = &ns
+	if err := serialize.RetrieveObject(QuotasFile, &quotas); err != nil || quotas == nil {
+		quotas = map[string]map[string]*types.Quota{}
+		log.Printf("-> using default quotas (none)")
+	}
+	if err := serialize.RetrieveObject(VolumesFile, &volumes); err != nil || volumes == nil {
+		volumes = map[string]*types.VolumeInfo{}
+		log.Printf("-> using default volumes (none)")
+	}
+	if restoreNetworkSecurity() && EnableNetsec {
+		monitorNetworkSecurity(NetworkSecurity)
+	} else if EnableNetsec {
+		log.Printf("-> not monitoring network security, it was not restored")
 	}
 	usedCPUShares = 0
 	usedMemoryLimit = 0
@@ -274,11 +394,23 @@ func containerManager() {
 		usedCPUShares += cont.Manifest.CPUShares
 		usedMemoryLimit += cont.Manifest.MemoryLimit
 	}
+	// the host's cores or the reserved ones may have changed since
+	if updateSharedCPUs() {
+		save()
+	}
 	var reserveReq *ReserveReq
 	var teardownReq *TeardownReq
 	var getReq *GetReq
 	var listRespCh chan *ListResp
 	var numsRespCh chan *NumsResp
+	var quotaReq *QuotaReq
+	var quotaNumsRespCh chan []*types.QuotaStats
+	var cpuSetNumsRespCh chan *types.CPUSetStats
+	var listVolumesReq *ListVolumesReq
+	var deleteVolumeReq *DeleteVolumeReq
+	var updateDepsReq *UpdateDepsReq
+	var validateDepsReq *ValidateDepsReq
+	var reencryptRespCh chan *ReencryptResp
 	for {
 		select {
 		case reserveReq = <-reserveChan:
@@ -291,11 +423,35 @@ func containerManager() {
 			get(getReq)
 		case numsRespCh = <-numsChan:
 			nums(numsRespCh)
+		case quotaReq = <-quotaChan:
+			updateQuota(quotaReq)
+		case quotaNumsRespCh = <-quotaNumsChan:
+			quotaNums(quotaNumsRespCh)
+		case cpuSetNumsRespCh = <-cpuSetNumsChan:
+			cpuSetNums(cpuSetNumsRespCh)
+		case listVolumesReq = <-listVolumesChan:
+			listVolumes(listVolumesReq)
+		case deleteVolumeReq = <-deleteVolumeChan:
+			deleteVolume(deleteVolumeReq)
+		case updateDepsReq = <-updateDepsChan:
+			updateDeps(updateDepsReq)
+		case validateDepsReq = <-validateDepsChan:
+			validateDepsReq.respChan <- validateDeps(validateDepsReq.deps)
+		case reencryptRespCh = <-reencryptChan:
+			reencryptState(reencryptRespCh)
 		case <-dieChan:
 			close(reserveChan)
 			close(teardownChan)
 			close(listChan)
 			close(numsChan)
+			close(quotaChan)
+			close(quotaNumsChan)
+			close(cpuSetNumsChan)
+			close(listVolumesChan)
+			close(deleteVolumeChan)
+			close(updateDepsChan)
+			close(validateDepsChan)
+			close(reencryptChan)
 			close(dieChan)
 			return
 		}
@@ -309,6 +465,12 @@ func save() {
 	}, serialize.SaveDefinition{
 		PortsFile,
 		ports,
+	}, serialize.SaveDefinition{
+		QuotasFile,
+		quotas,
+	}, serialize.SaveDefinition{
+		VolumesFile,
+		volumes,
 	})
 }
 
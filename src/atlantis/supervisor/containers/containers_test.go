@@ -12,7 +12,15 @@
 package containers
 
 import (
+	"atlantis/supervisor/constant"
+	"atlantis/supervisor/containers/serialize"
+	"atlantis/supervisor/crypto"
+	"atlantis/supervisor/docker"
+	"atlantis/supervisor/events"
+	"atlantis/supervisor/metrics"
+	"atlantis/supervisor/netsec"
 	"atlantis/supervisor/rpc/types"
+	"errors"
 	"github.com/adjust/gocheck"
 	"os"
 	"testing"
@@ -48,7 +56,7 @@ func (s *ContainersSuite) TestReserve(c *gocheck.C) {
 	os.RemoveAll(saveDir)
 	c.Assert(Init("localhost", saveDir, uint16(2), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
 	// First reserve should work
-	container, err := Reserve("first", &types.Manifest{CPUShares: 50, MemoryLimit: 512})
+	container, err := Reserve("first", "", "", &types.Manifest{CPUShares: 50, MemoryLimit: 512})
 	c.Assert(err, gocheck.IsNil)
 	c.Assert(container.PrimaryPort, gocheck.Equals, uint16(61000))
 	c.Assert(container.SecondaryPorts, gocheck.DeepEquals, []uint16{61004, 61006})
@@ -58,16 +66,16 @@ func (s *ContainersSuite) TestReserve(c *gocheck.C) {
 	c.Assert(container.Sha, gocheck.Equals, "")
 	c.Assert(container.DockerID, gocheck.Equals, "")
 	// Second should fail because id is taken
-	container, err = Reserve("first", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
+	container, err = Reserve("first", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
 	c.Assert(err, gocheck.ErrorMatches, "The ID \\(first\\) is in use\\.")
 	// Third should fail because not enough CPU shares
-	container, err = Reserve("third", &types.Manifest{CPUShares: 51, MemoryLimit: 1})
+	container, err = Reserve("third", "", "", &types.Manifest{CPUShares: 51, MemoryLimit: 1})
 	c.Assert(err, gocheck.ErrorMatches, "Not enough CPU Shares to reserve. \\(51 requested, 50 available\\)")
 	// Fourth should fail because not enough CPU shares
-	container, err = Reserve("fourth", &types.Manifest{CPUShares: 1, MemoryLimit: 513})
+	container, err = Reserve("fourth", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 513})
 	c.Assert(err, gocheck.ErrorMatches, "Not enough Memory to reserve. \\(513 requested, 512 available\\)")
 	// Fifth should work
-	container, err = Reserve("fifth", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
+	container, err = Reserve("fifth", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
 	c.Assert(err, gocheck.IsNil)
 	c.Assert(container.PrimaryPort, gocheck.Equals, uint16(61001))
 	c.Assert(container.SecondaryPorts, gocheck.DeepEquals, []uint16{61005, 61007})
@@ -77,7 +85,7 @@ func (s *ContainersSuite) TestReserve(c *gocheck.C) {
 	c.Assert(container.Sha, gocheck.Equals, "")
 	c.Assert(container.DockerID, gocheck.Equals, "")
 	// Sixth should fail because there are no containers
-	container, err = Reserve("sixth", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
+	container, err = Reserve("sixth", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
 	c.Assert(err, gocheck.ErrorMatches, "No free containers to reserve\\.")
 	os.RemoveAll(saveDir)
 	dieChan <- true
@@ -89,15 +97,15 @@ func (s *ContainersSuite) TestTeardown(c *gocheck.C) {
 	os.RemoveAll(saveDir)
 	c.Assert(Init("localhost", saveDir, uint16(2), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
 	// First reserve should work
-	_, err := Reserve("first", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
+	_, err := Reserve("first", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
 	c.Assert(err, gocheck.IsNil)
 	// Second should fail because id is taken
-	_, err = Reserve("first", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
+	_, err = Reserve("first", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
 	c.Assert(err, gocheck.ErrorMatches, "The ID \\(first\\) is in use\\.")
 	// Teardown
 	c.Assert(Teardown("first"), gocheck.Equals, true)
 	// Third should work
-	_, err = Reserve("first", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
+	_, err = Reserve("first", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
 	c.Assert(err, gocheck.IsNil)
 	os.RemoveAll(saveDir)
 	dieChan <- true
@@ -109,13 +117,13 @@ func (s *ContainersSuite) TestList(c *gocheck.C) {
 	os.RemoveAll(saveDir)
 	c.Assert(Init("localhost", saveDir, uint16(2), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
 	// reserve first and list
-	first, err := Reserve("first", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
+	first, err := Reserve("first", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
 	c.Assert(err, gocheck.IsNil)
 	conts, ports := List()
 	c.Assert(*conts["first"], gocheck.DeepEquals, first.Container)
 	c.Assert(ports, gocheck.DeepEquals, []uint16{61001})
 	// reserve second and list
-	second, err := Reserve("second", &types.Manifest{CPUShares: 2, MemoryLimit: 2})
+	second, err := Reserve("second", "", "", &types.Manifest{CPUShares: 2, MemoryLimit: 2})
 	c.Assert(err, gocheck.IsNil)
 	conts, ports = List()
 	c.Assert(*conts["second"], gocheck.DeepEquals, second.Container)
@@ -136,7 +144,7 @@ func (s *ContainersSuite) TestNums(c *gocheck.C) {
 	os.RemoveAll(saveDir)
 	c.Assert(Init("localhost", saveDir, uint16(2), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
 	// reserve first and list
-	_, err := Reserve("first", &types.Manifest{CPUShares: 1, MemoryLimit: 100})
+	_, err := Reserve("first", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 100})
 	c.Assert(err, gocheck.IsNil)
 	cont, cpu, mem := Nums()
 	c.Assert(cont.Total, gocheck.Equals, uint(2))
@@ -149,7 +157,7 @@ func (s *ContainersSuite) TestNums(c *gocheck.C) {
 	c.Assert(mem.Used, gocheck.Equals, uint(100))
 	c.Assert(mem.Free, gocheck.Equals, uint(924))
 	// reserve second and list
-	_, err = Reserve("second", &types.Manifest{CPUShares: 2, MemoryLimit: 200})
+	_, err = Reserve("second", "", "", &types.Manifest{CPUShares: 2, MemoryLimit: 200})
 	c.Assert(err, gocheck.IsNil)
 	cont, cpu, mem = Nums()
 	c.Assert(cont.Total, gocheck.Equals, uint(2))
@@ -176,3 +184,524 @@ func (s *ContainersSuite) TestNums(c *gocheck.C) {
 	os.RemoveAll(saveDir)
 	dieChan <- true
 }
+
+func (s *ContainersSuite) TestQuotas(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
+	c.Assert(UpdateQuota("bogus", "app1", &types.Quota{}), gocheck.ErrorMatches, "Invalid quota scope: bogus")
+	c.Assert(UpdateQuota(types.QuotaScopeApp, "app1", &types.Quota{MaxContainers: 1, CPUShares: 10}), gocheck.IsNil)
+	c.Assert(UpdateQuota(types.QuotaScopeEnv, "prod", &types.Quota{MemoryLimit: 300}), gocheck.IsNil)
+	// app quota on cpu
+	_, err := Reserve("first", "app1", "prod", &types.Manifest{CPUShares: 11, MemoryLimit: 100})
+	c.Assert(err, gocheck.ErrorMatches, "Not enough CPU Shares in the quota for app app1\\. \\(11 requested, 10 available\\)")
+	_, err = Reserve("first", "app1", "prod", &types.Manifest{CPUShares: 10, MemoryLimit: 100})
+	c.Assert(err, gocheck.IsNil)
+	// app quota on containers
+	_, err = Reserve("second", "app1", "dev", &types.Manifest{CPUShares: 0, MemoryLimit: 100})
+	c.Assert(err, gocheck.ErrorMatches, "No free containers in the quota for app app1\\. \\(1 used, 1 max\\)")
+	// env quota on memory
+	_, err = Reserve("third", "app2", "prod", &types.Manifest{CPUShares: 1, MemoryLimit: 201})
+	c.Assert(err, gocheck.ErrorMatches, "Not enough Memory in the quota for env prod\\. \\(201 requested, 200 available\\)")
+	_, err = Reserve("third", "app2", "prod", &types.Manifest{CPUShares: 1, MemoryLimit: 200})
+	c.Assert(err, gocheck.IsNil)
+	// stats
+	stats := QuotaNums()
+	c.Assert(stats, gocheck.HasLen, 2)
+	c.Assert(stats[0].Scope, gocheck.Equals, types.QuotaScopeApp)
+	c.Assert(stats[0].Name, gocheck.Equals, "app1")
+	c.Assert(*stats[0].Containers, gocheck.DeepEquals, types.ResourceStats{Total: 1, Used: 1, Free: 0})
+	c.Assert(*stats[0].CPUShares, gocheck.DeepEquals, types.ResourceStats{Total: 10, Used: 10, Free: 0})
+	c.Assert(*stats[0].Memory, gocheck.DeepEquals, types.ResourceStats{Total: 1024, Used: 100, Free: 924})
+	c.Assert(stats[1].Scope, gocheck.Equals, types.QuotaScopeEnv)
+	c.Assert(stats[1].Name, gocheck.Equals, "prod")
+	c.Assert(*stats[1].Containers, gocheck.DeepEquals, types.ResourceStats{Total: 4, Used: 2, Free: 2})
+	c.Assert(*stats[1].Memory, gocheck.DeepEquals, types.ResourceStats{Total: 300, Used: 300, Free: 0})
+	// lowering a quota below usage never underflows
+	c.Assert(UpdateQuota(types.QuotaScopeEnv, "prod", &types.Quota{MemoryLimit: 100}), gocheck.IsNil)
+	stats = QuotaNums()
+	c.Assert(*stats[1].Memory, gocheck.DeepEquals, types.ResourceStats{Total: 100, Used: 300, Free: 0})
+	// deleting a quota lifts it
+	c.Assert(DeleteQuota(types.QuotaScopeApp, "app1"), gocheck.IsNil)
+	c.Assert(DeleteQuota(types.QuotaScopeApp, "app1"), gocheck.ErrorMatches, "No quota for app app1\\.")
+	_, err = Reserve("second", "app1", "dev", &types.Manifest{CPUShares: 20, MemoryLimit: 100})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(QuotaNums(), gocheck.HasLen, 1)
+	os.RemoveAll(saveDir)
+	dieChan <- true
+}
+
+func (s *ContainersSuite) TestDedicatedCPUs(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	Topology = CPUTopology{0: []int{0, 1, 2, 3}, 1: []int{4, 5, 6, 7}}
+	c.Assert(InitCPUs("0"), gocheck.IsNil)
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
+	// best fit: node 0 has 3 free cores so a 2 core request lands there, leaving node 1 whole
+	first, err := Reserve("first", "", "", &types.Manifest{CPUShares: 1, DedicatedCPUs: 2, MemoryLimit: 1})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(first.CPUSet, gocheck.DeepEquals, []int{1, 2})
+	second, err := Reserve("second", "", "", &types.Manifest{CPUShares: 1, DedicatedCPUs: 4, MemoryLimit: 1})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(second.CPUSet, gocheck.DeepEquals, []int{4, 5, 6, 7})
+	_, err = Reserve("third", "", "", &types.Manifest{CPUShares: 1, DedicatedCPUs: 2, MemoryLimit: 1})
+	c.Assert(err, gocheck.ErrorMatches, "Not enough dedicated CPUs to reserve\\. \\(2 requested, 1 available\\)")
+	stats := CPUSetNums()
+	c.Assert(stats.Total, gocheck.Equals, uint(7))
+	c.Assert(stats.Used, gocheck.Equals, uint(6))
+	c.Assert(stats.Free, gocheck.Equals, uint(1))
+	c.Assert(stats.ReservedCPUs, gocheck.DeepEquals, []int{0})
+	c.Assert(stats.Nodes[0].FreeCPUs, gocheck.DeepEquals, []int{3})
+	c.Assert(stats.Nodes[1].UsedCPUs, gocheck.DeepEquals, []int{4, 5, 6, 7})
+	// teardown frees the cores, and requests that no longer fit a single node span nodes
+	c.Assert(Teardown("first"), gocheck.Equals, true)
+	c.Assert(Teardown("second"), gocheck.Equals, true)
+	_, err = Reserve("fourth", "", "", &types.Manifest{CPUShares: 1, DedicatedCPUs: 2, MemoryLimit: 1})
+	c.Assert(err, gocheck.IsNil)
+	fifth, err := Reserve("fifth", "", "", &types.Manifest{CPUShares: 1, DedicatedCPUs: 3, MemoryLimit: 1})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(fifth.CPUSet, gocheck.DeepEquals, []int{4, 5, 6})
+	sixth, err := Reserve("sixth", "", "", &types.Manifest{CPUShares: 1, DedicatedCPUs: 2, MemoryLimit: 1})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(sixth.CPUSet, gocheck.DeepEquals, []int{3, 7})
+	os.RemoveAll(saveDir)
+	dieChan <- true
+	Topology = nil
+	ReservedCPUs = nil
+}
+
+func (s *ContainersSuite) TestSharedCPUs(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	Topology = CPUTopology{0: []int{0, 1, 2, 3}}
+	c.Assert(InitCPUs("0"), gocheck.IsNil)
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
+	shared, err := Reserve("shared", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(shared.CPUSet, gocheck.HasLen, 0)
+	c.Assert(shared.SharedCPUSet, gocheck.DeepEquals, []int{1, 2, 3})
+	// shared containers move off cores as they are dedicated
+	_, err = Reserve("dedicated", "", "", &types.Manifest{CPUShares: 1, DedicatedCPUs: 2, MemoryLimit: 1})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(Get("shared").SharedCPUSet, gocheck.DeepEquals, []int{3})
+	other, err := Reserve("other", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(other.SharedCPUSet, gocheck.DeepEquals, []int{3})
+	// the last core stays shared
+	_, err = Reserve("greedy", "", "", &types.Manifest{CPUShares: 1, DedicatedCPUs: 1, MemoryLimit: 1})
+	c.Assert(err, gocheck.ErrorMatches, "Not enough dedicated CPUs to reserve\\. \\(1 requested, 0 available\\)")
+	// and they get the cores back once they are freed
+	c.Assert(Teardown("dedicated"), gocheck.Equals, true)
+	c.Assert(Get("shared").SharedCPUSet, gocheck.DeepEquals, []int{1, 2, 3})
+	c.Assert(Get("other").SharedCPUSet, gocheck.DeepEquals, []int{1, 2, 3})
+	os.RemoveAll(saveDir)
+	dieChan <- true
+	Topology = nil
+	ReservedCPUs = nil
+}
+
+func (s *ContainersSuite) TestVolumes(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
+	vols := []*types.Volume{&types.Volume{Name: "data", Path: "/data", SizeMB: 100}}
+	// volumes need an app and env to live under
+	_, err := Reserve("first", "", "prod", &types.Manifest{CPUShares: 1, MemoryLimit: 1, Volumes: vols})
+	c.Assert(err, gocheck.ErrorMatches, "Invalid app or env for volumes: .*")
+	_, err = Reserve("first", "app", "prod", &types.Manifest{CPUShares: 1, MemoryLimit: 1,
+		Volumes: []*types.Volume{&types.Volume{Name: "data", Path: "data"}}})
+	c.Assert(err, gocheck.ErrorMatches, "Invalid Manifest: path for volume data must be absolute")
+	_, err = Reserve("first", "app", "prod", &types.Manifest{CPUShares: 1, MemoryLimit: 1, Volumes: vols})
+	c.Assert(err, gocheck.IsNil)
+	_, err = Reserve("second", "app", "prod", &types.Manifest{CPUShares: 1, MemoryLimit: 1, Volumes: vols})
+	c.Assert(err, gocheck.IsNil)
+	_, err = Reserve("third", "app", "dev", &types.Manifest{CPUShares: 1, MemoryLimit: 1, Volumes: vols})
+	c.Assert(err, gocheck.IsNil)
+	list := ListVolumes("", "")
+	c.Assert(list, gocheck.HasLen, 2)
+	c.Assert(list[0].Key(), gocheck.Equals, "app/dev/data")
+	c.Assert(list[0].Containers, gocheck.DeepEquals, []string{"third"})
+	c.Assert(list[1].Key(), gocheck.Equals, "app/prod/data")
+	c.Assert(list[1].HostPath, gocheck.Equals, "/var/lib/atlantis/volumes/app/prod/data")
+	c.Assert(list[1].RefCount, gocheck.Equals, uint(2))
+	c.Assert(list[1].SizeMB, gocheck.Equals, uint(100))
+	c.Assert(ListVolumes("", "prod"), gocheck.HasLen, 1)
+	// volumes in use can't be deleted
+	c.Assert(DeleteVolume("app", "prod", "data"), gocheck.ErrorMatches,
+		"Volume app/prod/data is in use by 2 container\\(s\\): .*")
+	// volumes outlive their containers
+	c.Assert(Teardown("first"), gocheck.Equals, true)
+	c.Assert(Teardown("second"), gocheck.Equals, true)
+	list = ListVolumes("app", "prod")
+	c.Assert(list, gocheck.HasLen, 1)
+	c.Assert(list[0].RefCount, gocheck.Equals, uint(0))
+	c.Assert(DeleteVolume("app", "prod", "data"), gocheck.IsNil)
+	c.Assert(DeleteVolume("app", "prod", "data"), gocheck.ErrorMatches, "No such volume: app/prod/data")
+	c.Assert(ListVolumes("", ""), gocheck.HasLen, 1)
+	_, err = Reserve("fourth", "app", "prod", &types.Manifest{CPUShares: 1, MemoryLimit: 1,
+		Volumes: []*types.Volume{nil}})
+	c.Assert(err, gocheck.ErrorMatches, "Invalid Manifest: empty volume")
+	// the volume root is configurable
+	c.Assert(InitVolumeDir("volumes"), gocheck.ErrorMatches, "Invalid volume directory: volumes\\. It must be absolute\\.")
+	c.Assert(InitVolumeDir("/srv/volumes/"), gocheck.IsNil)
+	defer InitVolumeDir(constant.DefaultSupervisorVolumeDir)
+	_, err = Reserve("fourth", "app", "staging", &types.Manifest{CPUShares: 1, MemoryLimit: 1, Volumes: vols})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(ListVolumes("app", "staging")[0].HostPath, gocheck.Equals, "/srv/volumes/app/staging/data")
+	os.RemoveAll(saveDir)
+	dieChan <- true
+}
+
+func (s *ContainersSuite) TestPortSpecs(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
+	_, err := Reserve("first", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1,
+		SecondaryPorts: []*types.PortSpec{nil, nil, &types.PortSpec{Protocol: types.ProtocolUDP}}})
+	c.Assert(err, gocheck.ErrorMatches, "Invalid Manifest: 3 secondary ports declared, only 2 available")
+	_, err = Reserve("first", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1,
+		PrimaryPort: &types.PortSpec{HostIP: "localhost"}})
+	c.Assert(err, gocheck.ErrorMatches, "Invalid Manifest: primary port: Invalid host ip: localhost")
+	container, err := Reserve("first", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1,
+		SecondaryPorts: []*types.PortSpec{nil, &types.PortSpec{Protocol: types.ProtocolUDP, HostIP: "10.0.0.1"}}})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(container.SecondaryPorts, gocheck.DeepEquals, []uint16{61008, 61012})
+	c.Assert(container.SecondaryPortSpec(1), gocheck.DeepEquals, types.PortSpec{Protocol: "udp", HostIP: "10.0.0.1"})
+	_, err = Reserve("second", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1,
+		PrimaryPort: &types.PortSpec{Ingress: []string{"office"}}})
+	c.Assert(err, gocheck.ErrorMatches, "Invalid Manifest: ingress: IP Group office does not exist")
+	_, err = Reserve("second", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1, SSHIngress: []string{"10.0.0.0/8"}})
+	c.Assert(err, gocheck.IsNil)
+	os.RemoveAll(saveDir)
+	dieChan <- true
+}
+
+func (s *ContainersSuite) TestSecurityGroups(c *gocheck.C) {
+	cont := &Container{Container: types.Container{Manifest: &types.Manifest{Deps: types.DepsType{
+		"a": &types.AppDep{SecurityGroup: map[string][]uint16{"db": []uint16{5432}},
+			UDPSecurityGroup: map[string][]uint16{"dns": []uint16{53}}},
+		"b": &types.AppDep{SecurityGroup: map[string][]uint16{"db": []uint16{5432}}},
+	}}}}
+	tcpSGs, udpSGs := cont.getSecurityGroups()
+	c.Assert(tcpSGs, gocheck.DeepEquals, map[string][]uint16{"db": []uint16{5432}})
+	c.Assert(udpSGs, gocheck.DeepEquals, map[string][]uint16{"dns": []uint16{53}})
+}
+
+func (s *ContainersSuite) TestJanitor(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
+	c.Assert(InitJanitor(0, true), gocheck.ErrorMatches, "Invalid janitor interval: 0s?")
+	events.Clear()
+	metrics.Reset()
+	for _, id := range []string{"alive", "dead", "deploying", "gone"} {
+		cont, err := Reserve(id, "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1})
+		c.Assert(err, gocheck.IsNil)
+		if id != "deploying" {
+			cont.DockerID = "docker-" + id
+		}
+	}
+	states := []*docker.ContainerState{
+		&docker.ContainerState{DockerID: "docker-alive", Name: "alive", Running: true},
+		&docker.ContainerState{DockerID: "docker-dead", Name: "dead", ExitCode: 137},
+		&docker.ContainerState{DockerID: "docker-deploying", Name: "deploying"},
+		&docker.ContainerState{DockerID: "docker-orphan", Name: "orphan", Running: true},
+		&docker.ContainerState{DockerID: "docker-exited", Name: "exited", ExitCode: 1},
+	}
+	restarted := []string{}
+	removed := []string{}
+	listContainerStates = func() ([]*docker.ContainerState, error) { return states, nil }
+	restartTracked = func(id, dockerID string, stillTracked func() bool) (bool, error) {
+		if !stillTracked() {
+			return false, nil
+		}
+		restarted = append(restarted, id)
+		return true, nil
+	}
+	removeUntracked = func(name, dockerID string) (bool, error) {
+		removed = append(removed, dockerID)
+		return true, nil
+	}
+	defer func() {
+		listContainerStates = docker.ListContainerStates
+		restartTracked = docker.RestartTracked
+		removeUntracked = docker.RemoveUntracked
+		JanitorRestartDead = true
+	}()
+
+	j := newJanitorState()
+	j.run()
+	c.Assert(restarted, gocheck.DeepEquals, []string{"dead"})
+	c.Assert(removed, gocheck.DeepEquals, []string{"docker-exited"})
+	c.Assert(events.List("janitor-orphan", "", 0), gocheck.HasLen, 1)
+	c.Assert(events.List("janitor-missing", "gone", 0), gocheck.HasLen, 1)
+	c.Assert(metrics.Get("janitor.restarted"), gocheck.Equals, uint64(1))
+	c.Assert(metrics.Get("janitor.removed"), gocheck.Equals, uint64(1))
+	c.Assert(metrics.Get("janitor.orphan"), gocheck.Equals, uint64(1))
+	c.Assert(metrics.Get("janitor.missing"), gocheck.Equals, uint64(1))
+
+	// ongoing problems are only reported once, dead containers can be flagged instead of restarted
+	JanitorRestartDead = false
+	j.run()
+	j.run()
+	c.Assert(restarted, gocheck.HasLen, 1)
+	c.Assert(events.List("janitor-dead", "dead", 0), gocheck.HasLen, 1)
+	c.Assert(metrics.Get("janitor.orphan"), gocheck.Equals, uint64(1))
+	c.Assert(metrics.Get("janitor.missing"), gocheck.Equals, uint64(1))
+	c.Assert(metrics.Get("janitor.runs"), gocheck.Equals, uint64(3))
+
+	// a container torn down after the janitor listed it isn't restarted
+	JanitorRestartDead = true
+	listContainerStates = func() ([]*docker.ContainerState, error) {
+		c.Assert(Teardown("dead"), gocheck.Equals, true)
+		return states, nil
+	}
+	j.run()
+	c.Assert(restarted, gocheck.HasLen, 1)
+	c.Assert(Get("dead"), gocheck.IsNil)
+	events.Clear()
+	metrics.Reset()
+	os.RemoveAll(saveDir)
+	dieChan <- true
+}
+
+func (s *ContainersSuite) TestUpdateDeps(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
+	events.Clear()
+	reloads := []string{}
+	signalContainer = func(cont types.GenericContainer, signal string) error {
+		reloads = append(reloads, cont.GetID()+" "+signal)
+		return nil
+	}
+	runReloadCommand = func(cont types.GenericContainer, command string) error {
+		reloads = append(reloads, cont.GetID()+" "+command)
+		return nil
+	}
+	defer func() {
+		signalContainer = docker.Signal
+		runReloadCommand = docker.Exec
+	}()
+	_, err := Reserve("first", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1, Deps: types.DepsType{
+		"db": &types.AppDep{EncryptedData: `{"password":"old"}`}}})
+	c.Assert(err, gocheck.IsNil)
+
+	_, err = UpdateDeps("nope", types.DepsType{})
+	c.Assert(err, gocheck.ErrorMatches, "Unknown Container\\.")
+	_, err = UpdateDeps("first", types.DepsType{"db": &types.AppDep{EncryptedData: "garbage"}})
+	c.Assert(err, gocheck.ErrorMatches, "Invalid dependencies: db.EncryptedData: .*")
+	_, err = UpdateDeps("first", types.DepsType{"db": &types.AppDep{EncryptedData: `{"password":"new"}`,
+		SecurityGroup: map[string][]uint16{"db": []uint16{5432}}}})
+	c.Assert(err, gocheck.ErrorMatches, "Invalid dependencies: db.SecurityGroup\\[db\\]: IP Group db does not exist")
+	c.Assert(Get("first").Manifest.Deps["db"].EncryptedData, gocheck.Equals, `{"password":"old"}`)
+	c.Assert(reloads, gocheck.HasLen, 0)
+
+	cont, err := UpdateDeps("first", types.DepsType{"db": &types.AppDep{EncryptedData: `{"password":"new"}`}})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(cont.Manifest.Deps["db"].EncryptedData, gocheck.Equals, `{"password":"new"}`)
+	c.Assert(Get("first").Manifest.Deps["db"].EncryptedData, gocheck.Equals, `{"password":"new"}`)
+	c.Assert(events.List("deps-updated", "first", 0), gocheck.HasLen, 1)
+	containers["first"].Manifest.ReloadCommand = "sv hup app"
+	_, err = UpdateDeps("first", types.DepsType{})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(reloads, gocheck.DeepEquals, []string{"first HUP", "first sv hup app"})
+
+	// a slow reload doesn't hold up the container manager
+	reloading, reloaded := make(chan bool), make(chan bool)
+	runReloadCommand = func(cont types.GenericContainer, command string) error {
+		reloading <- true
+		<-reloaded
+		return errors.New("exit status 1")
+	}
+	updated := make(chan error)
+	go func() {
+		_, err := UpdateDeps("first", types.DepsType{})
+		updated <- err
+	}()
+	<-reloading
+	list, _ := List()
+	c.Assert(list, gocheck.HasLen, 1)
+	reloaded <- true
+	c.Assert(<-updated, gocheck.ErrorMatches, "Dependencies updated but reload failed: exit status 1")
+	c.Assert(events.List("reload-failed", "first", 0), gocheck.HasLen, 1)
+	events.Clear()
+	os.RemoveAll(saveDir)
+	dieChan <- true
+}
+
+func (s *ContainersSuite) TestReencryptState(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
+	defer crypto.SetKeyring(nil)
+	_, err := Reserve("first", "", "", &types.Manifest{CPUShares: 1, MemoryLimit: 1, Deps: types.DepsType{
+		"db": &types.AppDep{EncryptedData: `{"password":"secret"}`}}})
+	c.Assert(err, gocheck.IsNil)
+	_, err = ReencryptState()
+	c.Assert(err, gocheck.ErrorMatches, "Could not re-encrypt db of first: No active encryption key\\.")
+
+	keyring := crypto.NewKeyring()
+	c.Assert(keyring.Add("k1", make([]byte, 32), true), gocheck.IsNil)
+	crypto.SetKeyring(keyring)
+	stats, err := ReencryptState()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(*stats, gocheck.Equals, types.ReencryptStats{KeyID: "k1", Reencrypted: 1})
+	dep := Get("first").Manifest.Deps["db"]
+	c.Assert(crypto.KeyID(dep.EncryptedData), gocheck.Equals, "k1")
+	data, err := crypto.DecryptedAppDepData(dep)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(data["password"], gocheck.Equals, "secret")
+	stats, err = ReencryptState()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(*stats, gocheck.Equals, types.ReencryptStats{KeyID: "k1", Current: 1})
+	os.RemoveAll(saveDir)
+	dieChan <- true
+}
+
+func (s *ContainersSuite) TestValidateDeps(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
+	c.Assert(ValidateDeps(types.DepsType{}), gocheck.IsNil)
+	c.Assert(NetworkSecurity.UpdateIPGroup("db", []string{"10.0.0.1"}), gocheck.IsNil)
+	c.Assert(ValidateDeps(types.DepsType{"ok": &types.AppDep{EncryptedData: `{"a":"b"}`,
+		SecurityGroup: map[string][]uint16{"db": []uint16{5432}}}}), gocheck.IsNil)
+	err := ValidateDeps(types.DepsType{
+		"nil":   nil,
+		"empty": &types.AppDep{},
+		"bad": &types.AppDep{EncryptedData: "{",
+			SecurityGroup:    map[string][]uint16{"db": []uint16{0}, "web": []uint16{80}},
+			UDPSecurityGroup: map[string][]uint16{"dns": []uint16{53}}},
+	})
+	problems, ok := err.(types.DepProblems)
+	c.Assert(ok, gocheck.Equals, true)
+	strs := []string{}
+	for _, problem := range problems {
+		strs = append(strs, problem.String())
+	}
+	c.Assert(strs, gocheck.DeepEquals, []string{
+		"bad.EncryptedData: unexpected end of JSON input",
+		"bad.SecurityGroup[db]: port 0 is not allowed",
+		"bad.SecurityGroup[web]: IP Group web does not exist",
+		"bad.UDPSecurityGroup[dns]: IP Group dns does not exist",
+		"empty.EncryptedData: no data",
+		"nil: empty dependency",
+	})
+	c.Assert(err, gocheck.ErrorMatches, "Invalid dependencies: bad.EncryptedData: .*; nil: empty dependency")
+	os.RemoveAll(saveDir)
+	dieChan <- true
+}
+
+func (s *ContainersSuite) TestRestoreNetworkSecurity(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	c.Assert(serialize.Init(saveDir), gocheck.IsNil)
+	saved := map[string]*Container{"c1": &Container{types.Container{ID: "c1", Pid: 7,
+		Manifest: &types.Manifest{CPUShares: 1, MemoryLimit: 1}}}}
+	c.Assert(serialize.SaveObject(ContainersFile, saved), gocheck.IsNil)
+	c.Assert(serialize.SaveObject(NetworkSecurityFile, &netsec.NetworkSecurity{
+		IPGroups: map[string][]string{"db": []string{"10.0.0.1"}},
+		Containers: map[string]*netsec.ContainerSecurity{
+			"c1": &netsec.ContainerSecurity{Veth: "veth7", Mark: "7", ID: "c1", Pid: 7,
+				SecurityGroups: map[string][]uint16{"db": []uint16{5432}}},
+			"gone": &netsec.ContainerSecurity{Veth: "veth8", Mark: "8", ID: "gone", Pid: 8},
+		},
+	}), gocheck.IsNil)
+	recorder := netsec.NewRecorder()
+	netsec.NewFirewall = func(pretend bool) netsec.Firewall { return recorder }
+	defer netsec.InitFirewall(netsec.DefaultFirewall)
+
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
+	// wait for the containerManager to restore
+	c.Assert(ValidateDeps(types.DepsType{}), gocheck.IsNil)
+	c.Assert(NetworkSecurity.Containers, gocheck.HasLen, 1)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{
+		"mark veth7 7",
+		"group db 10.0.0.1",
+		"allow 7 tcp db:5432",
+		"deny 10.0.0.1",
+	})
+	os.RemoveAll(saveDir)
+	dieChan <- true
+}
+
+func (s *ContainersSuite) TestRestoreCurrentPid(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	c.Assert(serialize.Init(saveDir), gocheck.IsNil)
+	manifest := &types.Manifest{CPUShares: 1, MemoryLimit: 1}
+	saved := map[string]*Container{
+		"restarted": &Container{types.Container{ID: "restarted", Pid: 7, Manifest: manifest}},
+		"unknown":   &Container{types.Container{ID: "unknown", Pid: 8, Manifest: manifest}},
+	}
+	c.Assert(serialize.SaveObject(ContainersFile, saved), gocheck.IsNil)
+	// docker restarted one container and can't tell about the other
+	currentPid = func(cont types.GenericContainer) (int, error) {
+		if cont.GetID() == "restarted" {
+			return 17, nil
+		}
+		return 0, errors.New("no such container")
+	}
+	defer func() { currentPid = docker.CurrentPid }()
+
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, false), gocheck.IsNil)
+	c.Assert(Get("restarted").Pid, gocheck.Equals, 17)
+	c.Assert(Get("unknown").Pid, gocheck.Equals, 8)
+	// the new pid is saved
+	restored := map[string]*Container{}
+	c.Assert(serialize.RetrieveObject(ContainersFile, &restored), gocheck.IsNil)
+	c.Assert(restored["restarted"].Pid, gocheck.Equals, 17)
+	os.RemoveAll(saveDir)
+	dieChan <- true
+}
+
+func (s *ContainersSuite) TestMonitorNetworkSecurity(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	recorder := netsec.NewRecorder()
+	netsec.NewFirewall = func(pretend bool) netsec.Firewall { return recorder }
+	defer netsec.InitFirewall(netsec.DefaultFirewall)
+	monitored := make(chan *netsec.NetworkSecurity, 1)
+	monitor := monitorNetworkSecurity
+	monitorNetworkSecurity = func(n *netsec.NetworkSecurity) { monitored <- n }
+	defer func() { monitorNetworkSecurity = monitor }()
+	waitMonitored := func() *netsec.NetworkSecurity {
+		// wait for the containerManager to restore
+		c.Assert(ValidateDeps(types.DepsType{}), gocheck.IsNil)
+		select {
+		case n := <-monitored:
+			return n
+		default:
+			return nil
+		}
+	}
+
+	// nothing saved yet
+	os.RemoveAll(saveDir)
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, true), gocheck.IsNil)
+	n := waitMonitored()
+	c.Assert(n, gocheck.NotNil)
+	c.Assert(n, gocheck.Equals, NetworkSecurity)
+	dieChan <- true
+
+	// a save file that can't be read
+	os.RemoveAll(saveDir)
+	c.Assert(serialize.Init(saveDir), gocheck.IsNil)
+	c.Assert(serialize.SaveObject(NetworkSecurityFile, "not network security"), gocheck.IsNil)
+	c.Assert(Init("localhost", saveDir, uint16(4), uint16(2), uint16(61000), 100, 1024, true), gocheck.IsNil)
+	c.Assert(waitMonitored(), gocheck.IsNil)
+	os.RemoveAll(saveDir)
+	dieChan <- true
+}
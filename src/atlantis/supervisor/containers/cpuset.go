@@ -0,0 +1,226 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package containers
+
+import (
+	"atlantis/supervisor/docker"
+	"atlantis/supervisor/helper"
+	"atlantis/supervisor/rpc/types"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const NodeSysfsDir = "/sys/devices/system/node"
+
+// NUMA node -> cores on that node
+type CPUTopology map[int][]int
+
+// Read the host's NUMA topology from sysfs. Hosts without NUMA information are treated as a single node.
+func DetectCPUTopology() CPUTopology {
+	topology := CPUTopology{}
+	nodeDirs, _ := filepath.Glob(filepath.Join(NodeSysfsDir, "node[0-9]*"))
+	for _, dir := range nodeDirs {
+		node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "cpulist"))
+		if err != nil {
+			log.Printf("[cpuset] could not read cpulist for node %d: %v", node, err)
+			continue
+		}
+		cpus, err := helper.ParseCPUList(string(data))
+		if err != nil {
+			log.Printf("[cpuset] could not parse cpulist for node %d: %v", node, err)
+			continue
+		}
+		topology[node] = cpus
+	}
+	if len(topology) == 0 {
+		cpus := make([]int, runtime.NumCPU())
+		for i := range cpus {
+			cpus[i] = i
+		}
+		topology[0] = cpus
+	}
+	return topology
+}
+
+func (t CPUTopology) sortedNodes() []int {
+	nodes := make([]int, 0, len(t))
+	for node, _ := range t {
+		nodes = append(nodes, node)
+	}
+	sort.Ints(nodes)
+	return nodes
+}
+
+func usedCPUs() map[int]bool {
+	used := map[int]bool{}
+	for _, cont := range containers {
+		for _, cpu := range cont.CPUSet {
+			used[cpu] = true
+		}
+	}
+	return used
+}
+
+func freeCPUsByNode() map[int][]int {
+	used := usedCPUs()
+	free := map[int][]int{}
+	for node, cpus := range Topology {
+		free[node] = []int{}
+		for _, cpu := range cpus {
+			if !used[cpu] && !ReservedCPUs[cpu] {
+				free[node] = append(free[node], cpu)
+			}
+		}
+	}
+	return free
+}
+
+// The cores shared by containers without dedicated ones: every core that isn't dedicated or reserved for the host
+func sharedCPUs() []int {
+	shared := []int{}
+	for _, cpus := range freeCPUsByNode() {
+		shared = append(shared, cpus...)
+	}
+	sort.Ints(shared)
+	return shared
+}
+
+func hasSharedContainers() bool {
+	for _, cont := range containers {
+		if len(cont.CPUSet) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Pin the containers without dedicated cores to the shared ones again. Must be called whenever dedicated cores
+// are allocated or freed. Returns whether any container changed.
+func updateSharedCPUs() bool {
+	shared := sharedCPUs()
+	changed := false
+	for id, cont := range containers {
+		if len(cont.CPUSet) > 0 || sameCPUs(cont.SharedCPUSet, shared) {
+			continue
+		}
+		cont.SharedCPUSet = shared
+		changed = true
+		if err := docker.SetCPUSet(&cont.Container, shared); err != nil {
+			log.Printf("[cpuset] could not pin %s to cpus %s: %v", id, helper.FormatCPUList(shared), err)
+		}
+	}
+	return changed
+}
+
+func sameCPUs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Pick num exclusive cores. Prefer the node with the fewest free cores that can still fit the whole request
+// so that large requests remain satisfiable on a single node. Only span nodes when no single node fits. A core is
+// left for the containers without dedicated ones as long as there are any.
+func allocateCPUs(num uint) ([]int, error) {
+	if num == 0 {
+		return nil, nil
+	}
+	free := freeCPUsByNode()
+	nodes := Topology.sortedNodes()
+	totalFree := uint(0)
+	for _, node := range nodes {
+		totalFree += uint(len(free[node]))
+	}
+	available := totalFree
+	if hasSharedContainers() && available > 0 {
+		available--
+	}
+	if available < num {
+		return nil, errors.New(fmt.Sprintf("Not enough dedicated CPUs to reserve. (%d requested, %d available)",
+			num, available))
+	}
+	bestNode := -1
+	for _, node := range nodes {
+		numFree := uint(len(free[node]))
+		if numFree >= num && (bestNode < 0 || numFree < uint(len(free[bestNode]))) {
+			bestNode = node
+		}
+	}
+	if bestNode >= 0 {
+		return free[bestNode][:num], nil
+	}
+	// span nodes, taking from the emptiest first to touch as few nodes as possible
+	sort.Sort(byFreeCPUs{nodes, free})
+	cpus := []int{}
+	for _, node := range nodes {
+		for _, cpu := range free[node] {
+			if uint(len(cpus)) == num {
+				break
+			}
+			cpus = append(cpus, cpu)
+		}
+	}
+	log.Printf("[cpuset] WARNING: %d dedicated CPUs span NUMA nodes: %v", num, cpus)
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+type byFreeCPUs struct {
+	nodes []int
+	free  map[int][]int
+}
+
+func (b byFreeCPUs) Len() int      { return len(b.nodes) }
+func (b byFreeCPUs) Swap(i, j int) { b.nodes[i], b.nodes[j] = b.nodes[j], b.nodes[i] }
+func (b byFreeCPUs) Less(i, j int) bool {
+	return len(b.free[b.nodes[i]]) > len(b.free[b.nodes[j]])
+}
+
+func cpuSetNums(respChan chan *types.CPUSetStats) {
+	used := usedCPUs()
+	free := freeCPUsByNode()
+	stats := &types.CPUSetStats{ReservedCPUs: []int{}, Nodes: []*types.NUMANodeStats{}}
+	for cpu, _ := range ReservedCPUs {
+		stats.ReservedCPUs = append(stats.ReservedCPUs, cpu)
+	}
+	sort.Ints(stats.ReservedCPUs)
+	for _, node := range Topology.sortedNodes() {
+		nodeStats := &types.NUMANodeStats{Node: node, UsedCPUs: []int{}, FreeCPUs: free[node]}
+		for _, cpu := range Topology[node] {
+			if used[cpu] {
+				nodeStats.UsedCPUs = append(nodeStats.UsedCPUs, cpu)
+			}
+		}
+		stats.Used += uint(len(nodeStats.UsedCPUs))
+		stats.Free += uint(len(nodeStats.FreeCPUs))
+		stats.Nodes = append(stats.Nodes, nodeStats)
+	}
+	stats.Total = stats.Used + stats.Free
+	respChan <- stats
+}
@@ -0,0 +1,219 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package containers
+
+import (
+	"atlantis/supervisor/crypto"
+	"atlantis/supervisor/docker"
+	"atlantis/supervisor/events"
+	"atlantis/supervisor/rpc/types"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+type UpdateDepsReq struct {
+	id       string
+	deps     types.DepsType
+	respChan chan *UpdateDepsResp
+}
+
+type UpdateDepsResp struct {
+	container *types.Container
+	err       error
+}
+
+var (
+	// swapped out in tests
+	signalContainer  = docker.Signal
+	runReloadCommand = docker.Exec
+)
+
+// Replace the deps of a running container. The config files are rewritten, the security groups are updated
+// and the app is told to reload.
+func UpdateDeps(id string, deps types.DepsType) (*types.Container, error) {
+	respChan := make(chan *UpdateDepsResp)
+	updateDepsChan <- &UpdateDepsReq{id, deps, respChan}
+	resp := <-respChan
+	close(respChan)
+	if resp.err != nil {
+		return resp.container, resp.err
+	}
+	// reloading can take a while, so it happens outside the container manager
+	return resp.container, reloadApp(resp.container)
+}
+
+type ValidateDepsReq struct {
+	deps     types.DepsType
+	respChan chan error
+}
+
+// Find everything wrong with deps before anything is reserved or pulled for them. Returns nil if they're fine,
+// types.DepProblems otherwise.
+func ValidateDeps(deps types.DepsType) error {
+	respChan := make(chan error)
+	validateDepsChan <- &ValidateDepsReq{deps, respChan}
+	resp := <-respChan
+	close(respChan)
+	return resp
+}
+
+func validateDeps(deps types.DepsType) error {
+	problems := types.DepProblems{}
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dep := deps[name]
+		addProblem := func(field, problem string) {
+			problems = append(problems, &types.DepProblem{Dep: name, Field: field, Problem: problem})
+		}
+		if dep == nil {
+			addProblem("", "empty dependency")
+			continue
+		}
+		if dep.EncryptedData == "" {
+			addProblem("EncryptedData", "no data")
+		} else if _, err := crypto.DecryptedAppDepData(dep); err != nil {
+			addProblem("EncryptedData", err.Error())
+		}
+		for _, sg := range []struct {
+			field  string
+			groups map[string][]uint16
+		}{{"SecurityGroup", dep.SecurityGroup}, {"UDPSecurityGroup", dep.UDPSecurityGroup}} {
+			groupNames := make([]string, 0, len(sg.groups))
+			for group := range sg.groups {
+				groupNames = append(groupNames, group)
+			}
+			sort.Strings(groupNames)
+			for _, group := range groupNames {
+				field := sg.field + "[" + group + "]"
+				if !NetworkSecurity.IPGroupExists(group) {
+					addProblem(field, "IP Group "+group+" does not exist")
+				}
+				for _, port := range sg.groups[group] {
+					if port == 0 {
+						addProblem(field, "port 0 is not allowed")
+						break
+					}
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func updateDeps(req *UpdateDepsReq) {
+	resp := &UpdateDepsResp{}
+	resp.container, resp.err = applyDeps(req.id, req.deps)
+	req.respChan <- resp
+}
+
+func applyDeps(id string, deps types.DepsType) (*types.Container, error) {
+	cont, exists := containers[id]
+	if !exists {
+		return nil, errors.New("Unknown Container.")
+	}
+	// decrypts every dep. nothing has been touched if this fails.
+	if err := validateDeps(deps); err != nil {
+		return nil, err
+	}
+	updated := &Container{Container: cont.Container}
+	updated.Manifest = cont.Manifest.Dup()
+	updated.Manifest.Deps = deps
+	oldTCPSGs, oldUDPSGs := cont.getSecurityGroups()
+	tcpSGs, udpSGs := updated.getSecurityGroups()
+	// allow the new deps before the app is pointed at them
+	if err := NetworkSecurity.UpdateContainerSecurity(id, tcpSGs, udpSGs); err != nil {
+		return nil, err
+	}
+	if err := docker.WriteConfigs(&updated.Container); err != nil {
+		NetworkSecurity.UpdateContainerSecurity(id, oldTCPSGs, oldUDPSGs)
+		return nil, err
+	}
+	cont.Manifest = updated.Manifest
+	save()
+	events.Record("deps-updated", id, "updated dependencies")
+	castedContainer := cont.Container
+	return &castedContainer, nil
+}
+
+// Tell the app in a container its deps changed
+func reloadApp(cont *types.Container) error {
+	var err error
+	if cont.Manifest.ReloadCommand != "" {
+		err = runReloadCommand(cont, cont.Manifest.ReloadCommand)
+	} else {
+		err = signalContainer(cont, cont.Manifest.ReloadSignalName())
+	}
+	if err != nil {
+		log.Printf("[%s] could not reload after updating deps: %v", cont.ID, err)
+		events.Record("reload-failed", cont.ID, "could not reload after updating dependencies: %v", err)
+		return errors.New(fmt.Sprintf("Dependencies updated but reload failed: %v", err))
+	}
+	return nil
+}
+
+type ReencryptResp struct {
+	stats *types.ReencryptStats
+	err   error
+}
+
+// Rewrite the deps of every persisted manifest under the active encryption key
+func ReencryptState() (*types.ReencryptStats, error) {
+	respChan := make(chan *ReencryptResp)
+	reencryptChan <- respChan
+	resp := <-respChan
+	close(respChan)
+	return resp.stats, resp.err
+}
+
+func reencryptState(respChan chan *ReencryptResp) {
+	resp := &ReencryptResp{}
+	resp.stats, resp.err = reencryptDeps()
+	respChan <- resp
+}
+
+// Everything is re-encrypted before anything is replaced so a bad blob leaves the state untouched
+func reencryptDeps() (*types.ReencryptStats, error) {
+	stats := &types.ReencryptStats{KeyID: crypto.ActiveKeyID()}
+	reencrypted := map[*types.AppDep]string{}
+	for id, cont := range containers {
+		for name, dep := range cont.Manifest.Deps {
+			data, changed, err := crypto.ReencryptedAppDepData(dep)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not re-encrypt %s of %s: %v", name, id, err))
+			}
+			if !changed {
+				stats.Current++
+				continue
+			}
+			reencrypted[dep] = data
+		}
+	}
+	for dep, data := range reencrypted {
+		dep.EncryptedData = data
+	}
+	stats.Reencrypted = uint(len(reencrypted))
+	if stats.Reencrypted > 0 {
+		save()
+		events.Record("state-reencrypted", "", "re-encrypted %d dependencies with key %s", stats.Reencrypted,
+			stats.KeyID)
+	}
+	return stats, nil
+}
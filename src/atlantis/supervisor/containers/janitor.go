@@ -0,0 +1,166 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package containers
+
+import (
+	"atlantis/supervisor/docker"
+	"atlantis/supervisor/events"
+	"atlantis/supervisor/metrics"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const DefaultJanitorInterval = 1 * time.Minute
+
+var (
+	JanitorInterval    = DefaultJanitorInterval
+	JanitorRestartDead = true // restart tracked containers that died. if false they are only reported.
+
+	// swapped out in tests
+	listContainerStates = docker.ListContainerStates
+	removeUntracked     = docker.RemoveUntracked
+	restartTracked      = docker.RestartTracked
+
+	// container id -> teardowns started. kept outside the containerManager so the janitor can check it while
+	// holding a container's docker lock, which a teardown in the containerManager may be waiting on.
+	teardowns     = map[string]uint{}
+	teardownsLock sync.Mutex
+)
+
+// Set how often the janitor runs and what it does with dead containers. Must be called before Init.
+func InitJanitor(interval time.Duration, restartDead bool) error {
+	if interval <= 0 {
+		return errors.New("Invalid janitor interval: " + interval.String())
+	}
+	JanitorInterval = interval
+	JanitorRestartDead = restartDead
+	return nil
+}
+
+// Things already reported, so each is reported once rather than on every run
+type janitorState struct {
+	orphans map[string]bool // docker id -> true
+	dead    map[string]bool // container id -> true
+	missing map[string]bool // container id -> true
+}
+
+func newJanitorState() *janitorState {
+	return &janitorState{orphans: map[string]bool{}, dead: map[string]bool{}, missing: map[string]bool{}}
+}
+
+// Called by the containerManager before it tears a container down
+func startTeardown(id string) {
+	teardownsLock.Lock()
+	defer teardownsLock.Unlock()
+	teardowns[id]++
+}
+
+func teardownCounts() map[string]uint {
+	teardownsLock.Lock()
+	defer teardownsLock.Unlock()
+	counts := make(map[string]uint, len(teardowns))
+	for id, count := range teardowns {
+		counts[id] = count
+	}
+	return counts
+}
+
+// Whether no teardown of the container has started since counts was taken
+func notTornDownSince(counts map[string]uint, id string) func() bool {
+	return func() bool {
+		teardownsLock.Lock()
+		defer teardownsLock.Unlock()
+		return teardowns[id] == counts[id]
+	}
+}
+
+func janitor() {
+	state := newJanitorState()
+	for {
+		state.run()
+		time.Sleep(JanitorInterval)
+	}
+}
+
+func janitorEvent(kind, id, format string, args ...interface{}) {
+	events.Record("janitor-"+kind, id, format, args...)
+	metrics.Inc("janitor." + kind)
+}
+
+// Compare what docker has with what we track. Docker calls are made outside of the containerManager and
+// operations on a single container are serialized in the docker package, so this never races a deploy. A
+// container torn down after we listed it is left alone rather than restarted.
+func (j *janitorState) run() {
+	counts := teardownCounts() // before List() so any teardown the list doesn't reflect is counted
+	tracked, _ := List()
+	states, err := listContainerStates()
+	if err != nil {
+		log.Printf("[janitor] could not list docker containers: %v", err)
+		metrics.Inc("janitor.errors")
+		return
+	}
+	metrics.Inc("janitor.runs")
+	seen := map[string]bool{}
+	orphans := map[string]bool{}
+	dead := map[string]bool{}
+	for _, state := range states {
+		if cont, isTracked := tracked[state.Name]; isTracked {
+			seen[state.Name] = true
+			if cont.DockerID != state.DockerID || state.Running {
+				// still deploying, or alive and well
+				continue
+			}
+			if !JanitorRestartDead {
+				dead[state.Name] = true
+				if !j.dead[state.Name] {
+					janitorEvent("dead", state.Name, "container %s exited with %d", state.DockerID, state.ExitCode)
+				}
+				continue
+			}
+			restarted, err := restartTracked(state.Name, state.DockerID, notTornDownSince(counts, state.Name))
+			if err != nil {
+				janitorEvent("error", state.Name, "could not restart %s: %v", state.DockerID, err)
+			} else if restarted {
+				janitorEvent("restarted", state.Name, "restarted %s after it exited with %d", state.DockerID,
+					state.ExitCode)
+			}
+			continue
+		}
+		if state.Running {
+			orphans[state.DockerID] = true
+			if !j.orphans[state.DockerID] {
+				janitorEvent("orphan", "", "untracked container %s (%s) is running", state.DockerID, state.Name)
+			}
+			continue
+		}
+		removed, err := removeUntracked(state.Name, state.DockerID)
+		if err != nil {
+			janitorEvent("error", "", "could not remove untracked container %s (%s): %v", state.DockerID,
+				state.Name, err)
+		} else if removed {
+			janitorEvent("removed", "", "removed untracked container %s (%s)", state.DockerID, state.Name)
+		}
+	}
+	missing := map[string]bool{}
+	for id, cont := range tracked {
+		if seen[id] || cont.DockerID == "" {
+			continue
+		}
+		missing[id] = true
+		if !j.missing[id] {
+			janitorEvent("missing", id, "docker container %s no longer exists", cont.DockerID)
+		}
+	}
+	j.orphans, j.dead, j.missing = orphans, dead, missing
+}
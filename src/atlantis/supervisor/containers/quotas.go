@@ -0,0 +1,175 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package containers
+
+import (
+	"atlantis/supervisor/rpc/types"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+type QuotaReq struct {
+	scope    string
+	name     string
+	quota    *types.Quota // nil means delete
+	respChan chan error
+}
+
+// Set the quota for an app or env. Existing containers are never torn down because of a quota, it only
+// affects future reservations.
+func UpdateQuota(scope, name string, quota *types.Quota) error {
+	if quota == nil {
+		return errors.New("Please specify a quota.")
+	}
+	return sendQuotaReq(scope, name, quota)
+}
+
+// Remove the quota for an app or env
+func DeleteQuota(scope, name string) error {
+	return sendQuotaReq(scope, name, nil)
+}
+
+func sendQuotaReq(scope, name string, quota *types.Quota) error {
+	if !types.ValidQuotaScope(scope) {
+		return errors.New("Invalid quota scope: " + scope)
+	}
+	if name == "" {
+		return errors.New("Please specify a name.")
+	}
+	respChan := make(chan error)
+	quotaChan <- &QuotaReq{scope, name, quota, respChan}
+	resp := <-respChan
+	close(respChan)
+	return resp
+}
+
+// Return the total, used, and free resources for every quota
+func QuotaNums() []*types.QuotaStats {
+	respChan := make(chan []*types.QuotaStats)
+	quotaNumsChan <- respChan
+	resp := <-respChan
+	close(respChan)
+	return resp
+}
+
+func updateQuota(req *QuotaReq) {
+	if req.quota == nil {
+		if quotas[req.scope][req.name] == nil {
+			req.respChan <- errors.New(fmt.Sprintf("No quota for %s %s.", req.scope, req.name))
+			return
+		}
+		delete(quotas[req.scope], req.name)
+	} else {
+		if quotas[req.scope] == nil {
+			quotas[req.scope] = map[string]*types.Quota{}
+		}
+		quota := *req.quota
+		quotas[req.scope][req.name] = &quota
+	}
+	save()
+	req.respChan <- nil
+}
+
+func quotaNums(respChan chan []*types.QuotaStats) {
+	stats := []*types.QuotaStats{}
+	for _, scope := range []string{types.QuotaScopeApp, types.QuotaScopeEnv} {
+		names := make([]string, 0, len(quotas[scope]))
+		for name, _ := range quotas[scope] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			quota := quotas[scope][name]
+			usedContainers, usedCPU, usedMemory := quotaUsage(scope, name)
+			totalContainers := quotaLimit(quota.MaxContainers, uint(NumContainers))
+			totalCPU := quotaLimit(quota.CPUShares, CPUShares)
+			totalMemory := quotaLimit(quota.MemoryLimit, MemoryLimit)
+			stats = append(stats, &types.QuotaStats{
+				Scope:      scope,
+				Name:       name,
+				Containers: quotaStats(totalContainers, usedContainers),
+				CPUShares:  quotaStats(totalCPU, usedCPU),
+				Memory:     quotaStats(totalMemory, usedMemory),
+			})
+		}
+	}
+	respChan <- stats
+}
+
+// check every quota that applies to a new container for app in env
+func checkQuotas(app, env string, manifest *types.Manifest) error {
+	if err := checkQuota(types.QuotaScopeApp, app, manifest); err != nil {
+		return err
+	}
+	return checkQuota(types.QuotaScopeEnv, env, manifest)
+}
+
+func checkQuota(scope, name string, manifest *types.Manifest) error {
+	quota := quotas[scope][name]
+	if quota == nil {
+		return nil
+	}
+	usedContainers, usedCPU, usedMemory := quotaUsage(scope, name)
+	if quota.MaxContainers > 0 && usedContainers >= quota.MaxContainers {
+		return errors.New(fmt.Sprintf("No free containers in the quota for %s %s. (%d used, %d max)", scope, name,
+			usedContainers, quota.MaxContainers))
+	}
+	if quota.CPUShares > 0 && manifest.CPUShares+usedCPU > quota.CPUShares {
+		return errors.New(fmt.Sprintf("Not enough CPU Shares in the quota for %s %s. (%d requested, %d available)",
+			scope, name, manifest.CPUShares, available(quota.CPUShares, usedCPU)))
+	}
+	if quota.MemoryLimit > 0 && manifest.MemoryLimit+usedMemory > quota.MemoryLimit {
+		return errors.New(fmt.Sprintf("Not enough Memory in the quota for %s %s. (%d requested, %d available)",
+			scope, name, manifest.MemoryLimit, available(quota.MemoryLimit, usedMemory)))
+	}
+	return nil
+}
+
+func quotaUsage(scope, name string) (numContainers, cpu, memory uint) {
+	for _, cont := range containers {
+		if quotaName(&cont.Container, scope) != name {
+			continue
+		}
+		numContainers++
+		cpu += cont.Manifest.CPUShares
+		memory += cont.Manifest.MemoryLimit
+	}
+	return
+}
+
+func quotaName(c *types.Container, scope string) string {
+	if scope == types.QuotaScopeApp {
+		return c.App
+	}
+	return c.Env
+}
+
+func quotaStats(total, used uint) *types.ResourceStats {
+	return &types.ResourceStats{Total: total, Used: used, Free: available(total, used)}
+}
+
+// a zero quota is bounded only by the supervisor itself
+func quotaLimit(limit, total uint) uint {
+	if limit == 0 || limit > total {
+		return total
+	}
+	return limit
+}
+
+// quotas can be lowered below current usage, so never underflow
+func available(total, used uint) uint {
+	if used >= total {
+		return 0
+	}
+	return total - used
+}
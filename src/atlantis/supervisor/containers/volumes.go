@@ -0,0 +1,161 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package containers
+
+import (
+	"atlantis/supervisor/helper"
+	"atlantis/supervisor/rpc/types"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type ListVolumesReq struct {
+	app      string
+	env      string
+	respChan chan []*types.VolumeInfo
+}
+
+type DeleteVolumeReq struct {
+	app      string
+	env      string
+	name     string
+	respChan chan error
+}
+
+// Set where persistent volumes live on the host. Volumes already created under another directory stay there, so
+// their data has to be moved along. Must be called before Init.
+func InitVolumeDir(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return errors.New("Invalid volume directory: " + dir + ". It must be absolute.")
+	}
+	helper.VolumeDir = filepath.Clean(dir)
+	return nil
+}
+
+// List persistent volumes. Empty app or env match everything.
+func ListVolumes(app, env string) []*types.VolumeInfo {
+	respChan := make(chan []*types.VolumeInfo)
+	listVolumesChan <- &ListVolumesReq{app, env, respChan}
+	resp := <-respChan
+	close(respChan)
+	// walking the volumes can take a while so don't do it in the containerManager
+	for _, vol := range resp {
+		if pretending() {
+			continue
+		}
+		size, err := helper.DirSize(vol.HostPath)
+		if err != nil {
+			log.Printf("[volumes] could not get usage of %s: %v", vol.HostPath, err)
+		}
+		vol.UsedBytes = size
+	}
+	return resp
+}
+
+// Delete a volume and all of its data. Volumes still in use by a container can not be deleted.
+func DeleteVolume(app, env, name string) error {
+	respChan := make(chan error)
+	deleteVolumeChan <- &DeleteVolumeReq{app, env, name, respChan}
+	resp := <-respChan
+	close(respChan)
+	return resp
+}
+
+func checkVolumes(req *ReserveReq) error {
+	if len(req.manifest.Volumes) == 0 {
+		return nil
+	}
+	if err := req.manifest.ValidateVolumes(); err != nil {
+		return err
+	}
+	return types.ValidateVolumeOwner(req.app, req.env)
+}
+
+// make sure every volume the container declares is known. the directories are created on deploy.
+func registerVolumes(c *Container) {
+	for _, vol := range c.Manifest.Volumes {
+		key := types.VolumeKey(c.App, c.Env, vol.Name)
+		info, exists := volumes[key]
+		if !exists {
+			info = &types.VolumeInfo{
+				App:      c.App,
+				Env:      c.Env,
+				Name:     vol.Name,
+				HostPath: helper.HostVolumeDir(c.App, c.Env, vol.Name),
+			}
+			volumes[key] = info
+			log.Printf("[volumes] registered %s for %s", key, c.ID)
+		}
+		info.SizeMB = vol.SizeMB
+	}
+}
+
+// the containers currently using each volume, by volume key
+func volumeUsers() map[string][]string {
+	users := map[string][]string{}
+	for id, cont := range containers {
+		for _, vol := range cont.Manifest.Volumes {
+			key := types.VolumeKey(cont.App, cont.Env, vol.Name)
+			users[key] = append(users[key], id)
+		}
+	}
+	return users
+}
+
+func listVolumes(req *ListVolumesReq) {
+	users := volumeUsers()
+	keys := make([]string, 0, len(volumes))
+	for key, _ := range volumes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	resp := []*types.VolumeInfo{}
+	for _, key := range keys {
+		vol := volumes[key]
+		if (req.app != "" && req.app != vol.App) || (req.env != "" && req.env != vol.Env) {
+			continue
+		}
+		volCopy := *vol
+		volCopy.Containers = append([]string{}, users[key]...)
+		sort.Strings(volCopy.Containers)
+		volCopy.RefCount = uint(len(volCopy.Containers))
+		resp = append(resp, &volCopy)
+	}
+	req.respChan <- resp
+}
+
+func deleteVolume(req *DeleteVolumeReq) {
+	key := types.VolumeKey(req.app, req.env, req.name)
+	vol, exists := volumes[key]
+	if !exists {
+		req.respChan <- errors.New("No such volume: " + key)
+		return
+	}
+	if users := volumeUsers()[key]; len(users) > 0 {
+		req.respChan <- errors.New(fmt.Sprintf("Volume %s is in use by %d container(s): %v", key, len(users), users))
+		return
+	}
+	if pretending() {
+		log.Printf("[volumes][pretend] rm -rf %s", vol.HostPath)
+	} else if err := os.RemoveAll(vol.HostPath); err != nil {
+		req.respChan <- err
+		return
+	}
+	delete(volumes, key)
+	save()
+	log.Printf("[volumes] deleted %s", key)
+	req.respChan <- nil
+}
@@ -15,8 +15,28 @@ import (
 	"atlantis/crypto"
 	"atlantis/supervisor/rpc/types"
 	"encoding/json"
+	"errors"
 )
 
+// Encrypt with the active key, or the compiled in key if there is no keyring
+func encrypt(plain []byte) (string, error) {
+	if k := currentKeyring(); k != nil && k.ActiveID() != "" {
+		return k.Encrypt(plain)
+	}
+	return string(crypto.Encrypt(plain)), nil
+}
+
+func decrypt(ciphertext string) ([]byte, error) {
+	if KeyID(ciphertext) == "" {
+		return crypto.Decrypt([]byte(ciphertext)), nil
+	}
+	k := currentKeyring()
+	if k == nil {
+		return nil, errors.New("No keyring to decrypt with key " + KeyID(ciphertext))
+	}
+	return k.Decrypt(ciphertext)
+}
+
 func EncryptAppDep(data *types.AppDep) error {
 	// encrypt DataMap and nil out DataMap
 	// convert to JSON
@@ -25,7 +45,10 @@ func EncryptAppDep(data *types.AppDep) error {
 		return err
 	}
 	// encrypt into Data
-	data.EncryptedData = string(crypto.Encrypt(jsonBytes))
+	data.EncryptedData, err = encrypt(jsonBytes)
+	if err != nil {
+		return err
+	}
 	// nil out DataMap
 	data.DataMap = nil
 	return nil
@@ -40,8 +63,32 @@ func DecryptAppDep(data *types.AppDep) error {
 
 func DecryptedAppDepData(data *types.AppDep) (map[string]interface{}, error) {
 	// decrypt Data
-	decryptedBytes := crypto.Decrypt([]byte(data.EncryptedData))
+	decryptedBytes, err := decrypt(data.EncryptedData)
+	if err != nil {
+		return nil, err
+	}
 	dataMap := map[string]interface{}{}
 	// Unmarshal JSON
 	return dataMap, json.Unmarshal(decryptedBytes, &dataMap)
 }
+
+// The data encrypted with the active key. Data already encrypted with it is returned as is.
+func ReencryptedAppDepData(data *types.AppDep) (string, bool, error) {
+	activeID := ActiveKeyID()
+	if activeID == "" {
+		return "", false, errors.New("No active encryption key.")
+	}
+	if KeyID(data.EncryptedData) == activeID {
+		return data.EncryptedData, false, nil
+	}
+	plain, err := decrypt(data.EncryptedData)
+	if err != nil {
+		return "", false, err
+	}
+	// never rewrite data that doesn't decrypt to something usable
+	if err := json.Unmarshal(plain, &map[string]interface{}{}); err != nil {
+		return "", false, err
+	}
+	reencrypted, err := encrypt(plain)
+	return reencrypted, err == nil, err
+}
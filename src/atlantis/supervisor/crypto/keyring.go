@@ -0,0 +1,193 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Versioned ciphertext is "v1:<key id>:<base64 of nonce + AES-GCM sealed data>". Anything else is legacy data
+// encrypted with the key compiled into atlantis/crypto.
+const versionPrefix = "v1:"
+
+var (
+	keyIDRegexp = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+	keyring     *Keyring // nil means only the compiled in key is used
+	keyringLock = sync.RWMutex{}
+)
+
+// Encryption keys by id. New data is encrypted with the active key, any key can decrypt.
+type Keyring struct {
+	activeID string
+	keys     map[string]cipher.AEAD
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[string]cipher.AEAD{}}
+}
+
+// Add an AES key (16, 24 or 32 bytes). Only one key may be active.
+func (k *Keyring) Add(id string, key []byte, active bool) error {
+	if !keyIDRegexp.MatchString(id) {
+		return errors.New("Invalid encryption key id: " + id)
+	}
+	if _, exists := k.keys[id]; exists {
+		return errors.New("Duplicate encryption key id: " + id)
+	}
+	if active && k.activeID != "" {
+		return errors.New(fmt.Sprintf("Only one encryption key may be active (%s and %s)", k.activeID, id))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid encryption key %s: %v", id, err))
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.keys[id] = aead
+	if active {
+		k.activeID = id
+	}
+	return nil
+}
+
+// The id of the key new data is encrypted with. Empty if there is none.
+func (k *Keyring) ActiveID() string {
+	return k.activeID
+}
+
+func (k *Keyring) Encrypt(plain []byte) (string, error) {
+	aead, exists := k.keys[k.activeID]
+	if !exists {
+		return "", errors.New("No active encryption key.")
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, []byte(k.activeID))
+	return versionPrefix + k.activeID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (k *Keyring) Decrypt(ciphertext string) ([]byte, error) {
+	id, data, err := parseCiphertext(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	aead, exists := k.keys[id]
+	if !exists {
+		return nil, errors.New("Unknown encryption key: " + id)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("Invalid ciphertext: too short")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not decrypt with key %s: %v", id, err))
+	}
+	return plain, nil
+}
+
+func parseCiphertext(ciphertext string) (string, []byte, error) {
+	parts := strings.SplitN(strings.TrimPrefix(ciphertext, versionPrefix), ":", 2)
+	if len(parts) != 2 || !keyIDRegexp.MatchString(parts[0]) {
+		return "", nil, errors.New("Invalid ciphertext: missing key id")
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, errors.New("Invalid ciphertext: " + err.Error())
+	}
+	return parts[0], data, nil
+}
+
+// The id of the key that encrypted the data. Empty for legacy data.
+func KeyID(ciphertext string) string {
+	if !strings.HasPrefix(ciphertext, versionPrefix) {
+		return ""
+	}
+	id, _, err := parseCiphertext(ciphertext)
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// Load a keyring from files holding base64 encoded AES keys. A key's id is its file name without the
+// extension. The active key is used for new data, the others only decrypt.
+func LoadKeyring(activeFile string, decryptOnlyFiles []string) (*Keyring, error) {
+	k := NewKeyring()
+	files := append([]string{activeFile}, decryptOnlyFiles...)
+	for i, file := range files {
+		if file == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, errors.New(file + ": " + err.Error())
+		}
+		id := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		if err := k.Add(id, key, i == 0); err != nil {
+			return nil, errors.New(file + ": " + err.Error())
+		}
+	}
+	return k, nil
+}
+
+// Use the keys in the given files for AppDep data. With no files only the compiled in key is used.
+func InitKeyring(activeFile string, decryptOnlyFiles []string) error {
+	if activeFile == "" && len(decryptOnlyFiles) == 0 {
+		SetKeyring(nil)
+		return nil
+	}
+	k, err := LoadKeyring(activeFile, decryptOnlyFiles)
+	if err != nil {
+		return err
+	}
+	SetKeyring(k)
+	return nil
+}
+
+func SetKeyring(k *Keyring) {
+	keyringLock.Lock()
+	defer keyringLock.Unlock()
+	keyring = k
+}
+
+func currentKeyring() *Keyring {
+	keyringLock.RLock()
+	defer keyringLock.RUnlock()
+	return keyring
+}
+
+// The id of the key new AppDep data is encrypted with. Empty means the compiled in key.
+func ActiveKeyID() string {
+	if k := currentKeyring(); k != nil {
+		return k.ActiveID()
+	}
+	return ""
+}
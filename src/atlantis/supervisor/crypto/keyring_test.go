@@ -0,0 +1,85 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package crypto
+
+import (
+	"atlantis/supervisor/rpc/types"
+	"bytes"
+	"encoding/base64"
+	"github.com/adjust/gocheck"
+	"io/ioutil"
+	"os"
+)
+
+func writeKey(c *gocheck.C, file string, fill byte) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32))
+	c.Assert(ioutil.WriteFile(file, []byte(key+"\n"), 0600), gocheck.IsNil)
+}
+
+func (s *CryptoSuite) TestKeyring(c *gocheck.C) {
+	dir, err := ioutil.TempDir("", "keyring")
+	c.Assert(err, gocheck.IsNil)
+	defer os.RemoveAll(dir)
+	defer SetKeyring(nil)
+	writeKey(c, dir+"/old.key", 1)
+	writeKey(c, dir+"/new.key", 2)
+	c.Assert(ioutil.WriteFile(dir+"/bad.key", []byte("c2hvcnQ="), 0600), gocheck.IsNil)
+	_, err = LoadKeyring(dir+"/new.key", []string{dir + "/bad.key"})
+	c.Assert(err, gocheck.ErrorMatches, ".*/bad.key: Invalid encryption key bad: .*")
+	_, err = LoadKeyring(dir+"/new.key", []string{dir + "/new.key"})
+	c.Assert(err, gocheck.ErrorMatches, ".*/new.key: Duplicate encryption key id: new")
+
+	// legacy data decrypts with the compiled in key until a keyring is active
+	legacy := &types.AppDep{DataMap: map[string]interface{}{"password": "legacy"}}
+	c.Assert(EncryptAppDep(legacy), gocheck.IsNil)
+	c.Assert(KeyID(legacy.EncryptedData), gocheck.Equals, "")
+	_, _, err = ReencryptedAppDepData(legacy)
+	c.Assert(err, gocheck.ErrorMatches, "No active encryption key\\.")
+
+	c.Assert(InitKeyring(dir+"/old.key", nil), gocheck.IsNil)
+	old := &types.AppDep{DataMap: map[string]interface{}{"password": "old"}}
+	c.Assert(EncryptAppDep(old), gocheck.IsNil)
+	c.Assert(KeyID(old.EncryptedData), gocheck.Equals, "old")
+
+	// rotate. the old key can still decrypt but new data uses the new key.
+	c.Assert(InitKeyring(dir+"/new.key", []string{dir + "/old.key"}), gocheck.IsNil)
+	c.Assert(ActiveKeyID(), gocheck.Equals, "new")
+	data, err := DecryptedAppDepData(old)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(data["password"], gocheck.Equals, "old")
+	for _, dep := range []*types.AppDep{old, legacy} {
+		reencrypted, changed, err := ReencryptedAppDepData(dep)
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(changed, gocheck.Equals, true)
+		c.Assert(KeyID(reencrypted), gocheck.Equals, "new")
+		dep.EncryptedData = reencrypted
+	}
+	_, changed, err := ReencryptedAppDepData(old)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(changed, gocheck.Equals, false)
+	data, err = DecryptedAppDepData(legacy)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(data["password"], gocheck.Equals, "legacy")
+
+	// once the old key is gone its data can't be read, and tampering is caught
+	stale := &types.AppDep{}
+	c.Assert(InitKeyring(dir+"/old.key", nil), gocheck.IsNil)
+	stale.DataMap = map[string]interface{}{"password": "stale"}
+	c.Assert(EncryptAppDep(stale), gocheck.IsNil)
+	c.Assert(InitKeyring(dir+"/new.key", nil), gocheck.IsNil)
+	_, err = DecryptedAppDepData(stale)
+	c.Assert(err, gocheck.ErrorMatches, "Unknown encryption key: old")
+	tampered := &types.AppDep{EncryptedData: "v1:old" + old.EncryptedData[len("v1:new"):]}
+	c.Assert(InitKeyring(dir+"/new.key", []string{dir + "/old.key"}), gocheck.IsNil)
+	_, err = DecryptedAppDepData(tampered)
+	c.Assert(err, gocheck.ErrorMatches, "Could not decrypt with key old: .*")
+}
@@ -0,0 +1,101 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+)
+
+// Checks a detached signature over an image digest
+type DigestVerifier interface {
+	Verify(digest string, signature []byte) error
+}
+
+// Verifies signatures made with the private half of any of a set of RSA or ECDSA keys. Signatures are over
+// the SHA-256 of the digest string (RSA PKCS#1 v1.5 or ASN.1 ECDSA).
+type PublicKeyVerifier struct {
+	keys []crypto.PublicKey
+}
+
+// Load PEM encoded PKIX public keys. Each file may hold more than one key.
+func NewPublicKeyFileVerifier(files ...string) (*PublicKeyVerifier, error) {
+	verifier := &PublicKeyVerifier{keys: []crypto.PublicKey{}}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifier.AddPEM(data); err != nil {
+			return nil, errors.New(file + ": " + err.Error())
+		}
+	}
+	if len(verifier.keys) == 0 {
+		return nil, errors.New("No public keys to verify image signatures with")
+	}
+	return verifier, nil
+}
+
+func (v *PublicKeyVerifier) AddPEM(data []byte) error {
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			v.keys = append(v.keys, key)
+			found = true
+		default:
+			return errors.New("unsupported public key type")
+		}
+	}
+	if !found {
+		return errors.New("no PEM encoded public keys found")
+	}
+	return nil
+}
+
+func (v *PublicKeyVerifier) Verify(digest string, signature []byte) error {
+	if len(signature) == 0 {
+		return errors.New("No signature for image digest " + digest)
+	}
+	hashed := sha256.Sum256([]byte(digest))
+	for _, key := range v.keys {
+		switch typedKey := key.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(typedKey, crypto.SHA256, hashed[:], signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(typedKey, hashed[:], signature) {
+				return nil
+			}
+		}
+	}
+	return errors.New("Bad signature for image digest " + digest)
+}
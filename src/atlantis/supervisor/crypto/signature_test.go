@@ -0,0 +1,72 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/adjust/gocheck"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCrypto(t *testing.T) { gocheck.TestingT(t) }
+
+type CryptoSuite struct{}
+
+var _ = gocheck.Suite(&CryptoSuite{})
+
+func writePublicKey(c *gocheck.C, file string, key crypto.PublicKey) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	c.Assert(err, gocheck.IsNil)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	c.Assert(ioutil.WriteFile(file, pemBytes, 0644), gocheck.IsNil)
+}
+
+func (s *CryptoSuite) TestPublicKeyVerifier(c *gocheck.C) {
+	digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	hashed := sha256.Sum256([]byte(digest))
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, gocheck.IsNil)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gocheck.IsNil)
+	writePublicKey(c, "rsa_test.pem", &rsaKey.PublicKey)
+	writePublicKey(c, "ec_test.pem", &ecKey.PublicKey)
+	defer os.Remove("rsa_test.pem")
+	defer os.Remove("ec_test.pem")
+
+	_, err = NewPublicKeyFileVerifier("nonexistent_test.pem")
+	c.Assert(err, gocheck.NotNil)
+	verifier, err := NewPublicKeyFileVerifier("rsa_test.pem", "ec_test.pem")
+	c.Assert(err, gocheck.IsNil)
+
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hashed[:])
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(verifier.Verify(digest, rsaSig), gocheck.IsNil)
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecKey, hashed[:])
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(verifier.Verify(digest, ecSig), gocheck.IsNil)
+	c.Assert(verifier.Verify(digest+"0", rsaSig), gocheck.ErrorMatches, "Bad signature for image digest .*")
+	c.Assert(verifier.Verify(digest, nil), gocheck.ErrorMatches, "No signature for image digest .*")
+
+	// only trusts the keys it was given
+	verifier, err = NewPublicKeyFileVerifier("rsa_test.pem")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(verifier.Verify(digest, ecSig), gocheck.ErrorMatches, "Bad signature for image digest .*")
+}
@@ -48,7 +48,15 @@ func ContainerAppCfgs(c *types.Container) (*atypes.AppConfig, error) {
 	}, nil
 }
 
-func ContainerDockerCfgs(c *types.Container) (*docker.Config, *docker.HostConfig) {
+func ContainerVolumeDirs(c *types.Container) []string {
+	dirs := make([]string, len(c.Manifest.Volumes))
+	for i, vol := range c.Manifest.Volumes {
+		dirs[i] = helper.HostVolumeDir(c.App, c.Env, vol.Name)
+	}
+	return dirs
+}
+
+func ContainerDockerCfgs(c *types.Container) (*docker.Config, *docker.HostConfig, error) {
 	// get env cfg
 	envs := []string{
 		"ATLANTIS=true",
@@ -63,10 +71,11 @@ func ContainerDockerCfgs(c *types.Container) (*docker.Config, *docker.HostConfig
 	exposedPorts := map[docker.Port]struct{}{}
 	portBindings := map[docker.Port][]docker.PortBinding{}
 	sPrimaryPort := fmt.Sprintf("%d", c.PrimaryPort)
-	dPrimaryPort := NewDockerPort(sPrimaryPort, "tcp")
+	primarySpec := c.PrimaryPortSpec()
+	dPrimaryPort := NewDockerPort(sPrimaryPort, primarySpec.Protocol)
 	exposedPorts[dPrimaryPort] = struct{}{}
 	portBindings[dPrimaryPort] = []docker.PortBinding{docker.PortBinding{
-		HostIP:   "",
+		HostIP:   primarySpec.HostIP,
 		HostPort: sPrimaryPort,
 	}}
 	sSSHPort := fmt.Sprintf("%d", c.SSHPort)
@@ -78,40 +87,65 @@ func ContainerDockerCfgs(c *types.Container) (*docker.Config, *docker.HostConfig
 	}}
 	for i, port := range c.SecondaryPorts {
 		sPort := fmt.Sprintf("%d", port)
-		dPort := NewDockerPort(sPort, "tcp")
+		spec := c.SecondaryPortSpec(i)
+		dPort := NewDockerPort(sPort, spec.Protocol)
 		exposedPorts[dPort] = struct{}{}
 		portBindings[dPort] = []docker.PortBinding{docker.PortBinding{
-			HostIP:   "",
+			HostIP:   spec.HostIP,
 			HostPort: sPort,
 		}}
 		envs = append(envs, fmt.Sprintf("SECONDARY_PORT%d=%d", i, port))
 	}
+	envs = append(envs, c.PortEnv()...)
+	// manifest envs can't clobber the ones above, ValidateEnvironment rejects reserved names
+	manifestEnvs, err := c.ManifestEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	envs = append(envs, manifestEnvs...)
+	cmd := c.Manifest.ContainerCommand()
+
+	// get volume cfg
+	volumes := map[string]struct{}{
+		ContainerLogDir:           struct{}{},
+		atypes.ContainerConfigDir: struct{}{},
+	}
+	binds := []string{
+		fmt.Sprintf("%s:%s", helper.HostLogDir(c.ID), ContainerLogDir),
+		fmt.Sprintf("%s:%s", helper.HostConfigDir(c.ID), atypes.ContainerConfigDir),
+	}
+	for _, vol := range c.Manifest.Volumes {
+		volumes[vol.Path] = struct{}{}
+		binds = append(binds, fmt.Sprintf("%s:%s", helper.HostVolumeDir(c.App, c.Env, vol.Name), vol.Path))
+	}
+
+	image, err := ContainerImageRef(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	cpuSet := c.CPUSet
+	if len(cpuSet) == 0 {
+		cpuSet = c.SharedCPUSet
+	}
 
 	// setup actual cfg
 	dCfg := &docker.Config{
 		Tty:          true, // allocate pseudo-tty
 		OpenStdin:    true, // keep stdin open even if we're not attached
 		CPUShares:    int64(c.Manifest.CPUShares),
+		Cpuset:       helper.FormatCPUList(cpuSet),                     // empty means no pinning
 		Memory:       int64(c.Manifest.MemoryLimit) * int64(1024*1024), // this is in bytes
 		MemorySwap:   int64(-1),                                        // -1 turns swap off
 		ExposedPorts: exposedPorts,
 		Env:          envs,
-		Cmd: []string{
-			"runsvdir",
-			"/etc/service",
-		},
-		Image: fmt.Sprintf("%s/%s/%s-%s", RegistryHost, c.GetDockerRepo(), c.App, c.Sha),
-		Volumes: map[string]struct{}{
-			ContainerLogDir:           struct{}{},
-			atypes.ContainerConfigDir: struct{}{},
-		},
+		Entrypoint:   c.Manifest.Entrypoint,
+		Cmd:          cmd,
+		Image:        image,
+		Volumes:      volumes,
 	}
 	dHostCfg := &docker.HostConfig{
-		PortBindings: portBindings,
-		Binds: []string{
-			fmt.Sprintf("%s:%s", helper.HostLogDir(c.ID), ContainerLogDir),
-			fmt.Sprintf("%s:%s", helper.HostConfigDir(c.ID), atypes.ContainerConfigDir),
-		},
+		PortBindings:  portBindings,
+		Binds:         binds,
 		RestartPolicy: docker.AlwaysRestart(),
 
 		// We added this so that we could reference the veth after it was created. However, docker no longer
@@ -126,5 +160,5 @@ func ContainerDockerCfgs(c *types.Container) (*docker.Config, *docker.HostConfig
 		//			},
 
 	}
-	return dCfg, dHostCfg
+	return dCfg, dHostCfg, nil
 }
@@ -18,28 +18,31 @@ import (
 	"errors"
 	"fmt"
 	"github.com/fsouza/go-dockerclient"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
-	"sync"
 )
 
 var (
-	RegistryHost   string
-	dockerIDRegexp = regexp.MustCompile("^[A-Za-z0-9]+$")
-	dockerLock     = sync.Mutex{}
-	dockerClient   *docker.Client
+	RegistryHost    string
+	CgroupCPUSetDir = "/sys/fs/cgroup/cpuset/docker" // where docker keeps the cpuset cgroups of its containers
+	dockerIDRegexp  = regexp.MustCompile("^[A-Za-z0-9]+$")
+	dockerClient    dockerAPI // not for direct access. use client().
 )
 
-func Init(registry string) (err error) {
+func Init(registry string) error {
 	RegistryHost = registry
-	dockerClient, err = docker.NewClient("unix:///var/run/docker.sock")
+	c, err := newClient()
 	if err != nil {
 		return err
 	}
-	go removeExited()
-	go restartGhost()
+	setClient(c)
+	if !pretending() {
+		go monitorDaemon()
+	}
 	return nil
 }
 
@@ -47,64 +50,20 @@ func pretending() bool {
 	return os.Getenv("SUPERVISOR_PRETEND") != ""
 }
 
-func removeExited() {
-	if pretending() {
-		return
-	}
-	dockerLock.Lock()
-	defer dockerLock.Unlock()
-	containers, err := dockerClient.ListContainers(docker.ListContainersOptions{All: true})
-	if err != nil {
-		log.Printf("[RemoveExited] could not list containers: %v", err)
-		return
-	}
-	for _, cont := range containers {
-		log.Printf("[RemoveExited] checking %s (%v) : %s", cont.ID, cont.Names, cont.Status)
-		if !strings.HasPrefix(cont.Status, "Exit") {
-			continue
-		}
-		log.Printf("[RemoveExited] remove %s (%v)", cont.ID, cont.Names)
-		err := dockerClient.RemoveContainer(docker.RemoveContainerOptions{ID: cont.ID})
-		if err != nil {
-			log.Printf("[RemoveExited] -> error: %v", err)
-		} else {
-			log.Printf("[RemoveExited] -> success")
-		}
-	}
-}
-
-func restartGhost() {
-	if pretending() {
-		return
-	}
-	dockerLock.Lock()
-	defer dockerLock.Unlock()
-	containers, err := dockerClient.ListContainers(docker.ListContainersOptions{All: true})
-	if err != nil {
-		log.Printf("[RestartGhost] could not list containers: %v", err)
-		return
-	}
-	for _, cont := range containers {
-		log.Printf("[RestartGhost] checking %s (%v) : %s", cont.ID, cont.Names, cont.Status)
-		if !strings.HasPrefix(cont.Status, "Ghost") {
-			continue
-		}
-		log.Printf("[RestartGhost] restart %s (%v)", cont.ID, cont.Names)
-		err := dockerClient.RestartContainer(cont.ID, 0)
-		if err != nil {
-			log.Printf("[RestartGhost] -> error: %v", err)
-		} else {
-			log.Printf("[RestartGhost] -> success")
-		}
+// our containers are named by their id
+func containerName(cont docker.APIContainers) string {
+	if len(cont.Names) == 0 {
+		return cont.ID
 	}
+	return strings.TrimPrefix(cont.Names[0], "/")
 }
 
-func DockerCfgs(c types.GenericContainer) (*docker.Config, *docker.HostConfig) {
+func DockerCfgs(c types.GenericContainer) (*docker.Config, *docker.HostConfig, error) {
 	switch typedC := c.(type) {
 	case *types.Container:
 		return ContainerDockerCfgs(typedC)
 	default:
-		return nil, nil
+		return nil, nil, errors.New("could not fetch docker configs")
 	}
 }
 
@@ -117,24 +76,47 @@ func AppCfgs(c types.GenericContainer) (*atypes.AppConfig, error) {
 	}
 }
 
+func VolumeDirs(c types.GenericContainer) []string {
+	switch typedC := c.(type) {
+	case *types.Container:
+		return ContainerVolumeDirs(typedC)
+	default:
+		return nil
+	}
+}
+
 func Deploy(c types.GenericContainer) error {
-	dRepo := fmt.Sprintf("%s/%s/%s-%s", RegistryHost, c.GetDockerRepo(), c.GetApp(), c.GetSha())
+	dRepo, err := ImageRef(c)
+	if err != nil {
+		return err
+	}
+	pullOpts, err := pullImageOptions(dRepo)
+	if err != nil {
+		return err
+	}
+	c.SetImage(dRepo)
 	// Pull docker container
 	if pretending() {
 		log.Printf("[%s][pretend] deploy with %s @ %s...", c.GetID(), c.GetApp(), c.GetSha())
 		log.Printf("[%s][pretend] docker pull %s", c.GetID(), dRepo)
+		if c.GetExpectedDigest() != "" {
+			log.Printf("[%s][pretend] verify %s has digest %s", c.GetID(), dRepo, c.GetExpectedDigest())
+		}
 		log.Printf("[%s][pretend] docker run %s", c.GetID(), dRepo)
 		c.SetDockerID(fmt.Sprintf("pretend-docker-id-%s", c.GetID()))
 	} else {
 		log.Printf("[%s] deploy with %s @ %s...", c.GetID(), c.GetApp(), c.GetSha())
+		unlock := lockContainer(c.GetID())
+		defer unlock()
 		log.Printf("[%s] docker pull %s", c.GetID(), dRepo)
-		dockerLock.Lock()
-		err := dockerClient.PullImage(docker.PullImageOptions{Repository: dRepo}, docker.AuthConfiguration{})
-		dockerLock.Unlock()
+		err = pullImage(pullOpts)
 		if err != nil {
 			log.Printf("[%s] ERROR: failed to pull %s", c.GetID(), dRepo)
 			return err
 		}
+		if err := checkImage(c, dRepo); err != nil {
+			return err
+		}
 
 		// make log dir for volume
 		err = os.MkdirAll(helper.HostLogDir(c.GetID()), 0755)
@@ -146,22 +128,27 @@ func Deploy(c types.GenericContainer) error {
 		if err != nil {
 			return err
 		}
-		// put config in config dir
-		appCfg, err := AppCfgs(c)
-		if err != nil {
-			return err
+		// make persistent volume dirs. these are never removed on teardown.
+		for _, dir := range VolumeDirs(c) {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
 		}
-		if err := appCfg.Save(helper.HostConfigFile(c.GetID())); err != nil {
+		// put config and its renderings in config dir
+		if err := WriteConfigs(c); err != nil {
 			RemoveConfigDir(c)
 			return err
 		}
 
 		log.Printf("[%s] docker run %s", c.GetID(), dRepo)
 		// create docker container
-		dCfg, dHostCfg := DockerCfgs(c)
-		dockerLock.Lock()
-		dCont, err := dockerClient.CreateContainer(docker.CreateContainerOptions{Name: c.GetID(), Config: dCfg})
-		dockerLock.Unlock()
+		dCfg, dHostCfg, err := DockerCfgs(c)
+		if err != nil {
+			log.Printf("[%s] ERROR: failed to build docker config: %s", c.GetID(), err.Error())
+			RemoveConfigDir(c)
+			return err
+		}
+		dCont, err := client().CreateContainer(docker.CreateContainerOptions{Name: c.GetID(), Config: dCfg})
 		if err != nil {
 			log.Printf("[%s] ERROR: failed to create container: %s", c.GetID(), err.Error())
 			return err
@@ -169,16 +156,12 @@ func Deploy(c types.GenericContainer) error {
 		c.SetDockerID(dCont.ID)
 
 		// start docker container
-		dockerLock.Lock()
-		err = dockerClient.StartContainer(c.GetDockerID(), dHostCfg)
-		dockerLock.Unlock()
+		err = client().StartContainer(c.GetDockerID(), dHostCfg)
 		if err != nil {
 			log.Printf("[%s] ERROR: failed to start container: %s", c.GetID(), err.Error())
 			log.Printf("[%s] -- full create response:\n%+v", c.GetID(), dCont)
 			log.Printf("[%s] inspecting container for more information...", c.GetID())
-			dockerLock.Lock()
-			inspCont, ierr := dockerClient.InspectContainer(c.GetDockerID())
-			dockerLock.Unlock()
+			inspCont, ierr := client().InspectContainer(c.GetDockerID())
 			if ierr != nil {
 				log.Printf("[%s] ERROR: failed to inspect container: %s", c.GetID(), ierr.Error())
 				return ierr
@@ -187,9 +170,7 @@ func Deploy(c types.GenericContainer) error {
 			return err
 		}
 
-		dockerLock.Lock()
-		inspCont, err := dockerClient.InspectContainer(c.GetDockerID())
-		dockerLock.Unlock()
+		inspCont, err := client().InspectContainer(c.GetDockerID())
 		if err != nil {
 			log.Printf("[%s] ERROR: failed to inspect container: %s", c.GetID(), err.Error())
 			return err
@@ -200,6 +181,9 @@ func Deploy(c types.GenericContainer) error {
 		}
 		c.SetIP(inspCont.NetworkSettings.IPAddress)
 		c.SetPid(inspCont.State.Pid)
+		digest := runningImageDigest(dRepo, inspCont.Image)
+		c.SetImageDigest(digest)
+		log.Printf("[%s] running image %s (%s)", c.GetID(), inspCont.Image, digest)
 	}
 	return nil
 }
@@ -208,6 +192,35 @@ func RemoveConfigDir(c types.GenericContainer) error {
 	return os.RemoveAll(helper.HostConfigDir(c.GetID()))
 }
 
+// The pid of the container's process as docker sees it now. Restarted containers get a new one.
+func CurrentPid(c types.GenericContainer) (int, error) {
+	if pretending() {
+		return c.GetPid(), nil
+	}
+	inspCont, err := client().InspectContainer(c.GetDockerID())
+	if err != nil {
+		return 0, err
+	}
+	if !inspCont.State.Running {
+		return 0, errors.New("Container " + c.GetID() + " is not running")
+	}
+	return inspCont.State.Pid, nil
+}
+
+// Pin a running container to cpus. Containers that weren't created yet pick up their cpuset when they are.
+func SetCPUSet(c types.GenericContainer, cpus []int) error {
+	if c.GetDockerID() == "" {
+		return nil
+	}
+	cpuList := helper.FormatCPUList(cpus)
+	if pretending() {
+		log.Printf("[%s][pretend] pin to cpus %s", c.GetID(), cpuList)
+		return nil
+	}
+	log.Printf("[%s] pin to cpus %s", c.GetID(), cpuList)
+	return ioutil.WriteFile(filepath.Join(CgroupCPUSetDir, c.GetDockerID(), "cpuset.cpus"), []byte(cpuList), 0644)
+}
+
 // Teardown the container. This will kill the docker container but will not free the ports/containers
 func Teardown(c types.GenericContainer) error {
 	if pretending() {
@@ -216,22 +229,23 @@ func Teardown(c types.GenericContainer) error {
 	} else {
 		log.Printf("teardown %s...", c.GetID())
 	}
-	defer removeExited()
-	dockerLock.Lock()
-	err := dockerClient.KillContainer(docker.KillContainerOptions{ID: c.GetDockerID()})
-	dockerLock.Unlock()
+	unlock := lockContainer(c.GetID())
+	defer unlock()
+	err := client().KillContainer(docker.KillContainerOptions{ID: c.GetDockerID()})
 	if err != nil {
 		log.Printf("failed to teardown[kill] %s: %v", c.GetID(), err)
 		return err
 	}
 	// Make sure the container is dead before we return to avoid cmk (or other) race conditions
-	dockerLock.Lock()
-	_, err = dockerClient.WaitContainer(c.GetDockerID())
-	dockerLock.Unlock()
+	_, err = client().WaitContainer(c.GetDockerID())
 	if err != nil {
 		log.Printf("failed to wait on dead container[wait] %s: %v", c.GetID(), err)
 		// Continue, since this is non-fatal and we should continue cleaning up.
 	}
+	if err := client().RemoveContainer(docker.RemoveContainerOptions{ID: c.GetDockerID()}); err != nil {
+		// the janitor will get it later
+		log.Printf("failed to remove dead container[rm] %s: %v", c.GetID(), err)
+	}
 	// TODO do something with log dir
 	return RemoveConfigDir(c)
 }
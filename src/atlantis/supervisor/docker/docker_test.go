@@ -0,0 +1,298 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	. "atlantis/supervisor/constant"
+	"atlantis/supervisor/events"
+	"atlantis/supervisor/rpc/types"
+	"errors"
+	"github.com/adjust/gocheck"
+	"github.com/fsouza/go-dockerclient"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDocker(t *testing.T) { gocheck.TestingT(t) }
+
+type DockerSuite struct{}
+
+var _ = gocheck.Suite(&DockerSuite{})
+
+func (s *DockerSuite) TestInitEndpoint(c *gocheck.C) {
+	defer InitEndpoint(&Endpoint{}, DefaultProbeInterval)
+	c.Assert(InitEndpoint(&Endpoint{}, DefaultProbeInterval), gocheck.IsNil)
+	c.Assert(Health().Endpoint, gocheck.Equals, DefaultEndpoint)
+	c.Assert(InitEndpoint(&Endpoint{Address: "/tmp/docker.sock"}, time.Second), gocheck.IsNil)
+	c.Assert(Health().Endpoint, gocheck.Equals, "unix:///tmp/docker.sock")
+	c.Assert(InitEndpoint(&Endpoint{Address: "/tmp/docker.sock", CA: "ca.pem"}, time.Second), gocheck.ErrorMatches,
+		"Docker TLS settings are only valid for tcp endpoints: .*")
+	c.Assert(InitEndpoint(&Endpoint{Address: "tcp://docker:2376", Cert: "cert.pem"}, time.Second),
+		gocheck.ErrorMatches, "Please specify both a docker client cert and key\\.")
+	c.Assert(InitEndpoint(&Endpoint{Address: "tcp://docker:2376", CA: "ca.pem"}, time.Second),
+		gocheck.ErrorMatches, "Please specify a docker client cert and key to use with the CA\\.")
+	c.Assert(InitEndpoint(&Endpoint{Address: "tcp://docker:2376", Cert: "cert.pem", Key: "key.pem", CA: "ca.pem"},
+		time.Second), gocheck.IsNil)
+	c.Assert(InitEndpoint(&Endpoint{Address: "http://docker"}, time.Second), gocheck.ErrorMatches,
+		"Invalid docker endpoint: http://docker")
+	c.Assert(InitEndpoint(&Endpoint{}, 0), gocheck.ErrorMatches, "Invalid docker probe interval: 0s?")
+}
+
+func (s *DockerSuite) TestBackoff(c *gocheck.C) {
+	c.Assert(nextBackoff(0), gocheck.Equals, minReconnectBackoff)
+	c.Assert(nextBackoff(time.Second), gocheck.Equals, 2*time.Second)
+	c.Assert(nextBackoff(40*time.Second), gocheck.Equals, maxReconnectBackoff)
+	c.Assert(nextBackoff(maxReconnectBackoff), gocheck.Equals, maxReconnectBackoff)
+}
+
+func (s *DockerSuite) TestRecordProbe(c *gocheck.C) {
+	events.Clear()
+	recordProbe(nil)
+	c.Assert(Health().Healthy, gocheck.Equals, true)
+	c.Assert(events.List("", "", 0), gocheck.HasLen, 0)
+	recordProbe(errors.New("connection refused"))
+	recordProbe(errors.New("connection refused"))
+	health := Health()
+	c.Assert(health.Healthy, gocheck.Equals, false)
+	c.Assert(health.LastError, gocheck.Equals, "connection refused")
+	c.Assert(events.List("docker-unhealthy", "", 0), gocheck.HasLen, 1)
+	recordProbe(nil)
+	c.Assert(Health().Healthy, gocheck.Equals, true)
+	c.Assert(Health().LastError, gocheck.Equals, "")
+	c.Assert(events.List("docker-healthy", "", 0), gocheck.HasLen, 1)
+	events.Clear()
+}
+
+// a docker client whose pulls block until released
+type fakePullClient struct {
+	dockerAPI
+	sync.Mutex
+	release  chan struct{}
+	started  chan string
+	pulls    map[string]int
+	inFlight int
+	maxSeen  int
+}
+
+func newFakePullClient() *fakePullClient {
+	return &fakePullClient{release: make(chan struct{}), started: make(chan string, 10), pulls: map[string]int{}}
+}
+
+func (f *fakePullClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	f.Lock()
+	f.pulls[pullKey(opts)]++
+	f.inFlight++
+	if f.inFlight > f.maxSeen {
+		f.maxSeen = f.inFlight
+	}
+	f.Unlock()
+	f.started <- pullKey(opts)
+	<-f.release
+	f.Lock()
+	f.inFlight--
+	f.Unlock()
+	if opts.Repository == "bad" {
+		return errors.New("pull failed")
+	}
+	return nil
+}
+
+func waitStarted(c *gocheck.C, f *fakePullClient) string {
+	select {
+	case key := <-f.started:
+		return key
+	case <-time.After(time.Second):
+		c.Fatal("pull did not start")
+	}
+	return ""
+}
+
+func assertNotStarted(c *gocheck.C, f *fakePullClient) {
+	select {
+	case key := <-f.started:
+		c.Fatalf("pull of %s started", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (s *DockerSuite) TestPullDedup(c *gocheck.C) {
+	fake := newFakePullClient()
+	setClient(fake)
+	defer setClient(nil)
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { errs <- pullImage(docker.PullImageOptions{Repository: "bad", Tag: "v1"}) }()
+	}
+	waitStarted(c, fake)
+	assertNotStarted(c, fake)
+	close(fake.release)
+	for i := 0; i < 3; i++ {
+		c.Assert(<-errs, gocheck.ErrorMatches, "pull failed")
+	}
+	c.Assert(fake.pulls["bad:v1"], gocheck.Equals, 1)
+	// once done the next pull really pulls again
+	c.Assert(pullImage(docker.PullImageOptions{Repository: "bad", Tag: "v1"}), gocheck.NotNil)
+	c.Assert(fake.pulls["bad:v1"], gocheck.Equals, 2)
+}
+
+func (s *DockerSuite) TestPullLimit(c *gocheck.C) {
+	c.Assert(InitPullLimit(-1), gocheck.ErrorMatches, "Invalid pull limit: -1")
+	c.Assert(InitPullLimit(1), gocheck.IsNil)
+	defer InitPullLimit(DefaultMaxConcurrentPulls)
+	fake := newFakePullClient()
+	setClient(fake)
+	defer setClient(nil)
+	errs := make(chan error, 2)
+	go func() { errs <- pullImage(docker.PullImageOptions{Repository: "one"}) }()
+	waitStarted(c, fake)
+	go func() { errs <- pullImage(docker.PullImageOptions{Repository: "two"}) }()
+	assertNotStarted(c, fake)
+	fake.release <- struct{}{}
+	c.Assert(<-errs, gocheck.IsNil)
+	c.Assert(waitStarted(c, fake), gocheck.Equals, "two")
+	fake.release <- struct{}{}
+	c.Assert(<-errs, gocheck.IsNil)
+	c.Assert(fake.maxSeen, gocheck.Equals, 1)
+}
+
+// deploys of different containers hold different locks and pull different images, so they overlap. the pulls
+// fail so the deploys stop before touching the host.
+func (s *DockerSuite) TestIndependentDeploysOverlap(c *gocheck.C) {
+	fake := newFakePullClient()
+	setClient(fake)
+	defer setClient(nil)
+	errs := make(chan error, 3)
+	deploy := func(id, image string) {
+		errs <- Deploy(&types.Container{ID: id, Image: image})
+	}
+	go deploy("first", "bad:v1")
+	go deploy("second", "bad:v2")
+	waitStarted(c, fake)
+	waitStarted(c, fake)
+	c.Assert(fake.maxSeen, gocheck.Equals, 2)
+	// a deploy of the same container waits its turn
+	go deploy("first", "bad:v3")
+	assertNotStarted(c, fake)
+	close(fake.release)
+	for i := 0; i < 3; i++ {
+		c.Assert(<-errs, gocheck.ErrorMatches, "pull failed")
+	}
+	c.Assert(fake.pulls, gocheck.DeepEquals, map[string]int{"bad:v1": 1, "bad:v2": 1, "bad:v3": 1})
+	c.Assert(containerLocks, gocheck.HasLen, 0)
+}
+
+// a docker client that knows a single image
+type fakeImageClient struct {
+	dockerAPI
+	image *docker.Image
+}
+
+func (f *fakeImageClient) InspectImage(name string) (*docker.Image, error) {
+	if name != f.image.ID {
+		return nil, errors.New("no such image")
+	}
+	return f.image, nil
+}
+
+func (s *DockerSuite) TestRunningImageDigest(c *gocheck.C) {
+	setClient(&fakeImageClient{image: &docker.Image{ID: "sha256:ffff",
+		RepoDigests: []string{"mirror/app@sha256:eeee", "registry/app@sha256:aaaa"}}})
+	defer setClient(nil)
+	c.Assert(runningImageDigest("registry/app:v1", "sha256:ffff"), gocheck.Equals, "sha256:aaaa")
+	// built locally or pulled from elsewhere
+	c.Assert(runningImageDigest("other/app:v1", "sha256:ffff"), gocheck.Equals, "sha256:ffff")
+	c.Assert(runningImageDigest("registry/app:v1", "sha256:0000"), gocheck.Equals, "sha256:0000")
+}
+
+func (s *DockerSuite) TestImageRef(c *gocheck.C) {
+	RegistryHost = "registry"
+	defer func() { RegistryHost = "" }()
+	cont := &types.Container{App: "app", Sha: "sha"}
+	ref, err := ImageRef(cont)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(ref, gocheck.Equals, "registry/apps/app-sha")
+	c.Assert(InitImageTemplate("{{.Registry}}/{{.Repo}}/{{.App}}:{{.Sha}}", ""), gocheck.ErrorMatches,
+		"Invalid image repo: it can not be empty")
+	c.Assert(InitImageTemplate("{{.Registry}}/{{.Repo}}/{{.App}}:{{.Sha}}", "team"), gocheck.IsNil)
+	defer InitImageTemplate(DefaultSupervisorImageTemplate, DefaultSupervisorImageRepo)
+	ref, err = ImageRef(cont)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(ref, gocheck.Equals, "registry/team/app:sha")
+	// templated and explicit references name the repo the same way
+	cont.Image = ref
+	c.Assert(cont.GetDockerRepo(), gocheck.Equals, "registry/team/app")
+}
+
+// a docker client that runs execs with a fixed result
+type fakeExecClient struct {
+	dockerAPI
+	exitCode int
+	created  docker.CreateExecOptions
+}
+
+func (f *fakeExecClient) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	f.created = opts
+	return &docker.Exec{ID: "exec1"}, nil
+}
+
+func (f *fakeExecClient) StartExec(id string, opts docker.StartExecOptions) error {
+	opts.OutputStream.Write([]byte("reloaded\n"))
+	return nil
+}
+
+func (f *fakeExecClient) InspectExec(id string) (*docker.ExecInspect, error) {
+	return &docker.ExecInspect{ID: id, ExitCode: f.exitCode}, nil
+}
+
+func (s *DockerSuite) TestExec(c *gocheck.C) {
+	fake := &fakeExecClient{}
+	setClient(fake)
+	defer setClient(nil)
+	cont := &types.Container{ID: "cid", DockerID: "did"}
+	c.Assert(Exec(cont, "sv hup app"), gocheck.IsNil)
+	c.Assert(fake.created.Container, gocheck.Equals, "did")
+	c.Assert(fake.created.Cmd, gocheck.DeepEquals, []string{"/bin/sh", "-c", "sv hup app"})
+	fake.exitCode = 1
+	c.Assert(Exec(cont, "sv hup app"), gocheck.ErrorMatches, "Command \"sv hup app\" exited with 1")
+	c.Assert(containerLocks, gocheck.HasLen, 0)
+}
+
+// a docker client whose containers are all dead
+type fakeRestartClient struct {
+	dockerAPI
+	restarted []string
+}
+
+func (f *fakeRestartClient) InspectContainer(id string) (*docker.Container, error) {
+	return &docker.Container{ID: id}, nil
+}
+
+func (f *fakeRestartClient) RestartContainer(id string, timeout uint) error {
+	f.restarted = append(f.restarted, id)
+	return nil
+}
+
+func (s *DockerSuite) TestRestartTracked(c *gocheck.C) {
+	fake := &fakeRestartClient{}
+	setClient(fake)
+	defer setClient(nil)
+	restarted, err := RestartTracked("cid", "did", func() bool { return false })
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(restarted, gocheck.Equals, false)
+	c.Assert(fake.restarted, gocheck.HasLen, 0)
+	restarted, err = RestartTracked("cid", "did", func() bool { return true })
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(restarted, gocheck.Equals, true)
+	c.Assert(fake.restarted, gocheck.DeepEquals, []string{"did"})
+	c.Assert(containerLocks, gocheck.HasLen, 0)
+}
@@ -0,0 +1,196 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"atlantis/supervisor/events"
+	"atlantis/supervisor/rpc/types"
+	"errors"
+	"github.com/fsouza/go-dockerclient"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultEndpoint      = "unix:///var/run/docker.sock"
+	DefaultProbeInterval = 5 * time.Second
+	minReconnectBackoff  = 1 * time.Second
+	maxReconnectBackoff  = 1 * time.Minute
+)
+
+// The parts of the docker client the supervisor uses
+type dockerAPI interface {
+	Ping() error
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	RemoveContainer(opts docker.RemoveContainerOptions) error
+	RestartContainer(id string, timeout uint) error
+	PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error
+	InspectImage(name string) (*docker.Image, error)
+	CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error)
+	StartContainer(id string, hostConfig *docker.HostConfig) error
+	InspectContainer(id string) (*docker.Container, error)
+	KillContainer(opts docker.KillContainerOptions) error
+	WaitContainer(id string) (int, error)
+	CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error)
+	StartExec(id string, opts docker.StartExecOptions) error
+	InspectExec(id string) (*docker.ExecInspect, error)
+}
+
+// How to reach the docker daemon. Cert, Key and CA are only used for tcp endpoints.
+type Endpoint struct {
+	Address string // unix:///path, /path or tcp://host:port
+	Cert    string
+	Key     string
+	CA      string
+}
+
+var (
+	endpoint      = &Endpoint{Address: DefaultEndpoint}
+	ProbeInterval = DefaultProbeInterval
+	clientLock    = sync.RWMutex{}
+	health        = &types.DockerStats{Healthy: true}
+	healthLock    = sync.Mutex{}
+)
+
+// Set the docker endpoint and how often to probe it. Must be called before Init.
+func InitEndpoint(ep *Endpoint, probeInterval time.Duration) error {
+	if ep.Address == "" {
+		ep.Address = DefaultEndpoint
+	} else if strings.HasPrefix(ep.Address, "/") {
+		ep.Address = "unix://" + ep.Address
+	}
+	switch {
+	case strings.HasPrefix(ep.Address, "unix://"):
+		if ep.Cert != "" || ep.Key != "" || ep.CA != "" {
+			return errors.New("Docker TLS settings are only valid for tcp endpoints: " + ep.Address)
+		}
+	case strings.HasPrefix(ep.Address, "tcp://"):
+		if (ep.Cert == "") != (ep.Key == "") {
+			return errors.New("Please specify both a docker client cert and key.")
+		}
+		if ep.CA != "" && ep.Cert == "" {
+			return errors.New("Please specify a docker client cert and key to use with the CA.")
+		}
+	default:
+		return errors.New("Invalid docker endpoint: " + ep.Address)
+	}
+	if probeInterval <= 0 {
+		return errors.New("Invalid docker probe interval: " + probeInterval.String())
+	}
+	endpoint = ep
+	ProbeInterval = probeInterval
+	return nil
+}
+
+func newClient() (*docker.Client, error) {
+	if endpoint.Cert != "" {
+		return docker.NewTLSClient(endpoint.Address, endpoint.Cert, endpoint.Key, endpoint.CA)
+	}
+	return docker.NewClient(endpoint.Address)
+}
+
+// the current client. it is replaced when reconnecting.
+func client() dockerAPI {
+	clientLock.RLock()
+	defer clientLock.RUnlock()
+	return dockerClient
+}
+
+func setClient(c dockerAPI) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	dockerClient = c
+}
+
+// The health of the connection to the docker daemon
+func Health() *types.DockerStats {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	stats := *health
+	stats.Endpoint = endpoint.Address
+	return &stats
+}
+
+// Record the result of a probe. Changes in health are recorded as events.
+func recordProbe(err error) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	health.LastProbe = time.Now()
+	if err == nil {
+		if !health.Healthy {
+			events.Record("docker-healthy", "", "docker daemon at %s is reachable again", endpoint.Address)
+		}
+		health.Healthy = true
+		health.LastError = ""
+		return
+	}
+	if health.Healthy {
+		events.Record("docker-unhealthy", "", "docker daemon at %s is unreachable: %v", endpoint.Address, err)
+	}
+	health.Healthy = false
+	health.LastError = err.Error()
+}
+
+func recordReconnect() {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	health.Reconnects++
+}
+
+// double each time, up to maxReconnectBackoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff < minReconnectBackoff {
+		return minReconnectBackoff
+	}
+	backoff *= 2
+	if backoff > maxReconnectBackoff {
+		return maxReconnectBackoff
+	}
+	return backoff
+}
+
+// Probe the daemon every ProbeInterval. When it goes away keep reconnecting with backoff until it's back.
+func monitorDaemon() {
+	for {
+		err := client().Ping()
+		recordProbe(err)
+		if err == nil {
+			time.Sleep(ProbeInterval)
+			continue
+		}
+		log.Printf("[docker] ping %s failed: %v", endpoint.Address, err)
+		backoff := time.Duration(0)
+		for err != nil {
+			backoff = nextBackoff(backoff)
+			time.Sleep(backoff)
+			err = reconnect()
+			recordProbe(err)
+		}
+	}
+}
+
+func reconnect() error {
+	log.Printf("[docker] reconnecting to %s", endpoint.Address)
+	recordReconnect()
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := c.Ping(); err != nil {
+		return err
+	}
+	setClient(c)
+	log.Printf("[docker] reconnected to %s", endpoint.Address)
+	return nil
+}
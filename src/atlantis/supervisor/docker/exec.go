@@ -0,0 +1,52 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"atlantis/supervisor/rpc/types"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"log"
+)
+
+// Run a shell command in the container through docker, like docker exec does. It doesn't need anything running in
+// the container besides the command. Fails if the command exits non-zero.
+func Exec(c types.GenericContainer, command string) error {
+	if pretending() {
+		log.Printf("[%s][pretend] docker exec %s", c.GetID(), command)
+		return nil
+	}
+	unlock := lockContainer(c.GetID())
+	defer unlock()
+	log.Printf("[%s] docker exec %s", c.GetID(), command)
+	exec, err := client().CreateExec(docker.CreateExecOptions{Container: c.GetDockerID(),
+		Cmd: []string{"/bin/sh", "-c", command}, AttachStdout: true, AttachStderr: true})
+	if err != nil {
+		return err
+	}
+	var output bytes.Buffer
+	err = client().StartExec(exec.ID, docker.StartExecOptions{OutputStream: &output, ErrorStream: &output})
+	log.Printf("[%s] -> %s", c.GetID(), output.String())
+	if err != nil {
+		return err
+	}
+	inspected, err := client().InspectExec(exec.ID)
+	if err != nil {
+		return err
+	}
+	if inspected.ExitCode != 0 {
+		return errors.New(fmt.Sprintf("Command %q exited with %d", command, inspected.ExitCode))
+	}
+	return nil
+}
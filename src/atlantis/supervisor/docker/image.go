@@ -0,0 +1,175 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	. "atlantis/supervisor/constant"
+	"atlantis/supervisor/crypto"
+	"atlantis/supervisor/events"
+	"atlantis/supervisor/rpc/types"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"log"
+	"text/template"
+)
+
+var (
+	imageTemplate       = template.Must(parseImageTemplate(DefaultSupervisorImageTemplate))
+	ImageRepo           = DefaultSupervisorImageRepo // what the image template gets as {{.Repo}}
+	DigestVerifier      crypto.DigestVerifier        // nil means signatures can't be checked
+	RequireSignedImages bool
+)
+
+func parseImageTemplate(tmpl string) (*template.Template, error) {
+	return template.New("image").Option("missingkey=error").Parse(tmpl)
+}
+
+// Set the template used to name images that aren't given explicitly on deploy, and the repo it names them in
+func InitImageTemplate(tmpl, repo string) error {
+	parsed, err := parseImageTemplate(tmpl)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid image template %q: %v", tmpl, err))
+	}
+	if repo == "" {
+		return errors.New("Invalid image repo: it can not be empty")
+	}
+	imageTemplate = parsed
+	ImageRepo = repo
+	return nil
+}
+
+func ContainerImageRef(c *types.Container) (string, error) {
+	if c.Image != "" {
+		return c.Image, nil
+	}
+	var buf bytes.Buffer
+	err := imageTemplate.Execute(&buf, &types.ImageTemplateData{
+		Registry: RegistryHost,
+		Repo:     ImageRepo,
+		App:      c.App,
+		Sha:      c.Sha,
+		Env:      c.Env,
+	})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Could not render image template: %v", err))
+	}
+	if _, _, _, err := types.ParseImageRef(buf.String()); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func ImageRef(c types.GenericContainer) (string, error) {
+	switch typedC := c.(type) {
+	case *types.Container:
+		return ContainerImageRef(typedC)
+	default:
+		return "", errors.New("could not fetch image reference")
+	}
+}
+
+// What to pass to docker to pull ref. A digest wins over a tag.
+func pullImageOptions(ref string) (docker.PullImageOptions, error) {
+	repo, tag, digest, err := types.ParseImageRef(ref)
+	if err != nil {
+		return docker.PullImageOptions{}, err
+	}
+	if digest != "" {
+		tag = digest
+	}
+	return docker.PullImageOptions{Repository: repo, Tag: tag}, nil
+}
+
+// Trust images signed by any of the keys in keyFiles. If required, deploys without a signed digest are refused.
+func InitImageVerification(keyFiles []string, required bool) error {
+	RequireSignedImages = required
+	if len(keyFiles) == 0 {
+		if required {
+			return errors.New("Signed images are required but no public keys were given")
+		}
+		DigestVerifier = nil
+		return nil
+	}
+	verifier, err := crypto.NewPublicKeyFileVerifier(keyFiles...)
+	if err != nil {
+		return err
+	}
+	DigestVerifier = verifier
+	return nil
+}
+
+// Make sure the pulled image is the one that was asked for. Must be called after the pull and before the
+// container is created.
+func verifyImage(c types.GenericContainer, ref string) error {
+	expected := c.GetExpectedDigest()
+	if expected == "" {
+		if RequireSignedImages {
+			return errors.New("A signed image digest is required to deploy " + ref)
+		}
+		return nil
+	}
+	image, err := client().InspectImage(ref)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not inspect image %s: %v", ref, err))
+	}
+	if !types.DigestMatches(expected, ref, image.ID, image.RepoDigests) {
+		return errors.New(fmt.Sprintf("Image %s has digest %s, expected %s", ref, imageDigest(ref, image), expected))
+	}
+	return verifyDigestSignature(expected, c.GetDigestSignature())
+}
+
+// the registry digest of an image pulled as ref, or its id if it has none
+func imageDigest(ref string, image *docker.Image) string {
+	if digest := types.RepoDigest(ref, image.RepoDigests); digest != "" {
+		return digest
+	}
+	return image.ID
+}
+
+// The digest of the image a container was started from. Docker only knows the image's id by the container.
+func runningImageDigest(ref, id string) string {
+	image, err := client().InspectImage(id)
+	if err != nil {
+		return id
+	}
+	return imageDigest(ref, image)
+}
+
+func verifyDigestSignature(digest, signature string) error {
+	if signature == "" && !RequireSignedImages {
+		return nil
+	}
+	if DigestVerifier == nil {
+		return errors.New("Can not check the signature for image digest " + digest + ": no public keys configured")
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("Invalid signature for image digest " + digest + ": not base64")
+	}
+	return DigestVerifier.Verify(digest, sigBytes)
+}
+
+// verify the image, recording an event if it doesn't check out
+func checkImage(c types.GenericContainer, ref string) error {
+	if err := verifyImage(c, ref); err != nil {
+		log.Printf("[%s] ERROR: image verification failed: %v", c.GetID(), err)
+		events.Record("image-verification-failed", c.GetID(), "%s: %v", ref, err)
+		return errors.New("Image verification failed: " + err.Error())
+	}
+	if c.GetExpectedDigest() != "" {
+		log.Printf("[%s] verified %s has digest %s", c.GetID(), ref, c.GetExpectedDigest())
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"log"
+)
+
+// What the janitor needs to know about a docker container
+type ContainerState struct {
+	DockerID string
+	Name     string // the supervisor container id for containers we started
+	Running  bool
+	ExitCode int
+}
+
+// List every docker container on the host, running or not
+func ListContainerStates() ([]*ContainerState, error) {
+	conts, err := client().ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	states := []*ContainerState{}
+	for _, cont := range conts {
+		state, err := inspectState(cont.ID)
+		if err != nil {
+			// it may have been removed since we listed it
+			log.Printf("[docker] could not inspect %s (%v): %v", cont.ID, cont.Names, err)
+			continue
+		}
+		state.Name = containerName(cont)
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func inspectState(dockerID string) (*ContainerState, error) {
+	inspCont, err := client().InspectContainer(dockerID)
+	if err != nil {
+		return nil, err
+	}
+	return &ContainerState{
+		DockerID: dockerID,
+		// a ghost is a container docker thinks is running but whose process is gone
+		Running:  inspCont.State.Running && !inspCont.State.Ghost,
+		ExitCode: inspCont.State.ExitCode,
+	}, nil
+}
+
+// Remove a stopped container the supervisor doesn't know about. Running containers are left alone.
+func RemoveUntracked(name, dockerID string) (bool, error) {
+	unlock := lockContainer(name)
+	defer unlock()
+	state, err := inspectState(dockerID)
+	if err != nil {
+		return false, err
+	}
+	if state.Running {
+		return false, nil
+	}
+	return true, client().RemoveContainer(docker.RemoveContainerOptions{ID: dockerID})
+}
+
+// Restart a container the supervisor is tracking if it is still dead once any operation on it has finished.
+// stillTracked is checked under the container's lock so a container torn down in the meantime isn't restarted.
+func RestartTracked(id, dockerID string, stillTracked func() bool) (bool, error) {
+	unlock := lockContainer(id)
+	defer unlock()
+	if !stillTracked() {
+		return false, nil
+	}
+	state, err := inspectState(dockerID)
+	if err != nil {
+		return false, err
+	}
+	if state.Running {
+		return false, nil
+	}
+	return true, client().RestartContainer(dockerID, 0)
+}
@@ -0,0 +1,115 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"log"
+	"sync"
+)
+
+const DefaultMaxConcurrentPulls = 2
+
+// Operations on the same container are serialized. Operations on different containers run concurrently.
+type containerLock struct {
+	sync.Mutex
+	refs int
+}
+
+type pull struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	containerLocksLock = sync.Mutex{}
+	containerLocks     = map[string]*containerLock{}
+	pullsLock          = sync.Mutex{}
+	pulls              = map[string]*pull{}                             // image -> in flight pull
+	pullSlots          = make(chan struct{}, DefaultMaxConcurrentPulls) // nil means no limit
+)
+
+// Limit how many images are pulled at once. 0 means no limit. Must be called before Init.
+func InitPullLimit(maxPulls int) error {
+	if maxPulls < 0 {
+		return errors.New(fmt.Sprintf("Invalid pull limit: %d", maxPulls))
+	}
+	if maxPulls == 0 {
+		pullSlots = nil
+	} else {
+		pullSlots = make(chan struct{}, maxPulls)
+	}
+	return nil
+}
+
+// Lock the container with the given id. Call the returned func to unlock it.
+func lockContainer(id string) func() {
+	containerLocksLock.Lock()
+	lock, exists := containerLocks[id]
+	if !exists {
+		lock = &containerLock{}
+		containerLocks[id] = lock
+	}
+	lock.refs++
+	containerLocksLock.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		containerLocksLock.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(containerLocks, id)
+		}
+		containerLocksLock.Unlock()
+	}
+}
+
+func pullKey(opts docker.PullImageOptions) string {
+	if opts.Tag == "" {
+		return opts.Repository
+	}
+	return opts.Repository + ":" + opts.Tag
+}
+
+// Pull an image. Concurrent pulls of the same image share one pull and at most cap(pullSlots) different
+// images are pulled at once.
+func pullImage(opts docker.PullImageOptions) error {
+	key := pullKey(opts)
+	pullsLock.Lock()
+	if inFlight, exists := pulls[key]; exists {
+		pullsLock.Unlock()
+		log.Printf("[docker] waiting for in flight pull of %s", key)
+		<-inFlight.done
+		return inFlight.err
+	}
+	current := &pull{done: make(chan struct{})}
+	pulls[key] = current
+	slots := pullSlots
+	pullsLock.Unlock()
+
+	if slots != nil {
+		slots <- struct{}{}
+	}
+	current.err = client().PullImage(opts, docker.AuthConfiguration{})
+	if slots != nil {
+		<-slots
+	}
+
+	pullsLock.Lock()
+	delete(pulls, key)
+	pullsLock.Unlock()
+	close(current.done)
+	return current.err
+}
@@ -0,0 +1,254 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"atlantis/supervisor/helper"
+	"atlantis/supervisor/rpc/types"
+	atypes "atlantis/types"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	configFilePerm    = 0644
+	renderingFilePerm = 0600 // renderings hold decrypted deps
+)
+
+var envKeyRegexp = regexp.MustCompile("[^A-Z0-9_]")
+
+func ConfigRenderings(c types.GenericContainer) []*types.ConfigRendering {
+	switch typedC := c.(type) {
+	case *types.Container:
+		return typedC.Manifest.ConfigRenderings
+	default:
+		return nil
+	}
+}
+
+// Write config.json and every rendering the manifest asks for into the container's config dir. Everything is
+// rendered before anything is written and each file is replaced atomically so the app never reads a partial
+// config.
+func WriteConfigs(c types.GenericContainer) error {
+	appCfg, err := AppCfgs(c)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(appCfg)
+	if err != nil {
+		return err
+	}
+	paths := []string{helper.HostConfigFile(c.GetID())}
+	files := map[string][]byte{paths[0]: data}
+	for _, rendering := range ConfigRenderings(c) {
+		data, err := RenderConfig(appCfg, rendering)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(helper.HostConfigDir(c.GetID()), rendering.File)
+		paths = append(paths, path)
+		files[path] = data
+	}
+	for i, path := range paths {
+		perm := os.FileMode(renderingFilePerm)
+		if i == 0 {
+			perm = configFilePerm
+		}
+		if pretending() {
+			log.Printf("[%s][pretend] write %s", c.GetID(), path)
+			continue
+		}
+		if err := helper.WriteFileAtomic(path, files[path], perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func RenderConfig(appCfg *atypes.AppConfig, rendering *types.ConfigRendering) ([]byte, error) {
+	if rendering.Format == types.RenderTemplate {
+		tmpl, err := types.ParseRenderTemplate(rendering.File, rendering.Template)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, appCfg); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not render %s: %v", rendering.File, err))
+		}
+		return buf.Bytes(), nil
+	}
+	// the other formats are built from the same tree config.json has
+	data, err := json.Marshal(appCfg)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	switch rendering.Format {
+	case types.RenderEnv:
+		for _, leaf := range flatten(nil, tree) {
+			key := envKeyRegexp.ReplaceAllString(strings.ToUpper(strings.Join(leaf.path, "_")), "_")
+			fmt.Fprintf(&buf, "%s=%s\n", key, shellQuote(leaf.value))
+		}
+	case types.RenderProperties:
+		for _, leaf := range flatten(nil, tree) {
+			fmt.Fprintf(&buf, "%s=%s\n", propertiesEscape(strings.Join(leaf.path, "."), true),
+				propertiesEscape(leaf.value, false))
+		}
+	case types.RenderYAML:
+		buf.WriteString("---\n")
+		writeYAML(&buf, tree, 0)
+	default:
+		return nil, errors.New("Unknown config rendering format: " + rendering.Format)
+	}
+	return buf.Bytes(), nil
+}
+
+type configLeaf struct {
+	path  []string
+	value string
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Flatten the config into key paths and scalar values. List items are keyed by their index.
+func flatten(path []string, node interface{}) []configLeaf {
+	switch typedNode := node.(type) {
+	case map[string]interface{}:
+		leaves := []configLeaf{}
+		for _, key := range sortedKeys(typedNode) {
+			leaves = append(leaves, flatten(append(path[:len(path):len(path)], key), typedNode[key])...)
+		}
+		return leaves
+	case []interface{}:
+		leaves := []configLeaf{}
+		for i, item := range typedNode {
+			leaves = append(leaves, flatten(append(path[:len(path):len(path)], fmt.Sprintf("%d", i)), item)...)
+		}
+		return leaves
+	case nil:
+		return []configLeaf{configLeaf{path, ""}}
+	default:
+		return []configLeaf{configLeaf{path, fmt.Sprintf("%v", typedNode)}}
+	}
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+func propertiesEscape(value string, isKey bool) string {
+	var buf bytes.Buffer
+	for i, r := range value {
+		switch {
+		case r == '\\':
+			buf.WriteString(`\\`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r == ' ' && (isKey || i == 0):
+			buf.WriteString(`\ `)
+		case isKey && (r == '=' || r == ':'), (isKey || i == 0) && (r == '#' || r == '!'):
+			buf.WriteRune('\\')
+			buf.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			if r > 0xffff {
+				fmt.Fprintf(&buf, `\u%04x\u%04x`, 0xd7c0+(r>>10), 0xdc00|(r&0x3ff))
+			} else {
+				fmt.Fprintf(&buf, `\u%04x`, r)
+			}
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// yaml is a superset of json, so scalars are written as json to get quoting right
+func yamlScalar(node interface{}) string {
+	switch node.(type) {
+	case map[string]interface{}:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	}
+	data, _ := json.Marshal(node)
+	return string(data)
+}
+
+func yamlCollection(node interface{}) bool {
+	switch typedNode := node.(type) {
+	case map[string]interface{}:
+		return len(typedNode) > 0
+	case []interface{}:
+		return len(typedNode) > 0
+	}
+	return false
+}
+
+func writeYAML(buf *bytes.Buffer, node interface{}, depth int) {
+	indent := strings.Repeat("  ", depth)
+	switch typedNode := node.(type) {
+	case map[string]interface{}:
+		if len(typedNode) == 0 {
+			buf.WriteString(indent + "{}\n")
+			return
+		}
+		for _, key := range sortedKeys(typedNode) {
+			value := typedNode[key]
+			if yamlCollection(value) {
+				fmt.Fprintf(buf, "%s%s:\n", indent, yamlScalar(key))
+				writeYAML(buf, value, depth+1)
+			} else {
+				fmt.Fprintf(buf, "%s%s: %s\n", indent, yamlScalar(key), yamlScalar(value))
+			}
+		}
+	case []interface{}:
+		if len(typedNode) == 0 {
+			buf.WriteString(indent + "[]\n")
+			return
+		}
+		for _, item := range typedNode {
+			if yamlCollection(item) {
+				buf.WriteString(indent + "-\n")
+				writeYAML(buf, item, depth+1)
+			} else {
+				fmt.Fprintf(buf, "%s- %s\n", indent, yamlScalar(item))
+			}
+		}
+	default:
+		buf.WriteString(indent + yamlScalar(node) + "\n")
+	}
+}
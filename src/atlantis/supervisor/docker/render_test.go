@@ -0,0 +1,85 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"atlantis/supervisor/rpc/types"
+	atypes "atlantis/types"
+	"github.com/adjust/gocheck"
+)
+
+var renderAppCfg = &atypes.AppConfig{
+	HTTPPort:       61000,
+	SecondaryPorts: []uint16{61004},
+	Container:      &atypes.ContainerConfig{ID: "cid", Host: "host", Env: "prod"},
+	Dependencies: map[string]map[string]interface{}{
+		"db": map[string]interface{}{"password": "it's: #secret", "hosts": []interface{}{"a", "b"}},
+	},
+}
+
+func render(c *gocheck.C, format, tmpl string) string {
+	data, err := RenderConfig(renderAppCfg, &types.ConfigRendering{Format: format, File: "out", Template: tmpl})
+	c.Assert(err, gocheck.IsNil)
+	return string(data)
+}
+
+func (s *DockerSuite) TestRenderEnv(c *gocheck.C) {
+	c.Assert(render(c, types.RenderEnv, ""), gocheck.Equals, `CONTAINER_ENV='prod'
+CONTAINER_HOST='host'
+CONTAINER_ID='cid'
+DEPENDENCIES_DB_HOSTS_0='a'
+DEPENDENCIES_DB_HOSTS_1='b'
+DEPENDENCIES_DB_PASSWORD='it'\''s: #secret'
+HTTP_PORT='61000'
+SECONDARY_PORTS_0='61004'
+`)
+}
+
+func (s *DockerSuite) TestRenderProperties(c *gocheck.C) {
+	c.Assert(render(c, types.RenderProperties, ""), gocheck.Equals, `container.Env=prod
+container.Host=host
+container.ID=cid
+dependencies.db.hosts.0=a
+dependencies.db.hosts.1=b
+dependencies.db.password=it's: #secret
+http_port=61000
+secondary_ports.0=61004
+`)
+	c.Assert(propertiesEscape("a b=c", true), gocheck.Equals, `a\ b\=c`)
+	c.Assert(propertiesEscape(" #x\né", false), gocheck.Equals, `\ #x\n\u00e9`)
+}
+
+func (s *DockerSuite) TestRenderYAML(c *gocheck.C) {
+	c.Assert(render(c, types.RenderYAML, ""), gocheck.Equals, `---
+"container":
+  "Env": "prod"
+  "Host": "host"
+  "ID": "cid"
+"dependencies":
+  "db":
+    "hosts":
+      - "a"
+      - "b"
+    "password": "it's: #secret"
+"http_port": 61000
+"secondary_ports":
+  - 61004
+`)
+}
+
+func (s *DockerSuite) TestRenderTemplate(c *gocheck.C) {
+	c.Assert(render(c, types.RenderTemplate, `listen {{.HTTPPort}} db {{index .Dependencies.db "password"}}`),
+		gocheck.Equals, "listen 61000 db it's: #secret")
+	_, err := RenderConfig(renderAppCfg, &types.ConfigRendering{Format: types.RenderTemplate, File: "out",
+		Template: "{{.Nope}}"})
+	c.Assert(err, gocheck.ErrorMatches, "Could not render out: .*")
+}
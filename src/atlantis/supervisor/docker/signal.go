@@ -0,0 +1,44 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"atlantis/supervisor/rpc/types"
+	"errors"
+	"github.com/fsouza/go-dockerclient"
+	"log"
+)
+
+var signals = map[string]docker.Signal{
+	"HUP":   docker.SIGHUP,
+	"INT":   docker.SIGINT,
+	"QUIT":  docker.SIGQUIT,
+	"USR1":  docker.SIGUSR1,
+	"USR2":  docker.SIGUSR2,
+	"WINCH": docker.SIGWINCH,
+}
+
+// Send the named signal (HUP, SIGUSR1, ...) to the container's main process
+func Signal(c types.GenericContainer, name string) error {
+	signal, exists := signals[types.NormalizeSignal(name)]
+	if !exists {
+		return errors.New("Unsupported signal: " + name)
+	}
+	if pretending() {
+		log.Printf("[%s][pretend] docker kill -s %s", c.GetID(), name)
+		return nil
+	}
+	unlock := lockContainer(c.GetID())
+	defer unlock()
+	log.Printf("[%s] docker kill -s %s", c.GetID(), name)
+	return client().KillContainer(docker.KillContainerOptions{ID: c.GetDockerID(), Signal: signal})
+}
@@ -0,0 +1,69 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package events
+
+import (
+	"atlantis/supervisor/rpc/types"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const MaxEvents = 1000
+
+var (
+	lock   = sync.Mutex{}
+	events = []*types.Event{} // oldest first, at most MaxEvents
+)
+
+// Record an event. It is logged and kept in memory until MaxEvents newer ones push it out.
+func Record(kind, containerID, format string, args ...interface{}) {
+	event := &types.Event{
+		Time:        time.Now(),
+		Kind:        kind,
+		ContainerID: containerID,
+		Message:     fmt.Sprintf(format, args...),
+	}
+	log.Printf("[event] %s", event.String())
+	lock.Lock()
+	defer lock.Unlock()
+	if len(events) >= MaxEvents {
+		events = events[len(events)-MaxEvents+1:]
+	}
+	events = append(events, event)
+}
+
+// The most recent events, oldest first. Empty kind or containerID match everything, limit 0 means all.
+func List(kind, containerID string, limit int) []*types.Event {
+	lock.Lock()
+	defer lock.Unlock()
+	matched := []*types.Event{}
+	for _, event := range events {
+		if (kind != "" && kind != event.Kind) || (containerID != "" && containerID != event.ContainerID) {
+			continue
+		}
+		eventCopy := *event
+		matched = append(matched, &eventCopy)
+	}
+	if limit > 0 && len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+	return matched
+}
+
+// Forget all events
+func Clear() {
+	lock.Lock()
+	defer lock.Unlock()
+	events = []*types.Event{}
+}
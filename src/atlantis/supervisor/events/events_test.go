@@ -0,0 +1,45 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package events
+
+import (
+	"github.com/adjust/gocheck"
+	"testing"
+)
+
+func TestEvents(t *testing.T) { gocheck.TestingT(t) }
+
+type EventsSuite struct{}
+
+var _ = gocheck.Suite(&EventsSuite{})
+
+func (s *EventsSuite) TestRecordAndList(c *gocheck.C) {
+	Clear()
+	Record("deploy", "cont1", "pulled %s", "image")
+	Record("janitor", "", "nothing to do")
+	Record("deploy", "cont2", "failed")
+	c.Assert(List("", "", 0), gocheck.HasLen, 3)
+	list := List("deploy", "", 0)
+	c.Assert(list, gocheck.HasLen, 2)
+	c.Assert(list[0].Message, gocheck.Equals, "pulled image")
+	c.Assert(List("", "cont2", 0)[0].Message, gocheck.Equals, "failed")
+	list = List("", "", 1)
+	c.Assert(list, gocheck.HasLen, 1)
+	c.Assert(list[0].ContainerID, gocheck.Equals, "cont2")
+	for i := 0; i < MaxEvents+10; i++ {
+		Record("flood", "", "%d", i)
+	}
+	list = List("", "", 0)
+	c.Assert(list, gocheck.HasLen, MaxEvents)
+	c.Assert(list[0].Message, gocheck.Equals, "10")
+	Clear()
+}
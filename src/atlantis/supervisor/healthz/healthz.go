@@ -4,6 +4,7 @@ import (
 	. "atlantis/common"
 	. "atlantis/supervisor/client"
 	. "atlantis/supervisor/constant"
+	"atlantis/supervisor/metrics"
 	. "atlantis/supervisor/rpc/types"
 	"fmt"
 	"log"
@@ -26,8 +27,16 @@ func healthzHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, reply.Status)
 }
 
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if err := metrics.WriteTo(w); err != nil {
+		log.Println("ERROR: ", err)
+	}
+}
+
 func Run(port uint16) {
 	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/metrics", metricsHandler)
 	for {
 		log.Println("[healthz server] %s", http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", port), nil))
 		time.Sleep(1 * time.Second)
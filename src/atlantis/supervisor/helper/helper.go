@@ -12,9 +12,18 @@
 package helper
 
 import (
+	"atlantis/supervisor/constant"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
+var VolumeDir = constant.DefaultSupervisorVolumeDir // where persistent volumes live on the host
+
 func HostLogDir(cid string) string {
 	return fmt.Sprintf("/var/log/atlantis/containers/%s", cid)
 }
@@ -26,3 +35,85 @@ func HostConfigDir(cid string) string {
 func HostConfigFile(cid string) string {
 	return fmt.Sprintf("%s/config.json", HostConfigDir(cid))
 }
+
+func HostVolumeDir(app, env, name string) string {
+	return filepath.Join(VolumeDir, app, env, name)
+}
+
+// Total size in bytes of the regular files under dir. A missing dir is empty.
+func DirSize(dir string) (uint64, error) {
+	size := uint64(0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Parse a kernel style cpu list such as "0-3,8,10-11"
+func ParseCPUList(list string) ([]int, error) {
+	cpus := []int{}
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, errors.New("Invalid CPU list: " + list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, errors.New("Invalid CPU list: " + list)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// Format cores the way docker expects a cpuset
+func FormatCPUList(cpus []int) string {
+	strs := make([]string, len(cpus))
+	for i, cpu := range cpus {
+		strs[i] = fmt.Sprintf("%d", cpu)
+	}
+	return strings.Join(strs, ",")
+}
+
+// Replace the file at path with data. Readers see either the old or the new contents, never a partial write.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -28,3 +28,23 @@ func TestHostConfigFile(t *testing.T) {
       t.Fail()
    }
 }
+
+func TestParseCPUList(t *testing.T) {
+   out, err := ParseCPUList("0-2,5, 7-8\n")
+   if err != nil || FormatCPUList(out) != "0,1,2,5,7,8" {
+      fmt.Printf("helper::ParseCPUList expecting 0,1,2,5,7,8 but got %v (%v)", out, err)
+      t.Fail()
+   }
+   if _, err := ParseCPUList("3-1"); err == nil {
+      fmt.Printf("helper::ParseCPUList expecting an error for 3-1")
+      t.Fail()
+   }
+}
+
+func TestHostVolumeDir(t *testing.T) {
+   out := HostVolumeDir("app", "env", "data")
+   if out != "/var/lib/atlantis/volumes/app/env/data" {
+      fmt.Printf("helper::HostVolumeDir expecting /var/lib/atlantis/volumes/app/env/data but got %s", out)
+      t.Fail()
+   }
+}
@@ -0,0 +1,75 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+var (
+	lock     = sync.Mutex{}
+	counters = map[string]uint64{}
+)
+
+// Increment a counter by one
+func Inc(name string) {
+	Add(name, 1)
+}
+
+func Add(name string, delta uint64) {
+	lock.Lock()
+	defer lock.Unlock()
+	counters[name] += delta
+}
+
+func Get(name string) uint64 {
+	lock.Lock()
+	defer lock.Unlock()
+	return counters[name]
+}
+
+// A copy of every counter
+func Snapshot() map[string]uint64 {
+	lock.Lock()
+	defer lock.Unlock()
+	snapshot := make(map[string]uint64, len(counters))
+	for name, val := range counters {
+		snapshot[name] = val
+	}
+	return snapshot
+}
+
+// Write every counter as "name value" lines, sorted by name
+func WriteTo(w io.Writer) error {
+	snapshot := Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name, _ := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s %d\n", name, snapshot[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forget all counters
+func Reset() {
+	lock.Lock()
+	defer lock.Unlock()
+	counters = map[string]uint64{}
+}
@@ -0,0 +1,38 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"github.com/adjust/gocheck"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) { gocheck.TestingT(t) }
+
+type MetricsSuite struct{}
+
+var _ = gocheck.Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) TestCounters(c *gocheck.C) {
+	Reset()
+	Inc("janitor.removed")
+	Inc("janitor.removed")
+	Add("janitor.orphans", 3)
+	c.Assert(Get("janitor.removed"), gocheck.Equals, uint64(2))
+	c.Assert(Get("nope"), gocheck.Equals, uint64(0))
+	var buf bytes.Buffer
+	c.Assert(WriteTo(&buf), gocheck.IsNil)
+	c.Assert(buf.String(), gocheck.Equals, "janitor.orphans 3\njanitor.removed 2\n")
+	Reset()
+	c.Assert(Snapshot(), gocheck.HasLen, 0)
+}
@@ -0,0 +1,183 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package netsec
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// group names end up in ipset and nft set names, which are short and picky
+	ipGroupNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,22}$`)
+	hostnameRegexp    = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+	numericRegexp     = regexp.MustCompile(`^[0-9]+$`)
+	lookupHost        = net.LookupHost // swapped out in tests
+)
+
+func ValidIPGroupName(name string) bool {
+	return ipGroupNameRegexp.MatchString(name)
+}
+
+// An IPv4 or IPv6 address, CIDR block or hostname in its canonical form. Host bits are cleared from CIDR blocks
+// and /32s and /128s become plain addresses.
+func normalizeEntry(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return "", errors.New("invalid CIDR block " + entry)
+		}
+		ones, _ := ipNet.Mask.Size()
+		if ones == 0 {
+			return "", errors.New(entry + " would match every address")
+		}
+		return addrString(ipNet), nil
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		return ip.String(), nil
+	}
+	host := strings.TrimSuffix(strings.ToLower(entry), ".")
+	labels := strings.Split(host, ".")
+	if len(host) > 253 || !hostnameRegexp.MatchString(host) || numericRegexp.MatchString(labels[len(labels)-1]) {
+		return "", errors.New("invalid IP, CIDR block or hostname " + entry)
+	}
+	return host, nil
+}
+
+// Normalize, dedup and sort the entries of an IP group. Every invalid entry is reported.
+func NormalizeIPGroup(entries []string) ([]string, error) {
+	normalized := map[string]bool{}
+	problems := []string{}
+	for _, entry := range entries {
+		norm, err := normalizeEntry(entry)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		normalized[norm] = true
+	}
+	if len(problems) > 0 {
+		return nil, errors.New("Invalid IP group: " + strings.Join(problems, "; "))
+	}
+	group := []string{}
+	for entry, _ := range normalized {
+		group = append(group, entry)
+	}
+	sort.Strings(group)
+	return group, nil
+}
+
+// normalized entries that aren't addresses are hostnames
+func isHostname(entry string) bool {
+	return net.ParseIP(entry) == nil && !strings.Contains(entry, "/")
+}
+
+func parseAddr(addr string) *net.IPNet {
+	if ip := net.ParseIP(addr); ip != nil {
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+	}
+	if _, ipNet, err := net.ParseCIDR(addr); err == nil {
+		return ipNet
+	}
+	return nil
+}
+
+func isIPv6(addr string) bool {
+	ipNet := parseAddr(addr)
+	return ipNet != nil && len(ipNet.IP) == net.IPv6len
+}
+
+// Split addresses into IPv4 and IPv6, keeping their order
+func splitFamilies(addrs []string) (v4, v6 []string) {
+	v4, v6 = []string{}, []string{}
+	for _, addr := range addrs {
+		if isIPv6(addr) {
+			v6 = append(v6, addr)
+		} else {
+			v4 = append(v4, addr)
+		}
+	}
+	return v4, v6
+}
+
+func addrString(ipNet *net.IPNet) string {
+	if ones, bits := ipNet.Mask.Size(); ones == bits {
+		return ipNet.IP.String()
+	}
+	return ipNet.String()
+}
+
+type netsByStart []*net.IPNet
+
+func (n netsByStart) Len() int      { return len(n) }
+func (n netsByStart) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n netsByStart) Less(i, j int) bool {
+	// IPv4 first
+	if len(n[i].IP) != len(n[j].IP) {
+		return len(n[i].IP) < len(n[j].IP)
+	}
+	if c := bytes.Compare(n[i].IP, n[j].IP); c != 0 {
+		return c < 0
+	}
+	iOnes, _ := n[i].Mask.Size()
+	jOnes, _ := n[j].Mask.Size()
+	return iOnes < jOnes
+}
+
+// Drop addresses covered by a larger block, in address order with IPv4 first. Interval sets refuse overlapping
+// elements.
+func collapseAddrs(addrs []string) []string {
+	nets := netsByStart{}
+	for _, addr := range addrs {
+		if ipNet := parseAddr(addr); ipNet != nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	sort.Sort(nets)
+	collapsed := []string{}
+	var last *net.IPNet
+	for _, ipNet := range nets {
+		// blocks either nest or don't overlap, so anything starting inside the last one is covered by it
+		if last != nil && last.Contains(ipNet.IP) {
+			continue
+		}
+		last = ipNet
+		collapsed = append(collapsed, addrString(ipNet))
+	}
+	return collapsed
+}
+
+// The IPv4 and IPv6 addresses a hostname resolves to, sorted
+func resolve(host string) ([]string, error) {
+	addrs, err := lookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	ips := []string{}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip.String())
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New(host + " has no addresses")
+	}
+	return collapseAddrs(ips), nil
+}
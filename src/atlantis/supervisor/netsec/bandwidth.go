@@ -0,0 +1,168 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package netsec
+
+import (
+	"atlantis/supervisor/rpc/types"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultThroughputInterval = 10 * time.Second
+
+var (
+	ThroughputInterval = DefaultThroughputInterval
+	// runs tc. swapped out in tests.
+	runTC = func(pretend bool, args ...string) error {
+		_, err := executeCommand(pretend, "tc", args...)
+		return err
+	}
+	// reads a byte counter of a veth. swapped out in tests.
+	readVethCounter = func(veth, counter string) (uint64, error) {
+		data, err := ioutil.ReadFile(path.Join("/sys/class/net", veth, "statistics", counter))
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+)
+
+// Set how often the throughput of each container's veth is measured. Must be called before containers.Init.
+func InitThroughput(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("Invalid netsec throughput interval: " + interval.String())
+	}
+	ThroughputInterval = interval
+	return nil
+}
+
+// The byte counters of a veth at the last sample and the throughput in kbit/s since the one before it
+type throughput struct {
+	veth    string
+	rx      uint64 // from the container
+	tx      uint64 // to the container
+	ingress uint64
+	egress  uint64
+	sampled time.Time
+}
+
+// 10ms of traffic at the limit, but never less than a couple of full size packets
+func burstBytes(kbit uint) uint {
+	burst := kbit * 1000 / 8 / 100
+	if burst < 3200 {
+		burst = 3200
+	}
+	return burst
+}
+
+// Replace the qdiscs on a veth with ones enforcing the limits. Traffic to the container leaves the host through
+// the veth, so it is shaped by a tbf. Traffic from the container arrives on the veth and can only be policed.
+func shape(pretend bool, veth string, bandwidth *types.Bandwidth) error {
+	if !bandwidth.Limited() {
+		return nil
+	}
+	unshape(pretend, veth)
+	if kbit := bandwidth.IngressKbit; kbit > 0 {
+		if err := runTC(pretend, "qdisc", "add", "dev", veth, "root", "tbf", "rate", fmt.Sprintf("%dkbit", kbit),
+			"burst", fmt.Sprintf("%d", burstBytes(kbit)), "latency", "50ms"); err != nil {
+			return err
+		}
+	}
+	if kbit := bandwidth.EgressKbit; kbit > 0 {
+		if err := runTC(pretend, "qdisc", "add", "dev", veth, "handle", "ffff:", "ingress"); err != nil {
+			return err
+		}
+		if err := runTC(pretend, "filter", "add", "dev", veth, "parent", "ffff:", "protocol", "all", "u32", "match",
+			"u32", "0", "0", "police", "rate", fmt.Sprintf("%dkbit", kbit), "burst",
+			fmt.Sprintf("%d", burstBytes(kbit)), "drop", "flowid", ":1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove whatever qdiscs are on a veth
+func unshape(pretend bool, veth string) {
+	// these fail when there is nothing to delete
+	runTC(pretend, "qdisc", "del", "dev", veth, "root")
+	runTC(pretend, "qdisc", "del", "dev", veth, "ingress")
+}
+
+func (n *NetworkSecurity) MonitorThroughput() {
+	for {
+		n.SampleThroughput()
+		time.Sleep(ThroughputInterval)
+	}
+}
+
+// Read the byte counters of every container's veth. Throughput is measured from the second sample of a veth on.
+func (n *NetworkSecurity) SampleThroughput() {
+	n.Lock()
+	defer n.Unlock()
+	now := time.Now()
+	sampled := map[string]*throughput{}
+	for id, contSec := range n.Containers {
+		rx, err := readVethCounter(contSec.Veth, "rx_bytes")
+		if err != nil {
+			log.Printf("[netsec] could not read the counters of %s for %s: %v", contSec.Veth, id, err)
+			continue
+		}
+		tx, err := readVethCounter(contSec.Veth, "tx_bytes")
+		if err != nil {
+			log.Printf("[netsec] could not read the counters of %s for %s: %v", contSec.Veth, id, err)
+			continue
+		}
+		sample := &throughput{veth: contSec.Veth, rx: rx, tx: tx, sampled: now}
+		// counters start over with a new veth
+		if last, exists := n.throughput[id]; exists && last.veth == contSec.Veth && rx >= last.rx && tx >= last.tx {
+			if millis := uint64(now.Sub(last.sampled) / time.Millisecond); millis > 0 {
+				// bytes per ms * 8 is kbit/s
+				sample.ingress = (tx - last.tx) * 8 / millis
+				sample.egress = (rx - last.rx) * 8 / millis
+			}
+		}
+		sampled[id] = sample
+	}
+	n.throughput = sampled
+}
+
+// The bandwidth limits and last measured throughput of every container, sorted by id
+func (n *NetworkSecurity) BandwidthStats() []*types.BandwidthStats {
+	n.Lock()
+	defer n.Unlock()
+	ids := []string{}
+	for id, _ := range n.Containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	stats := []*types.BandwidthStats{}
+	for _, id := range ids {
+		contSec := n.Containers[id]
+		stat := &types.BandwidthStats{ContainerID: id, Veth: contSec.Veth}
+		if contSec.Bandwidth != nil {
+			stat.IngressLimit = contSec.Bandwidth.IngressKbit
+			stat.EgressLimit = contSec.Bandwidth.EgressKbit
+		}
+		if sample, exists := n.throughput[id]; exists {
+			stat.Ingress, stat.Egress, stat.LastSample = sample.ingress, sample.egress, sample.sampled
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
@@ -12,6 +12,7 @@
 package netsec
 
 import (
+	"atlantis/supervisor/rpc/types"
 	"errors"
 	"fmt"
 	"os"
@@ -21,6 +22,9 @@ import (
 	"time"
 )
 
+// finds the mark and veth of a container's eth0. swapped out in tests.
+var findVeth = guano
+
 func guano(pid int) (string, string, error) {
 	binDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
@@ -38,27 +42,41 @@ func guano(pid int) (string, string, error) {
 }
 
 type ContainerSecurity struct {
-	veth           string
-	mark           string
-	ID             string
-	Pid            int
-	Pretend        bool
-	SecurityGroups map[string][]uint16 // ipgroup name -> ports
+	Veth              string
+	Mark              string
+	ID                string
+	Pid               int
+	SecurityGroups    map[string][]uint16 // ipgroup name -> tcp ports
+	UDPSecurityGroups map[string][]uint16 // ipgroup name -> udp ports
+	Ingress           []*types.PortIngress
+	Bandwidth         *types.Bandwidth // nil means unlimited
 }
 
 func (c ContainerSecurity) String() string {
-	return fmt.Sprintf("veth %s mark %s id %s pid %d groups %v", c.veth, c.mark, c.ID, c.Pid, c.SecurityGroups)
+	ingress := []string{}
+	for _, in := range c.Ingress {
+		ingress = append(ingress, fmt.Sprintf("%s %d from %v", in.Protocol, in.Port, in.Sources))
+	}
+	bandwidth := "unlimited"
+	if c.Bandwidth.Limited() {
+		bandwidth = fmt.Sprintf("in %d out %d kbit", c.Bandwidth.IngressKbit, c.Bandwidth.EgressKbit)
+	}
+	return fmt.Sprintf("veth %s mark %s id %s pid %d groups %v udp groups %v ingress %v bandwidth %s", c.Veth,
+		c.Mark, c.ID, c.Pid, c.SecurityGroups, c.UDPSecurityGroups, ingress, bandwidth)
 }
 
-func NewContainerSecurity(id string, pid int, sgs map[string][]uint16, pretend bool) (contSec *ContainerSecurity, err error) {
+func NewContainerSecurity(id string, pid int, sgs, udpSGs map[string][]uint16,
+	ingress []*types.PortIngress, bandwidth *types.Bandwidth) (contSec *ContainerSecurity, err error) {
 	contSec = &ContainerSecurity{
-		ID:             id,
-		Pid:            pid,
-		SecurityGroups: sgs,
-		Pretend:        pretend,
+		ID:                id,
+		Pid:               pid,
+		SecurityGroups:    sgs,
+		UDPSecurityGroups: udpSGs,
+		Ingress:           ingress,
+		Bandwidth:         bandwidth,
 	}
 	for i := 0; i < 5; i++ {
-		contSec.mark, contSec.veth, err = guano(pid)
+		contSec.Mark, contSec.Veth, err = findVeth(pid)
 		if err == nil {
 			break
 		}
@@ -67,40 +85,49 @@ func NewContainerSecurity(id string, pid int, sgs map[string][]uint16, pretend b
 	return contSec, err
 }
 
-func (c *ContainerSecurity) filterPort(action, ip string, port uint16) error {
-	defer echoIPTables(c.Pretend)
-	_, err := c.executeCommand("iptables", action, "FORWARD",
-		"-d", ip,
-		"-p", "tcp", "--dport", fmt.Sprintf("%d", port),
-		"-m", "mark", "--mark", c.mark,
-		"-j", "ACCEPT")
-	return err
-}
-
-func (c *ContainerSecurity) allowPort(ip string, port uint16) error {
-	return c.filterPort("-I", ip, port)
-}
-
-func (c *ContainerSecurity) rejectPort(ip string, port uint16) error {
-	return c.filterPort("-D", ip, port)
+// protocol -> ipgroup name -> ports
+func (c *ContainerSecurity) groupsByProtocol() map[string]map[string][]uint16 {
+	return map[string]map[string][]uint16{
+		"tcp": c.SecurityGroups,
+		"udp": c.UDPSecurityGroups,
+	}
 }
 
-func (c *ContainerSecurity) markVeth(action string) error {
-	defer echoIPTables(c.Pretend)
-	_, err := c.executeCommand("iptables", action, "PREROUTING", "-t", "mangle",
-		"-m", "physdev", "--physdev-in", c.veth,
-		"-j", "MARK", "--set-mark", c.mark)
-	return err
+func (c *ContainerSecurity) markRule() Mark {
+	return Mark{Veth: c.Veth, Mark: c.Mark}
 }
 
-func (c *ContainerSecurity) addMark() error {
-	return c.markVeth("-I")
+func (c *ContainerSecurity) allowRule(protocol, group string, port uint16) Allow {
+	return Allow{Mark: c.Mark, Protocol: protocol, Group: group, Port: port}
 }
 
-func (c *ContainerSecurity) delMark() error {
-	return c.markVeth("-D")
+// sources are addresses when they parse as one and IP group names otherwise
+func (c *ContainerSecurity) ingressRules() ([]Ingress, []Guard) {
+	ingress, guards := []Ingress{}, []Guard{}
+	for _, in := range c.Ingress {
+		for _, source := range in.Sources {
+			if parseAddr(source) != nil {
+				ingress = append(ingress, Ingress{Protocol: in.Protocol, Port: in.Port, Addr: source})
+			} else {
+				ingress = append(ingress, Ingress{Protocol: in.Protocol, Port: in.Port, Group: source})
+			}
+		}
+		guards = append(guards, Guard{Protocol: in.Protocol, Port: in.Port})
+	}
+	return ingress, guards
 }
 
-func (c *ContainerSecurity) executeCommand(cmd string, args ...string) (string, error) {
-	return executeCommand(c.Pretend, cmd, args...)
+// Stop using an IP group, in the security groups and as an ingress source
+func (c *ContainerSecurity) dropIPGroup(name string) {
+	delete(c.SecurityGroups, name)
+	delete(c.UDPSecurityGroups, name)
+	for _, in := range c.Ingress {
+		sources := []string{}
+		for _, source := range in.Sources {
+			if source != name {
+				sources = append(sources, source)
+			}
+		}
+		in.Sources = sources
+	}
 }
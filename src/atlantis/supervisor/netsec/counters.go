@@ -0,0 +1,234 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package netsec
+
+import (
+	"atlantis/supervisor/events"
+	"atlantis/supervisor/metrics"
+	"atlantis/supervisor/rpc/types"
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// what the kernel logs rejects to denied addresses with
+const RejectLogPrefix = "atlantis-reject:"
+
+var (
+	RejectLogRate       = "" // how often the kernel logs rejects to denied addresses. empty means they aren't.
+	rejectLogRateRegexp = regexp.MustCompile(`^[1-9][0-9]*/(second|minute|hour|day)$`)
+	kernelLogRegexp     = regexp.MustCompile(`\b(SRC|DST|PROTO|DPT|MARK)=(\S+)`)
+	kernelLogRetry      = 5 * time.Second // how long to wait before opening the kernel log again after an error
+	// opens the kernel log, past what is already in it. swapped out in tests.
+	openKernelLog = func() (io.ReadCloser, error) {
+		kmsg, err := os.Open("/dev/kmsg")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := kmsg.Seek(0, os.SEEK_END); err != nil {
+			kmsg.Close()
+			return nil, err
+		}
+		return kmsg, nil
+	}
+)
+
+// Log rejects to denied addresses at most this often, like 10/minute. Empty turns logging off. Must be called
+// before containers.Init.
+func InitRejectLog(rate string) error {
+	if rate != "" && !rejectLogRateRegexp.MatchString(rate) {
+		return errors.New("Invalid netsec reject log rate: " + rate + ". Use a count per second, minute, hour or day.")
+	}
+	RejectLogRate = rate
+	return nil
+}
+
+// What matched each container's allows and the blanket denies, containers sorted by id. An empty id gets every
+// container and the denies. Counts carry over when the rules are reinstalled.
+func (n *NetworkSecurity) RuleCounters(id string) ([]*types.RuleCounter, error) {
+	n.Lock()
+	defer n.Unlock()
+	ids := []string{id}
+	if id == "" {
+		ids = []string{}
+		for contID, _ := range n.Containers {
+			ids = append(ids, contID)
+		}
+		sort.Strings(ids)
+	} else if _, exists := n.Containers[id]; !exists {
+		return nil, errors.New("No network security for container " + id)
+	}
+	live, err := n.firewall.Live()
+	if err != nil {
+		return nil, err
+	}
+	total := func(key string) Counter {
+		counter := n.carried[key]
+		counter.Packets += live.Counters[key].Packets
+		counter.Bytes += live.Counters[key].Bytes
+		return counter
+	}
+	counters := []*types.RuleCounter{}
+	for _, contID := range ids {
+		contSec := n.Containers[contID]
+		allows := []Allow{}
+		for protocol, groups := range contSec.groupsByProtocol() {
+			for group, ports := range groups {
+				for _, port := range ports {
+					allows = append(allows, contSec.allowRule(protocol, group, port))
+				}
+			}
+		}
+		sort.Sort(allowsByKey(allows))
+		for _, allow := range allows {
+			counter := total(allowCounter(allow))
+			counters = append(counters, &types.RuleCounter{ContainerID: contID, Rule: allow.String(),
+				Packets: counter.Packets, Bytes: counter.Bytes})
+		}
+	}
+	if id == "" {
+		counter := total(denyCounter)
+		counters = append(counters, &types.RuleCounter{Rule: denyCounter, Packets: counter.Packets,
+			Bytes: counter.Bytes})
+	}
+	return counters, nil
+}
+
+func (n *NetworkSecurity) MonitorCounters() {
+	for {
+		n.SampleCounters()
+		time.Sleep(ThroughputInterval)
+	}
+}
+
+// Add what matched the allows and denies since the last reading to the metrics
+func (n *NetworkSecurity) SampleCounters() {
+	n.Lock()
+	defer n.Unlock()
+	n.readCounters()
+}
+
+// Read the live counters and record them. Returns nil if they can't be read. Callers must hold the lock.
+func (n *NetworkSecurity) readCounters() map[string]Counter {
+	live, err := n.firewall.Live()
+	if err != nil {
+		log.Println("[netsec] could not read rule counters: " + err.Error())
+		return nil
+	}
+	n.recordCounters(live)
+	return live.Counters
+}
+
+// Add what matched the allows and denies since the last reading to the metrics. Callers must hold the lock.
+func (n *NetworkSecurity) recordCounters(live *Ruleset) {
+	for key, counter := range live.Counters {
+		last := n.counters[key]
+		// the rules were reinstalled by someone else, so what matched since the last reading is lost
+		if counter.Packets < last.Packets || counter.Bytes < last.Bytes {
+			last = Counter{}
+		}
+		name := "netsec.allowed"
+		if key == denyCounter {
+			name = "netsec.denied"
+		}
+		metrics.Add(name+"_packets", counter.Packets-last.Packets)
+		metrics.Add(name+"_bytes", counter.Bytes-last.Bytes)
+	}
+	n.counters = live.Counters
+}
+
+// Reinstalling the rules starts their counters over. Keep what they counted before, for the rules that are still
+// in the installed ruleset. live is what was read right before installing it.
+func (n *NetworkSecurity) carryCounters(live map[string]Counter, installed *Ruleset) {
+	carried := map[string]Counter{}
+	keys := []string{denyCounter}
+	for _, allow := range installed.Allows {
+		keys = append(keys, allowCounter(allow))
+	}
+	for _, key := range keys {
+		counter := n.carried[key]
+		counter.Packets += live[key].Packets
+		counter.Bytes += live[key].Bytes
+		if counter.Packets > 0 || counter.Bytes > 0 {
+			carried[key] = counter
+		}
+	}
+	n.carried = carried
+	n.counters = map[string]Counter{}
+}
+
+// Report the rejects the kernel logs, attributed to a container by the mark on the traffic. Does nothing unless
+// a reject log rate is set. The kernel log is opened again after errors, like when its ring buffer overruns.
+func (n *NetworkSecurity) MonitorRejects() {
+	if RejectLogRate == "" {
+		return
+	}
+	for {
+		kmsg, err := openKernelLog()
+		if err != nil {
+			log.Println("[netsec] could not open the kernel log, retrying: " + err.Error())
+			time.Sleep(kernelLogRetry)
+			continue
+		}
+		scanner := bufio.NewScanner(kmsg)
+		for scanner.Scan() {
+			n.reportReject(scanner.Text())
+		}
+		kmsg.Close()
+		if scanner.Err() == nil {
+			// the log was closed
+			return
+		}
+		log.Println("[netsec] could not read the kernel log, reopening it: " + scanner.Err().Error())
+		metrics.Inc("netsec.kernel_log_errors")
+		time.Sleep(kernelLogRetry)
+	}
+}
+
+// Report a kernel log line if it is a reject. Returns the container the rejected traffic came from, or "" if
+// the line isn't a reject or no container has its mark.
+func (n *NetworkSecurity) reportReject(line string) string {
+	i := strings.Index(line, RejectLogPrefix)
+	if i < 0 {
+		return ""
+	}
+	fields := map[string]string{}
+	for _, match := range kernelLogRegexp.FindAllStringSubmatch(line[i:], -1) {
+		fields[match[1]] = match[2]
+	}
+	n.Lock()
+	id := ""
+	for contID, contSec := range n.Containers {
+		if fields["MARK"] != "" && normalizeMark(contSec.Mark) == normalizeMark(fields["MARK"]) {
+			id = contID
+			break
+		}
+	}
+	n.Unlock()
+	metrics.Inc("netsec.rejects_logged")
+	conn := strings.ToLower(fields["PROTO"]) + " " + fields["SRC"] + " -> " + fields["DST"]
+	if fields["DPT"] != "" {
+		conn += ":" + fields["DPT"]
+	}
+	if id == "" {
+		log.Println("[netsec] rejected " + conn + " from no known container")
+		return ""
+	}
+	events.Record("netsec-reject", id, "rejected %s to a denied address", conn)
+	return id
+}
@@ -0,0 +1,129 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package netsec
+
+import (
+	"atlantis/supervisor/events"
+	"atlantis/supervisor/metrics"
+	"atlantis/supervisor/rpc/types"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultDriftInterval = 1 * time.Minute
+
+var (
+	DriftInterval = DefaultDriftInterval
+	RepairDrift   = true // reinstall the expected rules when they drift. if false drift is only reported.
+	drift         = &types.NetsecStats{Healthy: true}
+	driftLock     = sync.Mutex{}
+)
+
+// Set how often the live rules are checked and what to do when they drift. Must be called before
+// containers.Init.
+func InitDriftCheck(interval time.Duration, repair bool) error {
+	if interval <= 0 {
+		return errors.New("Invalid netsec drift interval: " + interval.String())
+	}
+	DriftInterval = interval
+	RepairDrift = repair
+	return nil
+}
+
+// The result of the last drift check
+func Status() *types.NetsecStats {
+	driftLock.Lock()
+	defer driftLock.Unlock()
+	stats := *drift
+	stats.Backend = Backend
+	stats.IPv6 = IPv6
+	stats.Repair = RepairDrift
+	return &stats
+}
+
+func (n *NetworkSecurity) MonitorDrift() {
+	for {
+		time.Sleep(DriftInterval)
+		n.CheckDrift()
+	}
+}
+
+// Compare the live rules with the ones expected from DeniedIPs, IPGroups and Containers. Drift is repaired by
+// applying the expected ruleset again if RepairDrift is set.
+func (n *NetworkSecurity) CheckDrift() *types.NetsecStats {
+	n.Lock()
+	defer n.Unlock()
+	metrics.Inc("netsec.drift_checks")
+	expected := n.ruleset()
+	live, err := n.firewall.Live()
+	if err != nil {
+		log.Println("[netsec] could not read live rules: " + err.Error())
+		metrics.Inc("netsec.drift_errors")
+		recordDrift(nil, nil, false, err)
+		return Status()
+	}
+	n.recordCounters(live)
+	missing, extra := expected.Diff(live)
+	if len(missing) == 0 && len(extra) == 0 {
+		recordDrift(nil, nil, false, nil)
+		return Status()
+	}
+	log.Printf("[netsec] drift: missing %v, extra %v", missing, extra)
+	metrics.Inc("netsec.drifts")
+	if !RepairDrift {
+		recordDrift(missing, extra, false, nil)
+		return Status()
+	}
+	if err := n.apply(); err != nil {
+		metrics.Inc("netsec.drift_errors")
+		recordDrift(missing, extra, false, err)
+		return Status()
+	}
+	metrics.Inc("netsec.repairs")
+	recordDrift(missing, extra, true, nil)
+	return Status()
+}
+
+// Changes in health are recorded as events, along with every repair
+func recordDrift(missing, extra []string, repaired bool, err error) {
+	driftLock.Lock()
+	defer driftLock.Unlock()
+	drifted := len(missing) > 0 || len(extra) > 0
+	healthy := err == nil && (!drifted || repaired)
+	if drifted {
+		drift.Drifts++
+	}
+	switch {
+	case repaired:
+		drift.Repairs++
+		events.Record("netsec-repaired", "", "reinstalled %s rules. missing: [%s], extra: [%s]", Backend,
+			strings.Join(missing, ", "), strings.Join(extra, ", "))
+	case !healthy && drift.Healthy && err != nil:
+		events.Record("netsec-unhealthy", "", "%s rules are unhealthy: %v", Backend, err)
+	case !healthy && drift.Healthy:
+		events.Record("netsec-drift", "", "%s rules drifted. missing: [%s], extra: [%s]", Backend,
+			strings.Join(missing, ", "), strings.Join(extra, ", "))
+	case healthy && !drift.Healthy:
+		events.Record("netsec-healthy", "", "%s rules match again", Backend)
+	}
+	drift.Healthy = healthy
+	drift.Missing = missing
+	drift.Extra = extra
+	drift.LastCheck = time.Now()
+	drift.LastError = ""
+	if err != nil {
+		drift.LastError = err.Error()
+	}
+}
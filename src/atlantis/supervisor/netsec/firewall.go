@@ -0,0 +1,117 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package netsec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Traffic coming in on a container's veth is marked so forward rules can tell containers apart
+type Mark struct {
+	Veth string
+	Mark string
+}
+
+func (m Mark) String() string {
+	return fmt.Sprintf("mark %s %s", m.Veth, m.Mark)
+}
+
+// Lets traffic with a container's mark through to a port on the addresses of an IP group
+type Allow struct {
+	Mark     string
+	Protocol string
+	Group    string
+	Port     uint16
+}
+
+func (a Allow) String() string {
+	return fmt.Sprintf("allow %s %s %s:%d", a.Mark, a.Protocol, a.Group, a.Port)
+}
+
+// Lets traffic published to a container's port in from an IP group or an address. Exactly one of Group and Addr
+// is set.
+type Ingress struct {
+	Protocol string
+	Port     uint16
+	Group    string
+	Addr     string
+}
+
+func (i Ingress) String() string {
+	if i.Group != "" {
+		return fmt.Sprintf("ingress %s %d from group %s", i.Protocol, i.Port, i.Group)
+	}
+	return fmt.Sprintf("ingress %s %d from %s", i.Protocol, i.Port, i.Addr)
+}
+
+// Rejects traffic published to a container's port that no ingress let in
+type Guard struct {
+	Protocol string
+	Port     uint16
+}
+
+func (g Guard) String() string {
+	return fmt.Sprintf("guard %s %d", g.Protocol, g.Port)
+}
+
+// The packets and bytes that matched a rule since it was installed
+type Counter struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// The addresses of an IP group, matched as a set so rules don't grow with the group
+type Group struct {
+	Name  string
+	Addrs []string
+}
+
+// How netsec's rules get installed. Allows let marked traffic through, denies reject all other forwarded
+// traffic to an address. Ingresses let traffic in to published ports, guards reject the rest of it. Replies to
+// established connections are always let through. Rejects to denied addresses may be logged first, with a prefix
+// and at a rate limit.
+type Firewall interface {
+	// replace everything netsec installed before with the ruleset, all at once
+	Apply(r *Ruleset) error
+	// read back what is actually installed, to catch changes made behind netsec's back
+	Live() (*Ruleset, error)
+}
+
+// Firewalls that can clean up the rules older supervisors installed some other way. Called on the first restore
+// of state they saved, with the iptables arguments deleting each rule.
+type legacyRemover interface {
+	RemoveLegacyRules(rules [][]string)
+}
+
+const DefaultFirewall = "iptables"
+
+var (
+	firewalls = map[string]func(pretend bool) Firewall{
+		"iptables": NewIPTables,
+		"nftables": NewNFTables,
+	}
+	// makes the firewall for new NetworkSecurity. tests may swap in a Recorder.
+	NewFirewall = firewalls[DefaultFirewall]
+	Backend     = DefaultFirewall
+)
+
+// Pick the firewall backend. Must be called before containers.Init.
+func InitFirewall(backend string) error {
+	newFirewall, exists := firewalls[backend]
+	if !exists {
+		return errors.New("Unknown firewall backend: " + backend)
+	}
+	NewFirewall = newFirewall
+	Backend = backend
+	return nil
+}
@@ -0,0 +1,255 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package netsec
+
+import (
+	"atlantis/supervisor/rpc/types"
+	"errors"
+	"log"
+	"sort"
+)
+
+type uint16s []uint16
+
+func (u uint16s) Len() int           { return len(u) }
+func (u uint16s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u uint16s) Less(i, j int) bool { return u[i] < u[j] }
+
+func overlaps(a, b string) bool {
+	aNet, bNet := parseAddr(a), parseAddr(b)
+	return aNet != nil && bNet != nil && (aNet.Contains(bNet.IP) || bNet.Contains(aNet.IP))
+}
+
+// The expected rules that aren't live. Callers must hold the lock.
+func (n *NetworkSecurity) missingRules(expected *Ruleset) (map[string]bool, error) {
+	live, err := n.firewall.Live()
+	if err != nil {
+		log.Println("[netsec] could not read live rules: " + err.Error())
+		return nil, err
+	}
+	missing, _ := expected.Diff(live)
+	missingSet := map[string]bool{}
+	for _, rule := range missing {
+		missingSet[rule] = true
+	}
+	return missingSet, nil
+}
+
+// Whether the rules of part are all live, the ones that are missing and why it couldn't be told. liveErr is from
+// reading the live rules.
+func installedOf(part *Ruleset, missing map[string]bool, liveErr error) (bool, []string, string) {
+	if liveErr != nil {
+		return false, []string{}, liveErr.Error()
+	}
+	partMissing := missingOf(part, missing)
+	return len(partMissing) == 0, partMissing, ""
+}
+
+// the rules of part that are missing
+func missingOf(part *Ruleset, missing map[string]bool) []string {
+	partMissing := []string{}
+	for _, rule := range part.normalized().Strings() {
+		if missing[rule] {
+			partMissing = append(partMissing, rule)
+		}
+	}
+	return partMissing
+}
+
+// The containers allowed through to a group, sorted by id. Callers must hold the lock.
+func (n *NetworkSecurity) ipGroupUsers(name string) []*types.IPGroupUser {
+	users := []*types.IPGroupUser{}
+	ids := []string{}
+	for id, _ := range n.Containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, protocol := range []string{"tcp", "udp"} {
+			if ports, uses := n.Containers[id].groupsByProtocol()[protocol][name]; uses {
+				sorted := append(uint16s{}, ports...)
+				sort.Sort(sorted)
+				users = append(users, &types.IPGroupUser{ContainerID: id, Protocol: protocol,
+					Ports: []uint16(sorted)})
+			}
+		}
+		// the published ports the group is let in to, by protocol
+		ingressPorts := map[string]uint16s{}
+		for _, in := range n.Containers[id].Ingress {
+			for _, source := range in.Sources {
+				if source == name {
+					ingressPorts[in.Protocol] = append(ingressPorts[in.Protocol], in.Port)
+				}
+			}
+		}
+		for _, protocol := range []string{"tcp", "udp"} {
+			if ports := ingressPorts[protocol]; len(ports) > 0 {
+				sort.Sort(ports)
+				users = append(users, &types.IPGroupUser{ContainerID: id, Protocol: protocol,
+					Ports: []uint16(ports), Ingress: true})
+			}
+		}
+	}
+	return users
+}
+
+// Callers must hold the lock
+func (n *NetworkSecurity) ipGroupInfo(name string, expected *Ruleset, missing map[string]bool,
+	liveErr error) *types.IPGroupInfo {
+	info := &types.IPGroupInfo{
+		Name:     name,
+		Members:  append([]string{}, n.IPGroups[name]...),
+		Resolved: map[string][]string{},
+	}
+	for _, entry := range n.IPGroups[name] {
+		if isHostname(entry) {
+			info.Resolved[entry] = n.Resolved[entry]
+		}
+	}
+	info.IPv4, info.IPv6 = splitFamilies(collapseAddrs(n.groupAddrs(name)))
+	info.Users = n.ipGroupUsers(name)
+	// the group's set, the allows using it and the denies covering its addresses
+	part := &Ruleset{}
+	for _, group := range expected.Groups {
+		if group.Name == name {
+			part.Groups = append(part.Groups, group)
+		}
+	}
+	for _, allow := range expected.Allows {
+		if allow.Group == name {
+			part.Allows = append(part.Allows, allow)
+		}
+	}
+	for _, in := range expected.Ingress {
+		if in.Group == name {
+			part.Ingress = append(part.Ingress, in)
+		}
+	}
+	for _, deny := range expected.Denies {
+		for _, addr := range n.groupAddrs(name) {
+			if overlaps(deny, addr) {
+				part.Denies = append(part.Denies, deny)
+				break
+			}
+		}
+	}
+	info.Installed, info.Missing, info.LastError = installedOf(part, missing, liveErr)
+	return info
+}
+
+// Every IP group, sorted by name, with the containers using it and whether its rules are installed. Groups are
+// listed even if the live rules can't be read.
+func (n *NetworkSecurity) ListIPGroups() ([]*types.IPGroupInfo, error) {
+	n.Lock()
+	defer n.Unlock()
+	expected := n.ruleset()
+	missing, liveErr := n.missingRules(expected)
+	names := []string{}
+	for name, _ := range n.IPGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	infos := []*types.IPGroupInfo{}
+	for _, name := range names {
+		infos = append(infos, n.ipGroupInfo(name, expected, missing, liveErr))
+	}
+	return infos, nil
+}
+
+func (n *NetworkSecurity) GetIPGroup(name string) (*types.IPGroupInfo, error) {
+	n.Lock()
+	defer n.Unlock()
+	if _, exists := n.IPGroups[name]; !exists {
+		return nil, errors.New("IP Group " + name + " does not exist")
+	}
+	expected := n.ruleset()
+	missing, liveErr := n.missingRules(expected)
+	return n.ipGroupInfo(name, expected, missing, liveErr), nil
+}
+
+// The mark and veth of a container, its groups, its ingress and whether its rules are installed
+func (n *NetworkSecurity) GetContainerSecurity(id string) (*types.ContainerSecurityInfo, error) {
+	n.Lock()
+	defer n.Unlock()
+	contSec, exists := n.Containers[id]
+	if !exists {
+		return nil, errors.New("No network security for container " + id)
+	}
+	missing, liveErr := n.missingRules(n.ruleset())
+	part := &Ruleset{Marks: []Mark{contSec.markRule()}}
+	for protocol, groups := range contSec.groupsByProtocol() {
+		for group, ports := range groups {
+			for _, port := range ports {
+				part.Allows = append(part.Allows, contSec.allowRule(protocol, group, port))
+			}
+		}
+	}
+	sort.Sort(allowsByKey(part.Allows))
+	part.Ingress, part.Guards = contSec.ingressRules()
+	sort.Sort(ingressByKey(part.Ingress))
+	info := &types.ContainerSecurityInfo{
+		ContainerID:       id,
+		Pid:               contSec.Pid,
+		Veth:              contSec.Veth,
+		Mark:              contSec.Mark,
+		SecurityGroups:    contSec.SecurityGroups,
+		UDPSecurityGroups: contSec.UDPSecurityGroups,
+		Ingress:           contSec.Ingress,
+		Bandwidth:         contSec.Bandwidth,
+	}
+	info.Installed, info.Missing, info.LastError = installedOf(part, missing, liveErr)
+	return info, nil
+}
+
+// What changed for a group since before, the ruleset and group addresses from before the change. Callers must
+// hold the lock.
+func (n *NetworkSecurity) ipGroupDiff(name string, before *Ruleset, beforeAddrs []string) *types.IPGroupDiff {
+	inserted, deleted := n.ruleset().Diff(before)
+	added, removed := addrsDiff(n.groupAddrs(name), beforeAddrs)
+	return &types.IPGroupDiff{
+		Name:     name,
+		Added:    added,
+		Removed:  removed,
+		Affected: n.ipGroupUsers(name),
+		Inserted: inserted,
+		Deleted:  deleted,
+	}
+}
+
+// the addresses only in a and only in b, IPv4 first
+func addrsDiff(a, b []string) (onlyA, onlyB []string) {
+	inA, inB := map[string]bool{}, map[string]bool{}
+	for _, str := range a {
+		inA[str] = true
+	}
+	for _, str := range b {
+		inB[str] = true
+	}
+	onlyA, onlyB = []string{}, []string{}
+	for str, _ := range inA {
+		if !inB[str] {
+			onlyA = append(onlyA, str)
+		}
+	}
+	for str, _ := range inB {
+		if !inA[str] {
+			onlyB = append(onlyB, str)
+		}
+	}
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+	v4, v6 := splitFamilies(onlyA)
+	onlyA = append(v4, v6...)
+	v4, v6 = splitFamilies(onlyB)
+	onlyB = append(v4, v6...)
+	return onlyA, onlyB
+}
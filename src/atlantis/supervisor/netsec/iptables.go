@@ -0,0 +1,429 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package netsec
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// netsec's rules live in these chains, in both iptables and ip6tables. The shared chains only get a single jump
+// into each. Addresses live in ipsets: per family, one per group that rules refer to and one with every denied
+// address. ipset names are at most 31 characters, so the IPv6 group prefix is no longer than the IPv4 one.
+const (
+	ForwardChain    = "ATLANTIS-FORWARD"
+	MarkChain       = "ATLANTIS-MARK"
+	DenySet         = "atlantis"
+	GroupSetPrefix  = "atlantis-"
+	tmpSetPrefix    = "atlantis_" // sets are filled under this name, then swapped in
+	DenySet6        = "atlantis6"
+	GroupSet6Prefix = "atl6-"
+	tmpSet6Prefix   = "atl6_"
+)
+
+// What differs between the iptables and ip6tables halves of the ruleset
+type ipFamily struct {
+	name        string // how rules only live in this family are reported
+	ipset       string // ipset family
+	denySet     string
+	groupPrefix string
+	tmpPrefix   string
+	iptables    string
+	v6          bool
+}
+
+var (
+	ipv4 = &ipFamily{name: "ip", ipset: "inet", denySet: DenySet, groupPrefix: GroupSetPrefix,
+		tmpPrefix: tmpSetPrefix, iptables: "iptables"}
+	ipv6 = &ipFamily{name: "ip6", ipset: "inet6", denySet: DenySet6, groupPrefix: GroupSet6Prefix,
+		tmpPrefix: tmpSet6Prefix, iptables: "ip6tables", v6: true}
+	ipFamilies = []*ipFamily{ipv4, ipv6}
+	// whether the host has ip6tables. without it netsec's rules are IPv4 only. detected once, by the first
+	// IPTables that isn't pretending.
+	IPv6           = true
+	detectIPv6Once sync.Once
+	// swapped out in tests
+	detectIPv6 = func() bool {
+		_, err := executeCommand(false, "ip6tables-save", "-t", "filter")
+		return err == nil
+	}
+)
+
+func (f *ipFamily) groupSet(group string) string {
+	return f.groupPrefix + group
+}
+
+// the addresses that belong to this family
+func (f *ipFamily) addrs(addrs []string) []string {
+	v4, v6 := splitFamilies(addrs)
+	if f.v6 {
+		return v6
+	}
+	return v4
+}
+
+type IPTables struct {
+	Pretend   bool
+	applied   *Ruleset // what Live returns when pretending
+	installed *Ruleset // the last ruleset installed in every family, to roll back to
+}
+
+func NewIPTables(pretend bool) Firewall {
+	if !pretend {
+		detectIPv6Once.Do(func() {
+			if IPv6 = detectIPv6(); !IPv6 {
+				log.Println("[netsec] ip6tables is unavailable, only IPv4 rules will be installed")
+			}
+		})
+	}
+	return &IPTables{Pretend: pretend}
+}
+
+// the families rules are installed in
+func (t *IPTables) families() []*ipFamily {
+	if !IPv6 {
+		return []*ipFamily{ipv4}
+	}
+	return ipFamilies
+}
+
+// fill a temporary set and swap it in, so the set is replaced in one step
+func ipsetReplace(buf *bytes.Buffer, family, name, tmpName string, addrs []string) {
+	fmt.Fprintf(buf, "create %s hash:net family %s -exist\n", name, family)
+	fmt.Fprintf(buf, "create %s hash:net family %s -exist\n", tmpName, family)
+	fmt.Fprintf(buf, "flush %s\n", tmpName)
+	for _, addr := range addrs {
+		fmt.Fprintf(buf, "add %s %s\n", tmpName, addr)
+	}
+	fmt.Fprintf(buf, "swap %s %s\n", tmpName, name)
+	fmt.Fprintf(buf, "destroy %s\n", tmpName)
+}
+
+// The ipset restore input for a ruleset in some families, IPv4 sets first
+func ipsetRestoreInput(r *Ruleset, families []*ipFamily) string {
+	var buf bytes.Buffer
+	for _, f := range families {
+		for _, group := range r.Groups {
+			ipsetReplace(&buf, f.ipset, f.groupSet(group.Name), f.tmpPrefix+group.Name, f.addrs(group.Addrs))
+		}
+		ipsetReplace(&buf, f.ipset, f.denySet, f.tmpPrefix, f.addrs(r.Denies))
+	}
+	return buf.String()
+}
+
+// The iptables-restore input for a family's half of a ruleset. Declaring our chains flushes them and --noflush
+// leaves every other chain alone, so the whole ruleset is swapped in one commit per table.
+func iptablesRestoreInput(r *Ruleset, f *ipFamily) string {
+	var buf bytes.Buffer
+	buf.WriteString("*mangle\n")
+	fmt.Fprintf(&buf, ":%s - [0:0]\n", MarkChain)
+	for _, m := range r.Marks {
+		fmt.Fprintf(&buf, "-A %s -m physdev --physdev-in %s -j MARK --set-mark %s\n", MarkChain, m.Veth, m.Mark)
+	}
+	buf.WriteString("COMMIT\n")
+	buf.WriteString("*filter\n")
+	fmt.Fprintf(&buf, ":%s - [0:0]\n", ForwardChain)
+	fmt.Fprintf(&buf, "-A %s -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT\n", ForwardChain)
+	for _, a := range r.Allows {
+		fmt.Fprintf(&buf, "-A %s -p %s -m %s --dport %d -m set --match-set %s dst -m mark --mark %s -j ACCEPT\n",
+			ForwardChain, a.Protocol, a.Protocol, a.Port, f.groupSet(a.Group), a.Mark)
+	}
+	// published traffic has been DNATed to the container by the time it is forwarded
+	for _, in := range r.Ingress {
+		if in.Group != "" {
+			fmt.Fprintf(&buf, "-A %s -p %s -m %s --dport %d -m conntrack --ctstate DNAT -m set --match-set %s src "+
+				"-j ACCEPT\n", ForwardChain, in.Protocol, in.Protocol, in.Port, f.groupSet(in.Group))
+		} else if isIPv6(in.Addr) == f.v6 {
+			fmt.Fprintf(&buf, "-A %s -s %s -p %s -m %s --dport %d -m conntrack --ctstate DNAT -j ACCEPT\n",
+				ForwardChain, in.Addr, in.Protocol, in.Protocol, in.Port)
+		}
+	}
+	for _, g := range r.Guards {
+		fmt.Fprintf(&buf, "-A %s -p %s -m %s --dport %d -m conntrack --ctstate DNAT -j REJECT\n", ForwardChain,
+			g.Protocol, g.Protocol, g.Port)
+	}
+	if r.LogRejects != "" {
+		fmt.Fprintf(&buf, "-A %s -m set --match-set %s dst -m limit --limit %s -j LOG --log-prefix %s\n",
+			ForwardChain, f.denySet, r.LogRejects, RejectLogPrefix)
+	}
+	fmt.Fprintf(&buf, "-A %s -m set --match-set %s dst -j REJECT\n", ForwardChain, f.denySet)
+	buf.WriteString("COMMIT\n")
+	return buf.String()
+}
+
+// table, shared chain, our chain
+var iptablesJumps = [][]string{
+	{"mangle", "PREROUTING", MarkChain},
+	{"filter", "FORWARD", ForwardChain},
+}
+
+// Sets are filled before the rules using them are swapped in. Group sets no rule uses anymore are destroyed after.
+// The IPv4 rules are swapped in before the IPv6 ones, so the families don't change in the same step. If a later
+// step fails the last ruleset that was installed in full is put back, so the families don't disagree.
+func (t *IPTables) Apply(r *Ruleset) error {
+	defer echoIPTables(t.Pretend)
+	if t.Pretend {
+		t.applied = r
+	}
+	if err := t.apply(r); err != nil {
+		if t.installed != nil {
+			log.Println("[netsec] -- rolling back to the last installed ruleset")
+			if rollbackErr := t.apply(t.installed); rollbackErr != nil {
+				log.Println("[netsec] -- rollback error: " + rollbackErr.Error())
+			}
+		}
+		return err
+	}
+	t.installed = r
+	t.destroyUnusedSets(r)
+	return nil
+}
+
+func (t *IPTables) apply(r *Ruleset) error {
+	families := t.families()
+	if _, err := executeCommandWithInput(t.Pretend, ipsetRestoreInput(r, families), "ipset", "restore"); err != nil {
+		return err
+	}
+	for _, f := range families {
+		_, err := executeCommandWithInput(t.Pretend, iptablesRestoreInput(r, f), f.iptables+"-restore", "--noflush")
+		if err != nil {
+			return err
+		}
+		if err := t.ensureJumps(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *IPTables) destroyUnusedSets(r *Ruleset) {
+	used := map[string]bool{}
+	for _, f := range ipFamilies {
+		for _, group := range r.Groups {
+			used[f.groupSet(group.Name)] = true
+		}
+	}
+	out, err := executeCommand(t.Pretend, "ipset", "list", "-n")
+	if err != nil {
+		return
+	}
+	for _, name := range strings.Fields(out) {
+		isGroupSet := strings.HasPrefix(name, GroupSetPrefix) || strings.HasPrefix(name, GroupSet6Prefix)
+		if isGroupSet && !used[name] {
+			// still in use if something else refers to it. it's harmless either way.
+			executeCommand(t.Pretend, "ipset", "destroy", name)
+		}
+	}
+}
+
+// add the jumps into our chains unless they are already there
+func (t *IPTables) ensureJumps(f *ipFamily) error {
+	for _, jump := range iptablesJumps {
+		table, chain, target := jump[0], jump[1], jump[2]
+		if _, err := executeCommand(t.Pretend, f.iptables, "-t", table, "-C", chain, "-j", target); err == nil {
+			continue
+		}
+		if _, err := executeCommand(t.Pretend, f.iptables, "-t", table, "-I", chain, "1", "-j", target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete the rules older supervisors inserted into the shared chains. They come before the jumps into our chains,
+// so stale ones would override the ruleset. They were only ever put in iptables, and may be gone already.
+func (t *IPTables) RemoveLegacyRules(rules [][]string) {
+	for _, rule := range rules {
+		if _, err := executeCommand(t.Pretend, "iptables", rule...); err != nil {
+			log.Printf("[netsec] -- legacy rule %v not removed: %v", rule, err)
+			continue
+		}
+		log.Printf("[netsec] -- removed legacy rule %v", rule)
+	}
+}
+
+func (t *IPTables) Live() (*Ruleset, error) {
+	if t.Pretend {
+		if t.applied == nil {
+			return &Ruleset{}, nil
+		}
+		return t.applied, nil
+	}
+	ipsets, err := executeCommand(false, "ipset", "save")
+	if err != nil {
+		return nil, err
+	}
+	families := []*Ruleset{}
+	for _, f := range t.families() {
+		mangle, err := executeCommand(false, f.iptables+"-save", "-t", "mangle")
+		if err != nil {
+			return nil, err
+		}
+		filter, err := executeCommand(false, f.iptables+"-save", "-c", "-t", "filter")
+		if err != nil {
+			return nil, err
+		}
+		families = append(families, parseIPTablesSave(f, mangle, filter, ipsets))
+	}
+	if len(families) == 1 {
+		return families[0], nil
+	}
+	return mergeFamilies(families[0], families[1]), nil
+}
+
+// flag -> value for one iptables-save rule. flags without a value map to "".
+func iptablesFlags(args []string) map[string]string {
+	flags := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			continue
+		}
+		if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			flags[args[i]] = args[i+1]
+			i++
+		} else {
+			flags[args[i]] = ""
+		}
+	}
+	return flags
+}
+
+// set name -> addresses, from ipset save output
+func parseIPSetSave(ipsets string) map[string][]string {
+	sets := map[string][]string{}
+	for _, line := range strings.Split(ipsets, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "add" {
+			addr := strings.TrimSuffix(strings.TrimSuffix(fields[2], "/32"), "/128")
+			sets[fields[1]] = append(sets[fields[1]], addr)
+		}
+	}
+	return sets
+}
+
+// iptables-save -c puts [packets:bytes] in front of each rule
+var iptablesCounterRegexp = regexp.MustCompile(`^\[(\d+):(\d+)\] `)
+
+// iptables-save abbreviates the units of limits
+var iptablesLimitUnits = map[string]string{"sec": "second", "min": "minute"}
+
+func iptablesLimit(limit string) string {
+	parts := strings.Split(limit, "/")
+	if unit, abbreviated := iptablesLimitUnits[parts[len(parts)-1]]; abbreviated {
+		parts[len(parts)-1] = unit
+	}
+	return strings.Join(parts, "/")
+}
+
+// A family's half of the ruleset in our chains and the sets they use, from iptables-save and ipset save output.
+// iptables-save normalizes rules (hex marks, extra matches) so rules are matched on the flags we set. Rules in a
+// chain nothing jumps to aren't live. Counters are read from the forward chain if filter has them.
+func parseIPTablesSave(f *ipFamily, mangle, filter, ipsets string) *Ruleset {
+	r := newLiveRuleset()
+	jumps := map[string]bool{}
+	marks, forwards := []string{}, []string{}
+	counters := map[string]Counter{} // forward rule -> counter
+	for _, line := range strings.Split(mangle+"\n"+filter, "\n") {
+		var counter Counter
+		if match := iptablesCounterRegexp.FindStringSubmatch(line); match != nil {
+			counter.Packets, _ = strconv.ParseUint(match[1], 10, 64)
+			counter.Bytes, _ = strconv.ParseUint(match[2], 10, 64)
+			line = line[len(match[0]):]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		switch fields[1] {
+		case MarkChain:
+			marks = append(marks, line)
+		case ForwardChain:
+			forwards = append(forwards, line)
+			counters[line] = counter
+		case "PREROUTING", "FORWARD":
+			if flags := iptablesFlags(fields[2:]); len(flags) == 1 {
+				jumps[fields[1]+" "+flags["-j"]] = true
+			}
+		}
+	}
+	if jumps["PREROUTING "+MarkChain] {
+		for _, line := range marks {
+			flags := iptablesFlags(strings.Fields(line)[2:])
+			mark := flags["--set-xmark"]
+			if mark == "" {
+				mark = flags["--set-mark"]
+			}
+			mark = strings.Split(mark, "/")[0]
+			if flags["-j"] == "MARK" && flags["--physdev-in"] != "" && mark != "" {
+				r.Marks = append(r.Marks, Mark{Veth: flags["--physdev-in"], Mark: mark})
+			} else {
+				r.Unknown = append(r.Unknown, line)
+			}
+		}
+	}
+	sets := parseIPSetSave(ipsets)
+	groups := map[string]bool{}
+	if jumps["FORWARD "+ForwardChain] {
+		for _, line := range forwards {
+			flags := iptablesFlags(strings.Fields(line)[2:])
+			set := flags["--match-set"]
+			port, err := parsePort(flags["--dport"])
+			switch {
+			case flags["--ctstate"] == "RELATED,ESTABLISHED" && flags["-j"] == "ACCEPT":
+				// always installed
+			case flags["-j"] == "ACCEPT" && strings.HasPrefix(set, f.groupPrefix) && flags["-p"] != "" &&
+				err == nil && flags["--mark"] != "" && flags["-d"] == "":
+				group := strings.TrimPrefix(set, f.groupPrefix)
+				mark := strings.Split(flags["--mark"], "/")[0]
+				allow := Allow{Mark: mark, Protocol: flags["-p"], Group: group, Port: port}
+				r.Allows = append(r.Allows, allow)
+				r.count(allowCounter(allow), counters[line].Packets, counters[line].Bytes)
+				groups[group] = true
+			case flags["-j"] == "ACCEPT" && flags["--ctstate"] == "DNAT" && flags["-p"] != "" && err == nil &&
+				strings.HasPrefix(set, f.groupPrefix) && flags["-s"] == "":
+				group := strings.TrimPrefix(set, f.groupPrefix)
+				r.Ingress = append(r.Ingress, Ingress{Protocol: flags["-p"], Port: port, Group: group})
+				groups[group] = true
+			case flags["-j"] == "ACCEPT" && flags["--ctstate"] == "DNAT" && flags["-p"] != "" && err == nil &&
+				set == "" && flags["-s"] != "":
+				addr := strings.TrimSuffix(strings.TrimSuffix(flags["-s"], "/32"), "/128")
+				r.Ingress = append(r.Ingress, Ingress{Protocol: flags["-p"], Port: port, Addr: addr})
+			case flags["-j"] == "REJECT" && flags["--ctstate"] == "DNAT" && flags["-p"] != "" && err == nil &&
+				set == "" && flags["-s"] == "":
+				r.Guards = append(r.Guards, Guard{Protocol: flags["-p"], Port: port})
+			case flags["-j"] == "LOG" && set == f.denySet && flags["--limit"] != "" &&
+				strings.Trim(flags["--log-prefix"], "\"") == RejectLogPrefix:
+				r.LogRejects = iptablesLimit(flags["--limit"])
+			case flags["-j"] == "REJECT" && set == f.denySet && flags["-p"] == "" && flags["-d"] == "":
+				r.Denies = collapseAddrs(sets[f.denySet])
+				r.count(denyCounter, counters[line].Packets, counters[line].Bytes)
+			default:
+				r.Unknown = append(r.Unknown, line)
+			}
+		}
+	}
+	names := []string{}
+	for group, _ := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	for _, group := range names {
+		r.Groups = append(r.Groups, Group{Name: group, Addrs: collapseAddrs(sets[f.groupSet(group)])})
+	}
+	return r
+}
@@ -13,8 +13,13 @@ package netsec
 
 import (
 	"atlantis/supervisor/containers/serialize"
+	"atlantis/supervisor/events"
+	"atlantis/supervisor/rpc/types"
 	"errors"
+	"fmt"
 	"log"
+	"os"
+	"sort"
 	"sync"
 )
 
@@ -22,9 +27,15 @@ type NetworkSecurity struct {
 	sync.Mutex
 	Pretend    bool
 	SaveFile   string                        // where to save state
-	DeniedIPs  map[string]bool               // list of denied IPs. map for easy existence check
-	IPGroups   map[string][]string           // group name -> list of infrastructure IPs to blanket deny
+	DeniedIPs  map[string]bool               // list of denied IPs and CIDR blocks. map for easy existence check
+	IPGroups   map[string][]string           // group name -> infrastructure IPs, CIDR blocks and hostnames to blanket deny
+	Resolved   map[string][]string           // hostname -> IPs it resolved to
 	Containers map[string]*ContainerSecurity // container id -> ContainerSecurity
+	Migrated   bool                          // the rules older supervisors put in FORWARD and PREROUTING are gone
+	firewall   Firewall
+	throughput map[string]*throughput // container id -> last sample of its veth
+	counters   map[string]Counter     // the live counters at the last reading
+	carried    map[string]Counter     // what the rules counted before they were last reinstalled
 }
 
 func New(saveFile string, pretend bool) *NetworkSecurity {
@@ -34,7 +45,151 @@ func New(saveFile string, pretend bool) *NetworkSecurity {
 		SaveFile:   saveFile,
 		DeniedIPs:  map[string]bool{},
 		IPGroups:   map[string][]string{},
+		Resolved:   map[string][]string{},
 		Containers: map[string]*ContainerSecurity{},
+		firewall:   NewFirewall(pretend),
+		throughput: map[string]*throughput{},
+	}
+}
+
+// Load the saved state and reinstall its rules. pids are the current pids of the containers that are still
+// running. Their veths and marks are looked up again since they change when a container is restarted, and
+// bandwidth limits are shaped on them again. Security for containers that are gone is dropped. State saved by an
+// older supervisor has its rules migrated out of the shared chains. The returned NetworkSecurity is usable even if
+// there is an error.
+func Restore(saveFile string, pretend bool, pids map[string]int) (*NetworkSecurity, error) {
+	n := New(saveFile, pretend)
+	if err := serialize.RetrieveObject(saveFile, n); err != nil {
+		fresh := New(saveFile, pretend)
+		// no older supervisor ran here
+		fresh.Migrated = os.IsNotExist(err)
+		return fresh, err
+	}
+	// older supervisors denied these straight in FORWARD
+	legacyDenied := []string{}
+	for ip, _ := range n.DeniedIPs {
+		legacyDenied = append(legacyDenied, ip)
+	}
+	// these come from the current config, not the saved state
+	n.Pretend = pretend
+	n.SaveFile = saveFile
+	if n.IPGroups == nil {
+		n.IPGroups = map[string][]string{}
+	}
+	if n.Resolved == nil {
+		n.Resolved = map[string][]string{}
+	}
+	if n.Containers == nil {
+		n.Containers = map[string]*ContainerSecurity{}
+	}
+	n.Lock()
+	defer n.Unlock()
+	n.restoreIPGroups()
+	for id, contSec := range n.Containers {
+		pid, running := pids[id]
+		if !running {
+			log.Println("[netsec] -- restore: dropping security for missing container " + id)
+			delete(n.Containers, id)
+			continue
+		}
+		mark, veth, err := findVeth(pid)
+		if err != nil {
+			if pid != contSec.Pid || contSec.Veth == "" {
+				log.Printf("[netsec] -- restore: dropping security for %s, pid %d: %v", id, pid, err)
+				delete(n.Containers, id)
+				continue
+			}
+			// same process, so the saved veth and mark still hold
+			log.Printf("[netsec] -- restore: using saved veth for %s: %v", id, err)
+		} else {
+			contSec.Mark, contSec.Veth = mark, veth
+		}
+		contSec.Pid = pid
+		log.Println("[netsec] -- restore: " + contSec.String())
+		if err := shape(n.Pretend, contSec.Veth, contSec.Bandwidth); err != nil {
+			log.Printf("[netsec] -- restore: could not limit bandwidth of %s: %v", id, err)
+		}
+	}
+	if !n.Migrated {
+		if legacy, ok := n.firewall.(legacyRemover); ok {
+			legacy.RemoveLegacyRules(n.legacyRules(legacyDenied))
+		}
+		n.Migrated = true
+	}
+	n.updateDeniedIPs()
+	err := n.apply()
+	n.save()
+	return n, err
+}
+
+// The rules supervisors from before the dedicated chains inserted straight into FORWARD and mangle PREROUTING, as
+// the iptables arguments deleting them. They are derived from the state those supervisors saved, with the marks
+// and veths looked up again, so rules other tools installed are left alone. Callers must hold the lock.
+func (n *NetworkSecurity) legacyRules(denied []string) [][]string {
+	rules := [][]string{}
+	ids := []string{}
+	for id, _ := range n.Containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		contSec := n.Containers[id]
+		if contSec.Veth == "" || contSec.Mark == "" {
+			continue
+		}
+		rules = append(rules, []string{"-t", "mangle", "-D", "PREROUTING", "-m", "physdev", "--physdev-in",
+			contSec.Veth, "-j", "MARK", "--set-mark", contSec.Mark})
+		groups := []string{}
+		for group, _ := range contSec.SecurityGroups {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			for _, port := range contSec.SecurityGroups[group] {
+				for _, ip := range n.IPGroups[group] {
+					rules = append(rules, []string{"-D", "FORWARD", "-d", ip, "-p", "tcp", "--dport",
+						fmt.Sprintf("%d", port), "-m", "mark", "--mark", contSec.Mark, "-j", "ACCEPT"})
+				}
+			}
+		}
+	}
+	sort.Strings(denied)
+	for _, ip := range denied {
+		rules = append(rules, []string{"-D", "FORWARD", "-d", ip, "-j", "REJECT"})
+	}
+	// they kept one of these in front of the rejects
+	if len(denied) > 0 {
+		rules = append(rules, []string{"-D", "FORWARD", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j",
+			"ACCEPT"})
+	}
+	return rules
+}
+
+// Saved groups may predate the checks on new ones. Entries are normalized like they are on update and invalid ones
+// are dropped. Groups with invalid names are dropped along with their use by containers, since every apply would
+// fail on them. Callers must hold the lock.
+func (n *NetworkSecurity) restoreIPGroups() {
+	for name, entries := range n.IPGroups {
+		if !ValidIPGroupName(name) {
+			log.Println("[netsec] -- restore: dropping IP group with invalid name " + name)
+			events.Record("netsec-invalid-group", "", "dropped saved IP group with invalid name %s", name)
+			delete(n.IPGroups, name)
+			for _, contSec := range n.Containers {
+				contSec.dropIPGroup(name)
+			}
+			continue
+		}
+		valid := []string{}
+		for _, entry := range entries {
+			if _, err := normalizeEntry(entry); err != nil {
+				log.Printf("[netsec] -- restore: dropping %q from IP group %s: %v", entry, name, err)
+				events.Record("netsec-invalid-group", "", "dropped %q from saved IP group %s: %v", entry, name, err)
+				continue
+			}
+			valid = append(valid, entry)
+		}
+		// every entry left is valid
+		n.IPGroups[name], _ = NormalizeIPGroup(valid)
 	}
 }
 
@@ -46,129 +201,283 @@ func (n *NetworkSecurity) save() {
 	})
 }
 
-func (n *NetworkSecurity) UpdateIPGroup(name string, ips []string) error {
-	n.Lock()
-	defer n.Unlock()
+// Install the ruleset for the current state, replacing whatever netsec installed before in one step
+func (n *NetworkSecurity) apply() error {
+	live := n.readCounters()
+	ruleset := n.ruleset()
+	if err := n.firewall.Apply(ruleset); err != nil {
+		log.Println("[netsec] -- apply error: " + err.Error())
+		return err
+	}
+	n.carryCounters(live, ruleset)
+	return nil
+}
 
-	if err := n.delConnTrackRule(); err != nil {
-		log.Println("[netsec] error deleting track rule: " + err.Error())
-		// continue, probably we never added it in the first place. **crosses fingers**
+// The addresses of a group, with its hostnames replaced by what they last resolved to
+func (n *NetworkSecurity) groupAddrs(name string) []string {
+	addrs := []string{}
+	for _, entry := range n.IPGroups[name] {
+		if isHostname(entry) {
+			addrs = append(addrs, n.Resolved[entry]...)
+		} else {
+			addrs = append(addrs, entry)
+		}
 	}
+	return addrs
+}
 
-	current, exists := n.IPGroups[name]
-	toRemove := []string{}
-	if exists {
-		// figure out what is being removed
-		incomingMap := map[string]bool{}
-		for _, ip := range ips {
-			incomingMap[ip] = true
-		}
-		for _, ip := range current {
-			if !incomingMap[ip] {
-				toRemove = append(toRemove, ip)
+// every address in any group is blanket denied
+func (n *NetworkSecurity) updateDeniedIPs() {
+	n.DeniedIPs = map[string]bool{}
+	for name, _ := range n.IPGroups {
+		for _, addr := range n.groupAddrs(name) {
+			n.DeniedIPs[addr] = true
+		}
+	}
+}
+
+// The hostnames in every group
+func (n *NetworkSecurity) hostnames() map[string]bool {
+	hosts := map[string]bool{}
+	for _, entries := range n.IPGroups {
+		for _, entry := range entries {
+			if isHostname(entry) {
+				hosts[entry] = true
 			}
 		}
 	}
-	// add blanket deny rule for new IPs
-	newIPs := []string{}
-	for _, ip := range ips {
-		if n.DeniedIPs[ip] {
-			// already exists
-			continue
+	return hosts
+}
+
+// Set the IPs, CIDR blocks and hostnames of a group. New hostnames are resolved right away and must resolve.
+func (n *NetworkSecurity) UpdateIPGroup(name string, entries []string) error {
+	_, err := n.updateIPGroup(name, entries, false)
+	return err
+}
+
+// What UpdateIPGroup would change, without installing anything. New hostnames are still resolved.
+func (n *NetworkSecurity) DryRunUpdateIPGroup(name string, entries []string) (*types.IPGroupDiff, error) {
+	return n.updateIPGroup(name, entries, true)
+}
+
+func (n *NetworkSecurity) updateIPGroup(name string, entries []string, dryRun bool) (*types.IPGroupDiff, error) {
+	if !ValidIPGroupName(name) {
+		return nil, errors.New("Invalid IP group name " + name + ". Use up to 22 letters, digits, '.', '_' or '-'.")
+	}
+	entries, err := NormalizeIPGroup(entries)
+	if err != nil {
+		return nil, err
+	}
+	// resolve outside the lock. lookups can be slow.
+	n.Lock()
+	hosts := n.hostnames()
+	n.Unlock()
+	resolved := map[string][]string{}
+	for _, entry := range entries {
+		if isHostname(entry) && !hosts[entry] {
+			if resolved[entry], err = resolve(entry); err != nil {
+				return nil, errors.New("Could not resolve " + entry + ": " + err.Error())
+			}
 		}
-		if err := n.rejectIP(ip); err != nil {
-			return err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	before, beforeAddrs := n.ruleset(), n.groupAddrs(name)
+	current, exists := n.IPGroups[name]
+	currentResolved := n.Resolved
+	// leave the state matching what is installed
+	restore := func() {
+		if exists {
+			n.IPGroups[name] = current
+		} else {
+			delete(n.IPGroups, name)
 		}
-		n.DeniedIPs[ip] = true
-		newIPs = append(newIPs, ip)
+		n.Resolved = currentResolved
+		n.updateDeniedIPs()
 	}
-	// remove blanket deny rule for removed IPs
-	for _, ip := range toRemove {
-		if !n.DeniedIPs[ip] {
-			// already removed
-			continue
+	n.IPGroups[name] = entries
+	n.updateResolved(resolved)
+	n.updateDeniedIPs()
+	diff := n.ipGroupDiff(name, before, beforeAddrs)
+	if dryRun {
+		restore()
+		return diff, nil
+	}
+	if err := n.apply(); err != nil {
+		restore()
+		return nil, err
+	}
+	n.save()
+	return diff, nil
+}
+
+func (n *NetworkSecurity) DeleteIPGroup(name string) error {
+	_, err := n.deleteIPGroup(name, false)
+	return err
+}
+
+// What DeleteIPGroup would change, without installing anything
+func (n *NetworkSecurity) DryRunDeleteIPGroup(name string) (*types.IPGroupDiff, error) {
+	return n.deleteIPGroup(name, true)
+}
+
+func (n *NetworkSecurity) deleteIPGroup(name string, dryRun bool) (*types.IPGroupDiff, error) {
+	n.Lock()
+	defer n.Unlock()
+	before, beforeAddrs := n.ruleset(), n.groupAddrs(name)
+	current, exists := n.IPGroups[name]
+	if !exists {
+		return n.ipGroupDiff(name, before, beforeAddrs), nil
+	}
+	currentResolved := n.Resolved
+	restore := func() {
+		n.IPGroups[name] = current
+		n.Resolved = currentResolved
+		n.updateDeniedIPs()
+	}
+	delete(n.IPGroups, name)
+	n.updateResolved(nil)
+	n.updateDeniedIPs()
+	diff := n.ipGroupDiff(name, before, beforeAddrs)
+	if dryRun {
+		restore()
+		return diff, nil
+	}
+	if err := n.apply(); err != nil {
+		restore()
+		return nil, err
+	}
+	n.save()
+	return diff, nil
+}
+
+func (n *NetworkSecurity) IPGroupExists(name string) bool {
+	n.Lock()
+	defer n.Unlock()
+	_, exists := n.IPGroups[name]
+	return exists
+}
+
+// Make sure every group exists before any rules are touched
+func (n *NetworkSecurity) checkGroups(groupMaps ...map[string][]uint16) error {
+	for _, groups := range groupMaps {
+		for group, _ := range groups {
+			if _, exists := n.IPGroups[group]; !exists {
+				return errors.New("IP Group " + group + " does not exist")
+			}
 		}
-		n.allowIP(ip)
-		delete(n.DeniedIPs, ip)
 	}
-	// add/remove forward rules for new IPs for everything that uses the name
-	for _, contSec := range n.Containers {
-		ports, exists := contSec.SecurityGroups[name]
-		if !exists {
-			// this container does not use this ip group
+	return nil
+}
+
+// Check that every ingress source is an address or an existing group. Addresses are normalized. Callers must
+// hold the lock.
+func (n *NetworkSecurity) normalizeIngress(ingress []*types.PortIngress) ([]*types.PortIngress, error) {
+	normalized := []*types.PortIngress{}
+	for _, in := range ingress {
+		if len(in.Sources) == 0 {
 			continue
 		}
-		for _, port := range ports {
-			// add new ips
-			for _, ip := range newIPs {
-				contSec.allowPort(ip, port)
+		norm := &types.PortIngress{Protocol: in.Protocol, Port: in.Port, Sources: []string{}}
+		for _, source := range in.Sources {
+			if parseAddr(source) == nil {
+				if _, exists := n.IPGroups[source]; !exists {
+					return nil, errors.New("IP Group " + source + " does not exist")
+				}
+				norm.Sources = append(norm.Sources, source)
+				continue
 			}
-			// remove old ips
-			for _, ip := range toRemove {
-				contSec.rejectPort(ip, port)
+			addr, err := normalizeEntry(source)
+			if err != nil {
+				return nil, err
 			}
+			norm.Sources = append(norm.Sources, addr)
 		}
+		normalized = append(normalized, norm)
 	}
-	// update ipGroups
-	n.IPGroups[name] = ips
-	n.save()
+	return normalized, nil
+}
 
-	return n.addConnTrackRule()
+// Check ingress before a container is deployed with it
+func (n *NetworkSecurity) ValidateIngress(ingress []*types.PortIngress) error {
+	n.Lock()
+	defer n.Unlock()
+	_, err := n.normalizeIngress(ingress)
+	return err
 }
 
-func (n *NetworkSecurity) DeleteIPGroup(name string) error {
-	if err := n.UpdateIPGroup(name, []string{}); err != nil {
-		return err
-	}
+// Replace the security groups of a container that already has network security set up. The new rules replace
+// the old ones atomically so connections to unchanged deps are never interrupted.
+func (n *NetworkSecurity) UpdateContainerSecurity(id string, sgs, udpSGs map[string][]uint16) error {
 	n.Lock()
 	defer n.Unlock()
-	delete(n.IPGroups, name)
+	log.Printf("[netsec] update container security: "+id+", sgs: %#v, udp sgs: %#v", sgs, udpSGs)
+	if err := n.checkGroups(sgs, udpSGs); err != nil {
+		log.Println("[netsec] -- not updating " + id + ": " + err.Error())
+		return err
+	}
+	contSec, exists := n.Containers[id]
+	if !exists {
+		// nothing installed to update
+		log.Println("[netsec] -- not updating, none existed for: " + id)
+		return nil
+	}
+	oldSGs, oldUDPSGs := contSec.SecurityGroups, contSec.UDPSecurityGroups
+	contSec.SecurityGroups = sgs
+	contSec.UDPSecurityGroups = udpSGs
+	if err := n.apply(); err != nil {
+		contSec.SecurityGroups = oldSGs
+		contSec.UDPSecurityGroups = oldUDPSGs
+		return err
+	}
 	n.save()
+	log.Println("[netsec] -- updated " + id)
 	return nil
 }
 
-func (n *NetworkSecurity) AddContainerSecurity(id string, pid int, sgs map[string][]uint16) error {
+// Set up a container's egress to its security groups, who may reach its published ports and its bandwidth limits
+func (n *NetworkSecurity) AddContainerSecurity(id string, pid int, sgs, udpSGs map[string][]uint16,
+	ingress []*types.PortIngress, bandwidth *types.Bandwidth) error {
 	n.Lock()
 	defer n.Unlock()
-	log.Printf("[netsec] add container security: "+id+", pid: %d, sgs: %#v", pid, sgs)
+	log.Printf("[netsec] add container security: "+id+", pid: %d, sgs: %#v, udp sgs: %#v", pid, sgs, udpSGs)
 	if _, exists := n.Containers[id]; exists {
 		// we already have security set up for this id. don't do it and return an error.
 		log.Println("[netsec] -- not adding, already existed for: " + id)
 		return errors.New("Container " + id + " already has Network Security set up.")
 	}
 	// make sure all groups exist
-	for group, _ := range sgs {
-		_, exists := n.IPGroups[group]
-		if !exists {
-			log.Println("[netsec] -- not adding group " + group + " doesn't exist for: " + id)
-			return errors.New("IP Group " + group + " does not exist")
-		}
+	if err := n.checkGroups(sgs, udpSGs); err != nil {
+		log.Println("[netsec] -- not adding " + id + ": " + err.Error())
+		return err
+	}
+	ingress, err := n.normalizeIngress(ingress)
+	if err != nil {
+		log.Println("[netsec] -- not adding " + id + ": " + err.Error())
+		return err
 	}
 
 	// fetch network info
-	contSec, err := NewContainerSecurity(id, pid, sgs, n.Pretend)
+	contSec, err := NewContainerSecurity(id, pid, sgs, udpSGs, ingress, bandwidth)
 	if err != nil {
 		log.Println("[netsec] -- guano error: " + err.Error())
 		return err
 	}
 	log.Println("[netsec] --> contSec: " + contSec.String())
-	contSec.addMark()
-
-	// add forward rules
-	for group, ports := range sgs {
-		for _, port := range ports {
-			ips := n.IPGroups[group]
-			for _, ip := range ips {
-				if err := contSec.allowPort(ip, port); err != nil {
-					defer n.RemoveContainerSecurity(id) // cleanup created references when we error out
-					log.Println("[netsec] -- allow port error: " + err.Error())
-					return err
-				}
-			}
-		}
-	}
 	n.Containers[id] = contSec
+	if err := n.apply(); err != nil {
+		delete(n.Containers, id)
+		return err
+	}
 	n.save()
+	// shaped only once the rules are in, so a container that failed to add has no qdiscs left behind. a container
+	// that can't be limited still gets its deps.
+	if err := shape(n.Pretend, contSec.Veth, bandwidth); err != nil {
+		log.Printf("[netsec] -- could not limit bandwidth of %s: %v", id, err)
+		events.Record("netsec-bandwidth", id, "could not limit bandwidth: %v", err)
+		unshape(n.Pretend, contSec.Veth)
+	}
 	log.Println("[netsec] -- added " + id)
 	return nil
 }
@@ -185,50 +494,10 @@ func (n *NetworkSecurity) RemoveContainerSecurity(id string) error {
 	}
 
 	log.Println("[netsec] --> contSec: " + contSec.String())
-	contSec.delMark()
-	// remove forward rules
-	for group, ports := range contSec.SecurityGroups {
-		for _, port := range ports {
-			ips := n.IPGroups[group]
-			for _, ip := range ips {
-				contSec.rejectPort(ip, port)
-			}
-		}
-	}
 	delete(n.Containers, id)
+	// the container is going away either way. its rules go with the next successful apply.
+	err := n.apply()
 	n.save()
 	log.Println("[netsec] -- removed " + id)
-	return nil
-}
-
-func (n *NetworkSecurity) delConnTrackRule() error {
-	defer echoIPTables(n.Pretend)
-	_, err := n.executeCommand("iptables", "-D", "FORWARD", "-m", "conntrack", "--ctstate",
-		"RELATED,ESTABLISHED", "-j", "ACCEPT")
-	return err
-}
-
-func (n *NetworkSecurity) addConnTrackRule() error {
-	defer echoIPTables(n.Pretend)
-	_, err := n.executeCommand("iptables", "-I", "FORWARD", "-m", "conntrack", "--ctstate",
-		"RELATED,ESTABLISHED", "-j", "ACCEPT")
 	return err
 }
-
-func (n *NetworkSecurity) forwardRule(action, ip string) error {
-	defer echoIPTables(n.Pretend)
-	_, err := n.executeCommand("iptables", action, "FORWARD", "-d", ip, "-j", "REJECT")
-	return err
-}
-
-func (n *NetworkSecurity) rejectIP(ip string) error {
-	return n.forwardRule("-I", ip)
-}
-
-func (n *NetworkSecurity) allowIP(ip string) error {
-	return n.forwardRule("-D", ip)
-}
-
-func (n *NetworkSecurity) executeCommand(cmd string, args ...string) (string, error) {
-	return executeCommand(n.Pretend, cmd, args...)
-}
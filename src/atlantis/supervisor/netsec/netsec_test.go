@@ -0,0 +1,1177 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package netsec
+
+import (
+	"atlantis/supervisor/containers/serialize"
+	"atlantis/supervisor/events"
+	"atlantis/supervisor/metrics"
+	"atlantis/supervisor/rpc/types"
+	"errors"
+	"fmt"
+	"github.com/adjust/gocheck"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestNetsec(t *testing.T) { gocheck.TestingT(t) }
+
+type NetsecSuite struct {
+	saveDir string
+}
+
+var _ = gocheck.Suite(&NetsecSuite{})
+
+func (s *NetsecSuite) SetUpTest(c *gocheck.C) {
+	var err error
+	s.saveDir, err = ioutil.TempDir("", "netsec")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(serialize.Init(s.saveDir), gocheck.IsNil)
+	findVeth = func(pid int) (string, string, error) {
+		return fmt.Sprintf("%d", pid), fmt.Sprintf("veth%d", pid), nil
+	}
+	drift = &types.NetsecStats{Healthy: true}
+	RepairDrift = true
+}
+
+func (s *NetsecSuite) TearDownTest(c *gocheck.C) {
+	findVeth = guano
+	os.RemoveAll(s.saveDir)
+}
+
+func newTestNetworkSecurity() (*NetworkSecurity, *Recorder) {
+	recorder := NewRecorder()
+	n := New("netsec", true)
+	n.firewall = recorder
+	return n, recorder
+}
+
+func (s *NetsecSuite) TestInitFirewall(c *gocheck.C) {
+	defer InitFirewall(DefaultFirewall)
+	c.Assert(InitFirewall("pf"), gocheck.ErrorMatches, "Unknown firewall backend: pf")
+	c.Assert(InitFirewall("nftables"), gocheck.IsNil)
+	_, isNFT := New("netsec", true).firewall.(*NFTables)
+	c.Assert(isNFT, gocheck.Equals, true)
+	c.Assert(InitFirewall("iptables"), gocheck.IsNil)
+	_, isIPT := New("netsec", true).firewall.(*IPTables)
+	c.Assert(isIPT, gocheck.Equals, true)
+}
+
+func (s *NetsecSuite) TestRuleset(c *gocheck.C) {
+	n, recorder := newTestNetworkSecurity()
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.1", "10.0.0.2"}), gocheck.IsNil)
+	c.Assert(n.UpdateIPGroup("dns", []string{"10.0.1.1"}), gocheck.IsNil)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{
+		"deny 10.0.0.1",
+		"deny 10.0.0.2",
+		"deny 10.0.1.1",
+	})
+
+	c.Assert(n.AddContainerSecurity("c1", 1, map[string][]uint16{"db": []uint16{5432}},
+		map[string][]uint16{"nope": []uint16{53}}, nil, nil), gocheck.ErrorMatches, "IP Group nope does not exist")
+	c.Assert(n.AddContainerSecurity("c1", 1, map[string][]uint16{"db": []uint16{5432}},
+		map[string][]uint16{"dns": []uint16{53}}, nil, nil), gocheck.IsNil)
+	c.Assert(n.AddContainerSecurity("c2", 2, map[string][]uint16{"db": []uint16{5432}}, nil, nil, nil), gocheck.IsNil)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{
+		"mark veth1 1",
+		"mark veth2 2",
+		"group db 10.0.0.1",
+		"group db 10.0.0.2",
+		"group dns 10.0.1.1",
+		"allow 1 tcp db:5432",
+		"allow 1 udp dns:53",
+		"allow 2 tcp db:5432",
+		"deny 10.0.0.1",
+		"deny 10.0.0.2",
+		"deny 10.0.1.1",
+	})
+
+	// group changes follow through to every container using the group without adding rules
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.2", "10.0.0.3"}), gocheck.IsNil)
+	c.Assert(n.UpdateContainerSecurity("c1", map[string][]uint16{"db": []uint16{5433}}, nil), gocheck.IsNil)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{
+		"mark veth1 1",
+		"mark veth2 2",
+		"group db 10.0.0.2",
+		"group db 10.0.0.3",
+		"allow 1 tcp db:5433",
+		"allow 2 tcp db:5432",
+		"deny 10.0.0.2",
+		"deny 10.0.0.3",
+		"deny 10.0.1.1",
+	})
+
+	c.Assert(n.RemoveContainerSecurity("c1"), gocheck.IsNil)
+	c.Assert(n.RemoveContainerSecurity("c2"), gocheck.IsNil)
+	c.Assert(n.DeleteIPGroup("db"), gocheck.IsNil)
+	c.Assert(n.DeleteIPGroup("dns"), gocheck.IsNil)
+	c.Assert(recorder.Rules(), gocheck.HasLen, 0)
+}
+
+func (s *NetsecSuite) TestNormalizeIPGroup(c *gocheck.C) {
+	group, err := NormalizeIPGroup([]string{" 10.0.0.1", "10.1.2.3/16", "10.0.0.9/32", "DB.Example.com.",
+		"10.0.0.1", "db.example.com"})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(group, gocheck.DeepEquals, []string{"10.0.0.1", "10.0.0.9", "10.1.0.0/16", "db.example.com"})
+	group, err = NormalizeIPGroup([]string{"FD00::1", "fd00:0:0:0::1/64", "2001:db8::5/128", "::ffff:10.0.0.1"})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(group, gocheck.DeepEquals, []string{"10.0.0.1", "2001:db8::5", "fd00::/64", "fd00::1"})
+	_, err = NormalizeIPGroup([]string{"10.0.0.1/33", "0.0.0.0/0", "::/0", "10.0.0", "-bad-.com", "ok.com"})
+	c.Assert(err, gocheck.ErrorMatches, "Invalid IP group: invalid CIDR block 10.0.0.1/33; 0.0.0.0/0 would match "+
+		"every address; ::/0 would match every address; invalid IP, CIDR block or hostname 10.0.0; invalid IP, CIDR "+
+		"block or hostname -bad-.com")
+	c.Assert(ValidIPGroupName("db-primary_1.a"), gocheck.Equals, true)
+	c.Assert(ValidIPGroupName("has space"), gocheck.Equals, false)
+	c.Assert(ValidIPGroupName("a-name-that-is-far-too-long"), gocheck.Equals, false)
+	c.Assert(collapseAddrs([]string{"10.0.1.5", "10.0.0.0/16", "10.0.0.7", "9.0.0.1", "10.1.0.0/24"}),
+		gocheck.DeepEquals, []string{"9.0.0.1", "10.0.0.0/16", "10.1.0.0/24"})
+	c.Assert(collapseAddrs([]string{"fd00::1", "10.0.0.1", "fd00::/64", "2001:db8::1"}), gocheck.DeepEquals,
+		[]string{"10.0.0.1", "2001:db8::1", "fd00::/64"})
+}
+
+func (s *NetsecSuite) TestCIDRsAndHostnames(c *gocheck.C) {
+	lookups := map[string][]string{"db.example.com": []string{"10.0.0.5", "10.9.0.1", "fd00::5"}}
+	lookupHost = func(host string) ([]string, error) {
+		if addrs, exists := lookups[host]; exists {
+			return addrs, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	defer func() { lookupHost = net.LookupHost }()
+
+	n, recorder := newTestNetworkSecurity()
+	c.Assert(n.UpdateIPGroup("bad name", []string{"10.0.0.1"}), gocheck.ErrorMatches, "Invalid IP group name .*")
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.1/33"}), gocheck.ErrorMatches, "Invalid IP group: .*")
+	c.Assert(n.UpdateIPGroup("db", []string{"nope.example.com"}), gocheck.ErrorMatches,
+		"Could not resolve nope.example.com: no such host")
+	c.Assert(n.IPGroups, gocheck.HasLen, 0)
+
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.0/24", "db.example.com"}), gocheck.IsNil)
+	c.Assert(n.UpdateIPGroup("cache", []string{"10.0.0.7"}), gocheck.IsNil)
+	c.Assert(n.AddContainerSecurity("c1", 1, map[string][]uint16{"db": []uint16{5432}}, nil, nil, nil), gocheck.IsNil)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{
+		"mark veth1 1",
+		"group db 10.0.0.0/24",
+		"group db 10.9.0.1",
+		"group db fd00::5",
+		"allow 1 tcp db:5432",
+		"deny 10.0.0.0/24",
+		"deny 10.9.0.1",
+		"deny fd00::5",
+	})
+
+	// changed lookups are diffed into the rules. failed ones keep what they last resolved to.
+	c.Assert(n.ResolveHostnames(), gocheck.IsNil)
+	c.Assert(recorder.Applies, gocheck.Equals, 3)
+	lookups["db.example.com"] = []string{"10.9.0.2"}
+	c.Assert(n.ResolveHostnames(), gocheck.IsNil)
+	c.Assert(n.Resolved, gocheck.DeepEquals, map[string][]string{"db.example.com": []string{"10.9.0.2"}})
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{
+		"mark veth1 1",
+		"group db 10.0.0.0/24",
+		"group db 10.9.0.2",
+		"allow 1 tcp db:5432",
+		"deny 10.0.0.0/24",
+		"deny 10.9.0.2",
+	})
+	delete(lookups, "db.example.com")
+	c.Assert(n.ResolveHostnames(), gocheck.IsNil)
+	c.Assert(n.Resolved, gocheck.DeepEquals, map[string][]string{"db.example.com": []string{"10.9.0.2"}})
+
+	// hostnames no group uses are forgotten
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.0/24"}), gocheck.IsNil)
+	c.Assert(n.Resolved, gocheck.HasLen, 0)
+}
+
+func (s *NetsecSuite) TestApplyFailure(c *gocheck.C) {
+	n, recorder := newTestNetworkSecurity()
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.1"}), gocheck.IsNil)
+	recorder.Err = errors.New("iptables-restore: line 3 failed")
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.2"}), gocheck.ErrorMatches, "iptables-restore: .*")
+	c.Assert(n.UpdateIPGroup("cache", []string{"10.0.0.3"}), gocheck.ErrorMatches, "iptables-restore: .*")
+	c.Assert(n.AddContainerSecurity("c1", 1, map[string][]uint16{"db": []uint16{5432}}, nil, nil, nil), gocheck.NotNil)
+	c.Assert(n.IPGroups, gocheck.DeepEquals, map[string][]string{"db": []string{"10.0.0.1"}})
+	c.Assert(n.DeniedIPs, gocheck.DeepEquals, map[string]bool{"10.0.0.1": true})
+	c.Assert(n.Containers, gocheck.HasLen, 0)
+	c.Assert(recorder.Applies, gocheck.Equals, 1)
+}
+
+func testRuleset() *Ruleset {
+	return &Ruleset{
+		Marks:  []Mark{Mark{Veth: "veth1", Mark: "1"}},
+		Groups: []Group{Group{Name: "db", Addrs: []string{"10.0.0.1", "10.1.0.0/16", "fd00::/64"}}},
+		Allows: []Allow{Allow{Mark: "1", Protocol: "tcp", Group: "db", Port: 5432}},
+		Ingress: []Ingress{
+			Ingress{Protocol: "tcp", Port: 61000, Group: "db"},
+			Ingress{Protocol: "tcp", Port: 61000, Addr: "10.9.0.0/24"},
+			Ingress{Protocol: "tcp", Port: 61000, Addr: "2001:db8::1"},
+		},
+		Guards: []Guard{Guard{Protocol: "tcp", Port: 61000}},
+		Denies: []string{"10.0.0.1", "10.1.0.0/16", "fd00::/64"},
+	}
+}
+
+func (s *NetsecSuite) TestIPTablesRestoreInput(c *gocheck.C) {
+	c.Assert(ipsetRestoreInput(testRuleset(), ipFamilies), gocheck.Equals, `create atlantis-db hash:net family inet -exist
+create atlantis_db hash:net family inet -exist
+flush atlantis_db
+add atlantis_db 10.0.0.1
+add atlantis_db 10.1.0.0/16
+swap atlantis_db atlantis-db
+destroy atlantis_db
+create atlantis hash:net family inet -exist
+create atlantis_ hash:net family inet -exist
+flush atlantis_
+add atlantis_ 10.0.0.1
+add atlantis_ 10.1.0.0/16
+swap atlantis_ atlantis
+destroy atlantis_
+create atl6-db hash:net family inet6 -exist
+create atl6_db hash:net family inet6 -exist
+flush atl6_db
+add atl6_db fd00::/64
+swap atl6_db atl6-db
+destroy atl6_db
+create atlantis6 hash:net family inet6 -exist
+create atl6_ hash:net family inet6 -exist
+flush atl6_
+add atl6_ fd00::/64
+swap atl6_ atlantis6
+destroy atl6_
+`)
+	c.Assert(iptablesRestoreInput(testRuleset(), ipv4), gocheck.Equals, `*mangle
+:ATLANTIS-MARK - [0:0]
+-A ATLANTIS-MARK -m physdev --physdev-in veth1 -j MARK --set-mark 1
+COMMIT
+*filter
+:ATLANTIS-FORWARD - [0:0]
+-A ATLANTIS-FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A ATLANTIS-FORWARD -p tcp -m tcp --dport 5432 -m set --match-set atlantis-db dst -m mark --mark 1 -j ACCEPT
+-A ATLANTIS-FORWARD -p tcp -m tcp --dport 61000 -m conntrack --ctstate DNAT -m set --match-set atlantis-db src -j ACCEPT
+-A ATLANTIS-FORWARD -s 10.9.0.0/24 -p tcp -m tcp --dport 61000 -m conntrack --ctstate DNAT -j ACCEPT
+-A ATLANTIS-FORWARD -p tcp -m tcp --dport 61000 -m conntrack --ctstate DNAT -j REJECT
+-A ATLANTIS-FORWARD -m set --match-set atlantis dst -j REJECT
+COMMIT
+`)
+	c.Assert(iptablesRestoreInput(testRuleset(), ipv6), gocheck.Equals, `*mangle
+:ATLANTIS-MARK - [0:0]
+-A ATLANTIS-MARK -m physdev --physdev-in veth1 -j MARK --set-mark 1
+COMMIT
+*filter
+:ATLANTIS-FORWARD - [0:0]
+-A ATLANTIS-FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A ATLANTIS-FORWARD -p tcp -m tcp --dport 5432 -m set --match-set atl6-db dst -m mark --mark 1 -j ACCEPT
+-A ATLANTIS-FORWARD -p tcp -m tcp --dport 61000 -m conntrack --ctstate DNAT -m set --match-set atl6-db src -j ACCEPT
+-A ATLANTIS-FORWARD -s 2001:db8::1 -p tcp -m tcp --dport 61000 -m conntrack --ctstate DNAT -j ACCEPT
+-A ATLANTIS-FORWARD -p tcp -m tcp --dport 61000 -m conntrack --ctstate DNAT -j REJECT
+-A ATLANTIS-FORWARD -m set --match-set atlantis6 dst -j REJECT
+COMMIT
+`)
+}
+
+func (s *NetsecSuite) TestIPv4Only(c *gocheck.C) {
+	oldDetectIPv6 := detectIPv6
+	defer func() {
+		detectIPv6, IPv6, detectIPv6Once = oldDetectIPv6, true, sync.Once{}
+	}()
+	detectIPv6 = func() bool { return false }
+	detectIPv6Once = sync.Once{}
+	c.Assert(NewIPTables(true).(*IPTables).families(), gocheck.HasLen, 2)
+	c.Assert(IPv6, gocheck.Equals, true)
+	c.Assert(NewIPTables(false).(*IPTables).families(), gocheck.DeepEquals, []*ipFamily{ipv4})
+	c.Assert(IPv6, gocheck.Equals, false)
+	c.Assert(Status().IPv6, gocheck.Equals, false)
+	c.Assert(ipsetRestoreInput(testRuleset(), []*ipFamily{ipv4}), gocheck.Not(gocheck.Matches), "(?s).*atl6.*")
+
+	// IPv6 addresses are left out of the rules instead of failing every apply
+	n, recorder := newTestNetworkSecurity()
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.1", "fd00::1"}), gocheck.IsNil)
+	c.Assert(n.AddContainerSecurity("c1", 1, map[string][]uint16{"db": []uint16{5432}}, nil,
+		[]*types.PortIngress{&types.PortIngress{Protocol: "tcp", Port: 61000, Sources: []string{"10.9.0.1",
+			"2001:db8::1"}}}, nil), gocheck.IsNil)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{
+		"mark veth1 1",
+		"group db 10.0.0.1",
+		"allow 1 tcp db:5432",
+		"ingress tcp 61000 from 10.9.0.1",
+		"guard tcp 61000",
+		"deny 10.0.0.1",
+	})
+	group, err := n.GetIPGroup("db")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(group.IPv6, gocheck.DeepEquals, []string{"fd00::1"})
+	c.Assert(group.Installed, gocheck.Equals, true)
+}
+
+func (s *NetsecSuite) TestNFTInput(c *gocheck.C) {
+	c.Assert(nftInput(testRuleset()), gocheck.Equals, `table bridge atlantis
+delete table bridge atlantis
+table bridge atlantis {
+	map marks {
+		type ifname : mark
+		elements = { "veth1" : 1 }
+	}
+	chain prerouting {
+		type filter hook prerouting priority -200;
+		meta mark set iifname map @marks
+	}
+}
+table ip atlantis
+delete table ip atlantis
+table inet atlantis
+delete table inet atlantis
+table inet atlantis {
+	set group_db {
+		type ipv4_addr
+		flags interval
+		elements = { 10.0.0.1, 10.1.0.0/16 }
+	}
+	set group6_db {
+		type ipv6_addr
+		flags interval
+		elements = { fd00::/64 }
+	}
+	set denies {
+		type ipv4_addr
+		flags interval
+		elements = { 10.0.0.1, 10.1.0.0/16 }
+	}
+	set denies6 {
+		type ipv6_addr
+		flags interval
+		elements = { fd00::/64 }
+	}
+	chain forward {
+		type filter hook forward priority 0;
+		ct state established,related accept
+		meta mark 1 ip daddr @group_db tcp dport 5432 counter accept
+		meta mark 1 ip6 daddr @group6_db tcp dport 5432 counter accept
+		ct status dnat ip saddr @group_db tcp dport 61000 accept
+		ct status dnat ip6 saddr @group6_db tcp dport 61000 accept
+		ct status dnat ip saddr 10.9.0.0/24 tcp dport 61000 accept
+		ct status dnat ip6 saddr 2001:db8::1 tcp dport 61000 accept
+		ct status dnat tcp dport 61000 reject
+		ip daddr @denies counter reject
+		ip6 daddr @denies6 counter reject
+	}
+}
+`)
+	// rejects are logged right before they happen
+	r := testRuleset()
+	r.LogRejects = "10/minute"
+	c.Assert(strings.Contains(nftInput(r), `
+		ip daddr @denies limit rate 10/minute log prefix "atlantis-reject:"
+		ip6 daddr @denies6 limit rate 10/minute log prefix "atlantis-reject:"
+		ip daddr @denies counter reject
+`), gocheck.Equals, true)
+	c.Assert(strings.Contains(iptablesRestoreInput(r, ipv6), `
+-A ATLANTIS-FORWARD -m set --match-set atlantis6 dst -m limit --limit 10/minute -j LOG --log-prefix atlantis-reject:
+-A ATLANTIS-FORWARD -m set --match-set atlantis6 dst -j REJECT
+`), gocheck.Equals, true)
+}
+
+func (s *NetsecSuite) TestCheckDrift(c *gocheck.C) {
+	n, recorder := newTestNetworkSecurity()
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.1"}), gocheck.IsNil)
+	c.Assert(n.AddContainerSecurity("c1", 1, map[string][]uint16{"db": []uint16{5432}}, nil, nil, nil), gocheck.IsNil)
+	stats := n.CheckDrift()
+	c.Assert(stats.Healthy, gocheck.Equals, true)
+	c.Assert(stats.Drifts, gocheck.Equals, uint(0))
+	c.Assert(stats.Backend, gocheck.Equals, DefaultFirewall)
+
+	// someone flushed the rules and left one of their own. only report it.
+	RepairDrift = false
+	recorder.SetLive(&Ruleset{Unknown: []string{"-A ATLANTIS-FORWARD -j ACCEPT"}})
+	stats = n.CheckDrift()
+	c.Assert(stats.Healthy, gocheck.Equals, false)
+	c.Assert(stats.Missing, gocheck.DeepEquals, []string{"mark veth1 1", "group db 10.0.0.1",
+		"allow 1 tcp db:5432", "deny 10.0.0.1"})
+	c.Assert(stats.Extra, gocheck.DeepEquals, []string{"unknown -A ATLANTIS-FORWARD -j ACCEPT"})
+	c.Assert(stats.Drifts, gocheck.Equals, uint(1))
+	c.Assert(Status(), gocheck.DeepEquals, stats)
+	c.Assert(recorder.Applies, gocheck.Equals, 2)
+
+	// repair it
+	RepairDrift = true
+	stats = n.CheckDrift()
+	c.Assert(stats.Healthy, gocheck.Equals, true)
+	c.Assert(stats.Drifts, gocheck.Equals, uint(2))
+	c.Assert(stats.Repairs, gocheck.Equals, uint(1))
+	c.Assert(recorder.Applies, gocheck.Equals, 3)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{"mark veth1 1", "group db 10.0.0.1",
+		"allow 1 tcp db:5432", "deny 10.0.0.1"})
+
+	// marks read back in hex are the same marks
+	recorder.SetLive(&Ruleset{
+		Marks:  []Mark{Mark{Veth: "veth1", Mark: "0x00000001"}},
+		Groups: []Group{Group{Name: "db", Addrs: []string{"10.0.0.1"}}},
+		Allows: []Allow{Allow{Mark: "0x1", Protocol: "tcp", Group: "db", Port: 5432}},
+		Denies: []string{"10.0.0.1"},
+	})
+	stats = n.CheckDrift()
+	c.Assert(stats.Healthy, gocheck.Equals, true)
+	c.Assert(stats.Missing, gocheck.HasLen, 0)
+	c.Assert(stats.Extra, gocheck.HasLen, 0)
+
+	// a failed repair leaves it unhealthy
+	recorder.SetLive(&Ruleset{})
+	recorder.Err = errors.New("iptables-restore: failed")
+	stats = n.CheckDrift()
+	c.Assert(stats.Healthy, gocheck.Equals, false)
+	c.Assert(stats.LastError, gocheck.Equals, "iptables-restore: failed")
+	c.Assert(stats.Repairs, gocheck.Equals, uint(1))
+}
+
+func (s *NetsecSuite) TestParseIPTablesSave(c *gocheck.C) {
+	mangle := `# Generated by iptables-save
+*mangle
+:PREROUTING ACCEPT [0:0]
+:ATLANTIS-MARK - [0:0]
+-A PREROUTING -j ATLANTIS-MARK
+-A ATLANTIS-MARK -m physdev --physdev-in veth1 -j MARK --set-xmark 0x1/0xffffffff
+COMMIT
+`
+	filter := `*filter
+:FORWARD ACCEPT [0:0]
+:ATLANTIS-FORWARD - [0:0]
+-A FORWARD -j ATLANTIS-FORWARD
+-A FORWARD -o docker0 -j DOCKER
+-A ATLANTIS-FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+[12:720] -A ATLANTIS-FORWARD -p tcp -m tcp --dport 5432 -m set --match-set atlantis-db dst -m mark --mark 0x1 -j ACCEPT
+-A ATLANTIS-FORWARD -p tcp -m tcp --dport 61000 -m conntrack --ctstate DNAT -m set --match-set atlantis-db src -j ACCEPT
+-A ATLANTIS-FORWARD -s 10.9.0.0/24 -p tcp -m tcp --dport 61000 -m conntrack --ctstate DNAT -j ACCEPT
+-A ATLANTIS-FORWARD -p tcp -m tcp --dport 61000 -m conntrack --ctstate DNAT -j REJECT --reject-with icmp-port-unreachable
+[5:300] -A ATLANTIS-FORWARD -m set --match-set atlantis dst -j REJECT --reject-with icmp-port-unreachable
+[1:60] -A ATLANTIS-FORWARD -s 10.0.0.9/32 -j ACCEPT
+COMMIT
+`
+	ipsets := `create atlantis-db hash:net family inet hashsize 1024 maxelem 65536
+add atlantis-db 10.0.0.1
+add atlantis-db 10.1.0.0/16
+create atlantis-old hash:net family inet hashsize 1024 maxelem 65536
+add atlantis-old 10.2.0.1
+create atlantis hash:net family inet hashsize 1024 maxelem 65536
+add atlantis 10.1.0.0/16
+add atlantis 10.0.0.1
+create atl6-db hash:net family inet6 hashsize 1024 maxelem 65536
+add atl6-db fd00::/64
+create atlantis6 hash:net family inet6 hashsize 1024 maxelem 65536
+add atlantis6 fd00::/64
+`
+	filter6 := `*filter
+:FORWARD ACCEPT [0:0]
+:ATLANTIS-FORWARD - [0:0]
+-A FORWARD -j ATLANTIS-FORWARD
+-A ATLANTIS-FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+[3:240] -A ATLANTIS-FORWARD -p tcp -m tcp --dport 5432 -m set --match-set atl6-db dst -m mark --mark 0x1 -j ACCEPT
+-A ATLANTIS-FORWARD -p tcp -m tcp --dport 61000 -m conntrack --ctstate DNAT -m set --match-set atl6-db src -j ACCEPT
+-A ATLANTIS-FORWARD -s 2001:db8::1/128 -p tcp -m tcp --dport 61000 -m conntrack --ctstate DNAT -j ACCEPT
+-A ATLANTIS-FORWARD -p tcp -m tcp --dport 61000 -m conntrack --ctstate DNAT -j REJECT --reject-with icmp6-port-unreachable
+[1:80] -A ATLANTIS-FORWARD -m set --match-set atlantis6 dst -j REJECT --reject-with icmp6-port-unreachable
+COMMIT
+`
+	live := mergeFamilies(parseIPTablesSave(ipv4, mangle, filter, ipsets),
+		parseIPTablesSave(ipv6, mangle, filter6, ipsets))
+	missing, extra := testRuleset().Diff(live)
+	c.Assert(missing, gocheck.HasLen, 0)
+	c.Assert(extra, gocheck.DeepEquals, []string{"unknown -A ATLANTIS-FORWARD -s 10.0.0.9/32 -j ACCEPT"})
+	c.Assert(live.Counters, gocheck.DeepEquals, map[string]Counter{
+		"allow 1 tcp db:5432": Counter{Packets: 15, Bytes: 960},
+		denyCounter:           Counter{Packets: 6, Bytes: 380},
+	})
+
+	// the reject log, in both families or only one
+	logged := testRuleset()
+	logged.LogRejects = "10/minute"
+	logRule := "-A ATLANTIS-FORWARD -m set --match-set %s dst -m limit --limit 10/min -j LOG " +
+		"--log-prefix \"atlantis-reject:\"\n"
+	loggedFilter := strings.Replace(filter, "[5:300]", fmt.Sprintf(logRule, "atlantis")+"[5:300]", 1)
+	loggedFilter6 := strings.Replace(filter6, "[1:80]", fmt.Sprintf(logRule, "atlantis6")+"[1:80]", 1)
+	live = mergeFamilies(parseIPTablesSave(ipv4, mangle, loggedFilter, ipsets),
+		parseIPTablesSave(ipv6, mangle, loggedFilter6, ipsets))
+	missing, extra = logged.Diff(live)
+	c.Assert(missing, gocheck.HasLen, 0)
+	c.Assert(extra, gocheck.DeepEquals, []string{"unknown -A ATLANTIS-FORWARD -s 10.0.0.9/32 -j ACCEPT"})
+	live = mergeFamilies(parseIPTablesSave(ipv4, mangle, loggedFilter, ipsets),
+		parseIPTablesSave(ipv6, mangle, filter6, ipsets))
+	missing, extra = logged.Diff(live)
+	c.Assert(missing, gocheck.DeepEquals, []string{"log rejects 10/minute"})
+	c.Assert(extra, gocheck.DeepEquals, []string{"unknown -A ATLANTIS-FORWARD -s 10.0.0.9/32 -j ACCEPT",
+		"unknown ip only: log rejects 10/minute"})
+
+	// rules in a chain nothing jumps to don't count. rules left in the other family are reported.
+	live = mergeFamilies(parseIPTablesSave(ipv4, mangle,
+		strings.Replace(filter, "-A FORWARD -j ATLANTIS-FORWARD\n", "", 1), ipsets),
+		parseIPTablesSave(ipv6, mangle, filter6, ipsets))
+	missing, extra = testRuleset().Diff(live)
+	c.Assert(missing, gocheck.DeepEquals, []string{"group db 10.0.0.1", "group db 10.1.0.0/16",
+		"allow 1 tcp db:5432", "ingress tcp 61000 from group db", "ingress tcp 61000 from 10.9.0.0/24",
+		"guard tcp 61000", "deny 10.0.0.1", "deny 10.1.0.0/16"})
+	c.Assert(extra, gocheck.DeepEquals, []string{"unknown ip6 only: allow 1 tcp db:5432",
+		"unknown ip6 only: ingress tcp 61000 from group db", "unknown ip6 only: guard tcp 61000"})
+
+	// marks are needed for IPv6 traffic too
+	live = mergeFamilies(parseIPTablesSave(ipv4, mangle, filter, ipsets),
+		parseIPTablesSave(ipv6, strings.Replace(mangle, "-A PREROUTING -j ATLANTIS-MARK\n", "", 1), filter6, ipsets))
+	missing, extra = testRuleset().Diff(live)
+	c.Assert(missing, gocheck.DeepEquals, []string{"mark veth1 1"})
+	c.Assert(extra, gocheck.DeepEquals, []string{"unknown -A ATLANTIS-FORWARD -s 10.0.0.9/32 -j ACCEPT",
+		"unknown ip only: mark veth1 1"})
+}
+
+func (s *NetsecSuite) TestParseNFTList(c *gocheck.C) {
+	bridge := `table bridge atlantis {
+	map marks {
+		type ifname : mark
+		elements = { "veth1" : 0x00000001 }
+	}
+
+	chain prerouting {
+		type filter hook prerouting priority -200; policy accept;
+		meta mark set iifname map @marks
+	}
+}
+`
+	inet := `table inet atlantis {
+	set group_db {
+		type ipv4_addr
+		flags interval
+		elements = { 10.0.0.1, 10.1.0.0/16,
+			     10.3.0.1 }
+	}
+
+	set group6_db {
+		type ipv6_addr
+		flags interval
+		elements = { fd00::/64 }
+	}
+
+	set denies {
+		type ipv4_addr
+		flags interval
+		elements = { 10.0.0.1, 10.1.0.0/16 }
+	}
+
+	set denies6 {
+		type ipv6_addr
+		flags interval
+		elements = { fd00::/64 }
+	}
+
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+		ct state established,related accept
+		meta mark 0x00000001 ip daddr @group_db tcp dport 5432 counter packets 12 bytes 720 accept
+		meta mark 0x00000001 ip6 daddr @group6_db tcp dport 5432 counter packets 3 bytes 240 accept
+		ct status dnat ip saddr @group_db tcp dport 61000 accept
+		ct status dnat ip6 saddr @group6_db tcp dport 61000 accept
+		ct status dnat ip saddr 10.9.0.0/24 tcp dport 61000 accept
+		ct status dnat ip6 saddr 2001:db8::1 tcp dport 61000 accept
+		ct status dnat tcp dport 61000 reject
+		ip daddr @denies counter packets 5 bytes 300 reject
+		ip6 daddr @denies6 counter packets 1 bytes 80 reject
+	}
+}
+`
+	live := parseNFTList(bridge, inet)
+	missing, extra := testRuleset().Diff(live)
+	c.Assert(missing, gocheck.HasLen, 0)
+	c.Assert(extra, gocheck.DeepEquals, []string{"group db 10.3.0.1"})
+	c.Assert(live.Counters, gocheck.DeepEquals, map[string]Counter{
+		"allow 1 tcp db:5432": Counter{Packets: 15, Bytes: 960},
+		denyCounter:           Counter{Packets: 6, Bytes: 380},
+	})
+
+	// the reject log
+	logged := testRuleset()
+	logged.LogRejects = "10/minute"
+	live = parseNFTList(bridge, strings.Replace(inet, "\t\tip daddr @denies counter",
+		"\t\tip daddr @denies limit rate 10/minute log prefix \"atlantis-reject:\"\n"+
+			"\t\tip6 daddr @denies6 limit rate 10/minute log prefix \"atlantis-reject:\"\n\t\tip daddr @denies counter", 1))
+	missing, extra = logged.Diff(live)
+	c.Assert(missing, gocheck.HasLen, 0)
+	c.Assert(extra, gocheck.DeepEquals, []string{"group db 10.3.0.1"})
+
+	// the denies set without the rule using it
+	live = parseNFTList(bridge, strings.Replace(inet, "\t\tip6 daddr @denies6 counter packets 1 bytes 80 reject\n", "", 1))
+	missing, extra = testRuleset().Diff(live)
+	c.Assert(missing, gocheck.DeepEquals, []string{"deny fd00::/64"})
+	c.Assert(extra, gocheck.DeepEquals, []string{"group db 10.3.0.1"})
+
+	// an allow in only one family
+	live = parseNFTList(bridge, strings.Replace(inet,
+		"\t\tmeta mark 0x00000001 ip6 daddr @group6_db tcp dport 5432 counter packets 3 bytes 240 accept\n", "", 1))
+	missing, extra = testRuleset().Diff(live)
+	c.Assert(missing, gocheck.DeepEquals, []string{"allow 1 tcp db:5432"})
+	c.Assert(extra, gocheck.DeepEquals, []string{"group db 10.3.0.1", "unknown ip only: allow 1 tcp db:5432"})
+
+	// IPv6 rules using the IPv4 sets don't count
+	live = parseNFTList(bridge, strings.Replace(strings.Replace(inet, "ip6 daddr @group6_db", "ip6 daddr @group_db", 1),
+		"ip6 saddr @group6_db", "ip6 saddr @group_db", 1))
+	missing, extra = testRuleset().Diff(live)
+	c.Assert(missing, gocheck.DeepEquals, []string{"group db fd00::/64", "allow 1 tcp db:5432",
+		"ingress tcp 61000 from group db"})
+	c.Assert(extra, gocheck.DeepEquals, []string{"group db 10.3.0.1", "unknown ip only: allow 1 tcp db:5432",
+		"unknown ip only: ingress tcp 61000 from group db",
+		"unknown forward meta mark 0x00000001 ip6 daddr @group_db tcp dport 5432 accept",
+		"unknown forward ct status dnat ip6 saddr @group_db tcp dport 61000 accept"})
+}
+
+func (s *NetsecSuite) TestNFTLive(c *gocheck.C) {
+	oldRunNFT := runNFT
+	defer func() { runNFT = oldRunNFT }()
+	// what nft lists with service names, and with numeric ports
+	tables := map[bool]string{
+		false: "table inet atlantis {\n\tchain forward {\n\t\tct status dnat tcp dport postgresql reject\n\t}\n}\n",
+		true:  "table inet atlantis {\n\tchain forward {\n\t\tct status dnat tcp dport 5432 reject\n\t}\n}\n",
+	}
+	runNFT = func(args ...string) (string, error) {
+		if args[len(args)-2] == "bridge" {
+			return "", errors.New("Error: No such file or directory; did you mean table 'atlantis' in family inet?")
+		}
+		return tables[args[0] == "-nn"], nil
+	}
+	live, err := (&NFTables{}).Live()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(live.Strings(), gocheck.DeepEquals, []string{"guard tcp 5432"})
+	c.Assert(parseNFTList("", tables[false]).Strings(), gocheck.DeepEquals,
+		[]string{"unknown forward ct status dnat tcp dport postgresql reject"})
+}
+
+func (s *NetsecSuite) TestRestore(c *gocheck.C) {
+	n, _ := newTestNetworkSecurity()
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.1"}), gocheck.IsNil)
+	for pid, id := range []string{"c0", "c1", "c2", "c3"} {
+		if pid > 0 {
+			c.Assert(n.AddContainerSecurity(id, pid, map[string][]uint16{"db": []uint16{5432}}, nil, nil, nil), gocheck.IsNil)
+		}
+	}
+
+	recorder := NewRecorder()
+	NewFirewall = func(pretend bool) Firewall { return recorder }
+	defer InitFirewall(DefaultFirewall)
+	findVeth = func(pid int) (string, string, error) {
+		if pid == 1 {
+			return "", "", errors.New("guano failed")
+		}
+		return fmt.Sprintf("%d", pid), fmt.Sprintf("veth%d", pid), nil
+	}
+	// c1 is the same process, c2 was restarted and c3 is gone
+	restored, err := Restore("netsec", false, map[string]int{"c1": 1, "c2": 12})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(restored.Pretend, gocheck.Equals, false)
+	c.Assert(restored.IPGroups, gocheck.DeepEquals, map[string][]string{"db": []string{"10.0.0.1"}})
+	c.Assert(restored.DeniedIPs, gocheck.DeepEquals, map[string]bool{"10.0.0.1": true})
+	c.Assert(restored.Containers, gocheck.HasLen, 2)
+	c.Assert(restored.Containers["c2"].Pid, gocheck.Equals, 12)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{
+		"mark veth1 1",
+		"mark veth12 12",
+		"group db 10.0.0.1",
+		"allow 1 tcp db:5432",
+		"allow 12 tcp db:5432",
+		"deny 10.0.0.1",
+	})
+
+	// the restored state was saved again
+	var saved NetworkSecurity
+	c.Assert(serialize.RetrieveObject("netsec", &saved), gocheck.IsNil)
+	c.Assert(saved.Containers, gocheck.HasLen, 2)
+	c.Assert(saved.Containers["c2"].Veth, gocheck.Equals, "veth12")
+	c.Assert(saved.Containers["c2"].Mark, gocheck.Equals, "12")
+	c.Assert(saved.Migrated, gocheck.Equals, true)
+
+	// the rules an older supervisor would have installed for the saved state were removed, once
+	legacy := []string{
+		"-t mangle -D PREROUTING -m physdev --physdev-in veth1 -j MARK --set-mark 1",
+		"-D FORWARD -d 10.0.0.1 -p tcp --dport 5432 -m mark --mark 1 -j ACCEPT",
+		"-t mangle -D PREROUTING -m physdev --physdev-in veth12 -j MARK --set-mark 12",
+		"-D FORWARD -d 10.0.0.1 -p tcp --dport 5432 -m mark --mark 12 -j ACCEPT",
+		"-D FORWARD -d 10.0.0.1 -j REJECT",
+		"-D FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+	}
+	c.Assert(recorder.Legacy, gocheck.DeepEquals, legacy)
+	_, err = Restore("netsec", false, map[string]int{"c1": 1, "c2": 12})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(recorder.Legacy, gocheck.DeepEquals, legacy)
+
+	// nothing saved yet, so there is nothing to remove
+	restored, err = Restore("nothing", true, nil)
+	c.Assert(os.IsNotExist(err), gocheck.Equals, true)
+	c.Assert(restored.Containers, gocheck.HasLen, 0)
+	c.Assert(restored.Pretend, gocheck.Equals, true)
+	c.Assert(restored.Migrated, gocheck.Equals, true)
+	c.Assert(recorder.Legacy, gocheck.DeepEquals, legacy)
+}
+
+func (s *NetsecSuite) TestRestoreInvalidIPGroups(c *gocheck.C) {
+	events.Clear()
+	n, _ := newTestNetworkSecurity()
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.1"}), gocheck.IsNil)
+	c.Assert(n.AddContainerSecurity("c1", 1, map[string][]uint16{"db": []uint16{5432}}, nil,
+		[]*types.PortIngress{&types.PortIngress{Protocol: "tcp", Port: 61000, Sources: []string{"db"}}}, nil),
+		gocheck.IsNil)
+	// saved by an older supervisor
+	longName := "a-group-name-too-long-for-ipset"
+	n.IPGroups["db"] = []string{"10.0.0.2/32", " 10.0.0.1", "not an address", "10.0.0.1"}
+	n.IPGroups[longName] = []string{"10.5.0.1"}
+	n.Containers["c1"].SecurityGroups[longName] = []uint16{80}
+	n.Containers["c1"].Ingress[0].Sources = append(n.Containers["c1"].Ingress[0].Sources, longName)
+	n.save()
+
+	recorder := NewRecorder()
+	NewFirewall = func(pretend bool) Firewall { return recorder }
+	defer InitFirewall(DefaultFirewall)
+	restored, err := Restore("netsec", true, map[string]int{"c1": 1})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(restored.IPGroups, gocheck.DeepEquals, map[string][]string{"db": []string{"10.0.0.1", "10.0.0.2"}})
+	c.Assert(restored.Containers["c1"].SecurityGroups, gocheck.DeepEquals, map[string][]uint16{"db": []uint16{5432}})
+	c.Assert(restored.Containers["c1"].Ingress[0].Sources, gocheck.DeepEquals, []string{"db"})
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{
+		"mark veth1 1",
+		"group db 10.0.0.1",
+		"group db 10.0.0.2",
+		"allow 1 tcp db:5432",
+		"ingress tcp 61000 from group db",
+		"guard tcp 61000",
+		"deny 10.0.0.1",
+		"deny 10.0.0.2",
+	})
+	c.Assert(events.List("netsec-invalid-group", "", 0), gocheck.HasLen, 2)
+}
+
+func (s *NetsecSuite) TestLegacyRules(c *gocheck.C) {
+	n := New("netsec", true)
+	n.IPGroups = map[string][]string{"db": []string{"10.0.0.1", "10.0.0.2"}, "cache": []string{"10.1.0.1"}}
+	n.Containers = map[string]*ContainerSecurity{
+		"c1": &ContainerSecurity{Veth: "veth7", Mark: "7", ID: "c1",
+			SecurityGroups: map[string][]uint16{"db": []uint16{5432}, "cache": []uint16{11211}}},
+		// its veth could not be found again
+		"c2": &ContainerSecurity{ID: "c2", SecurityGroups: map[string][]uint16{"db": []uint16{5432}}},
+	}
+	c.Assert(n.legacyRules([]string{"10.1.0.1"}), gocheck.DeepEquals, [][]string{
+		[]string{"-t", "mangle", "-D", "PREROUTING", "-m", "physdev", "--physdev-in", "veth7", "-j", "MARK",
+			"--set-mark", "7"},
+		[]string{"-D", "FORWARD", "-d", "10.1.0.1", "-p", "tcp", "--dport", "11211", "-m", "mark", "--mark", "7",
+			"-j", "ACCEPT"},
+		[]string{"-D", "FORWARD", "-d", "10.0.0.1", "-p", "tcp", "--dport", "5432", "-m", "mark", "--mark", "7",
+			"-j", "ACCEPT"},
+		[]string{"-D", "FORWARD", "-d", "10.0.0.2", "-p", "tcp", "--dport", "5432", "-m", "mark", "--mark", "7",
+			"-j", "ACCEPT"},
+		[]string{"-D", "FORWARD", "-d", "10.1.0.1", "-j", "REJECT"},
+		[]string{"-D", "FORWARD", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	})
+	// nothing was denied, so no conntrack rule went with it
+	n.Containers = map[string]*ContainerSecurity{}
+	c.Assert(n.legacyRules(nil), gocheck.HasLen, 0)
+}
+
+func (s *NetsecSuite) TestReadState(c *gocheck.C) {
+	lookupHost = func(host string) ([]string, error) { return []string{"10.9.0.1"}, nil }
+	defer func() { lookupHost = net.LookupHost }()
+	n, recorder := newTestNetworkSecurity()
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.0/24", "db.example.com"}), gocheck.IsNil)
+	c.Assert(n.UpdateIPGroup("dns", []string{"10.0.1.1"}), gocheck.IsNil)
+	c.Assert(n.AddContainerSecurity("c2", 2, map[string][]uint16{"db": []uint16{5433, 5432}},
+		map[string][]uint16{"db": []uint16{53}}, nil, nil), gocheck.IsNil)
+	c.Assert(n.AddContainerSecurity("c1", 1, map[string][]uint16{"db": []uint16{5432}}, nil, nil, nil), gocheck.IsNil)
+
+	groups, err := n.ListIPGroups()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(groups, gocheck.HasLen, 2)
+	c.Assert(*groups[0], gocheck.DeepEquals, types.IPGroupInfo{
+		Name:     "db",
+		Members:  []string{"10.0.0.0/24", "db.example.com"},
+		Resolved: map[string][]string{"db.example.com": []string{"10.9.0.1"}},
+		IPv4:     []string{"10.0.0.0/24", "10.9.0.1"},
+		IPv6:     []string{},
+		Users: []*types.IPGroupUser{
+			&types.IPGroupUser{ContainerID: "c1", Protocol: "tcp", Ports: []uint16{5432}},
+			&types.IPGroupUser{ContainerID: "c2", Protocol: "tcp", Ports: []uint16{5432, 5433}},
+			&types.IPGroupUser{ContainerID: "c2", Protocol: "udp", Ports: []uint16{53}},
+		},
+		Installed: true,
+		Missing:   []string{},
+	})
+	c.Assert(groups[1].Name, gocheck.Equals, "dns")
+	c.Assert(groups[1].Users, gocheck.HasLen, 0)
+
+	_, err = n.GetIPGroup("nope")
+	c.Assert(err, gocheck.ErrorMatches, "IP Group nope does not exist")
+	_, err = n.GetContainerSecurity("nope")
+	c.Assert(err, gocheck.ErrorMatches, "No network security for container nope")
+
+	// lose c2's mark and the dns deny
+	recorder.SetLive(&Ruleset{
+		Marks:  []Mark{Mark{Veth: "veth1", Mark: "1"}},
+		Groups: []Group{Group{Name: "db", Addrs: []string{"10.0.0.0/24", "10.9.0.1"}}},
+		Allows: []Allow{
+			Allow{Mark: "1", Protocol: "tcp", Group: "db", Port: 5432},
+			Allow{Mark: "2", Protocol: "tcp", Group: "db", Port: 5432},
+			Allow{Mark: "2", Protocol: "tcp", Group: "db", Port: 5433},
+			Allow{Mark: "2", Protocol: "udp", Group: "db", Port: 53},
+		},
+		Denies: []string{"10.0.0.0/24", "10.9.0.1"},
+	})
+	group, err := n.GetIPGroup("db")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(group.Installed, gocheck.Equals, true)
+	group, err = n.GetIPGroup("dns")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(group.Installed, gocheck.Equals, false)
+	c.Assert(group.Missing, gocheck.DeepEquals, []string{"deny 10.0.1.1"})
+	sec, err := n.GetContainerSecurity("c2")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(sec.Veth, gocheck.Equals, "veth2")
+	c.Assert(sec.Mark, gocheck.Equals, "2")
+	c.Assert(sec.Pid, gocheck.Equals, 2)
+	c.Assert(sec.Installed, gocheck.Equals, false)
+	c.Assert(sec.Missing, gocheck.DeepEquals, []string{"mark veth2 2"})
+	sec, err = n.GetContainerSecurity("c1")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(sec.Installed, gocheck.Equals, true)
+
+	// the stored state is still read when the live rules can't be
+	recorder.LiveErr = errors.New("iptables-save: Permission denied")
+	groups, err = n.ListIPGroups()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(groups, gocheck.HasLen, 2)
+	c.Assert(groups[0].Users, gocheck.HasLen, 3)
+	c.Assert(groups[0].Installed, gocheck.Equals, false)
+	c.Assert(groups[0].LastError, gocheck.Equals, "iptables-save: Permission denied")
+	group, err = n.GetIPGroup("dns")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(group.LastError, gocheck.Equals, "iptables-save: Permission denied")
+	sec, err = n.GetContainerSecurity("c1")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(sec.Mark, gocheck.Equals, "1")
+	c.Assert(sec.Installed, gocheck.Equals, false)
+	c.Assert(sec.Missing, gocheck.HasLen, 0)
+	c.Assert(sec.LastError, gocheck.Equals, "iptables-save: Permission denied")
+}
+
+func (s *NetsecSuite) TestDryRun(c *gocheck.C) {
+	n, recorder := newTestNetworkSecurity()
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.1"}), gocheck.IsNil)
+	c.Assert(n.AddContainerSecurity("c1", 1, map[string][]uint16{"db": []uint16{5432}}, nil, nil, nil), gocheck.IsNil)
+	rules := recorder.Rules()
+	applies := recorder.Applies
+
+	diff, err := n.DryRunUpdateIPGroup("db", []string{"10.0.0.2", "10.0.1.0/24"})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(*diff, gocheck.DeepEquals, types.IPGroupDiff{
+		Name:     "db",
+		Added:    []string{"10.0.0.2", "10.0.1.0/24"},
+		Removed:  []string{"10.0.0.1"},
+		Affected: []*types.IPGroupUser{&types.IPGroupUser{ContainerID: "c1", Protocol: "tcp", Ports: []uint16{5432}}},
+		Inserted: []string{"group db 10.0.0.2", "group db 10.0.1.0/24", "deny 10.0.0.2", "deny 10.0.1.0/24"},
+		Deleted:  []string{"group db 10.0.0.1", "deny 10.0.0.1"},
+	})
+	c.Assert(recorder.Applies, gocheck.Equals, applies)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, rules)
+	c.Assert(n.IPGroups["db"], gocheck.DeepEquals, []string{"10.0.0.1"})
+	c.Assert(n.DeniedIPs, gocheck.DeepEquals, map[string]bool{"10.0.0.1": true})
+
+	diff, err = n.DryRunUpdateIPGroup("new", []string{"10.0.2.1"})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(diff.Added, gocheck.DeepEquals, []string{"10.0.2.1"})
+	c.Assert(diff.Affected, gocheck.HasLen, 0)
+	c.Assert(diff.Inserted, gocheck.DeepEquals, []string{"deny 10.0.2.1"})
+	c.Assert(n.IPGroupExists("new"), gocheck.Equals, false)
+	_, err = n.DryRunUpdateIPGroup("db", []string{"nope!"})
+	c.Assert(err, gocheck.ErrorMatches, "Invalid IP group: .*")
+
+	// both families show up
+	diff, err = n.DryRunUpdateIPGroup("db", []string{"fd00::/64", "10.0.0.1", "2001:db8::1"})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(diff.Added, gocheck.DeepEquals, []string{"2001:db8::1", "fd00::/64"})
+	c.Assert(diff.Removed, gocheck.HasLen, 0)
+	c.Assert(diff.Inserted, gocheck.DeepEquals, []string{"group db 2001:db8::1", "group db fd00::/64",
+		"deny 2001:db8::1", "deny fd00::/64"})
+
+	diff, err = n.DryRunDeleteIPGroup("db")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(diff.Removed, gocheck.DeepEquals, []string{"10.0.0.1"})
+	c.Assert(diff.Affected, gocheck.HasLen, 1)
+	c.Assert(diff.Inserted, gocheck.HasLen, 0)
+	c.Assert(diff.Deleted, gocheck.DeepEquals, []string{"group db 10.0.0.1", "deny 10.0.0.1"})
+	c.Assert(n.IPGroupExists("db"), gocheck.Equals, true)
+	c.Assert(recorder.Applies, gocheck.Equals, applies)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, rules)
+}
+
+func (s *NetsecSuite) TestIngress(c *gocheck.C) {
+	n, recorder := newTestNetworkSecurity()
+	c.Assert(n.UpdateIPGroup("office", []string{"10.5.0.0/16"}), gocheck.IsNil)
+	ingress := []*types.PortIngress{
+		&types.PortIngress{Protocol: "tcp", Port: 61000, Sources: []string{"office", "10.9.0.1/32", "2001:DB8::1"}},
+		&types.PortIngress{Protocol: "udp", Port: 61004, Sources: []string{"office"}},
+		&types.PortIngress{Protocol: "tcp", Port: 61002}, // open to anyone
+	}
+	c.Assert(n.ValidateIngress([]*types.PortIngress{&types.PortIngress{Protocol: "tcp", Port: 61000,
+		Sources: []string{"nope"}}}), gocheck.ErrorMatches, "IP Group nope does not exist")
+	c.Assert(n.ValidateIngress([]*types.PortIngress{&types.PortIngress{Protocol: "tcp", Port: 61000,
+		Sources: []string{"10.0.0.0/0"}}}), gocheck.ErrorMatches, ".* would match every address")
+	c.Assert(n.ValidateIngress(ingress), gocheck.IsNil)
+	c.Assert(n.AddContainerSecurity("c1", 1, nil, nil, ingress, nil), gocheck.IsNil)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{
+		"mark veth1 1",
+		"group office 10.5.0.0/16",
+		"ingress tcp 61000 from 10.9.0.1",
+		"ingress tcp 61000 from 2001:db8::1",
+		"ingress tcp 61000 from group office",
+		"ingress udp 61004 from group office",
+		"guard tcp 61000",
+		"guard udp 61004",
+		"deny 10.5.0.0/16",
+	})
+
+	// group changes follow through to ingress like they do to egress
+	c.Assert(n.UpdateIPGroup("office", []string{"10.6.0.0/16"}), gocheck.IsNil)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{
+		"mark veth1 1",
+		"group office 10.6.0.0/16",
+		"ingress tcp 61000 from 10.9.0.1",
+		"ingress tcp 61000 from 2001:db8::1",
+		"ingress tcp 61000 from group office",
+		"ingress udp 61004 from group office",
+		"guard tcp 61000",
+		"guard udp 61004",
+		"deny 10.6.0.0/16",
+	})
+	group, err := n.GetIPGroup("office")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(group.Users, gocheck.DeepEquals, []*types.IPGroupUser{
+		&types.IPGroupUser{ContainerID: "c1", Protocol: "tcp", Ports: []uint16{61000}, Ingress: true},
+		&types.IPGroupUser{ContainerID: "c1", Protocol: "udp", Ports: []uint16{61004}, Ingress: true},
+	})
+	c.Assert(group.Installed, gocheck.Equals, true)
+	sec, err := n.GetContainerSecurity("c1")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(sec.Ingress, gocheck.HasLen, 2)
+	c.Assert(sec.Ingress[0].Sources, gocheck.DeepEquals, []string{"office", "10.9.0.1", "2001:db8::1"})
+	c.Assert(sec.Installed, gocheck.Equals, true)
+
+	c.Assert(n.RemoveContainerSecurity("c1"), gocheck.IsNil)
+	c.Assert(recorder.Rules(), gocheck.DeepEquals, []string{"deny 10.6.0.0/16"})
+}
+
+func (s *NetsecSuite) TestBandwidth(c *gocheck.C) {
+	commands := []string{}
+	var tcErr error
+	oldRunTC, oldReadVethCounter := runTC, readVethCounter
+	defer func() { runTC, readVethCounter = oldRunTC, oldReadVethCounter }()
+	runTC = func(pretend bool, args ...string) error {
+		commands = append(commands, strings.Join(args, " "))
+		return tcErr
+	}
+	counters := map[string]uint64{}
+	readVethCounter = func(veth, counter string) (uint64, error) {
+		if value, exists := counters[veth+" "+counter]; exists {
+			return value, nil
+		}
+		return 0, errors.New("no such veth")
+	}
+
+	n, _ := newTestNetworkSecurity()
+	bandwidth := &types.Bandwidth{IngressKbit: 10000, EgressKbit: 2000}
+	c.Assert(n.AddContainerSecurity("c1", 1, nil, nil, nil, bandwidth), gocheck.IsNil)
+	c.Assert(commands, gocheck.DeepEquals, []string{
+		"qdisc del dev veth1 root",
+		"qdisc del dev veth1 ingress",
+		"qdisc add dev veth1 root tbf rate 10000kbit burst 12500 latency 50ms",
+		"qdisc add dev veth1 handle ffff: ingress",
+		"filter add dev veth1 parent ffff: protocol all u32 match u32 0 0 police rate 2000kbit burst 3200 drop flowid :1",
+	})
+	// unlimited containers are left alone
+	commands = []string{}
+	c.Assert(n.AddContainerSecurity("c2", 2, nil, nil, nil, nil), gocheck.IsNil)
+	c.Assert(commands, gocheck.HasLen, 0)
+	// a container that can't be limited still gets its rules, and is left unshaped
+	events.Clear()
+	commands = []string{}
+	tcErr = errors.New("RTNETLINK answers: Operation not permitted")
+	c.Assert(n.AddContainerSecurity("c3", 3, nil, nil, nil, bandwidth), gocheck.IsNil)
+	c.Assert(n.Containers, gocheck.HasLen, 3)
+	c.Assert(commands[len(commands)-2:], gocheck.DeepEquals, []string{"qdisc del dev veth3 root",
+		"qdisc del dev veth3 ingress"})
+	c.Assert(events.List("netsec-bandwidth", "c3", 0), gocheck.HasLen, 1)
+	c.Assert(n.RemoveContainerSecurity("c3"), gocheck.IsNil)
+	// nothing is shaped for a container whose rules fail to apply
+	commands = []string{}
+	tcErr = nil
+	recorder := n.firewall.(*Recorder)
+	recorder.Err = errors.New("iptables-restore: line 3 failed")
+	c.Assert(n.AddContainerSecurity("c4", 4, nil, nil, nil, bandwidth), gocheck.ErrorMatches, "iptables-restore.*")
+	c.Assert(n.Containers, gocheck.HasLen, 2)
+	c.Assert(commands, gocheck.HasLen, 0)
+	recorder.Err = nil
+	sec, err := n.GetContainerSecurity("c1")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(sec.Bandwidth, gocheck.DeepEquals, bandwidth)
+
+	// throughput is measured from the second sample on. c2's veth can't be read.
+	counters["veth1 rx_bytes"], counters["veth1 tx_bytes"] = 1000, 5000
+	n.SampleThroughput()
+	stats := n.BandwidthStats()
+	c.Assert(stats, gocheck.HasLen, 2)
+	c.Assert(*stats[0], gocheck.Equals, types.BandwidthStats{ContainerID: "c1", Veth: "veth1", IngressLimit: 10000,
+		EgressLimit: 2000, LastSample: stats[0].LastSample})
+	c.Assert(stats[0].LastSample.IsZero(), gocheck.Equals, false)
+	c.Assert(*stats[1], gocheck.Equals, types.BandwidthStats{ContainerID: "c2", Veth: "veth2"})
+	// 1.25MB in and 250KB out over a second
+	n.throughput["c1"].sampled = n.throughput["c1"].sampled.Add(-1 * time.Second)
+	counters["veth1 rx_bytes"], counters["veth1 tx_bytes"] = 251000, 1255000
+	n.SampleThroughput()
+	stats = n.BandwidthStats()
+	c.Assert(stats[0].Ingress > 9900 && stats[0].Ingress <= 10000, gocheck.Equals, true)
+	c.Assert(stats[0].Egress > 1980 && stats[0].Egress <= 2000, gocheck.Equals, true)
+
+	// limits are shaped again on the new veth after a restart
+	recorder = NewRecorder()
+	NewFirewall = func(pretend bool) Firewall { return recorder }
+	defer InitFirewall(DefaultFirewall)
+	commands = []string{}
+	restored, err := Restore("netsec", true, map[string]int{"c1": 11, "c2": 2})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(restored.Containers["c1"].Bandwidth, gocheck.DeepEquals, bandwidth)
+	c.Assert(commands, gocheck.HasLen, 5)
+	c.Assert(commands[2], gocheck.Equals, "qdisc add dev veth11 root tbf rate 10000kbit burst 12500 latency 50ms")
+	// a new veth's counters start over
+	n.Containers["c1"].Veth = "veth11"
+	n.throughput["c1"].sampled = n.throughput["c1"].sampled.Add(-1 * time.Second)
+	counters["veth11 rx_bytes"], counters["veth11 tx_bytes"] = 10, 10
+	n.SampleThroughput()
+	c.Assert(n.BandwidthStats()[0].Ingress, gocheck.Equals, uint64(0))
+}
+
+func (s *NetsecSuite) TestRuleCounters(c *gocheck.C) {
+	metrics.Reset()
+	events.Clear()
+	n, recorder := newTestNetworkSecurity()
+	c.Assert(n.UpdateIPGroup("db", []string{"10.0.0.1"}), gocheck.IsNil)
+	c.Assert(n.UpdateIPGroup("dns", []string{"10.0.1.1"}), gocheck.IsNil)
+	c.Assert(n.AddContainerSecurity("c1", 1, map[string][]uint16{"db": []uint16{5432}},
+		map[string][]uint16{"dns": []uint16{53}}, nil, nil), gocheck.IsNil)
+	c.Assert(n.AddContainerSecurity("c2", 2, map[string][]uint16{"db": []uint16{5432}}, nil, nil, nil), gocheck.IsNil)
+	setCounters := func(counters map[string]Counter) {
+		live, err := recorder.Live()
+		c.Assert(err, gocheck.IsNil)
+		counted := *live
+		counted.Counters = counters
+		recorder.SetLive(&counted)
+	}
+	setCounters(map[string]Counter{
+		"allow 1 tcp db:5432": Counter{Packets: 10, Bytes: 1000},
+		"allow 1 udp dns:53":  Counter{Packets: 4, Bytes: 200},
+		denyCounter:           Counter{Packets: 2, Bytes: 120},
+	})
+	counters, err := n.RuleCounters("")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(counters, gocheck.DeepEquals, []*types.RuleCounter{
+		&types.RuleCounter{ContainerID: "c1", Rule: "allow 1 tcp db:5432", Packets: 10, Bytes: 1000},
+		&types.RuleCounter{ContainerID: "c1", Rule: "allow 1 udp dns:53", Packets: 4, Bytes: 200},
+		&types.RuleCounter{ContainerID: "c2", Rule: "allow 2 tcp db:5432"},
+		&types.RuleCounter{Rule: "deny", Packets: 2, Bytes: 120},
+	})
+	counters, err = n.RuleCounters("c2")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(counters, gocheck.DeepEquals, []*types.RuleCounter{
+		&types.RuleCounter{ContainerID: "c2", Rule: "allow 2 tcp db:5432"},
+	})
+	_, err = n.RuleCounters("nope")
+	c.Assert(err, gocheck.ErrorMatches, "No network security for container nope")
+
+	// samples add what matched since the last one to the metrics
+	n.SampleCounters()
+	c.Assert(metrics.Get("netsec.allowed_packets"), gocheck.Equals, uint64(14))
+	c.Assert(metrics.Get("netsec.denied_bytes"), gocheck.Equals, uint64(120))
+	setCounters(map[string]Counter{
+		"allow 1 tcp db:5432": Counter{Packets: 15, Bytes: 1500},
+		"allow 1 udp dns:53":  Counter{Packets: 4, Bytes: 200},
+		denyCounter:           Counter{Packets: 3, Bytes: 180},
+	})
+	n.SampleCounters()
+	c.Assert(metrics.Get("netsec.allowed_packets"), gocheck.Equals, uint64(19))
+	c.Assert(metrics.Get("netsec.allowed_bytes"), gocheck.Equals, uint64(1700))
+	c.Assert(metrics.Get("netsec.denied_packets"), gocheck.Equals, uint64(3))
+
+	// reinstalling the rules starts the live counters over, but what they counted is kept. so is what matched
+	// since the last sample. c2's allow is gone with c2.
+	setCounters(map[string]Counter{
+		"allow 1 tcp db:5432": Counter{Packets: 16, Bytes: 1600},
+		"allow 1 udp dns:53":  Counter{Packets: 4, Bytes: 200},
+		"allow 2 tcp db:5432": Counter{Packets: 1, Bytes: 100},
+		denyCounter:           Counter{Packets: 3, Bytes: 180},
+	})
+	c.Assert(n.RemoveContainerSecurity("c2"), gocheck.IsNil)
+	c.Assert(metrics.Get("netsec.allowed_packets"), gocheck.Equals, uint64(21))
+	setCounters(map[string]Counter{
+		"allow 1 tcp db:5432": Counter{Packets: 1, Bytes: 100},
+	})
+	n.SampleCounters()
+	c.Assert(metrics.Get("netsec.allowed_packets"), gocheck.Equals, uint64(22))
+	counters, err = n.RuleCounters("")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(counters, gocheck.DeepEquals, []*types.RuleCounter{
+		&types.RuleCounter{ContainerID: "c1", Rule: "allow 1 tcp db:5432", Packets: 17, Bytes: 1700},
+		&types.RuleCounter{ContainerID: "c1", Rule: "allow 1 udp dns:53", Packets: 4, Bytes: 200},
+		&types.RuleCounter{Rule: "deny", Packets: 3, Bytes: 180},
+	})
+	c.Assert(n.carried, gocheck.HasLen, 3)
+
+	// the reject log
+	defer InitRejectLog("")
+	c.Assert(InitRejectLog("10/fortnight"), gocheck.ErrorMatches, "Invalid netsec reject log rate: 10/fortnight.*")
+	c.Assert(InitRejectLog("10/minute"), gocheck.IsNil)
+	c.Assert(n.UpdateIPGroup("dns", []string{"10.0.1.2"}), gocheck.IsNil)
+	c.Assert(recorder.Rules()[len(recorder.Rules())-3:], gocheck.DeepEquals, []string{
+		"log rejects 10/minute",
+		"deny 10.0.0.1",
+		"deny 10.0.1.2",
+	})
+	oldOpenKernelLog, oldKernelLogRetry := openKernelLog, kernelLogRetry
+	defer func() { openKernelLog, kernelLogRetry = oldOpenKernelLog, oldKernelLogRetry }()
+	kernelLogRetry = time.Millisecond
+	// the log fails to open, then overruns, then ends
+	opens := 0
+	openKernelLog = func() (io.ReadCloser, error) {
+		opens++
+		switch opens {
+		case 1:
+			return nil, errors.New("permission denied")
+		case 2:
+			return ioutil.NopCloser(iotest.TimeoutReader(strings.NewReader("6,1001,5000,-;eth0: link up\n"))), nil
+		}
+		return ioutil.NopCloser(strings.NewReader(strings.Join([]string{
+			"4,1002,5001,-;atlantis-reject:IN=docker0 OUT=eth0 PHYSIN=veth1 SRC=172.17.0.2 DST=10.0.0.1 LEN=60 " +
+				"PROTO=TCP SPT=40000 DPT=5432 WINDOW=29200 SYN URGP=0 MARK=0x1",
+			"4,1003,5002,-;atlantis-reject:IN=docker0 OUT=eth0 PHYSIN=veth9 SRC=172.17.0.9 DST=10.0.1.2 LEN=60 " +
+				"PROTO=UDP SPT=40000 DPT=53 LEN=40 MARK=0x9",
+		}, "\n"))), nil
+	}
+	n.MonitorRejects()
+	c.Assert(opens, gocheck.Equals, 3)
+	c.Assert(metrics.Get("netsec.kernel_log_errors"), gocheck.Equals, uint64(1))
+	c.Assert(metrics.Get("netsec.rejects_logged"), gocheck.Equals, uint64(2))
+	rejects := events.List("netsec-reject", "", 0)
+	c.Assert(rejects, gocheck.HasLen, 1)
+	c.Assert(rejects[0].ContainerID, gocheck.Equals, "c1")
+	c.Assert(rejects[0].Message, gocheck.Equals, "rejected tcp 172.17.0.2 -> 10.0.0.1:5432 to a denied address")
+}
@@ -0,0 +1,302 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package netsec
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rules live in atlantis tables that hook in on their own. Each apply recreates the tables in a single nft
+// transaction.
+type NFTables struct {
+	Pretend bool
+	applied *Ruleset // what Live returns when pretending
+}
+
+func NewNFTables(pretend bool) Firewall {
+	return &NFTables{Pretend: pretend}
+}
+
+// the sets with a group's IPv4 and IPv6 addresses
+func nftGroupSet(group string) string {
+	return "group_" + group
+}
+
+func nftGroupSet6(group string) string {
+	return "group6_" + group
+}
+
+// an interval set of addresses
+func nftSet(buf *bytes.Buffer, name, addrType string, addrs []string) {
+	fmt.Fprintf(buf, "\tset %s {\n\t\ttype %s\n\t\tflags interval\n", name, addrType)
+	nftElements(buf, addrs)
+	buf.WriteString("\t}\n")
+}
+
+func nftElements(buf *bytes.Buffer, elements []string) {
+	if len(elements) > 0 {
+		fmt.Fprintf(buf, "\t\telements = { %s }\n", strings.Join(elements, ", "))
+	}
+}
+
+// The nft -f input for a ruleset. Creating then deleting each table first makes the delete safe when the table
+// doesn't exist yet. Veth marking happens in the bridge family since that is where the veth is the input
+// interface. Filtering happens in the inet family so one table covers IPv4 and IPv6, with a set per family for
+// each group. Group addresses are interval sets so CIDR blocks match without a rule per address. Allows and denies
+// count what they match. The ip table older supervisors used is dropped.
+func nftInput(r *Ruleset) string {
+	var buf bytes.Buffer
+	marks := []string{}
+	for _, m := range r.Marks {
+		marks = append(marks, fmt.Sprintf("\"%s\" : %s", m.Veth, m.Mark))
+	}
+	buf.WriteString("table bridge atlantis\ndelete table bridge atlantis\n")
+	buf.WriteString("table bridge atlantis {\n")
+	buf.WriteString("\tmap marks {\n\t\ttype ifname : mark\n")
+	nftElements(&buf, marks)
+	buf.WriteString("\t}\n")
+	buf.WriteString("\tchain prerouting {\n\t\ttype filter hook prerouting priority -200;\n")
+	buf.WriteString("\t\tmeta mark set iifname map @marks\n\t}\n")
+	buf.WriteString("}\n")
+
+	buf.WriteString("table ip atlantis\ndelete table ip atlantis\n")
+	buf.WriteString("table inet atlantis\ndelete table inet atlantis\n")
+	buf.WriteString("table inet atlantis {\n")
+	for _, group := range r.Groups {
+		v4, v6 := splitFamilies(group.Addrs)
+		nftSet(&buf, nftGroupSet(group.Name), "ipv4_addr", v4)
+		nftSet(&buf, nftGroupSet6(group.Name), "ipv6_addr", v6)
+	}
+	v4Denies, v6Denies := splitFamilies(r.Denies)
+	nftSet(&buf, "denies", "ipv4_addr", v4Denies)
+	nftSet(&buf, "denies6", "ipv6_addr", v6Denies)
+	buf.WriteString("\tchain forward {\n\t\ttype filter hook forward priority 0;\n")
+	buf.WriteString("\t\tct state established,related accept\n")
+	for _, a := range r.Allows {
+		fmt.Fprintf(&buf, "\t\tmeta mark %s ip daddr @%s %s dport %d counter accept\n", a.Mark,
+			nftGroupSet(a.Group), a.Protocol, a.Port)
+		fmt.Fprintf(&buf, "\t\tmeta mark %s ip6 daddr @%s %s dport %d counter accept\n", a.Mark,
+			nftGroupSet6(a.Group), a.Protocol, a.Port)
+	}
+	// published traffic has been DNATed to the container by the time it is forwarded
+	for _, in := range r.Ingress {
+		switch {
+		case in.Group != "":
+			fmt.Fprintf(&buf, "\t\tct status dnat ip saddr @%s %s dport %d accept\n", nftGroupSet(in.Group),
+				in.Protocol, in.Port)
+			fmt.Fprintf(&buf, "\t\tct status dnat ip6 saddr @%s %s dport %d accept\n", nftGroupSet6(in.Group),
+				in.Protocol, in.Port)
+		case isIPv6(in.Addr):
+			fmt.Fprintf(&buf, "\t\tct status dnat ip6 saddr %s %s dport %d accept\n", in.Addr, in.Protocol, in.Port)
+		default:
+			fmt.Fprintf(&buf, "\t\tct status dnat ip saddr %s %s dport %d accept\n", in.Addr, in.Protocol, in.Port)
+		}
+	}
+	for _, g := range r.Guards {
+		fmt.Fprintf(&buf, "\t\tct status dnat %s dport %d reject\n", g.Protocol, g.Port)
+	}
+	if r.LogRejects != "" {
+		fmt.Fprintf(&buf, "\t\tip daddr @denies limit rate %s log prefix \"%s\"\n", r.LogRejects, RejectLogPrefix)
+		fmt.Fprintf(&buf, "\t\tip6 daddr @denies6 limit rate %s log prefix \"%s\"\n", r.LogRejects, RejectLogPrefix)
+	}
+	buf.WriteString("\t\tip daddr @denies counter reject\n")
+	buf.WriteString("\t\tip6 daddr @denies6 counter reject\n\t}\n")
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+func (t *NFTables) Apply(r *Ruleset) error {
+	if t.Pretend {
+		t.applied = r
+	}
+	_, err := executeCommandWithInput(t.Pretend, nftInput(r), "nft", "-f", "-")
+	return err
+}
+
+var (
+	nftElementsRegexp = regexp.MustCompile(`(?s)(?:map|set) (\S+) \{[^{}]*?elements = \{([^}]*)\}`)
+	nftChainRegexp    = regexp.MustCompile(`(?s)chain (\w+) \{([^}]*)\}`)
+	nftAllowRegexp    = regexp.MustCompile(`^meta mark (\S+) (ip6?) daddr @(group6?)_(\S+) (\S+) dport (\d+) accept$`)
+	nftIngressRegexp  = regexp.MustCompile(`^ct status dnat (ip6?) saddr (\S+) (\S+) dport (\d+) accept$`)
+	nftGuardRegexp    = regexp.MustCompile(`^ct status dnat (\S+) dport (\d+) reject$`)
+	nftGroupRegexp    = regexp.MustCompile(`^@(group6?)_(\S+)$`)
+	nftLogRegexp      = regexp.MustCompile(`^(ip6?) daddr @(denies6?) limit rate (\S+) log prefix "(\S+)"$`)
+	nftCounterRegexp  = regexp.MustCompile(` counter packets (\d+) bytes (\d+)`)
+)
+
+// the set of denied addresses and the prefix of group sets, by family
+var (
+	nftDenySets         = map[string]string{"ip": "denies", "ip6": "denies6"}
+	nftGroupSetPrefixes = map[string]string{"ip": "group", "ip6": "group6"}
+)
+
+func (t *NFTables) Live() (*Ruleset, error) {
+	if t.Pretend {
+		if t.applied == nil {
+			return &Ruleset{}, nil
+		}
+		return t.applied, nil
+	}
+	bridge, err := nftListTable("bridge")
+	if err != nil {
+		return nil, err
+	}
+	inet, err := nftListTable("inet")
+	if err != nil {
+		return nil, err
+	}
+	return parseNFTList(bridge, inet), nil
+}
+
+// runs nft without input. swapped out in tests.
+var runNFT = func(args ...string) (string, error) {
+	return executeCommand(false, "nft", args...)
+}
+
+// A table that doesn't exist has no rules. Ports are listed as numbers, not as service names.
+func nftListTable(family string) (string, error) {
+	out, err := runNFT("-nn", "list", "table", family, "atlantis")
+	if err != nil && strings.Contains(err.Error(), "No such file or directory") {
+		return "", nil
+	}
+	return out, err
+}
+
+// set or map name -> elements
+func nftSetElements(list string) map[string][]string {
+	sets := map[string][]string{}
+	for _, match := range nftElementsRegexp.FindAllStringSubmatch(list, -1) {
+		for _, element := range strings.Split(match[2], ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				sets[match[1]] = append(sets[match[1]], element)
+			}
+		}
+	}
+	return sets
+}
+
+// The ruleset in our tables, from nft list output. Rules are split by the family they match and merged like the
+// iptables halves, marks and guards match both. Set elements only count while a chain rule uses the set.
+// Counters are read from the rules that have them.
+func parseNFTList(bridge, inet string) *Ruleset {
+	families := map[string]*Ruleset{"ip": newLiveRuleset(), "ip6": newLiveRuleset()}
+	sets := nftSetElements(bridge + "\n" + inet)
+	// family -> group names, in the order rules use them
+	groups := map[string][]string{}
+	useGroup := func(family, group string) {
+		for _, used := range groups[family] {
+			if used == group {
+				return
+			}
+		}
+		groups[family] = append(groups[family], group)
+	}
+	unknown := []string{}
+	for _, match := range nftChainRegexp.FindAllStringSubmatch(bridge+"\n"+inet, -1) {
+		for _, line := range strings.Split(match[2], "\n") {
+			line = strings.TrimSpace(line)
+			// rules are matched without their counters
+			var counter Counter
+			if count := nftCounterRegexp.FindStringSubmatch(line); count != nil {
+				counter.Packets, _ = strconv.ParseUint(count[1], 10, 64)
+				counter.Bytes, _ = strconv.ParseUint(count[2], 10, 64)
+				line = strings.Replace(line, count[0], "", 1)
+			}
+			allow := nftAllowRegexp.FindStringSubmatch(line)
+			ingress := nftIngressRegexp.FindStringSubmatch(line)
+			guard := nftGuardRegexp.FindStringSubmatch(line)
+			logRejects := nftLogRegexp.FindStringSubmatch(line)
+			switch {
+			case line == "" || strings.HasPrefix(line, "type "):
+			case strings.HasPrefix(line, "ct state established,related accept"):
+			case strings.HasSuffix(line, "@marks"):
+				for _, element := range sets["marks"] {
+					parts := strings.Split(element, " : ")
+					if len(parts) != 2 {
+						unknown = append(unknown, "marks "+element)
+						continue
+					}
+					mark := Mark{Veth: strings.Trim(parts[0], "\""), Mark: parts[1]}
+					for _, r := range families {
+						r.Marks = append(r.Marks, mark)
+					}
+				}
+			case allow != nil && nftGroupSetPrefixes[allow[2]] == allow[3]:
+				port, err := parsePort(allow[6])
+				if err != nil {
+					unknown = append(unknown, match[1]+" "+line)
+					continue
+				}
+				r := families[allow[2]]
+				a := Allow{Mark: allow[1], Protocol: allow[5], Group: allow[4], Port: port}
+				r.Allows = append(r.Allows, a)
+				r.count(allowCounter(a), counter.Packets, counter.Bytes)
+				useGroup(allow[2], allow[4])
+			case ingress != nil:
+				port, err := parsePort(ingress[4])
+				if err != nil {
+					unknown = append(unknown, match[1]+" "+line)
+					continue
+				}
+				in := Ingress{Protocol: ingress[3], Port: port, Addr: ingress[2]}
+				if group := nftGroupRegexp.FindStringSubmatch(ingress[2]); group != nil {
+					// the set has to be the one for the family
+					if nftGroupSetPrefixes[ingress[1]] != group[1] {
+						unknown = append(unknown, match[1]+" "+line)
+						continue
+					}
+					in.Group, in.Addr = group[2], ""
+					useGroup(ingress[1], group[2])
+				}
+				families[ingress[1]].Ingress = append(families[ingress[1]].Ingress, in)
+			case guard != nil:
+				port, err := parsePort(guard[2])
+				if err != nil {
+					unknown = append(unknown, match[1]+" "+line)
+					continue
+				}
+				for _, r := range families {
+					r.Guards = append(r.Guards, Guard{Protocol: guard[1], Port: port})
+				}
+			case strings.HasPrefix(line, "ip daddr @denies reject"):
+				families["ip"].Denies = collapseAddrs(sets["denies"])
+				families["ip"].count(denyCounter, counter.Packets, counter.Bytes)
+			case strings.HasPrefix(line, "ip6 daddr @denies6 reject"):
+				families["ip6"].Denies = collapseAddrs(sets["denies6"])
+				families["ip6"].count(denyCounter, counter.Packets, counter.Bytes)
+			case logRejects != nil && nftDenySets[logRejects[1]] == logRejects[2] && logRejects[4] == RejectLogPrefix:
+				families[logRejects[1]].LogRejects = logRejects[3]
+			default:
+				unknown = append(unknown, match[1]+" "+line)
+			}
+		}
+	}
+	for family, names := range groups {
+		sort.Strings(names)
+		for _, group := range names {
+			set := nftGroupSet(group)
+			if family == "ip6" {
+				set = nftGroupSet6(group)
+			}
+			families[family].Groups = append(families[family].Groups, Group{Name: group,
+				Addrs: collapseAddrs(sets[set])})
+		}
+	}
+	r := mergeFamilies(families["ip"], families["ip6"])
+	r.Unknown = append(r.Unknown, unknown...)
+	return r
+}
@@ -0,0 +1,73 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package netsec
+
+import (
+	"strings"
+	"sync"
+)
+
+// An in-memory firewall for tests. It keeps the last ruleset applied.
+type Recorder struct {
+	sync.Mutex
+	ruleset *Ruleset
+	Applies int
+	Err     error    // returned from Apply instead of applying, if set
+	LiveErr error    // returned from Live instead of the rules, if set
+	Legacy  []string // the legacy rules removed
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{ruleset: &Ruleset{}}
+}
+
+func (r *Recorder) Apply(ruleset *Ruleset) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.Applies++
+	r.ruleset = ruleset
+	return nil
+}
+
+func (r *Recorder) Live() (*Ruleset, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.LiveErr != nil {
+		return nil, r.LiveErr
+	}
+	return r.ruleset, nil
+}
+
+func (r *Recorder) RemoveLegacyRules(rules [][]string) {
+	r.Lock()
+	defer r.Unlock()
+	for _, rule := range rules {
+		r.Legacy = append(r.Legacy, strings.Join(rule, " "))
+	}
+}
+
+// Change the installed rules without going through Apply, like someone flushing iptables by hand
+func (r *Recorder) SetLive(ruleset *Ruleset) {
+	r.Lock()
+	defer r.Unlock()
+	r.ruleset = ruleset
+}
+
+// The installed rules, one per line
+func (r *Recorder) Rules() []string {
+	r.Lock()
+	defer r.Unlock()
+	return r.ruleset.Strings()
+}
@@ -0,0 +1,100 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package netsec
+
+import (
+	"atlantis/supervisor/events"
+	"atlantis/supervisor/metrics"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DefaultResolveInterval = 1 * time.Minute
+
+var ResolveInterval = DefaultResolveInterval
+
+// Set how often hostnames in IP groups are resolved again. Must be called before containers.Init.
+func InitResolver(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("Invalid netsec resolve interval: " + interval.String())
+	}
+	ResolveInterval = interval
+	return nil
+}
+
+// Replace Resolved with a new map holding the updates and the hostnames still in a group. The old map is left
+// alone so callers can put it back. Callers must hold the lock.
+func (n *NetworkSecurity) updateResolved(updates map[string][]string) {
+	resolved := map[string][]string{}
+	for host, _ := range n.hostnames() {
+		if ips, updated := updates[host]; updated {
+			resolved[host] = ips
+		} else if ips, exists := n.Resolved[host]; exists {
+			resolved[host] = ips
+		}
+	}
+	n.Resolved = resolved
+}
+
+func (n *NetworkSecurity) MonitorHostnames() {
+	for {
+		time.Sleep(ResolveInterval)
+		n.ResolveHostnames()
+	}
+}
+
+// Resolve every hostname again and install the rules for any changes. A hostname that fails to resolve keeps
+// the IPs it last resolved to.
+func (n *NetworkSecurity) ResolveHostnames() error {
+	n.Lock()
+	hosts := n.hostnames()
+	n.Unlock()
+	resolved := map[string][]string{}
+	for host, _ := range hosts {
+		ips, err := resolve(host)
+		if err != nil {
+			log.Printf("[netsec] could not resolve %s: %v", host, err)
+			metrics.Inc("netsec.resolve_errors")
+			continue
+		}
+		resolved[host] = ips
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	changes := []string{}
+	for host, ips := range resolved {
+		if !reflect.DeepEqual(n.Resolved[host], ips) {
+			changes = append(changes, fmt.Sprintf("%s %v -> %v", host, n.Resolved[host], ips))
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	sort.Strings(changes)
+	currentResolved := n.Resolved
+	n.updateResolved(resolved)
+	n.updateDeniedIPs()
+	if err := n.apply(); err != nil {
+		n.Resolved = currentResolved
+		n.updateDeniedIPs()
+		return err
+	}
+	n.save()
+	events.Record("netsec-resolved", "", "hostnames resolved to new IPs: %s", strings.Join(changes, ", "))
+	return nil
+}
@@ -0,0 +1,388 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package netsec
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Everything netsec installs. Firewalls turn it into their own rules and swap it in atomically.
+type Ruleset struct {
+	Marks   []Mark
+	Groups  []Group // the groups allows and ingresses refer to
+	Allows  []Allow
+	Ingress []Ingress
+	Guards  []Guard
+	Denies  []string // addresses of every group
+	// how often rejects to denied addresses are logged, like 10/minute. empty means they aren't.
+	LogRejects string
+	// live rules in netsec's chains that it would never install. never part of an expected ruleset.
+	Unknown []string
+	// what matched each allow, by its normalized string, and the denies, under denyCounter. only filled in for
+	// live rules.
+	Counters map[string]Counter
+}
+
+// the key of the counter of the blanket deny rules
+const denyCounter = "deny"
+
+// the key of an allow's counter
+func allowCounter(a Allow) string {
+	a.Mark = normalizeMark(a.Mark)
+	return a.String()
+}
+
+type allowsByKey []Allow
+
+func (a allowsByKey) Len() int      { return len(a) }
+func (a allowsByKey) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a allowsByKey) Less(i, j int) bool {
+	if a[i].Mark != a[j].Mark {
+		return a[i].Mark < a[j].Mark
+	}
+	if a[i].Protocol != a[j].Protocol {
+		return a[i].Protocol < a[j].Protocol
+	}
+	if a[i].Group != a[j].Group {
+		return a[i].Group < a[j].Group
+	}
+	return a[i].Port < a[j].Port
+}
+
+type ingressByKey []Ingress
+
+func (i ingressByKey) Len() int      { return len(i) }
+func (i ingressByKey) Swap(a, b int) { i[a], i[b] = i[b], i[a] }
+func (i ingressByKey) Less(a, b int) bool {
+	if i[a].Port != i[b].Port {
+		return i[a].Port < i[b].Port
+	}
+	if i[a].Protocol != i[b].Protocol {
+		return i[a].Protocol < i[b].Protocol
+	}
+	if i[a].Group != i[b].Group {
+		return i[a].Group < i[b].Group
+	}
+	return i[a].Addr < i[b].Addr
+}
+
+type guardsByKey []Guard
+
+func (g guardsByKey) Len() int      { return len(g) }
+func (g guardsByKey) Swap(i, j int) { g[i], g[j] = g[j], g[i] }
+func (g guardsByKey) Less(i, j int) bool {
+	if g[i].Port != g[j].Port {
+		return g[i].Port < g[j].Port
+	}
+	return g[i].Protocol < g[j].Protocol
+}
+
+type marksByVeth []Mark
+
+func (m marksByVeth) Len() int           { return len(m) }
+func (m marksByVeth) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m marksByVeth) Less(i, j int) bool { return m[i].Veth < m[j].Veth }
+
+// The rules for the current state. Sorted and without duplicates so equal states give equal rulesets.
+// Callers must hold the lock.
+func (n *NetworkSecurity) ruleset() *Ruleset {
+	r := &Ruleset{Marks: []Mark{}, Groups: []Group{}, Allows: []Allow{}, Ingress: []Ingress{}, Guards: []Guard{},
+		LogRejects: RejectLogRate}
+	denies := []string{}
+	for addr, _ := range n.DeniedIPs {
+		denies = append(denies, addr)
+	}
+	r.Denies = collapseAddrs(denies)
+	allows := map[Allow]bool{}
+	groups := map[string]bool{}
+	for _, contSec := range n.Containers {
+		r.Marks = append(r.Marks, contSec.markRule())
+		for protocol, sgs := range contSec.groupsByProtocol() {
+			for group, ports := range sgs {
+				for _, port := range ports {
+					allows[contSec.allowRule(protocol, group, port)] = true
+					groups[group] = true
+				}
+			}
+		}
+		ingress, guards := contSec.ingressRules()
+		for _, in := range ingress {
+			if in.Group != "" {
+				groups[in.Group] = true
+			}
+		}
+		r.Ingress = append(r.Ingress, ingress...)
+		r.Guards = append(r.Guards, guards...)
+	}
+	for allow, _ := range allows {
+		r.Allows = append(r.Allows, allow)
+	}
+	names := []string{}
+	for group, _ := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	for _, group := range names {
+		r.Groups = append(r.Groups, Group{Name: group, Addrs: collapseAddrs(n.groupAddrs(group))})
+	}
+	sort.Sort(marksByVeth(r.Marks))
+	sort.Sort(allowsByKey(r.Allows))
+	sort.Sort(ingressByKey(r.Ingress))
+	sort.Sort(guardsByKey(r.Guards))
+	if !IPv6 {
+		r.dropIPv6()
+	}
+	return r
+}
+
+// Leave out the IPv6 addresses, for hosts that can't install IPv6 rules
+func (r *Ruleset) dropIPv6() {
+	for i, group := range r.Groups {
+		r.Groups[i].Addrs, _ = splitFamilies(group.Addrs)
+	}
+	r.Denies, _ = splitFamilies(r.Denies)
+	ingress := []Ingress{}
+	for _, in := range r.Ingress {
+		if in.Addr == "" || !isIPv6(in.Addr) {
+			ingress = append(ingress, in)
+		}
+	}
+	r.Ingress = ingress
+}
+
+// One line per rule, in the order they are installed
+func (r *Ruleset) Strings() []string {
+	strs := []string{}
+	for _, mark := range r.Marks {
+		strs = append(strs, mark.String())
+	}
+	for _, group := range r.Groups {
+		for _, addr := range group.Addrs {
+			strs = append(strs, "group "+group.Name+" "+addr)
+		}
+	}
+	for _, allow := range r.Allows {
+		strs = append(strs, allow.String())
+	}
+	for _, in := range r.Ingress {
+		strs = append(strs, in.String())
+	}
+	for _, guard := range r.Guards {
+		strs = append(strs, guard.String())
+	}
+	if r.LogRejects != "" {
+		strs = append(strs, "log rejects "+r.LogRejects)
+	}
+	for _, ip := range r.Denies {
+		strs = append(strs, "deny "+ip)
+	}
+	for _, rule := range r.Unknown {
+		strs = append(strs, "unknown "+rule)
+	}
+	return strs
+}
+
+// marks read back from the firewall are in hex. compare them as numbers.
+func normalizeMark(mark string) string {
+	if n, err := strconv.ParseUint(mark, 0, 32); err == nil {
+		return strconv.FormatUint(n, 10)
+	}
+	return mark
+}
+
+func (r *Ruleset) normalized() *Ruleset {
+	norm := &Ruleset{Groups: r.Groups, Ingress: r.Ingress, Guards: r.Guards, Denies: r.Denies,
+		LogRejects: r.LogRejects, Unknown: r.Unknown, Counters: r.Counters}
+	for _, m := range r.Marks {
+		norm.Marks = append(norm.Marks, Mark{Veth: m.Veth, Mark: normalizeMark(m.Mark)})
+	}
+	for _, a := range r.Allows {
+		a.Mark = normalizeMark(a.Mark)
+		norm.Allows = append(norm.Allows, a)
+	}
+	return norm
+}
+
+func parsePort(port string) (uint16, error) {
+	n, err := strconv.ParseUint(port, 10, 16)
+	return uint16(n), err
+}
+
+// The rules that are expected but not live, and the ones that are live but not expected
+func (r *Ruleset) Diff(live *Ruleset) (missing, extra []string) {
+	expectedStrs := r.normalized().Strings()
+	liveStrs := live.normalized().Strings()
+	expectedSet := map[string]bool{}
+	for _, rule := range expectedStrs {
+		expectedSet[rule] = true
+	}
+	liveSet := map[string]bool{}
+	for _, rule := range liveStrs {
+		liveSet[rule] = true
+	}
+	missing, extra = []string{}, []string{}
+	for _, rule := range expectedStrs {
+		if !liveSet[rule] {
+			missing = append(missing, rule)
+		}
+	}
+	for _, rule := range liveStrs {
+		if !expectedSet[rule] {
+			extra = append(extra, rule)
+		}
+	}
+	return missing, extra
+}
+
+// an empty ruleset for reading live rules into
+func newLiveRuleset() *Ruleset {
+	return &Ruleset{Marks: []Mark{}, Groups: []Group{}, Allows: []Allow{}, Ingress: []Ingress{}, Guards: []Guard{},
+		Denies: []string{}, Unknown: []string{}, Counters: map[string]Counter{}}
+}
+
+// add what matched a rule to its counter
+func (r *Ruleset) count(key string, packets, bytes uint64) {
+	counter := r.Counters[key]
+	counter.Packets += packets
+	counter.Bytes += bytes
+	r.Counters[key] = counter
+}
+
+// Combine the live IPv4 and IPv6 halves of a ruleset. Addresses come from whichever family holds them. Every other
+// rule has to be installed in both families to count. A rule live in only one family is reported as unknown.
+// Counters are summed over both families.
+func mergeFamilies(v4, v6 *Ruleset) *Ruleset {
+	r := &Ruleset{Marks: []Mark{}, Groups: []Group{}, Allows: []Allow{}, Ingress: []Ingress{}, Guards: []Guard{},
+		Unknown: append([]string{}, v4.Unknown...), Counters: map[string]Counter{}}
+	for _, half := range []*Ruleset{v4, v6} {
+		for key, counter := range half.Counters {
+			r.count(key, counter.Packets, counter.Bytes)
+		}
+	}
+	for _, rule := range v6.Unknown {
+		r.Unknown = append(r.Unknown, "ip6 "+rule)
+	}
+	// rules in both halves, by their string
+	inBoth := func(v4Rules, v6Rules []string) map[string]bool {
+		v6Set := map[string]bool{}
+		for _, rule := range v6Rules {
+			v6Set[rule] = true
+		}
+		both := map[string]bool{}
+		for _, rule := range v4Rules {
+			if v6Set[rule] {
+				both[rule] = true
+			} else {
+				r.Unknown = append(r.Unknown, "ip only: "+rule)
+			}
+		}
+		for _, rule := range v6Rules {
+			if !both[rule] {
+				r.Unknown = append(r.Unknown, "ip6 only: "+rule)
+			}
+		}
+		return both
+	}
+
+	v4Marks, v6Marks := []string{}, []string{}
+	for _, m := range v4.normalized().Marks {
+		v4Marks = append(v4Marks, m.String())
+	}
+	for _, m := range v6.normalized().Marks {
+		v6Marks = append(v6Marks, m.String())
+	}
+	marks := inBoth(v4Marks, v6Marks)
+	for _, m := range v4.normalized().Marks {
+		if marks[m.String()] {
+			r.Marks = append(r.Marks, m)
+		}
+	}
+
+	v4Allows, v6Allows := []string{}, []string{}
+	for _, a := range v4.normalized().Allows {
+		v4Allows = append(v4Allows, a.String())
+	}
+	for _, a := range v6.normalized().Allows {
+		v6Allows = append(v6Allows, a.String())
+	}
+	allows := inBoth(v4Allows, v6Allows)
+	for _, a := range v4.normalized().Allows {
+		if allows[a.String()] {
+			r.Allows = append(r.Allows, a)
+		}
+	}
+
+	// ingress from an address only lives in the address's family
+	v4Ingress, v6Ingress := []string{}, []string{}
+	for _, in := range v4.Ingress {
+		if in.Group == "" {
+			r.Ingress = append(r.Ingress, in)
+		} else {
+			v4Ingress = append(v4Ingress, in.String())
+		}
+	}
+	for _, in := range v6.Ingress {
+		if in.Group == "" {
+			r.Ingress = append(r.Ingress, in)
+		} else {
+			v6Ingress = append(v6Ingress, in.String())
+		}
+	}
+	ingress := inBoth(v4Ingress, v6Ingress)
+	for _, in := range v4.Ingress {
+		if in.Group != "" && ingress[in.String()] {
+			r.Ingress = append(r.Ingress, in)
+		}
+	}
+	sort.Sort(ingressByKey(r.Ingress))
+
+	v4Guards, v6Guards := []string{}, []string{}
+	for _, g := range v4.Guards {
+		v4Guards = append(v4Guards, g.String())
+	}
+	for _, g := range v6.Guards {
+		v6Guards = append(v6Guards, g.String())
+	}
+	guards := inBoth(v4Guards, v6Guards)
+	for _, g := range v4.Guards {
+		if guards[g.String()] {
+			r.Guards = append(r.Guards, g)
+		}
+	}
+
+	v4Log, v6Log := []string{}, []string{}
+	if v4.LogRejects != "" {
+		v4Log = append(v4Log, "log rejects "+v4.LogRejects)
+	}
+	if v6.LogRejects != "" {
+		v6Log = append(v6Log, "log rejects "+v6.LogRejects)
+	}
+	if inBoth(v4Log, v6Log)["log rejects "+v4.LogRejects] {
+		r.LogRejects = v4.LogRejects
+	}
+
+	groups := map[string][]string{}
+	names := []string{}
+	for _, group := range append(append([]Group{}, v4.Groups...), v6.Groups...) {
+		if _, seen := groups[group.Name]; !seen {
+			names = append(names, group.Name)
+		}
+		groups[group.Name] = append(groups[group.Name], group.Addrs...)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r.Groups = append(r.Groups, Group{Name: name, Addrs: collapseAddrs(groups[name])})
+	}
+	r.Denies = collapseAddrs(append(append([]string{}, v4.Denies...), v6.Denies...))
+	return r
+}
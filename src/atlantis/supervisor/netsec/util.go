@@ -21,20 +21,37 @@ import (
 func echoIPTables(pretend bool) {
 	executeCommand(pretend, "iptables", "-L")
 	executeCommand(pretend, "iptables", "-t", "mangle", "-L")
+	if IPv6 {
+		executeCommand(pretend, "ip6tables", "-L")
+		executeCommand(pretend, "ip6tables", "-t", "mangle", "-L")
+	}
 }
 
 func executeCommand(pretend bool, command string, args ...string) (string, error) {
+	return executeCommandWithInput(pretend, "", command, args...)
+}
+
+// Run the command with input on stdin
+func executeCommandWithInput(pretend bool, input, command string, args ...string) (string, error) {
 	cmdStr := command
 	for _, arg := range args {
 		cmdStr += " " + arg
 	}
 	log.Println("[netsec][exec] " + cmdStr)
+	for _, line := range strings.Split(strings.TrimSpace(input), "\n") {
+		if line != "" {
+			log.Println("[netsec][exec] < " + line)
+		}
+	}
 	var out string
 	var err error
 	if pretend {
 		out = "pretending. no output."
 	} else {
 		cmd := exec.Command(command, args...)
+		if input != "" {
+			cmd.Stdin = strings.NewReader(input)
+		}
 		var outBytes []byte
 		outBytes, err = cmd.CombinedOutput()
 		out = string(outBytes)
@@ -65,12 +65,55 @@ func (e *DeployExecutor) Execute(t *Task) error {
 	if e.arg.Manifest.MemoryLimit == 0 {
 		return errors.New("Please specify a memory limit.")
 	}
-	cont, err := containers.Reserve(e.arg.ContainerID, e.arg.Manifest)
+	if e.arg.Image != "" {
+		if _, _, _, err := ParseImageRef(e.arg.Image); err != nil {
+			return err
+		}
+	}
+	if e.arg.ExpectedDigest != "" {
+		if err := ValidateDigest(e.arg.ExpectedDigest); err != nil {
+			return err
+		}
+	} else if e.arg.DigestSignature != "" {
+		return errors.New("Please specify the digest the signature is for.")
+	}
+	if err := e.arg.Manifest.ValidateEnvironment(); err != nil {
+		return err
+	}
+	if err := e.arg.Manifest.ValidateVolumes(); err != nil {
+		return err
+	}
+	if err := e.arg.Manifest.ValidateConfigRenderings(); err != nil {
+		return err
+	}
+	if err := e.arg.Manifest.ValidateReload(); err != nil {
+		return err
+	}
+	if err := e.arg.Manifest.ValidateBandwidth(); err != nil {
+		return err
+	}
+	// check every dep up front so nothing is reserved or pulled for a deploy that can't work. the problems are
+	// replied rather than returned since rpc errors don't carry replies.
+	if err := containers.ValidateDeps(e.arg.Manifest.Deps); err != nil {
+		t.Log("-> %v", err)
+		problems, ok := err.(DepProblems)
+		if !ok {
+			return err
+		}
+		e.reply.Problems = problems
+		e.reply.Status = StatusError
+		return nil
+	}
+	cont, err := containers.Reserve(e.arg.ContainerID, e.arg.App, e.arg.Env, e.arg.Manifest)
 	if err != nil {
 		t.Log("-> Error reserving container: %v", err)
 		return err
 	}
-	err = cont.Deploy(e.arg.Host, e.arg.App, e.arg.Sha, e.arg.Env)
+	err = cont.Deploy(e.arg.Host, e.arg.App, e.arg.Sha, e.arg.Env, &ImageSpec{
+		Ref:             e.arg.Image,
+		ExpectedDigest:  e.arg.ExpectedDigest,
+		DigestSignature: e.arg.DigestSignature,
+	})
 	if err != nil {
 		cont.Teardown()
 		return err
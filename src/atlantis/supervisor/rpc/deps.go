@@ -0,0 +1,108 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package rpc
+
+import (
+	. "atlantis/common"
+	"atlantis/supervisor/containers"
+	. "atlantis/supervisor/rpc/types"
+	"errors"
+)
+
+// Replace the dependencies of a running container. Its config is rewritten in place and the app is told to
+// reload instead of being redeployed.
+type UpdateDepsExecutor struct {
+	arg   SupervisorUpdateDepsArg
+	reply *SupervisorUpdateDepsReply
+}
+
+func (e *UpdateDepsExecutor) Request() interface{} {
+	return e.arg
+}
+
+func (e *UpdateDepsExecutor) Result() interface{} {
+	return e.reply
+}
+
+func (e *UpdateDepsExecutor) Description() string {
+	return e.arg.ContainerID
+}
+
+func (e *UpdateDepsExecutor) Authorize() error {
+	return nil
+}
+
+func (e *UpdateDepsExecutor) Execute(t *Task) error {
+	if e.arg.ContainerID == "" {
+		return errors.New("Please specify a container id.")
+	}
+	if e.arg.Deps == nil {
+		return errors.New("Please specify the dependencies.")
+	}
+	cont, err := containers.UpdateDeps(e.arg.ContainerID, e.arg.Deps)
+	e.reply.Container = cont
+	if err != nil {
+		t.Log("-> Error updating deps: %v", err)
+		// problems with the deps are replied since rpc errors don't carry replies
+		problems, ok := err.(DepProblems)
+		if !ok {
+			return err
+		}
+		e.reply.Problems = problems
+		e.reply.Status = StatusError
+		return nil
+	}
+	e.reply.Status = StatusOk
+	return nil
+}
+
+func (ih *Supervisor) UpdateDeps(arg SupervisorUpdateDepsArg, reply *SupervisorUpdateDepsReply) error {
+	return NewTask("UpdateDeps", &UpdateDepsExecutor{arg, reply}).Run()
+}
+
+// Re-encrypt the deps of every container under the active key so old keys can be retired
+type ReencryptStateExecutor struct {
+	arg   SupervisorReencryptStateArg
+	reply *SupervisorReencryptStateReply
+}
+
+func (e *ReencryptStateExecutor) Request() interface{} {
+	return e.arg
+}
+
+func (e *ReencryptStateExecutor) Result() interface{} {
+	return e.reply
+}
+
+func (e *ReencryptStateExecutor) Description() string {
+	return "ReencryptState"
+}
+
+func (e *ReencryptStateExecutor) Authorize() error {
+	return nil
+}
+
+func (e *ReencryptStateExecutor) Execute(t *Task) error {
+	stats, err := containers.ReencryptState()
+	if err != nil {
+		t.Log("-> Error re-encrypting state: %v", err)
+		e.reply.Status = StatusError
+		return err
+	}
+	e.reply.Stats = stats
+	e.reply.Status = StatusOk
+	return nil
+}
+
+func (ih *Supervisor) ReencryptState(arg SupervisorReencryptStateArg, reply *SupervisorReencryptStateReply) error {
+	return NewTask("ReencryptState", &ReencryptStateExecutor{arg, reply}).Run()
+}
@@ -0,0 +1,51 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package rpc
+
+import (
+	. "atlantis/common"
+	"atlantis/supervisor/events"
+	. "atlantis/supervisor/rpc/types"
+	"fmt"
+)
+
+// List what the supervisor recorded on its own, e.g. failed image verifications
+type ListEventsExecutor struct {
+	arg   SupervisorListEventsArg
+	reply *SupervisorListEventsReply
+}
+
+func (e *ListEventsExecutor) Request() interface{} {
+	return e.arg
+}
+
+func (e *ListEventsExecutor) Result() interface{} {
+	return e.reply
+}
+
+func (e *ListEventsExecutor) Description() string {
+	return fmt.Sprintf("kind: %s, container: %s, limit: %d", e.arg.Kind, e.arg.ContainerID, e.arg.Limit)
+}
+
+func (e *ListEventsExecutor) Authorize() error {
+	return nil
+}
+
+func (e *ListEventsExecutor) Execute(t *Task) error {
+	e.reply.Events = events.List(e.arg.Kind, e.arg.ContainerID, e.arg.Limit)
+	e.reply.Status = StatusOk
+	return nil
+}
+
+func (ih *Supervisor) ListEvents(arg SupervisorListEventsArg, reply *SupervisorListEventsReply) error {
+	return NewTask("ListEvents", &ListEventsExecutor{arg, reply}).Run()
+}
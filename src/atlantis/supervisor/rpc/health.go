@@ -15,6 +15,8 @@ import (
 	. "atlantis/common"
 	. "atlantis/supervisor/constant"
 	"atlantis/supervisor/containers"
+	"atlantis/supervisor/docker"
+	"atlantis/supervisor/netsec"
 	. "atlantis/supervisor/rpc/types"
 )
 
@@ -49,8 +51,15 @@ func (e *HealthCheckExecutor) Execute(t *Task) error {
 	e.reply.Zone = Zone
 	e.reply.Price = Price
 	e.reply.Containers, e.reply.CPUShares, e.reply.Memory = containers.Nums()
+	e.reply.CPUSet = containers.CPUSetNums()
+	e.reply.Quotas = containers.QuotaNums()
+	e.reply.Docker = docker.Health()
+	e.reply.Netsec = netsec.Status()
+	e.reply.Bandwidth = containers.NetworkSecurity.BandwidthStats()
 	if Tracker.UnderMaintenance() {
 		e.reply.Status = StatusMaintenance
+	} else if !e.reply.Docker.Healthy || !e.reply.Netsec.Healthy {
+		e.reply.Status = StatusError
 	} else if e.reply.Containers.Free == 0 || e.reply.Memory.Free == 0 || e.reply.CPUShares.Free == 0 {
 		e.reply.Status = StatusFull
 	} else {
@@ -63,6 +72,21 @@ func (e *HealthCheckExecutor) Execute(t *Task) error {
 		e.reply.CPUShares.Used, e.reply.CPUShares.Free)
 	t.Log("-> memory: %d MB total, %d MB used, %d MB free", e.reply.Memory.Total,
 		e.reply.Memory.Used, e.reply.Memory.Free)
+	t.Log("-> dedicated cpus: %d total, %d used, %d free, reserved %v", e.reply.CPUSet.Total,
+		e.reply.CPUSet.Used, e.reply.CPUSet.Free, e.reply.CPUSet.ReservedCPUs)
+	for _, quota := range e.reply.Quotas {
+		t.Log("-> %s %s quota: containers %d/%d, cpu shares %d/%d, memory %d/%d MB", quota.Scope, quota.Name,
+			quota.Containers.Used, quota.Containers.Total, quota.CPUShares.Used, quota.CPUShares.Total,
+			quota.Memory.Used, quota.Memory.Total)
+	}
+	t.Log("-> docker: %s healthy: %t, last error: %s, reconnects: %d", e.reply.Docker.Endpoint,
+		e.reply.Docker.Healthy, e.reply.Docker.LastError, e.reply.Docker.Reconnects)
+	t.Log("-> netsec: %s healthy: %t, missing: %d, extra: %d, last error: %s", e.reply.Netsec.Backend,
+		e.reply.Netsec.Healthy, len(e.reply.Netsec.Missing), len(e.reply.Netsec.Extra), e.reply.Netsec.LastError)
+	for _, bw := range e.reply.Bandwidth {
+		t.Log("-> bandwidth %s: in %d/%d kbit/s, out %d/%d kbit/s", bw.ContainerID, bw.Ingress, bw.IngressLimit,
+			bw.Egress, bw.EgressLimit)
+	}
 	t.Log("-> status: %s", e.reply.Status)
 	return nil
 }
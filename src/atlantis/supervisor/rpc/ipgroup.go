@@ -33,7 +33,7 @@ func (e *UpdateIPGroupExecutor) Result() interface{} {
 }
 
 func (e *UpdateIPGroupExecutor) Description() string {
-	return fmt.Sprintf("%s -> %v", e.arg.Name, e.arg.IPs)
+	return fmt.Sprintf("%s -> %v, dry run: %t", e.arg.Name, e.arg.IPs, e.arg.DryRun)
 }
 
 func (e *UpdateIPGroupExecutor) Authorize() error {
@@ -45,13 +45,19 @@ func (e *UpdateIPGroupExecutor) Execute(t *Task) error {
 		return errors.New("Please specify a Name.")
 	}
 	if e.arg.IPs == nil {
-		return errors.New("Please specify a list of IPs.")
+		return errors.New("Please specify a list of IPs, CIDR blocks or hostnames.")
 	}
-	err := containers.NetworkSecurity.UpdateIPGroup(e.arg.Name, e.arg.IPs)
-	if err != nil {
-		e.reply.Status = StatusOk
+	var err error
+	if e.arg.DryRun {
+		e.reply.Diff, err = containers.NetworkSecurity.DryRunUpdateIPGroup(e.arg.Name, e.arg.IPs)
+		logIPGroupDiff(t, e.reply.Diff)
 	} else {
+		err = containers.NetworkSecurity.UpdateIPGroup(e.arg.Name, e.arg.IPs)
+	}
+	if err != nil {
 		e.reply.Status = StatusError
+	} else {
+		e.reply.Status = StatusOk
 	}
 	return err
 }
@@ -60,6 +66,22 @@ func (ih *Supervisor) UpdateIPGroup(arg SupervisorUpdateIPGroupArg, reply *Super
 	return NewTask("UpdateIPGroup", &UpdateIPGroupExecutor{arg, reply}).Run()
 }
 
+func logIPGroupDiff(t *Task, diff *IPGroupDiff) {
+	if diff == nil {
+		return
+	}
+	t.Log("-> would add %v, remove %v", diff.Added, diff.Removed)
+	for _, user := range diff.Affected {
+		t.Log("-> affects %s on %s %v", user.ContainerID, user.Protocol, user.Ports)
+	}
+	for _, rule := range diff.Inserted {
+		t.Log("-> would insert: %s", rule)
+	}
+	for _, rule := range diff.Deleted {
+		t.Log("-> would delete: %s", rule)
+	}
+}
+
 type DeleteIPGroupExecutor struct {
 	arg   SupervisorDeleteIPGroupArg
 	reply *SupervisorDeleteIPGroupReply
@@ -74,7 +96,7 @@ func (e *DeleteIPGroupExecutor) Result() interface{} {
 }
 
 func (e *DeleteIPGroupExecutor) Description() string {
-	return fmt.Sprintf("%s", e.arg.Name)
+	return fmt.Sprintf("%s, dry run: %t", e.arg.Name, e.arg.DryRun)
 }
 
 func (e *DeleteIPGroupExecutor) Authorize() error {
@@ -85,11 +107,17 @@ func (e *DeleteIPGroupExecutor) Execute(t *Task) error {
 	if e.arg.Name == "" {
 		return errors.New("Please specify a Name.")
 	}
-	err := containers.NetworkSecurity.DeleteIPGroup(e.arg.Name)
-	if err != nil {
-		e.reply.Status = StatusOk
+	var err error
+	if e.arg.DryRun {
+		e.reply.Diff, err = containers.NetworkSecurity.DryRunDeleteIPGroup(e.arg.Name)
+		logIPGroupDiff(t, e.reply.Diff)
 	} else {
+		err = containers.NetworkSecurity.DeleteIPGroup(e.arg.Name)
+	}
+	if err != nil {
 		e.reply.Status = StatusError
+	} else {
+		e.reply.Status = StatusOk
 	}
 	return err
 }
@@ -97,3 +125,81 @@ func (e *DeleteIPGroupExecutor) Execute(t *Task) error {
 func (ih *Supervisor) DeleteIPGroup(arg SupervisorDeleteIPGroupArg, reply *SupervisorDeleteIPGroupReply) error {
 	return NewTask("DeleteIPGroup", &DeleteIPGroupExecutor{arg, reply}).Run()
 }
+
+type ListIPGroupsExecutor struct {
+	arg   SupervisorListIPGroupsArg
+	reply *SupervisorListIPGroupsReply
+}
+
+func (e *ListIPGroupsExecutor) Request() interface{} {
+	return e.arg
+}
+
+func (e *ListIPGroupsExecutor) Result() interface{} {
+	return e.reply
+}
+
+func (e *ListIPGroupsExecutor) Description() string {
+	return "ListIPGroups"
+}
+
+func (e *ListIPGroupsExecutor) Authorize() error {
+	return nil
+}
+
+func (e *ListIPGroupsExecutor) Execute(t *Task) (err error) {
+	e.reply.IPGroups, err = containers.NetworkSecurity.ListIPGroups()
+	if err != nil {
+		e.reply.Status = StatusError
+		return err
+	}
+	e.reply.Status = StatusOk
+	for _, group := range e.reply.IPGroups {
+		t.Log("-> %s: %v, %d users, installed: %t", group.Name, group.Members, len(group.Users), group.Installed)
+	}
+	return nil
+}
+
+func (ih *Supervisor) ListIPGroups(arg SupervisorListIPGroupsArg, reply *SupervisorListIPGroupsReply) error {
+	return NewTask("ListIPGroups", &ListIPGroupsExecutor{arg, reply}).Run()
+}
+
+type GetIPGroupExecutor struct {
+	arg   SupervisorGetIPGroupArg
+	reply *SupervisorGetIPGroupReply
+}
+
+func (e *GetIPGroupExecutor) Request() interface{} {
+	return e.arg
+}
+
+func (e *GetIPGroupExecutor) Result() interface{} {
+	return e.reply
+}
+
+func (e *GetIPGroupExecutor) Description() string {
+	return e.arg.Name
+}
+
+func (e *GetIPGroupExecutor) Authorize() error {
+	return nil
+}
+
+func (e *GetIPGroupExecutor) Execute(t *Task) (err error) {
+	if e.arg.Name == "" {
+		return errors.New("Please specify a Name.")
+	}
+	e.reply.IPGroup, err = containers.NetworkSecurity.GetIPGroup(e.arg.Name)
+	if err != nil {
+		e.reply.Status = StatusError
+		return err
+	}
+	e.reply.Status = StatusOk
+	t.Log("-> %v, %d users, installed: %t", e.reply.IPGroup.Members, len(e.reply.IPGroup.Users),
+		e.reply.IPGroup.Installed)
+	return nil
+}
+
+func (ih *Supervisor) GetIPGroup(arg SupervisorGetIPGroupArg, reply *SupervisorGetIPGroupReply) error {
+	return NewTask("GetIPGroup", &GetIPGroupExecutor{arg, reply}).Run()
+}
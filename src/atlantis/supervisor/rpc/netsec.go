@@ -0,0 +1,150 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package rpc
+
+import (
+	. "atlantis/common"
+	"atlantis/supervisor/containers"
+	"atlantis/supervisor/netsec"
+	. "atlantis/supervisor/rpc/types"
+	"errors"
+	"fmt"
+)
+
+type NetsecStatusExecutor struct {
+	arg   SupervisorNetsecStatusArg
+	reply *SupervisorNetsecStatusReply
+}
+
+func (e *NetsecStatusExecutor) Request() interface{} {
+	return e.arg
+}
+
+func (e *NetsecStatusExecutor) Result() interface{} {
+	return e.reply
+}
+
+func (e *NetsecStatusExecutor) Description() string {
+	return fmt.Sprintf("check: %t", e.arg.Check)
+}
+
+func (e *NetsecStatusExecutor) Authorize() error {
+	return nil
+}
+
+func (e *NetsecStatusExecutor) AllowDuringMaintenance() bool {
+	return true
+}
+
+func (e *NetsecStatusExecutor) Execute(t *Task) error {
+	if e.arg.Check {
+		e.reply.Netsec = containers.NetworkSecurity.CheckDrift()
+	} else {
+		e.reply.Netsec = netsec.Status()
+	}
+	if e.reply.Netsec.Healthy {
+		e.reply.Status = StatusOk
+	} else {
+		e.reply.Status = StatusError
+	}
+	t.Log("-> %s healthy: %t, missing: %v, extra: %v, drifts: %d, repairs: %d", e.reply.Netsec.Backend,
+		e.reply.Netsec.Healthy, e.reply.Netsec.Missing, e.reply.Netsec.Extra, e.reply.Netsec.Drifts,
+		e.reply.Netsec.Repairs)
+	return nil
+}
+
+func (ih *Supervisor) NetsecStatus(arg SupervisorNetsecStatusArg, reply *SupervisorNetsecStatusReply) error {
+	return NewTask("NetsecStatus", &NetsecStatusExecutor{arg, reply}).Run()
+}
+
+type GetContainerSecurityExecutor struct {
+	arg   SupervisorGetContainerSecurityArg
+	reply *SupervisorGetContainerSecurityReply
+}
+
+func (e *GetContainerSecurityExecutor) Request() interface{} {
+	return e.arg
+}
+
+func (e *GetContainerSecurityExecutor) Result() interface{} {
+	return e.reply
+}
+
+func (e *GetContainerSecurityExecutor) Description() string {
+	return e.arg.ContainerID
+}
+
+func (e *GetContainerSecurityExecutor) Authorize() error {
+	return nil
+}
+
+func (e *GetContainerSecurityExecutor) Execute(t *Task) (err error) {
+	if e.arg.ContainerID == "" {
+		return errors.New("Please specify a container id.")
+	}
+	e.reply.Security, err = containers.NetworkSecurity.GetContainerSecurity(e.arg.ContainerID)
+	if err != nil {
+		e.reply.Status = StatusError
+		return err
+	}
+	e.reply.Status = StatusOk
+	t.Log("-> veth %s, mark %s, installed: %t", e.reply.Security.Veth, e.reply.Security.Mark,
+		e.reply.Security.Installed)
+	return nil
+}
+
+func (ih *Supervisor) GetContainerSecurity(arg SupervisorGetContainerSecurityArg,
+	reply *SupervisorGetContainerSecurityReply) error {
+	return NewTask("GetContainerSecurity", &GetContainerSecurityExecutor{arg, reply}).Run()
+}
+
+type RuleCountersExecutor struct {
+	arg   SupervisorRuleCountersArg
+	reply *SupervisorRuleCountersReply
+}
+
+func (e *RuleCountersExecutor) Request() interface{} {
+	return e.arg
+}
+
+func (e *RuleCountersExecutor) Result() interface{} {
+	return e.reply
+}
+
+func (e *RuleCountersExecutor) Description() string {
+	return e.arg.ContainerID
+}
+
+func (e *RuleCountersExecutor) Authorize() error {
+	return nil
+}
+
+func (e *RuleCountersExecutor) AllowDuringMaintenance() bool {
+	return true
+}
+
+func (e *RuleCountersExecutor) Execute(t *Task) (err error) {
+	e.reply.Counters, err = containers.NetworkSecurity.RuleCounters(e.arg.ContainerID)
+	if err != nil {
+		e.reply.Status = StatusError
+		return err
+	}
+	e.reply.Status = StatusOk
+	for _, counter := range e.reply.Counters {
+		t.Log("-> %s %s: %d packets, %d bytes", counter.ContainerID, counter.Rule, counter.Packets, counter.Bytes)
+	}
+	return nil
+}
+
+func (ih *Supervisor) RuleCounters(arg SupervisorRuleCountersArg, reply *SupervisorRuleCountersReply) error {
+	return NewTask("RuleCounters", &RuleCountersExecutor{arg, reply}).Run()
+}
@@ -0,0 +1,107 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package rpc
+
+import (
+	. "atlantis/common"
+	"atlantis/supervisor/containers"
+	. "atlantis/supervisor/rpc/types"
+	"errors"
+	"fmt"
+)
+
+type UpdateQuotaExecutor struct {
+	arg   SupervisorUpdateQuotaArg
+	reply *SupervisorUpdateQuotaReply
+}
+
+func (e *UpdateQuotaExecutor) Request() interface{} {
+	return e.arg
+}
+
+func (e *UpdateQuotaExecutor) Result() interface{} {
+	return e.reply
+}
+
+func (e *UpdateQuotaExecutor) Description() string {
+	if e.arg.Quota == nil {
+		return fmt.Sprintf("%s %s -> ?", e.arg.Scope, e.arg.Name)
+	}
+	return fmt.Sprintf("%s %s -> containers %d, cpu %d, mem %d", e.arg.Scope, e.arg.Name,
+		e.arg.Quota.MaxContainers, e.arg.Quota.CPUShares, e.arg.Quota.MemoryLimit)
+}
+
+func (e *UpdateQuotaExecutor) Authorize() error {
+	return nil
+}
+
+func (e *UpdateQuotaExecutor) Execute(t *Task) error {
+	if !ValidQuotaScope(e.arg.Scope) {
+		return errors.New("Please specify a scope (" + QuotaScopeApp + " or " + QuotaScopeEnv + ").")
+	}
+	if e.arg.Name == "" {
+		return errors.New("Please specify a Name.")
+	}
+	if e.arg.Quota == nil {
+		return errors.New("Please specify a Quota.")
+	}
+	if err := containers.UpdateQuota(e.arg.Scope, e.arg.Name, e.arg.Quota); err != nil {
+		e.reply.Status = StatusError
+		return err
+	}
+	e.reply.Status = StatusOk
+	return nil
+}
+
+func (ih *Supervisor) UpdateQuota(arg SupervisorUpdateQuotaArg, reply *SupervisorUpdateQuotaReply) error {
+	return NewTask("UpdateQuota", &UpdateQuotaExecutor{arg, reply}).Run()
+}
+
+type DeleteQuotaExecutor struct {
+	arg   SupervisorDeleteQuotaArg
+	reply *SupervisorDeleteQuotaReply
+}
+
+func (e *DeleteQuotaExecutor) Request() interface{} {
+	return e.arg
+}
+
+func (e *DeleteQuotaExecutor) Result() interface{} {
+	return e.reply
+}
+
+func (e *DeleteQuotaExecutor) Description() string {
+	return fmt.Sprintf("%s %s", e.arg.Scope, e.arg.Name)
+}
+
+func (e *DeleteQuotaExecutor) Authorize() error {
+	return nil
+}
+
+func (e *DeleteQuotaExecutor) Execute(t *Task) error {
+	if !ValidQuotaScope(e.arg.Scope) {
+		return errors.New("Please specify a scope (" + QuotaScopeApp + " or " + QuotaScopeEnv + ").")
+	}
+	if e.arg.Name == "" {
+		return errors.New("Please specify a Name.")
+	}
+	if err := containers.DeleteQuota(e.arg.Scope, e.arg.Name); err != nil {
+		e.reply.Status = StatusError
+		return err
+	}
+	e.reply.Status = StatusOk
+	return nil
+}
+
+func (ih *Supervisor) DeleteQuota(arg SupervisorDeleteQuotaArg, reply *SupervisorDeleteQuotaReply) error {
+	return NewTask("DeleteQuota", &DeleteQuotaExecutor{arg, reply}).Run()
+}
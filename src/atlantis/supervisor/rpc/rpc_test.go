@@ -16,6 +16,8 @@ import (
 	"atlantis/supervisor/containers"
 	. "atlantis/supervisor/rpc/types"
 	"github.com/adjust/gocheck"
+	"net"
+	netrpc "net/rpc"
 	"os"
 	"sort"
 	"testing"
@@ -56,9 +58,31 @@ func (s *RpcSuite) TestDeploy(c *gocheck.C) {
 	arg = SupervisorDeployArg{App: "theApp", Sha: "theSha", ContainerID: "theContainerID", Manifest: &Manifest{CPUShares: 1}}
 	reply = SupervisorDeployReply{}
 	c.Assert(ih.Deploy(arg, &reply), gocheck.ErrorMatches, "Please specify a memory limit\\.")
+	arg = SupervisorDeployArg{App: "theApp", Sha: "theSha", ContainerID: "theContainerID", Image: "registry/app:",
+		Manifest: &Manifest{CPUShares: 1, MemoryLimit: 1}}
+	c.Assert(ih.Deploy(arg, &reply), gocheck.ErrorMatches, "Invalid image tag: ")
+	arg = SupervisorDeployArg{App: "theApp", Sha: "theSha", ContainerID: "theContainerID", ExpectedDigest: "sha256:x",
+		Manifest: &Manifest{CPUShares: 1, MemoryLimit: 1}}
+	c.Assert(ih.Deploy(arg, &reply), gocheck.ErrorMatches, "Invalid image digest: sha256:x")
+	arg = SupervisorDeployArg{App: "theApp", Sha: "theSha", ContainerID: "theContainerID", DigestSignature: "c2ln",
+		Manifest: &Manifest{CPUShares: 1, MemoryLimit: 1}}
+	c.Assert(ih.Deploy(arg, &reply), gocheck.ErrorMatches, "Please specify the digest the signature is for\\.")
+	arg = SupervisorDeployArg{App: "theApp", Sha: "theSha", ContainerID: "theContainerID",
+		Manifest: &Manifest{CPUShares: 1, MemoryLimit: 1, ReloadSignal: "KILL"}}
+	c.Assert(ih.Deploy(arg, &reply), gocheck.ErrorMatches, "Invalid Manifest: unsupported reload signal: KILL")
+	arg = SupervisorDeployArg{App: "theApp", Sha: "theSha", ContainerID: "theContainerID",
+		Manifest: &Manifest{CPUShares: 1, MemoryLimit: 1, Deps: DepsType{"db": &AppDep{EncryptedData: "{",
+			SecurityGroup: map[string][]uint16{"db": []uint16{5432}}}}}}
+	reply = SupervisorDeployReply{}
+	c.Assert(ih.Deploy(arg, &reply), gocheck.IsNil)
+	c.Assert(reply.Problems, gocheck.HasLen, 2)
+	c.Assert(reply.Status, gocheck.Equals, StatusError)
+	list, _ := containers.List()
+	c.Assert(list, gocheck.HasLen, 0)
 	arg = SupervisorDeployArg{App: "theApp", Sha: "theSha", ContainerID: "theContainerID", Manifest: &Manifest{CPUShares: 1, MemoryLimit: 1}}
 	reply = SupervisorDeployReply{}
 	c.Assert(ih.Deploy(arg, &reply), gocheck.IsNil)
+	c.Assert(reply.Container.Image, gocheck.Equals, "localhost/apps/theApp-theSha")
 	c.Assert(reply.Container.ID, gocheck.Equals, arg.ContainerID)
 	c.Assert(reply.Container.PrimaryPort, gocheck.Equals, uint16(61000))
 	c.Assert(reply.Container.SecondaryPorts, gocheck.DeepEquals, []uint16{61004, 61006})
@@ -67,6 +91,72 @@ func (s *RpcSuite) TestDeploy(c *gocheck.C) {
 	c.Assert(reply.Container.App, gocheck.Equals, "theApp")
 	c.Assert(reply.Container.Sha, gocheck.Equals, "theSha")
 	c.Assert(reply.Container.DockerID, gocheck.Equals, "pretend-docker-id-theContainerID")
+	var updateReply SupervisorUpdateDepsReply
+	c.Assert(ih.UpdateDeps(SupervisorUpdateDepsArg{ContainerID: "theContainerID"}, &updateReply),
+		gocheck.ErrorMatches, "Please specify the dependencies\\.")
+	c.Assert(ih.UpdateDeps(SupervisorUpdateDepsArg{ContainerID: "theContainerID", Deps: DepsType{}}, &updateReply),
+		gocheck.IsNil)
+	c.Assert(updateReply.Status, gocheck.Equals, StatusOk)
+	c.Assert(updateReply.Container.ID, gocheck.Equals, "theContainerID")
+	os.RemoveAll(saveDir)
+}
+
+func (s *RpcSuite) TestDepProblemsOverRPC(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	containers.Init("localhost", saveDir, 2, 2, 61000, 100, 1024, false)
+	server := netrpc.NewServer()
+	c.Assert(server.RegisterName("Supervisor", new(Supervisor)), gocheck.IsNil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gocheck.IsNil)
+	defer listener.Close()
+	go server.Accept(listener)
+	client, err := netrpc.Dial("tcp", listener.Addr().String())
+	c.Assert(err, gocheck.IsNil)
+	defer client.Close()
+	arg := SupervisorDeployArg{App: "theApp", Sha: "theSha", ContainerID: "theContainerID",
+		Manifest: &Manifest{CPUShares: 1, MemoryLimit: 1, Deps: DepsType{"db": &AppDep{EncryptedData: "{",
+			SecurityGroup: map[string][]uint16{"db": []uint16{5432}}}}}}
+	var reply SupervisorDeployReply
+	c.Assert(client.Call("Supervisor.Deploy", arg, &reply), gocheck.IsNil)
+	c.Assert(reply.Status, gocheck.Equals, StatusError)
+	c.Assert(reply.Problems, gocheck.HasLen, 2)
+	c.Assert(reply.Problems[0].Dep, gocheck.Equals, "db")
+	c.Assert(reply.Problems[0].Field, gocheck.Equals, "EncryptedData")
+	c.Assert(reply.Problems[1].String(), gocheck.Equals, "db.SecurityGroup[db]: IP Group db does not exist")
+	arg.Manifest.Deps = DepsType{}
+	reply = SupervisorDeployReply{}
+	c.Assert(client.Call("Supervisor.Deploy", arg, &reply), gocheck.IsNil)
+	c.Assert(reply.Status, gocheck.Equals, StatusOk)
+	var updateReply SupervisorUpdateDepsReply
+	c.Assert(client.Call("Supervisor.UpdateDeps", SupervisorUpdateDepsArg{ContainerID: "theContainerID",
+		Deps: DepsType{"db": &AppDep{EncryptedData: "{"}}}, &updateReply), gocheck.IsNil)
+	c.Assert(updateReply.Status, gocheck.Equals, StatusError)
+	c.Assert(updateReply.Problems, gocheck.HasLen, 1)
+	c.Assert(updateReply.Problems[0].Field, gocheck.Equals, "EncryptedData")
+	var teardownReply SupervisorTeardownReply
+	c.Assert(client.Call("Supervisor.Teardown", SupervisorTeardownArg{All: true}, &teardownReply), gocheck.IsNil)
+	os.RemoveAll(saveDir)
+}
+
+func (s *RpcSuite) TestIPGroupStatus(c *gocheck.C) {
+	os.Setenv("SUPERVISOR_PRETEND", "true")
+	saveDir := "save_test"
+	os.RemoveAll(saveDir)
+	containers.Init("localhost", saveDir, 2, 2, 61000, 100, 1024, false)
+	ih := new(Supervisor)
+	var reply SupervisorUpdateIPGroupReply
+	c.Assert(ih.UpdateIPGroup(SupervisorUpdateIPGroupArg{Name: "db", IPs: []string{"10.0.0.1"}}, &reply),
+		gocheck.IsNil)
+	c.Assert(reply.Status, gocheck.Equals, StatusOk)
+	reply = SupervisorUpdateIPGroupReply{}
+	c.Assert(ih.UpdateIPGroup(SupervisorUpdateIPGroupArg{Name: "db", IPs: []string{"not an address"}}, &reply),
+		gocheck.NotNil)
+	c.Assert(reply.Status, gocheck.Equals, StatusError)
+	var deleteReply SupervisorDeleteIPGroupReply
+	c.Assert(ih.DeleteIPGroup(SupervisorDeleteIPGroupArg{Name: "db"}, &deleteReply), gocheck.IsNil)
+	c.Assert(deleteReply.Status, gocheck.Equals, StatusOk)
 	os.RemoveAll(saveDir)
 }
 
@@ -154,6 +244,23 @@ func (s *RpcSuite) TestHealthCheck(c *gocheck.C) {
 	c.Assert(reply.Containers.Total, gocheck.Equals, uint(2))
 	c.Assert(reply.Containers.Free, gocheck.Equals, uint(2))
 	c.Assert(reply.Containers.Used, gocheck.Equals, uint(0))
+	c.Assert(reply.Netsec.Healthy, gocheck.Equals, true)
+	c.Assert(reply.Bandwidth, gocheck.HasLen, 0) // no container has network security here
+	// check the netsec rules now
+	var nreply SupervisorNetsecStatusReply
+	c.Assert(ih.NetsecStatus(SupervisorNetsecStatusArg{Check: true}, &nreply), gocheck.IsNil)
+	c.Assert(nreply.Status, gocheck.Equals, StatusOk)
+	c.Assert(nreply.Netsec.Missing, gocheck.HasLen, 0)
+	c.Assert(nreply.Netsec.Extra, gocheck.HasLen, 0)
+	var lreply SupervisorListIPGroupsReply
+	c.Assert(ih.ListIPGroups(SupervisorListIPGroupsArg{}, &lreply), gocheck.IsNil)
+	c.Assert(lreply.Status, gocheck.Equals, StatusOk)
+	c.Assert(lreply.IPGroups, gocheck.HasLen, 0)
+	var greply SupervisorGetIPGroupReply
+	c.Assert(ih.GetIPGroup(SupervisorGetIPGroupArg{Name: "nope"}, &greply), gocheck.NotNil)
+	var creply SupervisorRuleCountersReply
+	c.Assert(ih.RuleCounters(SupervisorRuleCountersArg{}, &creply), gocheck.IsNil)
+	c.Assert(creply.Counters, gocheck.DeepEquals, []*RuleCounter{&RuleCounter{Rule: "deny"}})
 	// deploy one
 	var dreply SupervisorDeployReply
 	darg := SupervisorDeployArg{App: "theApp1", Sha: "theSha1", ContainerID: "theContainerID1", Manifest: &Manifest{CPUShares: 1, MemoryLimit: 1}}
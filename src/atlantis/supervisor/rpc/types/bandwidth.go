@@ -0,0 +1,62 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package types
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// tc won't shape below this
+const MinBandwidthKbit = 8
+
+// Bandwidth limits of a container in kbit/s. 0 means unlimited.
+type Bandwidth struct {
+	IngressKbit uint // traffic to the container
+	EgressKbit  uint // traffic from the container
+}
+
+func (b *Bandwidth) Limited() bool {
+	return b != nil && (b.IngressKbit > 0 || b.EgressKbit > 0)
+}
+
+func (b *Bandwidth) dup() *Bandwidth {
+	bandwidth := *b
+	return &bandwidth
+}
+
+func (m *Manifest) ValidateBandwidth() error {
+	if m.Bandwidth == nil {
+		return nil
+	}
+	if m.Bandwidth.IngressKbit > 0 && m.Bandwidth.IngressKbit < MinBandwidthKbit {
+		return errors.New(fmt.Sprintf("Invalid Manifest: ingress bandwidth must be at least %d kbit/s",
+			MinBandwidthKbit))
+	}
+	if m.Bandwidth.EgressKbit > 0 && m.Bandwidth.EgressKbit < MinBandwidthKbit {
+		return errors.New(fmt.Sprintf("Invalid Manifest: egress bandwidth must be at least %d kbit/s",
+			MinBandwidthKbit))
+	}
+	return nil
+}
+
+// The bandwidth limits of a container and the throughput last measured on its veth, in kbit/s
+type BandwidthStats struct {
+	ContainerID  string
+	Veth         string
+	IngressLimit uint // 0 means unlimited
+	EgressLimit  uint
+	Ingress      uint64 // measured over the last sample interval
+	Egress       uint64
+	LastSample   time.Time
+}
@@ -0,0 +1,41 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package types
+
+import (
+	"strings"
+)
+
+// Something wrong with one field of one dep
+type DepProblem struct {
+	Dep     string
+	Field   string // EncryptedData, SecurityGroup[<ip group>] or UDPSecurityGroup[<ip group>]. empty for the dep itself.
+	Problem string
+}
+
+func (p *DepProblem) String() string {
+	if p.Field == "" {
+		return p.Dep + ": " + p.Problem
+	}
+	return p.Dep + "." + p.Field + ": " + p.Problem
+}
+
+// Every problem found with a set of deps. Replies list them one by one, the error names all of them.
+type DepProblems []*DepProblem
+
+func (p DepProblems) Error() string {
+	strs := make([]string, len(p))
+	for i, problem := range p {
+		strs[i] = problem.String()
+	}
+	return "Invalid dependencies: " + strings.Join(strs, "; ")
+}
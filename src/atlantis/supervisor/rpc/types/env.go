@@ -0,0 +1,118 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package types
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"text/template"
+)
+
+var (
+	envNameRegexp     = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+	reservedEnvRegexp = regexp.MustCompile("^(ATLANTIS.*|CONTAINER_ID|CONTAINER_HOST|CONTAINER_ENV|HTTP_PORT.*|" +
+		"SSHD_PORT|SECONDARY_PORT[0-9]+.*)$")
+)
+
+// What manifest environment values can reference, e.g. "{{.PrimaryPort}}" or "{{index .SecondaryPorts 0}}"
+type EnvTemplateData struct {
+	ID             string
+	Host           string
+	App            string
+	Sha            string
+	Env            string
+	PrimaryPort    uint16
+	SSHPort        uint16
+	SecondaryPorts []uint16
+}
+
+func parseEnvTemplate(name, val string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(val)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid Manifest: bad template for environment variable %s: %v", name,
+			err))
+	}
+	return tmpl, nil
+}
+
+// Check the manifest's environment, entrypoint and command before anything is reserved for it
+func (m *Manifest) ValidateEnvironment() error {
+	for name, val := range m.Environment {
+		if !envNameRegexp.MatchString(name) {
+			return errors.New("Invalid Manifest: bad environment variable name: " + name)
+		}
+		if reservedEnvRegexp.MatchString(name) {
+			return errors.New("Invalid Manifest: environment variable " + name + " is reserved")
+		}
+		if _, err := parseEnvTemplate(name, val); err != nil {
+			return err
+		}
+	}
+	for _, arg := range m.Entrypoint {
+		if arg == "" {
+			return errors.New("Invalid Manifest: empty argument in entrypoint")
+		}
+	}
+	for _, arg := range m.Command {
+		if arg == "" {
+			return errors.New("Invalid Manifest: empty argument in command")
+		}
+	}
+	return nil
+}
+
+// What the container runs. runit starts the image's services, the run commands and sshd among them, unless the
+// manifest sets its own command or entrypoint. An entrypoint without a command runs on its own.
+func (m *Manifest) ContainerCommand() []string {
+	if len(m.Command) > 0 {
+		return append([]string{}, m.Command...)
+	}
+	if len(m.Entrypoint) > 0 {
+		return nil
+	}
+	return []string{"runsvdir", "/etc/service"}
+}
+
+// Render the manifest's environment for this container as NAME=value, sorted by name
+func (c *Container) ManifestEnv() ([]string, error) {
+	if err := c.Manifest.ValidateEnvironment(); err != nil {
+		return nil, err
+	}
+	data := &EnvTemplateData{
+		ID:             c.ID,
+		Host:           c.Host,
+		App:            c.App,
+		Sha:            c.Sha,
+		Env:            c.Env,
+		PrimaryPort:    c.PrimaryPort,
+		SSHPort:        c.SSHPort,
+		SecondaryPorts: c.SecondaryPorts,
+	}
+	names := make([]string, 0, len(c.Manifest.Environment))
+	for name, _ := range c.Manifest.Environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	envs := make([]string, len(names))
+	for i, name := range names {
+		tmpl, _ := parseEnvTemplate(name, c.Manifest.Environment[name])
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not render environment variable %s: %v", name, err))
+		}
+		envs[i] = name + "=" + buf.String()
+	}
+	return envs, nil
+}
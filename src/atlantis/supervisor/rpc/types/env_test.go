@@ -0,0 +1,234 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package types
+
+import (
+	"github.com/adjust/gocheck"
+	"testing"
+)
+
+func TestTypes(t *testing.T) { gocheck.TestingT(t) }
+
+type TypesSuite struct{}
+
+var _ = gocheck.Suite(&TypesSuite{})
+
+func (s *TypesSuite) TestValidateEnvironment(c *gocheck.C) {
+	m := &Manifest{Environment: map[string]string{"1BAD": "x"}}
+	c.Assert(m.ValidateEnvironment(), gocheck.ErrorMatches, "Invalid Manifest: bad environment variable name: 1BAD")
+	m = &Manifest{Environment: map[string]string{"HTTP_PORT": "80"}}
+	c.Assert(m.ValidateEnvironment(), gocheck.ErrorMatches, "Invalid Manifest: environment variable HTTP_PORT is reserved")
+	m = &Manifest{Environment: map[string]string{"ATLANTIS_FOO": "x"}}
+	c.Assert(m.ValidateEnvironment(), gocheck.ErrorMatches, "Invalid Manifest: environment variable ATLANTIS_FOO is reserved")
+	m = &Manifest{Environment: map[string]string{"SECONDARY_PORT3": "x"}}
+	c.Assert(m.ValidateEnvironment(), gocheck.ErrorMatches, "Invalid Manifest: environment variable SECONDARY_PORT3 is reserved")
+	m = &Manifest{Environment: map[string]string{"FOO": "{{.PrimaryPort"}}
+	c.Assert(m.ValidateEnvironment(), gocheck.ErrorMatches, "Invalid Manifest: bad template for environment variable FOO: .*")
+	m = &Manifest{Command: []string{"run", ""}}
+	c.Assert(m.ValidateEnvironment(), gocheck.ErrorMatches, "Invalid Manifest: empty argument in command")
+	m = &Manifest{Environment: map[string]string{"FOO": "bar"}, Entrypoint: []string{"/bin/sh", "-c"},
+		Command: []string{"run"}}
+	c.Assert(m.ValidateEnvironment(), gocheck.IsNil)
+}
+
+func (s *TypesSuite) TestManifestEnv(c *gocheck.C) {
+	cont := &Container{ID: "cid", Env: "prod", PrimaryPort: 61000, SecondaryPorts: []uint16{61004, 61006},
+		Manifest: &Manifest{Environment: map[string]string{
+			"STATSD_PORT": "{{index .SecondaryPorts 1}}",
+			"LISTEN":      "0.0.0.0:{{.PrimaryPort}}",
+			"NAME":        "{{.ID}}-{{.Env}}",
+		}}}
+	envs, err := cont.ManifestEnv()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(envs, gocheck.DeepEquals, []string{"LISTEN=0.0.0.0:61000", "NAME=cid-prod", "STATSD_PORT=61006"})
+	cont.Manifest.Environment = map[string]string{"BAD": "{{index .SecondaryPorts 5}}"}
+	_, err = cont.ManifestEnv()
+	c.Assert(err, gocheck.ErrorMatches, "Could not render environment variable BAD: .*")
+	cont.Manifest.Environment = map[string]string{"BAD": "{{.Nope}}"}
+	_, err = cont.ManifestEnv()
+	c.Assert(err, gocheck.ErrorMatches, "Could not render environment variable BAD: .*")
+}
+
+func (s *TypesSuite) TestContainerCommand(c *gocheck.C) {
+	// run commands are runit services in the image
+	m := &Manifest{RunCommands: []string{"bin/server", "bin/worker"}}
+	c.Assert(m.ContainerCommand(), gocheck.DeepEquals, []string{"runsvdir", "/etc/service"})
+	m.Entrypoint = []string{"bin/app"}
+	c.Assert(m.ContainerCommand(), gocheck.IsNil)
+	m.Command = []string{"serve"}
+	c.Assert(m.ContainerCommand(), gocheck.DeepEquals, []string{"serve"})
+	m.Entrypoint = nil
+	c.Assert(m.ContainerCommand(), gocheck.DeepEquals, []string{"serve"})
+}
+
+func (s *TypesSuite) TestValidatePorts(c *gocheck.C) {
+	m := &Manifest{PrimaryPort: &PortSpec{Protocol: "sctp"}}
+	c.Assert(m.ValidatePorts(2), gocheck.ErrorMatches, "Invalid Manifest: primary port: Invalid protocol: sctp")
+	m = &Manifest{SecondaryPorts: []*PortSpec{nil, &PortSpec{HostIP: "10.0.0.256"}}}
+	c.Assert(m.ValidatePorts(2), gocheck.ErrorMatches, "Invalid Manifest: secondary port 1: Invalid host ip: 10.0.0.256")
+	m = &Manifest{SecondaryPorts: []*PortSpec{nil, nil, nil}}
+	c.Assert(m.ValidatePorts(2), gocheck.ErrorMatches, "Invalid Manifest: 3 secondary ports declared, only 2 available")
+	m = &Manifest{PrimaryPort: &PortSpec{HostIP: "127.0.0.1"}, SecondaryPorts: []*PortSpec{
+		&PortSpec{Protocol: ProtocolUDP}, &PortSpec{Protocol: ProtocolUDP, HostIP: "::1"}}}
+	c.Assert(m.ValidatePorts(2), gocheck.IsNil)
+	m = &Manifest{SSHIngress: []string{"office", ""}}
+	c.Assert(m.ValidatePorts(2), gocheck.ErrorMatches,
+		"Invalid Manifest: ssh port: Invalid ingress: empty IP group or CIDR block")
+}
+
+func (s *TypesSuite) TestPortIngress(c *gocheck.C) {
+	cont := &Container{PrimaryPort: 61000, SSHPort: 61001, SecondaryPorts: []uint16{61004, 61006}, Manifest: &Manifest{
+		PrimaryPort:    &PortSpec{Ingress: []string{"office", "10.0.0.0/8"}},
+		SecondaryPorts: []*PortSpec{nil, &PortSpec{Protocol: ProtocolUDP, Ingress: []string{"office"}}},
+		SSHIngress:     []string{"bastion"},
+	}}
+	c.Assert(cont.PortIngress(), gocheck.DeepEquals, []*PortIngress{
+		&PortIngress{Protocol: ProtocolTCP, Port: 61000, Sources: []string{"office", "10.0.0.0/8"}},
+		&PortIngress{Protocol: ProtocolTCP, Port: 61001, Sources: []string{"bastion"}},
+		&PortIngress{Protocol: ProtocolUDP, Port: 61006, Sources: []string{"office"}},
+	})
+	dup := cont.Manifest.Dup()
+	dup.PrimaryPort.Ingress[0] = "changed"
+	dup.SSHIngress[0] = "changed"
+	c.Assert(cont.Manifest.PrimaryPort.Ingress[0], gocheck.Equals, "office")
+	c.Assert(cont.Manifest.SSHIngress[0], gocheck.Equals, "bastion")
+}
+
+func (s *TypesSuite) TestPortEnv(c *gocheck.C) {
+	cont := &Container{PrimaryPort: 61000, SecondaryPorts: []uint16{61004, 61006}, Manifest: &Manifest{
+		PrimaryPort:    &PortSpec{HostIP: "127.0.0.1"},
+		SecondaryPorts: []*PortSpec{&PortSpec{Protocol: ProtocolUDP, HostIP: "10.0.0.1"}},
+	}}
+	c.Assert(cont.PrimaryPortSpec(), gocheck.DeepEquals, PortSpec{Protocol: ProtocolTCP, HostIP: "127.0.0.1"})
+	c.Assert(cont.SecondaryPortSpec(1), gocheck.DeepEquals, PortSpec{Protocol: ProtocolTCP})
+	c.Assert(cont.PortEnv(), gocheck.DeepEquals, []string{
+		"HTTP_PORT_PROTOCOL=tcp",
+		"HTTP_PORT_HOST_IP=127.0.0.1",
+		"SECONDARY_PORT0_PROTOCOL=udp",
+		"SECONDARY_PORT0_HOST_IP=10.0.0.1",
+		"SECONDARY_PORT1_PROTOCOL=tcp",
+	})
+	m := &Manifest{Environment: map[string]string{"SECONDARY_PORT0_PROTOCOL": "x"}}
+	c.Assert(m.ValidateEnvironment(), gocheck.ErrorMatches,
+		"Invalid Manifest: environment variable SECONDARY_PORT0_PROTOCOL is reserved")
+}
+
+func (s *TypesSuite) TestParseImageRef(c *gocheck.C) {
+	repo, tag, digest, err := ParseImageRef("localhost:5000/apps/app-sha")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert([]string{repo, tag, digest}, gocheck.DeepEquals, []string{"localhost:5000/apps/app-sha", "", ""})
+	repo, tag, digest, err = ParseImageRef("registry/apps/app:v1.2")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert([]string{repo, tag, digest}, gocheck.DeepEquals, []string{"registry/apps/app", "v1.2", ""})
+	dgst := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	repo, tag, digest, err = ParseImageRef("registry:5000/app:v1@" + dgst)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert([]string{repo, tag, digest}, gocheck.DeepEquals, []string{"registry:5000/app", "v1", dgst})
+	_, _, _, err = ParseImageRef("registry/app@sha256:nothex")
+	c.Assert(err, gocheck.ErrorMatches, "Invalid image digest: sha256:nothex")
+	_, _, _, err = ParseImageRef("registry/app:bad/tag")
+	c.Assert(err, gocheck.ErrorMatches, "Invalid image reference: registry/app:bad/tag")
+	_, _, _, err = ParseImageRef("registry/app:")
+	c.Assert(err, gocheck.ErrorMatches, "Invalid image tag: ")
+}
+
+func (s *TypesSuite) TestGetDockerRepo(c *gocheck.C) {
+	cont := &Container{}
+	c.Assert(cont.GetDockerRepo(), gocheck.Equals, "")
+	cont.Image = "registry:5000/team/app:v1@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	c.Assert(cont.GetDockerRepo(), gocheck.Equals, "registry:5000/team/app")
+}
+
+func (s *TypesSuite) TestDigests(c *gocheck.C) {
+	dgst := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	c.Assert(ValidateDigest(dgst), gocheck.IsNil)
+	c.Assert(ValidateDigest(dgst[len("sha256:"):]), gocheck.IsNil)
+	c.Assert(ValidateDigest("sha256:"), gocheck.ErrorMatches, "Invalid image digest: sha256:")
+	c.Assert(DigestMatches(dgst, "registry/app", dgst, nil), gocheck.Equals, true)
+	c.Assert(DigestMatches(dgst, "registry/app", dgst[len("sha256:"):], nil), gocheck.Equals, true)
+	c.Assert(DigestMatches(dgst, "registry/app@"+dgst, "sha256:ffff", nil), gocheck.Equals, true)
+	c.Assert(DigestMatches(dgst, "registry/app", "sha256:ffff", nil), gocheck.Equals, false)
+	c.Assert(DigestMatches("", "registry/app", "", nil), gocheck.Equals, false)
+	// a digest pinned on the registry is the manifest digest, not the image id
+	repoDigests := []string{"mirror/app@sha256:eeee", "registry/app@" + dgst}
+	c.Assert(DigestMatches(dgst, "registry/app:v1", "sha256:ffff", repoDigests), gocheck.Equals, true)
+	c.Assert(DigestMatches(dgst, "mirror/app:v1", "sha256:ffff", repoDigests), gocheck.Equals, false)
+	c.Assert(RepoDigest("registry/app:v1", repoDigests), gocheck.Equals, dgst)
+	c.Assert(RepoDigest("other/app", repoDigests), gocheck.Equals, "")
+}
+
+func (s *TypesSuite) TestValidateConfigRenderings(c *gocheck.C) {
+	m := &Manifest{ConfigRenderings: []*ConfigRendering{&ConfigRendering{Format: "xml", File: "config.xml"}}}
+	c.Assert(m.ValidateConfigRenderings(), gocheck.ErrorMatches, "Invalid Manifest: unknown config rendering format: xml")
+	m = &Manifest{ConfigRenderings: []*ConfigRendering{&ConfigRendering{Format: RenderEnv, File: "../env"}}}
+	c.Assert(m.ValidateConfigRenderings(), gocheck.ErrorMatches, "Invalid Manifest: bad config rendering file name: \\.\\./env")
+	m = &Manifest{ConfigRenderings: []*ConfigRendering{&ConfigRendering{Format: RenderYAML, File: "config.json"}}}
+	c.Assert(m.ValidateConfigRenderings(), gocheck.ErrorMatches, "Invalid Manifest: config file config.json is rendered more than once")
+	m = &Manifest{ConfigRenderings: []*ConfigRendering{&ConfigRendering{Format: RenderEnv, File: "env", Template: "x"}}}
+	c.Assert(m.ValidateConfigRenderings(), gocheck.ErrorMatches, "Invalid Manifest: only template renderings take a template: env")
+	m = &Manifest{ConfigRenderings: []*ConfigRendering{&ConfigRendering{Format: RenderTemplate, File: "app.conf",
+		Template: "{{.HTTPPort"}}}
+	c.Assert(m.ValidateConfigRenderings(), gocheck.ErrorMatches, "Invalid Manifest: bad template for config file app.conf: .*")
+	m = &Manifest{ConfigRenderings: []*ConfigRendering{
+		&ConfigRendering{Format: RenderEnv, File: "config.env"},
+		&ConfigRendering{Format: RenderYAML, File: "config.yml"},
+		&ConfigRendering{Format: RenderProperties, File: "config.properties"},
+		&ConfigRendering{Format: RenderTemplate, File: "app.conf", Template: "port {{.HTTPPort}}\n"},
+	}}
+	c.Assert(m.ValidateConfigRenderings(), gocheck.IsNil)
+	c.Assert(m.Dup().ConfigRenderings, gocheck.DeepEquals, m.ConfigRenderings)
+	// duplicating comes before validating
+	m.ConfigRenderings = append(m.ConfigRenderings, nil)
+	c.Assert(m.Dup().ConfigRenderings, gocheck.DeepEquals, m.ConfigRenderings)
+	c.Assert(m.Dup().ValidateConfigRenderings(), gocheck.ErrorMatches, "Invalid Manifest: empty config rendering")
+}
+
+func (s *TypesSuite) TestValidateReload(c *gocheck.C) {
+	m := &Manifest{ReloadSignal: "HUP", ReloadCommand: "sv hup app"}
+	c.Assert(m.ValidateReload(), gocheck.ErrorMatches, "Invalid Manifest: please specify either .*")
+	m = &Manifest{ReloadSignal: "KILL"}
+	c.Assert(m.ValidateReload(), gocheck.ErrorMatches, "Invalid Manifest: unsupported reload signal: KILL")
+	m = &Manifest{}
+	c.Assert(m.ValidateReload(), gocheck.IsNil)
+	c.Assert(m.ReloadSignalName(), gocheck.Equals, "HUP")
+	m = &Manifest{ReloadSignal: "sigusr1"}
+	c.Assert(m.ValidateReload(), gocheck.IsNil)
+	c.Assert(m.ReloadSignalName(), gocheck.Equals, "USR1")
+	m = &Manifest{ReloadCommand: "sv hup app"}
+	c.Assert(m.ReloadSignalName(), gocheck.Equals, "")
+}
+
+func (s *TypesSuite) TestValidateBandwidth(c *gocheck.C) {
+	m := &Manifest{}
+	c.Assert(m.ValidateBandwidth(), gocheck.IsNil)
+	c.Assert(m.Bandwidth.Limited(), gocheck.Equals, false)
+	m = &Manifest{Bandwidth: &Bandwidth{IngressKbit: 4}}
+	c.Assert(m.ValidateBandwidth(), gocheck.ErrorMatches, "Invalid Manifest: ingress bandwidth must be at least 8 kbit/s")
+	m = &Manifest{Bandwidth: &Bandwidth{EgressKbit: 1}}
+	c.Assert(m.ValidateBandwidth(), gocheck.ErrorMatches, "Invalid Manifest: egress bandwidth must be at least 8 kbit/s")
+	m = &Manifest{Bandwidth: &Bandwidth{IngressKbit: 10000}}
+	c.Assert(m.ValidateBandwidth(), gocheck.IsNil)
+	c.Assert(m.Bandwidth.Limited(), gocheck.Equals, true)
+	dup := m.Dup()
+	c.Assert(dup.Bandwidth, gocheck.DeepEquals, m.Bandwidth)
+	dup.Bandwidth.EgressKbit = 500
+	c.Assert(m.Bandwidth.EgressKbit, gocheck.Equals, uint(0))
+}
+
+func (s *TypesSuite) TestDupVolumes(c *gocheck.C) {
+	m := &Manifest{Volumes: []*Volume{&Volume{Name: "data", Path: "/data"}, nil}}
+	dup := m.Dup()
+	c.Assert(dup.Volumes, gocheck.DeepEquals, m.Volumes)
+	dup.Volumes[0].Path = "/other"
+	c.Assert(m.Volumes[0].Path, gocheck.Equals, "/data")
+	c.Assert(dup.ValidateVolumes(), gocheck.ErrorMatches, "Invalid Manifest: empty volume")
+}
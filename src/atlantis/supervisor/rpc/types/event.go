@@ -0,0 +1,32 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// Something the supervisor did or noticed on its own that an operator may want to know about
+type Event struct {
+	Time        time.Time
+	Kind        string
+	ContainerID string // empty if the event isn't about a container
+	Message     string
+}
+
+func (e *Event) String() string {
+	if e.ContainerID == "" {
+		return fmt.Sprintf("%s [%s] %s", e.Time.Format(time.RFC3339), e.Kind, e.Message)
+	}
+	return fmt.Sprintf("%s [%s] %s: %s", e.Time.Format(time.RFC3339), e.Kind, e.ContainerID, e.Message)
+}
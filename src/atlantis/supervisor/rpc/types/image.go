@@ -0,0 +1,109 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package types
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var (
+	imageRepoRegexp   = regexp.MustCompile("^[a-z0-9]+([._-][a-z0-9]+)*(:[0-9]+)?(/[a-zA-Z0-9]+([._-][a-zA-Z0-9]+)*)*$")
+	imageTagRegexp    = regexp.MustCompile("^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$")
+	imageDigestRegexp = regexp.MustCompile("^[a-z0-9]+([+._-][a-z0-9]+)*:[a-fA-F0-9]{32,}$")
+	imageIDRegexp     = regexp.MustCompile("^[a-fA-F0-9]{32,}$")
+)
+
+// Where to find the image to run and how to make sure it's the right one
+type ImageSpec struct {
+	Ref             string // empty means the one named by the image template
+	ExpectedDigest  string
+	DigestSignature string
+}
+
+// What the image template in server.toml can reference, e.g. "{{.Registry}}/{{.Repo}}/{{.App}}-{{.Sha}}"
+type ImageTemplateData struct {
+	Registry string
+	Repo     string // image_repo from server.toml
+	App      string
+	Sha      string
+	Env      string
+}
+
+// Split an image reference of the form repo[:tag][@digest]
+func ParseImageRef(ref string) (repo, tag, digest string, err error) {
+	repo = ref
+	if i := strings.Index(repo, "@"); i >= 0 {
+		digest = repo[i+1:]
+		repo = repo[:i]
+		if !imageDigestRegexp.MatchString(digest) {
+			return "", "", "", errors.New("Invalid image digest: " + digest)
+		}
+	}
+	// a colon after the last slash is a tag, anything before it could be a registry port
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		tag = repo[i+1:]
+		repo = repo[:i]
+		if !imageTagRegexp.MatchString(tag) {
+			return "", "", "", errors.New("Invalid image tag: " + tag)
+		}
+	}
+	if !imageRepoRegexp.MatchString(repo) {
+		return "", "", "", errors.New("Invalid image reference: " + ref)
+	}
+	return repo, tag, digest, nil
+}
+
+// A digest is either algorithm:hex or a bare hex image id
+func ValidateDigest(digest string) error {
+	if !imageDigestRegexp.MatchString(digest) && !imageIDRegexp.MatchString(digest) {
+		return errors.New("Invalid image digest: " + digest)
+	}
+	return nil
+}
+
+// The registry digest of an image pulled as ref, from the repo@digest entries docker reports for the image.
+// Returns "" if the image has none for ref's repo, like images that were built locally.
+func RepoDigest(ref string, repoDigests []string) string {
+	repo, _, _, err := ParseImageRef(ref)
+	if err != nil {
+		return ""
+	}
+	for _, repoDigest := range repoDigests {
+		if i := strings.LastIndex(repoDigest, "@"); i >= 0 && repoDigest[:i] == repo {
+			return repoDigest[i+1:]
+		}
+	}
+	return ""
+}
+
+// Whether the expected digest names the pulled image. That's the digest ref is pinned to, the registry digest of
+// the image or, for bare image ids, the id docker reports.
+func DigestMatches(expected, ref, id string, repoDigests []string) bool {
+	if expected == "" {
+		return false
+	}
+	expected = strings.ToLower(expected)
+	if _, _, pinned, err := ParseImageRef(ref); err == nil && strings.ToLower(pinned) == expected {
+		return true
+	}
+	if strings.ToLower(RepoDigest(ref, repoDigests)) == expected {
+		return true
+	}
+	id = strings.ToLower(id)
+	if expected == id {
+		return true
+	}
+	// docker may or may not prefix ids with the algorithm
+	return strings.TrimPrefix(expected, "sha256:") == strings.TrimPrefix(id, "sha256:")
+}
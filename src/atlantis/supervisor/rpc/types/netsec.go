@@ -0,0 +1,72 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package types
+
+// A container allowed through to a group on some ports, or letting the group in to some of its ports
+type IPGroupUser struct {
+	ContainerID string
+	Protocol    string // tcp or udp
+	Ports       []uint16
+	Ingress     bool // the ports are the container's published ports the group may reach
+}
+
+// A published port of a container and the IP groups and CIDR blocks allowed to reach it
+type PortIngress struct {
+	Protocol string // tcp or udp
+	Port     uint16
+	Sources  []string
+}
+
+type IPGroupInfo struct {
+	Name      string
+	Members   []string            // IPs, CIDR blocks and hostnames
+	Resolved  map[string][]string // hostname -> IPs it last resolved to
+	IPv4      []string            // the IPv4 addresses and blocks the group matches, hostnames resolved
+	IPv6      []string            // the IPv6 addresses and blocks the group matches, hostnames resolved
+	Users     []*IPGroupUser
+	Installed bool     // whether every rule for the group is live
+	Missing   []string // the group's rules that aren't live
+	LastError string   // why the live rules couldn't be read, if they couldn't
+}
+
+type ContainerSecurityInfo struct {
+	ContainerID       string
+	Pid               int
+	Veth              string
+	Mark              string
+	SecurityGroups    map[string][]uint16 // ipgroup name -> tcp ports
+	UDPSecurityGroups map[string][]uint16 // ipgroup name -> udp ports
+	Ingress           []*PortIngress      // published ports only some sources may reach
+	Bandwidth         *Bandwidth          // nil means unlimited
+	Installed         bool                // whether every rule for the container is live
+	Missing           []string            // the container's rules that aren't live
+	LastError         string              // why the live rules couldn't be read, if they couldn't
+}
+
+// The packets and bytes that matched a firewall rule since it was installed. The blanket deny rule has no
+// container.
+type RuleCounter struct {
+	ContainerID string
+	Rule        string
+	Packets     uint64
+	Bytes       uint64
+}
+
+// What an IP group update or delete changes
+type IPGroupDiff struct {
+	Name     string
+	Added    []string       // addresses the group gains, IPv4 first
+	Removed  []string       // addresses the group loses, IPv4 first
+	Affected []*IPGroupUser // containers allowed through to the group
+	Inserted []string       // rules installed
+	Deleted  []string       // rules removed
+}
@@ -0,0 +1,151 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// How a port is published on the host
+type PortSpec struct {
+	Protocol string   // tcp or udp. empty means tcp
+	HostIP   string   // host address to bind to. empty means all interfaces
+	Ingress  []string // IP groups and CIDR blocks allowed to reach the port. empty means anyone
+}
+
+var defaultPortSpec = PortSpec{Protocol: ProtocolTCP}
+
+func ValidProtocol(protocol string) bool {
+	return protocol == ProtocolTCP || protocol == ProtocolUDP
+}
+
+func (p *PortSpec) Validate() error {
+	if p.Protocol != "" && !ValidProtocol(p.Protocol) {
+		return errors.New("Invalid protocol: " + p.Protocol)
+	}
+	if p.HostIP != "" && net.ParseIP(p.HostIP) == nil {
+		return errors.New("Invalid host ip: " + p.HostIP)
+	}
+	return validateIngress(p.Ingress)
+}
+
+func validateIngress(ingress []string) error {
+	for _, source := range ingress {
+		if source == "" {
+			return errors.New("Invalid ingress: empty IP group or CIDR block")
+		}
+	}
+	return nil
+}
+
+func (p *PortSpec) dup() *PortSpec {
+	spec := *p
+	if p.Ingress != nil {
+		spec.Ingress = append([]string{}, p.Ingress...)
+	}
+	return &spec
+}
+
+// fill in the defaults
+func (p *PortSpec) resolve() PortSpec {
+	if p == nil {
+		return defaultPortSpec
+	}
+	spec := *p
+	if spec.Protocol == "" {
+		spec.Protocol = ProtocolTCP
+	}
+	return spec
+}
+
+// Check the manifest's port specs against the number of secondary ports each container gets
+func (m *Manifest) ValidatePorts(numSecondaryPorts uint16) error {
+	if m.PrimaryPort != nil {
+		if err := m.PrimaryPort.Validate(); err != nil {
+			return errors.New("Invalid Manifest: primary port: " + err.Error())
+		}
+	}
+	if err := validateIngress(m.SSHIngress); err != nil {
+		return errors.New("Invalid Manifest: ssh port: " + err.Error())
+	}
+	if len(m.SecondaryPorts) > int(numSecondaryPorts) {
+		return errors.New(fmt.Sprintf("Invalid Manifest: %d secondary ports declared, only %d available",
+			len(m.SecondaryPorts), numSecondaryPorts))
+	}
+	for i, spec := range m.SecondaryPorts {
+		if spec == nil {
+			continue
+		}
+		if err := spec.Validate(); err != nil {
+			return errors.New(fmt.Sprintf("Invalid Manifest: secondary port %d: %v", i, err))
+		}
+	}
+	return nil
+}
+
+func (c *Container) PrimaryPortSpec() PortSpec {
+	if c.Manifest == nil {
+		return defaultPortSpec
+	}
+	return c.Manifest.PrimaryPort.resolve()
+}
+
+func (c *Container) SecondaryPortSpec(i int) PortSpec {
+	if c.Manifest == nil || i >= len(c.Manifest.SecondaryPorts) {
+		return defaultPortSpec
+	}
+	return c.Manifest.SecondaryPorts[i].resolve()
+}
+
+// The published ports that only let some sources in
+func (c *Container) PortIngress() []*PortIngress {
+	ingress := []*PortIngress{}
+	addIngress := func(protocol string, port uint16, sources []string) {
+		if len(sources) > 0 {
+			ingress = append(ingress, &PortIngress{Protocol: protocol, Port: port,
+				Sources: append([]string{}, sources...)})
+		}
+	}
+	primarySpec := c.PrimaryPortSpec()
+	addIngress(primarySpec.Protocol, c.PrimaryPort, primarySpec.Ingress)
+	if c.Manifest != nil {
+		addIngress(ProtocolTCP, c.SSHPort, c.Manifest.SSHIngress)
+	}
+	for i, port := range c.SecondaryPorts {
+		spec := c.SecondaryPortSpec(i)
+		addIngress(spec.Protocol, port, spec.Ingress)
+	}
+	return ingress
+}
+
+// Environment describing each port's protocol and bind address, e.g. SECONDARY_PORT0_PROTOCOL=udp
+func (c *Container) PortEnv() []string {
+	envs := []string{}
+	addSpec := func(prefix string, spec PortSpec) {
+		envs = append(envs, prefix+"_PROTOCOL="+spec.Protocol)
+		if spec.HostIP != "" {
+			envs = append(envs, prefix+"_HOST_IP="+spec.HostIP)
+		}
+	}
+	addSpec("HTTP_PORT", c.PrimaryPortSpec())
+	for i, _ := range c.SecondaryPorts {
+		addSpec(fmt.Sprintf("SECONDARY_PORT%d", i), c.SecondaryPortSpec(i))
+	}
+	return envs
+}
@@ -0,0 +1,55 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package types
+
+import (
+	"errors"
+	"strings"
+)
+
+const DefaultReloadSignal = "HUP"
+
+// signals a container may be told to reload with
+var ReloadSignals = map[string]bool{
+	"HUP":   true,
+	"INT":   true,
+	"QUIT":  true,
+	"USR1":  true,
+	"USR2":  true,
+	"WINCH": true,
+}
+
+// HUP, SIGHUP and sighup are all the same signal
+func NormalizeSignal(signal string) string {
+	return strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+}
+
+func (m *Manifest) ValidateReload() error {
+	if m.ReloadSignal != "" && m.ReloadCommand != "" {
+		return errors.New("Invalid Manifest: please specify either a reload signal or a reload command, not both")
+	}
+	if m.ReloadSignal != "" && !ReloadSignals[NormalizeSignal(m.ReloadSignal)] {
+		return errors.New("Invalid Manifest: unsupported reload signal: " + m.ReloadSignal)
+	}
+	return nil
+}
+
+// The signal to send after the config changes. Empty if a reload command is run instead.
+func (m *Manifest) ReloadSignalName() string {
+	if m.ReloadCommand != "" {
+		return ""
+	}
+	if m.ReloadSignal == "" {
+		return DefaultReloadSignal
+	}
+	return NormalizeSignal(m.ReloadSignal)
+}
@@ -0,0 +1,78 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package types
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"text/template"
+)
+
+const (
+	RenderEnv        = "env"        // shell-sourceable NAME='value' lines
+	RenderYAML       = "yaml"       // yaml document
+	RenderProperties = "properties" // java properties
+	RenderTemplate   = "template"   // text/template over the atlantis/types.AppConfig
+)
+
+var renderingFileRegexp = regexp.MustCompile("^[A-Za-z0-9_][A-Za-z0-9_.-]*$")
+
+// An extra rendering of the app config, written next to config.json in the container's config dir
+type ConfigRendering struct {
+	Format   string
+	File     string // file name in the config dir
+	Template string // only for RenderTemplate
+}
+
+func ValidRenderFormat(format string) bool {
+	switch format {
+	case RenderEnv, RenderYAML, RenderProperties, RenderTemplate:
+		return true
+	}
+	return false
+}
+
+func ParseRenderTemplate(name, tmpl string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(tmpl)
+}
+
+// Check the manifest's config renderings before anything is reserved for them
+func (m *Manifest) ValidateConfigRenderings() error {
+	files := map[string]bool{"config.json": true}
+	for _, rendering := range m.ConfigRenderings {
+		if rendering == nil {
+			return errors.New("Invalid Manifest: empty config rendering")
+		}
+		if !ValidRenderFormat(rendering.Format) {
+			return errors.New("Invalid Manifest: unknown config rendering format: " + rendering.Format)
+		}
+		if !renderingFileRegexp.MatchString(rendering.File) {
+			return errors.New("Invalid Manifest: bad config rendering file name: " + rendering.File)
+		}
+		if files[rendering.File] {
+			return errors.New("Invalid Manifest: config file " + rendering.File + " is rendered more than once")
+		}
+		files[rendering.File] = true
+		if rendering.Format != RenderTemplate {
+			if rendering.Template != "" {
+				return errors.New("Invalid Manifest: only template renderings take a template: " + rendering.File)
+			}
+			continue
+		}
+		if _, err := ParseRenderTemplate(rendering.File, rendering.Template); err != nil {
+			return errors.New(fmt.Sprintf("Invalid Manifest: bad template for config file %s: %v", rendering.File,
+				err))
+		}
+	}
+	return nil
+}
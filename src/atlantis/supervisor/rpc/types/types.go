@@ -16,6 +16,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 )
 
 type GenericContainer interface {
@@ -25,6 +26,11 @@ type GenericContainer interface {
 	SetDockerID(string)
 	GetDockerID() string
 	GetDockerRepo() string
+	GetImage() string
+	SetImage(string)
+	SetImageDigest(string)
+	GetExpectedDigest() string
+	GetDigestSignature() string
 	GetIP() string
 	SetIP(string)
 	GetPid() int
@@ -41,10 +47,17 @@ type Container struct {
 	PrimaryPort    uint16
 	SecondaryPorts []uint16
 	SSHPort        uint16
+	CPUSet         []int // dedicated cores, empty if the container only uses CPU shares
+	SharedCPUSet   []int // cores shared by the containers without dedicated ones. kept up to date by the supervisor.
 	App            string
 	Sha            string
 	Env            string
-	Manifest       *Manifest
+	Image          string // image reference to run. rendered from the image template if not given on deploy.
+	ImageDigest    string // registry digest of the image docker actually started, its id if it has none
+	ExpectedDigest string // if set the pulled image must have this digest
+	// base64 detached signature over ExpectedDigest, checked if set or if signed images are required
+	DigestSignature string
+	Manifest        *Manifest
 }
 
 func (c *Container) GetID() string {
@@ -67,8 +80,33 @@ func (c *Container) GetDockerID() string {
 	return c.DockerID
 }
 
+// The repository of the image the container runs, without tag or digest. Empty until its image is known.
 func (c *Container) GetDockerRepo() string {
-	return "apps"
+	repo, _, _, err := ParseImageRef(c.Image)
+	if err != nil {
+		return ""
+	}
+	return repo
+}
+
+func (c *Container) GetImage() string {
+	return c.Image
+}
+
+func (c *Container) SetImage(image string) {
+	c.Image = image
+}
+
+func (c *Container) SetImageDigest(digest string) {
+	c.ImageDigest = digest
+}
+
+func (c *Container) GetExpectedDigest() string {
+	return c.ExpectedDigest
+}
+
+func (c *Container) GetDigestSignature() string {
+	return c.DigestSignature
 }
 
 func (c *Container) SetIP(ip string) {
@@ -106,28 +144,47 @@ Secondary Ports : %v
 App             : %s
 SHA             : %s
 CPU Shares      : %d
+CPU Set         : %v
 Memory Limit    : %d
+Image           : %s
+Image Digest    : %s
 Docker ID       : %s`, c.ID, c.IP, c.Pid, c.Host, c.PrimaryPort, c.SSHPort, c.SecondaryPorts, c.App, c.Sha,
-		c.Manifest.CPUShares, c.Manifest.MemoryLimit, c.DockerID)
+		c.Manifest.CPUShares, c.CPUSet, c.Manifest.MemoryLimit, c.Image, c.ImageDigest, c.DockerID)
 }
 
 type DepsType map[string]*AppDep
 type AppDep struct {
-	SecurityGroup map[string][]uint16
-	DataMap       map[string]interface{}
-	EncryptedData string
+	SecurityGroup    map[string][]uint16 // ipgroup name -> tcp ports
+	UDPSecurityGroup map[string][]uint16 // ipgroup name -> udp ports
+	DataMap          map[string]interface{}
+	EncryptedData    string
 }
 
 type Manifest struct {
-	Name        string
-	Description string
-	Instances   uint
-	CPUShares   uint
-	MemoryLimit uint
-	AppType     string
-	JavaType    string
-	RunCommands []string
-	Deps        DepsType
+	Name          string
+	Description   string
+	Instances     uint
+	CPUShares     uint
+	DedicatedCPUs uint // # of cores to pin the container to. 0 means share the cores not dedicated or reserved.
+	MemoryLimit   uint
+	AppType       string
+	JavaType      string
+	RunCommands   []string          // baked into the image as runit services by the builder
+	Environment   map[string]string // extra env vars. values are text/templates over EnvTemplateData.
+	Entrypoint    []string          // overrides the image's entrypoint, and runsvdir, if set
+	Command       []string          // overrides "runsvdir /etc/service" if set
+	Volumes       []*Volume         // persistent volumes, kept across deploys of the same app+env
+	PrimaryPort   *PortSpec         // protocol and bind address of the primary port. nil means tcp on all
+	// protocol and bind address of each secondary port by index. missing entries mean tcp on all interfaces.
+	SecondaryPorts []*PortSpec
+	SSHIngress     []string   // IP groups and CIDR blocks allowed to reach the ssh port. empty means anyone
+	Bandwidth      *Bandwidth // ingress and egress limits. nil means unlimited
+	// extra renderings of the app config next to config.json
+	ConfigRenderings []*ConfigRendering
+	// how to tell the app its config changed. a signal (HUP by default) or a command run in the container.
+	ReloadSignal  string
+	ReloadCommand string
+	Deps          DepsType
 }
 
 func (m *Manifest) Dup() *Manifest {
@@ -135,6 +192,61 @@ func (m *Manifest) Dup() *Manifest {
 	for i, cmd := range m.RunCommands {
 		runCommands[i] = cmd
 	}
+	var environment map[string]string
+	if m.Environment != nil {
+		environment = make(map[string]string, len(m.Environment))
+		for name, val := range m.Environment {
+			environment[name] = val
+		}
+	}
+	var entrypoint, command []string
+	if m.Entrypoint != nil {
+		entrypoint = append([]string{}, m.Entrypoint...)
+	}
+	if m.Command != nil {
+		command = append([]string{}, m.Command...)
+	}
+	var primaryPort *PortSpec
+	if m.PrimaryPort != nil {
+		primaryPort = m.PrimaryPort.dup()
+	}
+	var secondaryPorts []*PortSpec
+	if m.SecondaryPorts != nil {
+		secondaryPorts = make([]*PortSpec, len(m.SecondaryPorts))
+		for i, spec := range m.SecondaryPorts {
+			if spec != nil {
+				secondaryPorts[i] = spec.dup()
+			}
+		}
+	}
+	var sshIngress []string
+	if m.SSHIngress != nil {
+		sshIngress = append([]string{}, m.SSHIngress...)
+	}
+	var bandwidth *Bandwidth
+	if m.Bandwidth != nil {
+		bandwidth = m.Bandwidth.dup()
+	}
+	var renderings []*ConfigRendering
+	if m.ConfigRenderings != nil {
+		renderings = make([]*ConfigRendering, len(m.ConfigRenderings))
+		for i, rendering := range m.ConfigRenderings {
+			if rendering != nil {
+				renderingCopy := *rendering
+				renderings[i] = &renderingCopy
+			}
+		}
+	}
+	var volumes []*Volume
+	if m.Volumes != nil {
+		volumes = make([]*Volume, len(m.Volumes))
+		for i, vol := range m.Volumes {
+			if vol != nil {
+				volCopy := *vol
+				volumes[i] = &volCopy
+			}
+		}
+	}
 	deps := DepsType{}
 	for key, val := range m.Deps {
 		deps[key] = &AppDep{
@@ -150,21 +262,42 @@ func (m *Manifest) Dup() *Manifest {
 				deps[key].SecurityGroup[ipGroupName][i] = port
 			}
 		}
+		if val.UDPSecurityGroup != nil {
+			deps[key].UDPSecurityGroup = make(map[string][]uint16, len(val.UDPSecurityGroup))
+			for ipGroupName, ports := range val.UDPSecurityGroup {
+				if len(ports) == 0 {
+					continue
+				}
+				deps[key].UDPSecurityGroup[ipGroupName] = append([]uint16{}, ports...)
+			}
+		}
 		for innerKey, innerVal := range val.DataMap {
 			deps[key].DataMap[innerKey] = innerVal
 		}
 		deps[key].EncryptedData = val.EncryptedData
 	}
 	return &Manifest{
-		Name:        m.Name,
-		Description: m.Description,
-		Instances:   m.Instances,
-		CPUShares:   m.CPUShares,
-		MemoryLimit: m.MemoryLimit,
-		AppType:     m.AppType,
-		JavaType:    m.JavaType,
-		RunCommands: runCommands,
-		Deps:        deps,
+		Name:             m.Name,
+		Description:      m.Description,
+		Instances:        m.Instances,
+		CPUShares:        m.CPUShares,
+		DedicatedCPUs:    m.DedicatedCPUs,
+		MemoryLimit:      m.MemoryLimit,
+		AppType:          m.AppType,
+		JavaType:         m.JavaType,
+		RunCommands:      runCommands,
+		Environment:      environment,
+		Entrypoint:       entrypoint,
+		Command:          command,
+		Volumes:          volumes,
+		PrimaryPort:      primaryPort,
+		SecondaryPorts:   secondaryPorts,
+		SSHIngress:       sshIngress,
+		Bandwidth:        bandwidth,
+		ConfigRenderings: renderings,
+		ReloadSignal:     m.ReloadSignal,
+		ReloadCommand:    m.ReloadCommand,
+		Deps:             deps,
 	}
 }
 
@@ -220,6 +353,23 @@ func (m *Manifest) DepNames() []string {
 	return names
 }
 
+const (
+	QuotaScopeApp = "app"
+	QuotaScopeEnv = "env"
+)
+
+// Quota limits the resources a single app or env may use on this supervisor. A zero value means no limit
+// beyond the supervisor's own.
+type Quota struct {
+	MaxContainers uint
+	CPUShares     uint
+	MemoryLimit   uint
+}
+
+func ValidQuotaScope(scope string) bool {
+	return scope == QuotaScopeApp || scope == QuotaScopeEnv
+}
+
 // ----------------------------------------------------------------------------------------------------------
 // Supervisor RPC Types
 // ----------------------------------------------------------------------------------------------------------
@@ -235,10 +385,61 @@ type ResourceStats struct {
 	Free  uint
 }
 
+type QuotaStats struct {
+	Scope      string
+	Name       string
+	Containers *ResourceStats
+	CPUShares  *ResourceStats
+	Memory     *ResourceStats
+}
+
+type NUMANodeStats struct {
+	Node     int
+	UsedCPUs []int
+	FreeCPUs []int
+}
+
+// Dedicated core usage. Cores reserved for the host are not counted in Total.
+type CPUSetStats struct {
+	Total        uint
+	Used         uint
+	Free         uint
+	ReservedCPUs []int
+	Nodes        []*NUMANodeStats
+}
+
+// The connection to the docker daemon
+type DockerStats struct {
+	Endpoint   string
+	Healthy    bool
+	LastError  string
+	LastProbe  time.Time
+	Reconnects uint
+}
+
+// Whether the firewall rules installed match what netsec expects
+type NetsecStats struct {
+	Backend   string
+	IPv6      bool     // whether rules are installed for IPv6 too
+	Repair    bool     // whether drift is repaired or only reported
+	Healthy   bool     // false while drift is unrepaired or the live rules can't be read
+	Missing   []string // expected rules that were not installed at the last check
+	Extra     []string // installed rules netsec did not expect at the last check
+	LastError string
+	LastCheck time.Time
+	Drifts    uint // checks that found drift
+	Repairs   uint
+}
+
 type SupervisorHealthCheckReply struct {
 	Containers *ResourceStats
 	CPUShares  *ResourceStats
 	Memory     *ResourceStats
+	CPUSet     *CPUSetStats
+	Quotas     []*QuotaStats
+	Docker     *DockerStats
+	Netsec     *NetsecStats
+	Bandwidth  []*BandwidthStats
 	Price      float64
 	Region     string
 	Zone       string
@@ -253,12 +454,57 @@ type SupervisorDeployArg struct {
 	Sha         string
 	Env         string
 	ContainerID string
-	Manifest    *Manifest
+	Image       string // optional full image reference (repo[:tag][@digest]). overrides the image template.
+	// optional digest the pulled image must have, with an optional base64 detached signature over it
+	ExpectedDigest  string
+	DigestSignature string
+	Manifest        *Manifest
 }
 
 type SupervisorDeployReply struct {
 	Status    string
 	Container *Container
+	Problems  []*DepProblem // everything wrong with the deps, if that's why the deploy failed
+}
+
+// ------------ UpdateDeps ------------
+// Used to replace the dependencies of a running container without redeploying it
+type SupervisorUpdateDepsArg struct {
+	ContainerID string
+	Deps        DepsType
+}
+
+type SupervisorUpdateDepsReply struct {
+	Status    string
+	Container *Container
+	Problems  []*DepProblem // everything wrong with the deps, if that's why the update failed
+}
+
+// ------------ ReencryptState ------------
+// Used to rewrite the deps of every persisted manifest under the active encryption key
+type SupervisorReencryptStateArg struct {
+}
+
+type ReencryptStats struct {
+	KeyID       string // the active key
+	Reencrypted uint   // deps rewritten under the active key
+	Current     uint   // deps already encrypted with it
+}
+
+type SupervisorReencryptStateReply struct {
+	Stats  *ReencryptStats
+	Status string
+}
+
+// ------------ NetsecStatus ------------
+// Used to check whether the installed firewall rules have drifted from netsec's state
+type SupervisorNetsecStatusArg struct {
+	Check bool // check now instead of returning the last periodic check
+}
+
+type SupervisorNetsecStatusReply struct {
+	Netsec *NetsecStats
+	Status string
 }
 
 // ------------ Teardown ------------
@@ -320,20 +566,121 @@ type SupervisorDeauthorizeSSHReply struct {
 
 // ------------ Update IP Group ------------
 type SupervisorUpdateIPGroupArg struct {
-	Name string
-	IPs  []string
+	Name   string
+	IPs    []string // IPs, CIDR blocks and hostnames
+	DryRun bool     // only report what would change
 }
 
 type SupervisorUpdateIPGroupReply struct {
+	Diff   *IPGroupDiff
 	Status string
 }
 
 // ------------ Delete IP Group ------------
 type SupervisorDeleteIPGroupArg struct {
-	Name string
+	Name   string
+	DryRun bool // only report what would change
 }
 
 type SupervisorDeleteIPGroupReply struct {
+	Diff   *IPGroupDiff
+	Status string
+}
+
+// ------------ List IP Groups ------------
+type SupervisorListIPGroupsArg struct {
+}
+
+type SupervisorListIPGroupsReply struct {
+	IPGroups []*IPGroupInfo
+	Status   string
+}
+
+// ------------ Get IP Group ------------
+type SupervisorGetIPGroupArg struct {
+	Name string
+}
+
+type SupervisorGetIPGroupReply struct {
+	IPGroup *IPGroupInfo
+	Status  string
+}
+
+// ------------ Get Container Security ------------
+type SupervisorGetContainerSecurityArg struct {
+	ContainerID string
+}
+
+type SupervisorGetContainerSecurityReply struct {
+	Security *ContainerSecurityInfo
+	Status   string
+}
+
+// ------------ Rule Counters ------------
+type SupervisorRuleCountersArg struct {
+	ContainerID string // empty means every container and the denies
+}
+
+type SupervisorRuleCountersReply struct {
+	Counters []*RuleCounter
+	Status   string
+}
+
+// ------------ Update Quota ------------
+type SupervisorUpdateQuotaArg struct {
+	Scope string // QuotaScopeApp or QuotaScopeEnv
+	Name  string
+	Quota *Quota
+}
+
+type SupervisorUpdateQuotaReply struct {
+	Status string
+}
+
+// ------------ Delete Quota ------------
+type SupervisorDeleteQuotaArg struct {
+	Scope string
+	Name  string
+}
+
+type SupervisorDeleteQuotaReply struct {
+	Status string
+}
+
+// ------------ List Volumes ------------
+// List persistent volumes, optionally only those of one app and/or env
+type SupervisorListVolumesArg struct {
+	App string
+	Env string
+}
+
+type SupervisorListVolumesReply struct {
+	Volumes []*VolumeInfo
+	Status  string
+}
+
+// ------------ Delete Volume ------------
+// Delete a persistent volume and its data. Fails if a container still uses it.
+type SupervisorDeleteVolumeArg struct {
+	App  string
+	Env  string
+	Name string
+}
+
+type SupervisorDeleteVolumeReply struct {
+	Status string
+}
+
+// ------------ List Events ------------
+// List recent events, optionally only those of one kind and/or container
+type SupervisorListEventsArg struct {
+	Kind        string
+	ContainerID string
+	Limit       int // 0 means all that are kept
+}
+
+type SupervisorListEventsReply struct {
+	Events []*Event
 	Status string
 }
 
@@ -0,0 +1,90 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package types
+
+import (
+	. "atlantis/supervisor/constant"
+	atypes "atlantis/types"
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var volumeNameRegexp = regexp.MustCompile("^[A-Za-z0-9_][A-Za-z0-9_.-]*$")
+
+// A named directory that outlives the container. Every container of the same app+env that declares a volume
+// with the same name gets the same directory.
+type Volume struct {
+	Name   string
+	Path   string // mount point inside the container
+	SizeMB uint   // a hint for capacity planning, not enforced
+}
+
+type VolumeInfo struct {
+	App        string
+	Env        string
+	Name       string
+	HostPath   string
+	SizeMB     uint
+	RefCount   uint
+	Containers []string // ids of the containers using this volume
+	UsedBytes  uint64
+}
+
+func VolumeKey(app, env, name string) string {
+	return app + "/" + env + "/" + name
+}
+
+func (v *VolumeInfo) Key() string {
+	return VolumeKey(v.App, v.Env, v.Name)
+}
+
+// Check the manifest's volumes before anything is reserved for them
+func (m *Manifest) ValidateVolumes() error {
+	names := map[string]bool{}
+	paths := map[string]bool{}
+	for _, vol := range m.Volumes {
+		if vol == nil {
+			return errors.New("Invalid Manifest: empty volume")
+		}
+		if !volumeNameRegexp.MatchString(vol.Name) {
+			return errors.New("Invalid Manifest: bad volume name: " + vol.Name)
+		}
+		if names[vol.Name] {
+			return errors.New("Invalid Manifest: duplicate volume " + vol.Name)
+		}
+		names[vol.Name] = true
+		if !path.IsAbs(vol.Path) {
+			return errors.New("Invalid Manifest: path for volume " + vol.Name + " must be absolute")
+		}
+		cleanPath := path.Clean(vol.Path)
+		if cleanPath == "/" || cleanPath == ContainerLogDir || cleanPath == atypes.ContainerConfigDir {
+			return errors.New("Invalid Manifest: path " + cleanPath + " for volume " + vol.Name + " is reserved")
+		}
+		if paths[cleanPath] {
+			return errors.New("Invalid Manifest: path " + cleanPath + " is used by more than one volume")
+		}
+		paths[cleanPath] = true
+	}
+	return nil
+}
+
+// App and env names become part of the volume's host path, so they must be safe to use there
+func ValidateVolumeOwner(app, env string) error {
+	for _, name := range []string{app, env} {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return errors.New("Invalid app or env for volumes: " + app + " / " + env)
+		}
+	}
+	return nil
+}
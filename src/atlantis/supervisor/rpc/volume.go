@@ -0,0 +1,95 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package rpc
+
+import (
+	. "atlantis/common"
+	"atlantis/supervisor/containers"
+	. "atlantis/supervisor/rpc/types"
+	"errors"
+	"fmt"
+)
+
+// List the persistent volumes along with who uses them and how much space they take up
+type ListVolumesExecutor struct {
+	arg   SupervisorListVolumesArg
+	reply *SupervisorListVolumesReply
+}
+
+func (e *ListVolumesExecutor) Request() interface{} {
+	return e.arg
+}
+
+func (e *ListVolumesExecutor) Result() interface{} {
+	return e.reply
+}
+
+func (e *ListVolumesExecutor) Description() string {
+	return fmt.Sprintf("app: %s, env: %s", e.arg.App, e.arg.Env)
+}
+
+func (e *ListVolumesExecutor) Authorize() error {
+	return nil
+}
+
+func (e *ListVolumesExecutor) Execute(t *Task) error {
+	e.reply.Volumes = containers.ListVolumes(e.arg.App, e.arg.Env)
+	e.reply.Status = StatusOk
+	return nil
+}
+
+func (ih *Supervisor) ListVolumes(arg SupervisorListVolumesArg, reply *SupervisorListVolumesReply) error {
+	return NewTask("ListVolumes", &ListVolumesExecutor{arg, reply}).Run()
+}
+
+type DeleteVolumeExecutor struct {
+	arg   SupervisorDeleteVolumeArg
+	reply *SupervisorDeleteVolumeReply
+}
+
+func (e *DeleteVolumeExecutor) Request() interface{} {
+	return e.arg
+}
+
+func (e *DeleteVolumeExecutor) Result() interface{} {
+	return e.reply
+}
+
+func (e *DeleteVolumeExecutor) Description() string {
+	return VolumeKey(e.arg.App, e.arg.Env, e.arg.Name)
+}
+
+func (e *DeleteVolumeExecutor) Authorize() error {
+	return nil
+}
+
+func (e *DeleteVolumeExecutor) Execute(t *Task) error {
+	if e.arg.App == "" {
+		return errors.New("Please specify an app.")
+	}
+	if e.arg.Env == "" {
+		return errors.New("Please specify an env.")
+	}
+	if e.arg.Name == "" {
+		return errors.New("Please specify a Name.")
+	}
+	if err := containers.DeleteVolume(e.arg.App, e.arg.Env, e.arg.Name); err != nil {
+		e.reply.Status = StatusError
+		return err
+	}
+	e.reply.Status = StatusOk
+	return nil
+}
+
+func (ih *Supervisor) DeleteVolume(arg SupervisorDeleteVolumeArg, reply *SupervisorDeleteVolumeReply) error {
+	return NewTask("DeleteVolume", &DeleteVolumeExecutor{arg, reply}).Run()
+}
@@ -16,8 +16,12 @@ import (
 	"atlantis/crypto"
 	. "atlantis/supervisor/constant"
 	"atlantis/supervisor/containers"
+	scrypto "atlantis/supervisor/crypto"
+	"atlantis/supervisor/docker"
 	"atlantis/supervisor/healthz"
+	"atlantis/supervisor/netsec"
 	"atlantis/supervisor/rpc"
+	"atlantis/supervisor/rpc/types"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/jigish/go-flags"
@@ -29,25 +33,58 @@ import (
 )
 
 type Config struct {
-	SaveDir                  string  `toml:"save_dir"`
-	NumContainers            uint16  `toml:"num_containers"`
-	NumSecondary             uint16  `toml:"num_secondary"`
-	CPUShares                uint    `toml:"cpu_shares"`
-	MemoryLimit              uint    `toml:"memory_limit"`
-	MinPort                  uint16  `toml:"min_port"`
-	RpcAddr                  string  `toml:"rpc_addr"`
-	RegistryHost             string  `toml:"registry_host"`
-	ResultDuration           string  `toml:"result_duration"`
-	Region                   string  `toml:"region"`
-	Zone                     string  `toml:"zone"`
-	MaintenanceFile          string  `toml:"maintenance_file"`
-	MaintenanceCheckInterval string  `toml:"maintenance_check_interval"`
-	EnableNetsec             bool    `toml:"enable_netsec"`
-	Price                    float64 `toml:"price"`
+	SaveDir                  string                 `toml:"save_dir"`
+	VolumeDir                string                 `toml:"volume_dir"`
+	NumContainers            uint16                 `toml:"num_containers"`
+	NumSecondary             uint16                 `toml:"num_secondary"`
+	CPUShares                uint                   `toml:"cpu_shares"`
+	MemoryLimit              uint                   `toml:"memory_limit"`
+	MinPort                  uint16                 `toml:"min_port"`
+	RpcAddr                  string                 `toml:"rpc_addr"`
+	RegistryHost             string                 `toml:"registry_host"`
+	ImageTemplate            string                 `toml:"image_template"`
+	ImageRepo                string                 `toml:"image_repo"`
+	ImagePublicKeys          []string               `toml:"image_public_keys"`
+	DockerEndpoint           string                 `toml:"docker_endpoint"`
+	DockerCert               string                 `toml:"docker_cert"`
+	DockerKey                string                 `toml:"docker_key"`
+	DockerCA                 string                 `toml:"docker_ca"`
+	DockerProbeInterval      string                 `toml:"docker_probe_interval"`
+	MaxConcurrentPulls       int                    `toml:"max_concurrent_pulls"` // 0 means no limit
+	JanitorInterval          string                 `toml:"janitor_interval"`
+	JanitorRestartDead       bool                   `toml:"janitor_restart_dead"`
+	RequireSignedImages      bool                   `toml:"require_signed_images"`
+	EncryptionKey            string                 `toml:"encryption_key"`  // file with the active key
+	DecryptionKeys           []string               `toml:"decryption_keys"` // files with decrypt-only keys
+	ResultDuration           string                 `toml:"result_duration"`
+	Region                   string                 `toml:"region"`
+	Zone                     string                 `toml:"zone"`
+	MaintenanceFile          string                 `toml:"maintenance_file"`
+	MaintenanceCheckInterval string                 `toml:"maintenance_check_interval"`
+	EnableNetsec             bool                   `toml:"enable_netsec"`
+	FirewallBackend          string                 `toml:"firewall_backend"` // iptables or nftables
+	NetsecDriftInterval      string                 `toml:"netsec_drift_interval"`
+	NetsecRepairDrift        bool                   `toml:"netsec_repair_drift"`
+	NetsecResolveInterval    string                 `toml:"netsec_resolve_interval"`    // how often ip group hostnames are resolved
+	NetsecThroughputInterval string                 `toml:"netsec_throughput_interval"` // how often container veth throughput is measured
+	NetsecRejectLogRate      string                 `toml:"netsec_reject_log_rate"`     // log rejects to denied ips at most this often, like 10/minute
+	Price                    float64                `toml:"price"`
+	ReservedCPUs             string                 `toml:"reserved_cpus"`
+	AppQuotas                map[string]QuotaConfig `toml:"app_quotas"`
+	EnvQuotas                map[string]QuotaConfig `toml:"env_quotas"`
+}
+
+// Quotas from the config file are applied on every start, overriding any set through the UpdateQuota RPC for
+// the same app or env.
+type QuotaConfig struct {
+	MaxContainers uint `toml:"max_containers"`
+	CPUShares     uint `toml:"cpu_shares"`
+	MemoryLimit   uint `toml:"memory_limit"`
 }
 
 type Opts struct {
 	SaveDir                  string  `long:"save" description:"the directory to save to"`
+	VolumeDir                string  `long:"volume-dir" description:"the directory to keep persistent volumes in"`
 	NumContainers            uint16  `long:"containers" description:"the # of available containers"`
 	NumSecondary             uint16  `long:"secondary" description:"the # of secondary ports"`
 	CPUShares                uint    `long:"cpu-shares" description:"the total # of CPU shares available"`
@@ -55,6 +92,13 @@ type Opts struct {
 	MinPort                  uint16  `long:"min-port" description:"the minimum port number to use"`
 	RpcAddr                  string  `long:"rpc" description:"the RPC listen addr"`
 	RegistryHost             string  `long:"registry" description:"the Registry Host to talk to"`
+	ImageTemplate            string  `long:"image-template" description:"the template used to name app images"`
+	ImageRepo                string  `long:"image-repo" description:"the repo the image template names app images in"`
+	RequireSignedImages      bool    `long:"require-signed-images" description:"refuse deploys without a signed digest"`
+	EncryptionKey            string  `long:"encryption-key" description:"the file with the key to encrypt dependency data with"`
+	DockerEndpoint           string  `long:"docker-endpoint" description:"the docker daemon to talk to (unix socket or tcp://)"`
+	MaxConcurrentPulls       int     `long:"max-concurrent-pulls" description:"the # of images to pull at once"`
+	JanitorInterval          string  `long:"janitor-interval" description:"how often to clean up docker containers"`
 	ResultDuration           string  `long:"result-duration" description:"How long to keep the results of an Async Command"`
 	Region                   string  `long:"region" description:"the region this supervisor is in"`
 	Zone                     string  `long:"zone" description:"the availability zone this supervisor is in"`
@@ -62,12 +106,16 @@ type Opts struct {
 	MaintenanceFile          string  `long:"maintenance-file" description:"the maintenance file to check"`
 	MaintenanceCheckInterval string  `long:"maintenance-check-interval" description:"the interval to check the maintenance file"`
 	EnableNetsec             bool    `long:"enable-netsec" description:"enable network security (iptables)"`
+	FirewallBackend          string  `long:"firewall-backend" description:"how netsec installs rules (iptables or nftables)"`
+	NetsecDriftInterval      string  `long:"netsec-drift-interval" description:"how often to check netsec rules are still installed"`
 	Price                    float64 `long:"price"`
+	ReservedCPUs             string  `long:"reserved-cpus" description:"cores never dedicated to a container (e.g. 0-1)"`
 }
 
 var opts = &Opts{}
 var config = &Config{
 	SaveDir:                  DefaultSupervisorSaveDir,
+	VolumeDir:                DefaultSupervisorVolumeDir,
 	NumContainers:            DefaultSupervisorNumContainers,
 	NumSecondary:             DefaultSupervisorNumSecondary,
 	CPUShares:                DefaultSupervisorCPUShares,
@@ -75,12 +123,24 @@ var config = &Config{
 	MinPort:                  DefaultSupervisorMinPort,
 	RpcAddr:                  fmt.Sprintf(":%d", DefaultSupervisorRPCPort),
 	RegistryHost:             DefaultSupervisorRegistryHost,
+	ImageTemplate:            DefaultSupervisorImageTemplate,
+	ImageRepo:                DefaultSupervisorImageRepo,
+	DockerEndpoint:           docker.DefaultEndpoint,
+	DockerProbeInterval:      docker.DefaultProbeInterval.String(),
+	MaxConcurrentPulls:       docker.DefaultMaxConcurrentPulls,
+	JanitorInterval:          containers.DefaultJanitorInterval.String(),
+	JanitorRestartDead:       true,
 	ResultDuration:           DefaultResultDuration,
 	Region:                   DefaultRegion,
 	Zone:                     DefaultZone,
 	MaintenanceFile:          DefaultMaintenanceFile,
 	MaintenanceCheckInterval: DefaultMaintenanceCheckInterval,
 	EnableNetsec:             false,
+	FirewallBackend:          netsec.DefaultFirewall,
+	NetsecDriftInterval:      netsec.DefaultDriftInterval.String(),
+	NetsecRepairDrift:        true,
+	NetsecResolveInterval:    netsec.DefaultResolveInterval.String(),
+	NetsecThroughputInterval: netsec.DefaultThroughputInterval.String(),
 }
 
 type Supervisor struct {
@@ -100,12 +160,42 @@ func (ih *Supervisor) Run() {
 	log.Println("                          -- Supervisor\n")
 	crypto.Init()
 	overlayConfig()
+	handleError(scrypto.InitKeyring(config.EncryptionKey, config.DecryptionKeys))
 	Region = config.Region
 	Zone = config.Zone
 	Price = config.Price
 	log.Printf("Initializing Atlantis Supervisor [%s] [%s]", Region, Zone)
+	handleError(containers.InitCPUs(config.ReservedCPUs))
+	janitorInterval, err := time.ParseDuration(config.JanitorInterval)
+	handleError(err)
+	handleError(containers.InitJanitor(janitorInterval, config.JanitorRestartDead))
+	handleError(containers.InitVolumeDir(config.VolumeDir))
+	dockerProbeInterval, err := time.ParseDuration(config.DockerProbeInterval)
+	handleError(err)
+	handleError(docker.InitEndpoint(&docker.Endpoint{
+		Address: config.DockerEndpoint,
+		Cert:    config.DockerCert,
+		Key:     config.DockerKey,
+		CA:      config.DockerCA,
+	}, dockerProbeInterval))
+	handleError(docker.InitPullLimit(config.MaxConcurrentPulls))
+	handleError(docker.InitImageTemplate(config.ImageTemplate, config.ImageRepo))
+	handleError(docker.InitImageVerification(config.ImagePublicKeys, config.RequireSignedImages))
+	handleError(netsec.InitFirewall(config.FirewallBackend))
+	netsecDriftInterval, err := time.ParseDuration(config.NetsecDriftInterval)
+	handleError(err)
+	handleError(netsec.InitDriftCheck(netsecDriftInterval, config.NetsecRepairDrift))
+	netsecResolveInterval, err := time.ParseDuration(config.NetsecResolveInterval)
+	handleError(err)
+	handleError(netsec.InitResolver(netsecResolveInterval))
+	netsecThroughputInterval, err := time.ParseDuration(config.NetsecThroughputInterval)
+	handleError(err)
+	handleError(netsec.InitThroughput(netsecThroughputInterval))
+	handleError(netsec.InitRejectLog(config.NetsecRejectLogRate))
 	handleError(containers.Init(config.RegistryHost, config.SaveDir, config.NumContainers, config.NumSecondary,
 		config.MinPort, config.CPUShares, config.MemoryLimit, config.EnableNetsec))
+	applyQuotas(types.QuotaScopeApp, config.AppQuotas)
+	applyQuotas(types.QuotaScopeEnv, config.EnvQuotas)
 	handleError(rpc.Init(config.RpcAddr))
 	maintenanceCheckInterval, err := time.ParseDuration(config.MaintenanceCheckInterval)
 	if err != nil {
@@ -123,6 +213,17 @@ func handleError(err error) {
 	}
 }
 
+func applyQuotas(scope string, quotas map[string]QuotaConfig) {
+	for name, quota := range quotas {
+		log.Printf("Setting %s quota for %s: %+v", scope, name, quota)
+		handleError(containers.UpdateQuota(scope, name, &types.Quota{
+			MaxContainers: quota.MaxContainers,
+			CPUShares:     quota.CPUShares,
+			MemoryLimit:   quota.MemoryLimit,
+		}))
+	}
+}
+
 func overlayConfig() {
 	if opts.Config != "" {
 		_, err := toml.DecodeFile(opts.Config, config)
@@ -134,6 +235,9 @@ func overlayConfig() {
 	if opts.SaveDir != "" {
 		config.SaveDir = opts.SaveDir
 	}
+	if opts.VolumeDir != "" {
+		config.VolumeDir = opts.VolumeDir
+	}
 	if opts.NumContainers != 0 {
 		config.NumContainers = opts.NumContainers
 	}
@@ -149,6 +253,21 @@ func overlayConfig() {
 	if opts.RegistryHost != "" {
 		config.RegistryHost = opts.RegistryHost
 	}
+	if opts.DockerEndpoint != "" {
+		config.DockerEndpoint = opts.DockerEndpoint
+	}
+	if opts.JanitorInterval != "" {
+		config.JanitorInterval = opts.JanitorInterval
+	}
+	if opts.MaxConcurrentPulls != 0 {
+		config.MaxConcurrentPulls = opts.MaxConcurrentPulls
+	}
+	if opts.ImageTemplate != "" {
+		config.ImageTemplate = opts.ImageTemplate
+	}
+	if opts.ImageRepo != "" {
+		config.ImageRepo = opts.ImageRepo
+	}
 	if opts.ResultDuration != "" {
 		config.ResultDuration = opts.ResultDuration
 	}
@@ -164,6 +283,21 @@ func overlayConfig() {
 	if opts.MaintenanceCheckInterval != "" {
 		config.MaintenanceCheckInterval = opts.MaintenanceCheckInterval
 	}
+	if opts.ReservedCPUs != "" {
+		config.ReservedCPUs = opts.ReservedCPUs
+	}
+	if opts.EncryptionKey != "" {
+		config.EncryptionKey = opts.EncryptionKey
+	}
+	if opts.RequireSignedImages {
+		config.RequireSignedImages = opts.RequireSignedImages
+	}
+	if opts.FirewallBackend != "" {
+		config.FirewallBackend = opts.FirewallBackend
+	}
+	if opts.NetsecDriftInterval != "" {
+		config.NetsecDriftInterval = opts.NetsecDriftInterval
+	}
 	if opts.EnableNetsec {
 		config.EnableNetsec = opts.EnableNetsec
 	}